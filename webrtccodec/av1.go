@@ -0,0 +1,176 @@
+package webrtccodec
+
+import (
+	"github.com/pion/rtp"
+)
+
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+	av1OBUFrameHeader       = 3
+	av1OBUMetadata          = 5
+	av1OBUFrame             = 6
+)
+
+/*
+inspectAV1 reads the aggregation header and the OBU elements of an AV1 RTP payload.
+A packet starts a keyframe when its N bit starts a coded video sequence, or when it
+holds the header of a key frame; the N bit of a packet continuing an OBU is
+ignored. Sequence headers give the maximum frame size of the sequence.
+*/
+func inspectAV1(packet *rtp.Packet) (PacketInfo, error) {
+	payload := packet.Payload
+	aggregation := payload[0]
+	continued := aggregation&0x80 != 0
+	count := int(aggregation >> 4 & 0x03)
+	info := PacketInfo{
+		Keyframe: !continued && aggregation&0x08 != 0,
+		FrameEnd: packet.Marker,
+	}
+	reducedStillPicture := false
+	layered := false
+	for i, element := 1, 0; i < len(payload); element++ {
+		size := len(payload) - i
+		if count == 0 || element < count-1 {
+			length, n, err := readLEB128(payload[i:])
+			if err != nil || uint64(len(payload)-i-n) < length {
+				return PacketInfo{}, ErrInvalidPayload
+			}
+			i += n
+			size = int(length)
+		}
+		obu := payload[i : i+size]
+		i += size
+		if element == 0 && continued || len(obu) == 0 {
+			continue
+		}
+		obuType := obu[0] >> 3 & 0x0f
+		if element == 0 {
+			switch obuType {
+			case av1OBUSequenceHeader, av1OBUTemporalDelimiter, av1OBUFrameHeader, av1OBUMetadata, av1OBUFrame:
+				info.FrameStart = true
+			}
+		}
+		offset := 1
+		if obu[0]&0x04 != 0 {
+			if len(obu) < 2 {
+				return PacketInfo{}, ErrInvalidPayload
+			}
+			if !layered {
+				layered = true
+				info.TemporalID = obu[1] >> 5
+				info.SpatialID = obu[1] >> 3 & 0x03
+			}
+			offset++
+		}
+		if obu[0]&0x02 != 0 {
+			// The OBU carries its own size field, which the payload format makes
+			// optional.
+			_, n, err := readLEB128(obu[offset:])
+			if err != nil {
+				// The OBU is fragmented right after its header.
+				continue
+			}
+			offset += n
+		}
+		body := obu[offset:]
+		switch obuType {
+		case av1OBUSequenceHeader:
+			// A sequence header cut short by fragmentation gives no frame size.
+			if header, err := parseAV1SequenceHeader(body); err == nil {
+				reducedStillPicture = header.reducedStillPicture
+				info.Width, info.Height = header.width, header.height
+			}
+		case av1OBUFrameHeader, av1OBUFrame:
+			// A frame header starts with show_existing_frame and frame_type, of
+			// which KEY_FRAME is 0; reduced still picture headers are all keys.
+			if reducedStillPicture || len(body) > 0 && body[0]&0xe0 == 0 {
+				info.Keyframe = true
+			}
+		}
+	}
+	return info, nil
+}
+
+/*
+av1SequenceHeader is what inspection needs from a sequence header OBU.
+*/
+type av1SequenceHeader struct {
+	reducedStillPicture bool
+	width               uint16
+	height              uint16
+}
+
+/*
+parseAV1SequenceHeader reads a sequence header OBU up to the maximum frame size.
+*/
+func parseAV1SequenceHeader(data []byte) (av1SequenceHeader, error) {
+	header := av1SequenceHeader{}
+	r := &bitReader{data: data}
+	r.readBits(3)
+	r.readBit()
+	header.reducedStillPicture = r.readBit() == 1
+	if header.reducedStillPicture {
+		r.readBits(5)
+	} else {
+		decoderModelInfo := false
+		bufferDelayLength := 0
+		if r.readBit() == 1 {
+			r.readBits(32)
+			r.readBits(32)
+			if r.readBit() == 1 {
+				r.readUE()
+			}
+			decoderModelInfo = r.readBit() == 1
+			if decoderModelInfo {
+				bufferDelayLength = int(r.readBits(5)) + 1
+				r.readBits(32)
+				r.readBits(5)
+				r.readBits(5)
+			}
+		}
+		initialDisplayDelay := r.readBit() == 1
+		operatingPoints := int(r.readBits(5)) + 1
+		for i := 0; i < operatingPoints && r.err == nil; i++ {
+			r.readBits(12)
+			if r.readBits(5) > 7 {
+				r.readBit()
+			}
+			if decoderModelInfo && r.readBit() == 1 {
+				r.readBits(bufferDelayLength)
+				r.readBits(bufferDelayLength)
+				r.readBit()
+			}
+			if initialDisplayDelay && r.readBit() == 1 {
+				r.readBits(4)
+			}
+		}
+	}
+	widthBits := int(r.readBits(4)) + 1
+	heightBits := int(r.readBits(4)) + 1
+	width := r.readBits(widthBits) + 1
+	height := r.readBits(heightBits) + 1
+	if r.err != nil {
+		return av1SequenceHeader{}, r.err
+	}
+	if width > 0xffff || height > 0xffff {
+		return av1SequenceHeader{}, ErrInvalidPayload
+	}
+	header.width, header.height = uint16(width), uint16(height)
+	return header, nil
+}
+
+/*
+readLEB128 reads an unsigned LEB128 value, returning it and the number of bytes it
+takes.
+*/
+func readLEB128(data []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < len(data) && i < 8; i++ {
+		value |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, ErrInvalidPayload
+}
@@ -0,0 +1,49 @@
+package webrtccodec
+
+/*
+bitReader reads the fixed length and Exp-Golomb coded fields of codec headers,
+most significant bit first. Reading past the end sets err and returns zeros.
+*/
+type bitReader struct {
+	data []byte
+	bit  int
+	err  error
+}
+
+func (r *bitReader) readBit() uint64 {
+	if r.bit >= len(r.data)*8 {
+		r.err = ErrInvalidPayload
+		return 0
+	}
+	bit := r.data[r.bit/8] >> (7 - r.bit%8) & 1
+	r.bit++
+	return uint64(bit)
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var value uint64
+	for i := 0; i < n; i++ {
+		value = value<<1 | r.readBit()
+	}
+	return value
+}
+
+func (r *bitReader) readUE() uint64 {
+	zeros := 0
+	for r.readBit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = ErrInvalidPayload
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.readBits(zeros)
+}
+
+func (r *bitReader) readSE() int64 {
+	value := r.readUE()
+	if value%2 == 1 {
+		return int64(value+1) / 2
+	}
+	return -int64(value / 2)
+}
@@ -0,0 +1,11 @@
+/*
+Package webrtccodec inspects the RTP payloads of video codecs.
+
+An Inspector reads, from a packet of a VP8, VP9, H.264 or AV1 track, whether it
+starts a keyframe, whether it starts or ends a frame, the temporal and spatial layer
+of the frame and the resolution the packet carries, without depacketizing or
+decoding the frame. It is what keyframe caches, simulcast and SVC layer switching
+and recorders need to know about packets that are otherwise forwarded as opaque
+bytes.
+*/
+package webrtccodec
@@ -0,0 +1,242 @@
+package webrtccodec
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	h264NALUnitSlice  = 1
+	h264NALUnitIDR    = 5
+	h264NALUnitSEI    = 6
+	h264NALUnitSPS    = 7
+	h264NALUnitPPS    = 8
+	h264NALUnitAUD    = 9
+	h264NALUnitPrefix = 14
+	h264NALUnitSubset = 15
+	h264NALUnitSVC    = 20
+	h264NALUnitSTAPA  = 24
+	h264NALUnitFUA    = 28
+)
+
+var ErrInvalidSPS = errors.New("invalid H.264 sequence parameter set")
+
+/*
+inspectH264 reads the NAL units of an RFC 6184 payload: a single NAL unit, the
+units aggregated in a STAP-A or the start of one fragmented in an FU-A. The middle
+and end fragments of an FU-A tell nothing but the marker bit.
+*/
+func inspectH264(packet *rtp.Packet) (PacketInfo, error) {
+	payload := packet.Payload
+	info := PacketInfo{FrameEnd: packet.Marker}
+	switch payload[0] & 0x1f {
+	case h264NALUnitSTAPA:
+		first := true
+		for i := 1; i < len(payload); {
+			if i+2 > len(payload) {
+				return PacketInfo{}, ErrInvalidPayload
+			}
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if size == 0 || i+size > len(payload) {
+				return PacketInfo{}, ErrInvalidPayload
+			}
+			inspectH264NALUnit(&info, payload[i:i+size], first)
+			first = false
+			i += size
+		}
+	case h264NALUnitFUA:
+		if len(payload) < 2 {
+			return PacketInfo{}, ErrInvalidPayload
+		}
+		if payload[1]&0x80 != 0 {
+			// The NAL unit header is rebuilt from the FU indicator and header.
+			nalu := append([]byte{payload[0]&0xe0 | payload[1]&0x1f}, payload[2:]...)
+			inspectH264NALUnit(&info, nalu, true)
+		}
+	case 0, 25, 26, 27, 29, 30, 31:
+		// STAP-B, MTAPs, FU-B and the reserved types are not used by WebRTC.
+		return PacketInfo{}, ErrInvalidPayload
+	default:
+		inspectH264NALUnit(&info, payload, true)
+	}
+	return info, nil
+}
+
+/*
+inspectH264NALUnit adds what a NAL unit tells to info. The first NAL unit of a
+packet starts a frame when it comes before the slices of an access unit or is its
+first slice.
+*/
+func inspectH264NALUnit(info *PacketInfo, nalu []byte, first bool) {
+	switch nalu[0] & 0x1f {
+	case h264NALUnitIDR:
+		info.Keyframe = true
+		info.FrameStart = info.FrameStart || first && h264FirstSlice(nalu)
+	case h264NALUnitSlice:
+		info.FrameStart = info.FrameStart || first && h264FirstSlice(nalu)
+	case h264NALUnitSPS:
+		info.Keyframe = true
+		info.FrameStart = info.FrameStart || first
+		if sps, err := ParseH264SPS(nalu); err == nil {
+			info.Width, info.Height = sps.Width, sps.Height
+		}
+	case h264NALUnitAUD, h264NALUnitSEI, h264NALUnitPPS, h264NALUnitSubset:
+		info.FrameStart = info.FrameStart || first
+	case h264NALUnitPrefix, h264NALUnitSVC:
+		if nalu[0]&0x1f == h264NALUnitPrefix {
+			info.FrameStart = info.FrameStart || first
+		}
+		// The SVC extension header: svc_extension_flag, idr_flag and priority_id,
+		// then no_inter_layer_pred_flag, dependency_id and quality_id, then
+		// temporal_id.
+		if len(nalu) >= 4 && nalu[1]&0x80 != 0 {
+			info.SpatialID = nalu[2] >> 4 & 0x07
+			info.TemporalID = nalu[3] >> 5
+		}
+	}
+}
+
+/*
+h264FirstSlice reports a slice NAL unit whose first_mb_in_slice is 0, the
+Exp-Golomb code of which is a single 1 bit.
+*/
+func h264FirstSlice(nalu []byte) bool {
+	return len(nalu) > 1 && nalu[1]&0x80 != 0
+}
+
+/*
+H264SPS is what a sequence parameter set tells about the stream, as recorders need
+it for their sample descriptions.
+*/
+type H264SPS struct {
+	Profile       uint8
+	Compatibility uint8
+	Level         uint8
+	// HighProfile is set for the profiles whose parameter sets code the chroma format
+	// and bit depths. The others are 4:2:0 with 8 bit samples.
+	HighProfile  bool
+	ChromaFormat uint64
+	// BitDepthLuma and BitDepthChroma are the bit depths less 8.
+	BitDepthLuma   uint64
+	BitDepthChroma uint64
+	// Width and Height are the cropped picture size.
+	Width  uint16
+	Height uint16
+}
+
+/*
+ParseH264SPS reads a sequence parameter set NAL unit, returning ErrInvalidSPS when
+it is cut short or is not one.
+*/
+func ParseH264SPS(nalu []byte) (H264SPS, error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != h264NALUnitSPS {
+		return H264SPS{}, ErrInvalidSPS
+	}
+	sps := H264SPS{Profile: nalu[1], Compatibility: nalu[2], Level: nalu[3], ChromaFormat: 1}
+	r := &bitReader{data: h264RBSP(nalu[4:])}
+	separatePlanes := false
+	r.readUE()
+	switch sps.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.HighProfile = true
+		sps.ChromaFormat = r.readUE()
+		if sps.ChromaFormat == 3 {
+			separatePlanes = r.readBit() == 1
+		}
+		sps.BitDepthLuma = r.readUE()
+		sps.BitDepthChroma = r.readUE()
+		r.readBit()
+		if r.readBit() == 1 {
+			lists := 8
+			if sps.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.readBit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int64(8), int64(8)
+				for j := 0; j < size && r.err == nil; j++ {
+					if next != 0 {
+						next = (last + r.readSE() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.readUE()
+	switch r.readUE() {
+	case 0:
+		r.readUE()
+	case 1:
+		r.readBit()
+		r.readSE()
+		r.readSE()
+		cycle := r.readUE()
+		for i := uint64(0); i < cycle && r.err == nil; i++ {
+			r.readSE()
+		}
+	}
+	r.readUE()
+	r.readBit()
+	widthInMBs := r.readUE() + 1
+	heightInMapUnits := r.readUE() + 1
+	frameMBsOnly := r.readBit()
+	if frameMBsOnly == 0 {
+		r.readBit()
+	}
+	r.readBit()
+	var cropLeft, cropRight, cropTop, cropBottom uint64
+	if r.readBit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.readUE(), r.readUE(), r.readUE(), r.readUE()
+	}
+	if r.err != nil {
+		return H264SPS{}, ErrInvalidSPS
+	}
+	// Monochrome and separately coded colour planes are cropped in luma samples.
+	cropX, cropY := uint64(1), 2-frameMBsOnly
+	switch {
+	case separatePlanes:
+	case sps.ChromaFormat == 1:
+		cropX, cropY = 2, 2*(2-frameMBsOnly)
+	case sps.ChromaFormat == 2:
+		cropX = 2
+	}
+	width := widthInMBs*16 - cropX*(cropLeft+cropRight)
+	height := (2-frameMBsOnly)*heightInMapUnits*16 - cropY*(cropTop+cropBottom)
+	if width > 0xffff || height > 0xffff {
+		return H264SPS{}, ErrInvalidSPS
+	}
+	sps.Width, sps.Height = uint16(width), uint16(height)
+	return sps, nil
+}
+
+/*
+h264RBSP removes the emulation prevention bytes of a NAL unit.
+*/
+func h264RBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
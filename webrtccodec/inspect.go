@@ -0,0 +1,106 @@
+package webrtccodec
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("codec not supported for inspection")
+	ErrEmptyPayload     = errors.New("empty RTP payload")
+	ErrInvalidPayload   = errors.New("invalid RTP payload")
+)
+
+/*
+PacketInfo is what an RTP packet of a video track tells about the frame it belongs
+to.
+*/
+type PacketInfo struct {
+	// Keyframe is true for the first packet of a keyframe, a frame decoded without
+	// any before it. For H.264 and AV1 it is told once per unit, by the packet
+	// starting it or, when that does not show it, the first that does.
+	Keyframe bool
+	// FrameStart is true for the first packet of a frame. For VP9 it starts the
+	// frame of a spatial layer; for H.264 and AV1 it starts the access unit or
+	// temporal unit, and the other packets of the unit that start a slice, a
+	// parameter set or an OBU do not.
+	FrameStart bool
+	// FrameEnd is true for the last packet of a frame. For VP9 it ends the frame of
+	// a spatial layer; for the other codecs it is the marker bit, which ends the
+	// access unit or temporal unit with all its layers.
+	FrameEnd bool
+	// TemporalID and SpatialID are the layer of the frame, 0 when the stream is
+	// not layered or the packet does not tell.
+	TemporalID uint8
+	SpatialID  uint8
+	// Width and Height are the resolution the packet announces, as keyframes and
+	// sequence headers do, or 0.
+	Width  uint16
+	Height uint16
+}
+
+/*
+Inspector reads the RTP packets of one codec. For H.264 and AV1 it keeps the
+timestamp of the unit it last saw start, so it reads the packets of one stream, in
+order, and is not safe for concurrent use.
+*/
+type Inspector struct {
+	inspect func(packet *rtp.Packet) (PacketInfo, error)
+	// units is set for the codecs whose frames are the access units or temporal
+	// units all of whose packets share a timestamp.
+	units          bool
+	started        bool
+	unitTimestamp  uint32
+	unitIsKeyframe bool
+}
+
+/*
+NewInspector creates the Inspector of a VP8, VP9, H.264 or AV1 codec, or returns
+ErrUnsupportedCodec for any other.
+*/
+func NewInspector(codec webrtc.RTPCodecCapability) (*Inspector, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &Inspector{inspect: inspectVP8}, nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return &Inspector{inspect: inspectVP9}, nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &Inspector{inspect: inspectH264, units: true}, nil
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return &Inspector{inspect: inspectAV1, units: true}, nil
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+}
+
+/*
+Inspect reads a packet. It returns ErrEmptyPayload for packets without a payload,
+such as padding, and ErrInvalidPayload when the payload is cut short or does not
+follow the payload format.
+*/
+func (i *Inspector) Inspect(packet *rtp.Packet) (PacketInfo, error) {
+	if len(packet.Payload) == 0 {
+		return PacketInfo{}, ErrEmptyPayload
+	}
+	info, err := i.inspect(packet)
+	if err != nil || !i.units || !info.FrameStart && !info.Keyframe {
+		return info, err
+	}
+	if i.started && packet.Timestamp == i.unitTimestamp {
+		// The unit started with an earlier packet, such as the STAP-A of the parameter
+		// sets ahead of the IDR slices or the frame of a lower spatial layer. A keyframe
+		// is told once, by the start or, as after an SEI, by the first packet after it
+		// to show one.
+		info.FrameStart = false
+		info.Keyframe = info.Keyframe && !i.unitIsKeyframe
+		i.unitIsKeyframe = i.unitIsKeyframe || info.Keyframe
+		return info, nil
+	}
+	i.started = true
+	i.unitTimestamp = packet.Timestamp
+	i.unitIsKeyframe = info.Keyframe
+	return info, nil
+}
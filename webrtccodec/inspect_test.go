@@ -0,0 +1,222 @@
+package webrtccodec
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+corpusCapture is an entry of testdata/corpus.json: a capture of real encoder output
+sent by an SfuPeer, made by testdata/capture, and what each of its RTP packets is
+known to carry, in order.
+*/
+type corpusCapture struct {
+	Codec   string `json:"codec"`
+	Capture string `json:"capture"`
+	Source  string `json:"source"`
+	Packets []struct {
+		Name string     `json:"name"`
+		Want PacketInfo `json:"want"`
+	} `json:"packets"`
+}
+
+func loadCorpus(t *testing.T) []corpusCapture {
+	t.Helper()
+	data, err := os.ReadFile("testdata/corpus.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corpus []corpusCapture
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatal(err)
+	}
+	return corpus
+}
+
+/*
+readCapture returns the RTP packets sent in a pcapng capture of an SfuPeer, leaving
+out RTCP and the packets received.
+*/
+func readCapture(t *testing.T, path string) []*rtp.Packet {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []*rtp.Packet
+	for len(data) >= 12 {
+		length := binary.LittleEndian.Uint32(data[4:])
+		if binary.LittleEndian.Uint32(data) == 6 {
+			// An enhanced packet block: the captured length at 12, the packet at 20
+			// and, past its padding, the flags option telling its direction. The
+			// packet is an IPv4 and UDP header around the RTP or RTCP.
+			captured := binary.LittleEndian.Uint32(data[20:])
+			packet := data[28 : 28+captured]
+			flags := binary.LittleEndian.Uint32(data[28+(captured+3)&^3+4:])
+			payload := packet[28:]
+			// RTCP packet types are 200 to 204 where RTP has its marker and payload type.
+			if flags == 2 && (payload[1] < 192 || payload[1] > 223) {
+				rtpPacket := &rtp.Packet{}
+				assert.Nil(t, rtpPacket.Unmarshal(payload))
+				packets = append(packets, rtpPacket)
+			}
+		}
+		data = data[length:]
+	}
+	return packets
+}
+
+func newTestInspector(t *testing.T, mimeType string) *Inspector {
+	t.Helper()
+	inspector, err := NewInspector(webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inspector
+}
+
+func TestInspectCorpus(t *testing.T) {
+	for _, c := range loadCorpus(t) {
+		t.Run(c.Codec, func(t *testing.T) {
+			t.Parallel()
+			packets := readCapture(t, filepath.Join("testdata", c.Capture))
+			if !assert.Len(t, packets, len(c.Packets), c.Source) {
+				return
+			}
+			inspector := newTestInspector(t, c.Codec)
+			for i, packet := range packets {
+				info, err := inspector.Inspect(packet)
+				assert.Nil(t, err, c.Packets[i].Name)
+				assert.Equal(t, c.Packets[i].Want, info, c.Packets[i].Name)
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	t.Run("Matches codecs case-insensitively", func(t *testing.T) {
+		t.Parallel()
+		for _, mimeType := range []string{"video/vp8", "video/vp9", "video/h264", "video/av1"} {
+			_, err := NewInspector(webrtc.RTPCodecCapability{MimeType: mimeType})
+			assert.Nil(t, err, mimeType)
+		}
+	})
+	t.Run("Rejects codecs without frames to inspect", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewInspector(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus})
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+	})
+	t.Run("Reads hand-written payloads of what the captures lack", func(t *testing.T) {
+		t.Parallel()
+		// There is no VP9 encoder to capture, nor a VP8 one with temporal layers.
+		cases := []struct {
+			name     string
+			mimeType string
+			payload  string
+			marker   bool
+			want     PacketInfo
+		}{
+			{"VP8 delta frame on temporal layer 2", webrtc.MimeTypeVP8, "90e0800205a0312800010203", true, PacketInfo{FrameStart: true, FrameEnd: true, TemporalID: 2}},
+			{"VP8 second partition", webrtc.MimeTypeVP8, "91e0800305a000010203", false, PacketInfo{TemporalID: 2}},
+			{"VP9 keyframe with scalability structure", webrtc.MimeTypeVP9, "aa800100001007800324824983420077f032343038241c19401803405fb400010203", false, PacketInfo{Keyframe: true, FrameStart: true, Width: 1920, Height: 804}},
+			{"VP9 keyframe end", webrtc.MimeTypeVP9, "a48001000000010203", true, PacketInfo{FrameEnd: true}},
+			{"VP9 inter frame on temporal layer 2", webrtc.MimeTypeVP9, "ec8002400086000000010203", true, PacketInfo{FrameStart: true, FrameEnd: true, TemporalID: 2}},
+			{"VP9 spatial layer 1 of a keyframe", webrtc.MimeTypeVP9, "ac8003030086000000010203", true, PacketInfo{FrameStart: true, FrameEnd: true, SpatialID: 1}},
+			{"VP9 keyframe of the pion payloader", webrtc.MimeTypeVP9, "8f9f401807800324011401824983420077f032343038241c19401803405fb4", true, PacketInfo{Keyframe: true, FrameStart: true, FrameEnd: true, Width: 1920, Height: 804}},
+			{"VP9 4K keyframe of the pion payloader", webrtc.MimeTypeVP9, "8f9f40180f0008700114018249834240eff086f40421a0e000307000000001", true, PacketInfo{Keyframe: true, FrameStart: true, FrameEnd: true, Width: 3840, Height: 2160}},
+			{"H.264 STAP-A of an SEI and a slice", webrtc.MimeTypeH264, "780004060501800004419a216c", true, PacketInfo{FrameStart: true, FrameEnd: true}},
+			{"H.264 SVC prefix NAL unit of dependency 1", webrtc.MimeTypeH264, "6e801047", false, PacketInfo{FrameStart: true, TemporalID: 2, SpatialID: 1}},
+			{"AV1 key frame without a new sequence", webrtc.MimeTypeAV1, "10301000010203", true, PacketInfo{Keyframe: true, FrameStart: true, FrameEnd: true}},
+			{"AV1 spatial layer 1 after a fragment", webrtc.MimeTypeAV1, "a00500010203041c0830", false, PacketInfo{SpatialID: 1}},
+		}
+		for _, c := range cases {
+			payload, err := hex.DecodeString(c.payload)
+			assert.Nil(t, err, c.name)
+			info, err := newTestInspector(t, c.mimeType).Inspect(&rtp.Packet{Header: rtp.Header{Marker: c.marker}, Payload: payload})
+			assert.Nil(t, err, c.name)
+			assert.Equal(t, c.want, info, c.name)
+		}
+	})
+	t.Run("Tells an H.264 keyframe once, after the SEI starting it", func(t *testing.T) {
+		t.Parallel()
+		inspector := newTestInspector(t, webrtc.MimeTypeH264)
+		packets := []struct {
+			timestamp uint32
+			payload   string
+			want      PacketInfo
+		}{
+			{3000, "0605018000", PacketInfo{FrameStart: true}},
+			// IDR slices with first_mb_in_slice 0 and 1.
+			{3000, "65888400", PacketInfo{Keyframe: true}},
+			{3000, "65408400", PacketInfo{}},
+			{6000, "419a216c", PacketInfo{FrameStart: true}},
+		}
+		for _, p := range packets {
+			payload, _ := hex.DecodeString(p.payload)
+			info, err := inspector.Inspect(&rtp.Packet{Header: rtp.Header{Timestamp: p.timestamp}, Payload: payload})
+			assert.Nil(t, err)
+			assert.Equal(t, p.want, info, p.payload)
+		}
+	})
+	t.Run("Rejects empty and malformed payloads", func(t *testing.T) {
+		t.Parallel()
+		cases := []struct {
+			mimeType string
+			payload  []byte
+			err      error
+		}{
+			{webrtc.MimeTypeVP8, nil, ErrEmptyPayload},
+			{webrtc.MimeTypeVP8, []byte{0x90, 0x80}, ErrInvalidPayload},
+			{webrtc.MimeTypeVP9, []byte{0x80}, ErrInvalidPayload},
+			{webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x05, 0x67}, ErrInvalidPayload},
+			{webrtc.MimeTypeH264, []byte{0x7c}, ErrInvalidPayload},
+			{webrtc.MimeTypeH264, []byte{0x79, 0x00}, ErrInvalidPayload},
+			{webrtc.MimeTypeAV1, []byte{0x00, 0x05, 0x30}, ErrInvalidPayload},
+			{webrtc.MimeTypeAV1, []byte{0x10, 0x0c}, ErrInvalidPayload},
+		}
+		for _, c := range cases {
+			_, err := newTestInspector(t, c.mimeType).Inspect(&rtp.Packet{Payload: c.payload})
+			assert.ErrorIs(t, err, c.err, "%s %x", c.mimeType, c.payload)
+		}
+	})
+}
+
+func TestParseH264SPS(t *testing.T) {
+	// A 1920x1080 Constrained Baseline SPS with emulation prevention bytes.
+	baseline, _ := hex.DecodeString("6742c01fda01e0089f96101000000300100000030320f1831960")
+	t.Run("Reads the cropped picture size", func(t *testing.T) {
+		t.Parallel()
+		sps, err := ParseH264SPS(baseline)
+		assert.Nil(t, err)
+		assert.Equal(t, uint8(66), sps.Profile)
+		assert.Equal(t, uint8(31), sps.Level)
+		assert.False(t, sps.HighProfile)
+		assert.Equal(t, uint16(1920), sps.Width)
+		assert.Equal(t, uint16(1080), sps.Height)
+	})
+	t.Run("Reads the chroma format of High profiles", func(t *testing.T) {
+		t.Parallel()
+		high, _ := hex.DecodeString("67640028acd940780227e5c044000003000400000300f03c60c658")
+		sps, err := ParseH264SPS(high)
+		assert.Nil(t, err)
+		assert.True(t, sps.HighProfile)
+		assert.Equal(t, uint64(1), sps.ChromaFormat)
+		assert.Equal(t, uint16(1920), sps.Width)
+		assert.Equal(t, uint16(1080), sps.Height)
+	})
+	t.Run("Rejects truncated parameter sets", func(t *testing.T) {
+		t.Parallel()
+		_, err := ParseH264SPS(baseline[:6])
+		assert.ErrorIs(t, err, ErrInvalidSPS)
+		_, err = ParseH264SPS([]byte{0x68, 0xce, 0x3c, 0x80})
+		assert.ErrorIs(t, err, ErrInvalidSPS)
+	})
+}
@@ -0,0 +1,465 @@
+/*
+Command capture builds the inspector corpus: it packetizes real encoder output, sends
+it through an SfuPeer to a plain peer connection and captures what the peer sends,
+then writes what each packet is known to carry to corpus.json.
+
+The encoder output is in the IVF files of testdata, from the programs of
+testdata/encode, whose comments tell how they encode. From webrtccodec:
+
+	gcc -o /tmp/vp8enc testdata/encode/vp8enc.c -l:libwebp.so.7 && /tmp/vp8enc testdata/vp8.ivf
+	g++ -o /tmp/h264enc testdata/encode/h264enc.cpp -I$OPENH264/include $OPENH264/lib/libopenh264.a -lpthread && /tmp/h264enc testdata/h264.ivf
+	gcc -o /tmp/av1enc testdata/encode/av1enc.c -l:libaom.so.3 && /tmp/av1enc testdata/av1.ivf
+	go run ./testdata/capture
+
+What the packets carry is worked out from how the encoders were configured and
+from the NAL unit and OBU headers, never by the inspector under test.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mtu = 1200
+	// keyframeInterval and temporalLayers are the settings of the H.264 and AV1
+	// encoders, and spatialLayers that of the AV1 encoder.
+	keyframeInterval = 4
+	temporalLayers   = 2
+	spatialLayers    = 2
+	// frameDuration is 30 frames per second at the 90 kHz video clock.
+	frameDuration = 3000
+	firstSequence = 1000
+)
+
+/*
+capture is an entry of corpus.json: the capture of a stream and what its packets carry.
+*/
+type capture struct {
+	Codec   string   `json:"codec"`
+	Capture string   `json:"capture"`
+	Source  string   `json:"source"`
+	Packets []packet `json:"packets"`
+}
+
+type packet struct {
+	Name string `json:"name"`
+	Want want   `json:"want"`
+	// payload and marker are what is sent.
+	payload []byte
+	marker  bool
+}
+
+/*
+want mirrors webrtccodec.PacketInfo with the field names of corpus.json.
+*/
+type want struct {
+	Keyframe   bool   `json:"keyframe"`
+	FrameStart bool   `json:"frameStart"`
+	FrameEnd   bool   `json:"frameEnd"`
+	TemporalID uint8  `json:"temporalId"`
+	SpatialID  uint8  `json:"spatialId"`
+	Width      uint16 `json:"width"`
+	Height     uint16 `json:"height"`
+}
+
+func main() {
+	streams := []struct {
+		codec     webrtc.RTPCodecCapability
+		name      string
+		source    string
+		packetize func(ivf *ivfFile) ([][]packet, error)
+	}{
+		{
+			codec:     webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			name:      "vp8",
+			source:    "libwebp 1.2.4 keyframes of a 320x240 test pattern, libwebp being the only VP8 encoder at hand; pion VP8Payloader with picture IDs",
+			packetize: packetizeVP8,
+		},
+		{
+			codec:     webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+			name:      "h264",
+			source:    "OpenH264 2.1.1, 320x240 Constrained Baseline in 2 temporal layers with prefix NAL units, 2 slices per frame and a keyframe every 4 frames; pion H264Payloader",
+			packetize: packetizeH264,
+		},
+		{
+			codec:     webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+			name:      "av1",
+			source:    "libaom 3.6.0 realtime, 320x240 in L2T2 SVC with a keyframe every 4 frames; OBU size fields left out as the payload format recommends, pion AV1Payloader",
+			packetize: packetizeAV1,
+		},
+	}
+	var corpus []capture
+	for _, stream := range streams {
+		ivf, err := readIVF(filepath.Join("testdata", stream.name+".ivf"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		frames, err := stream.packetize(ivf)
+		if err != nil {
+			log.Fatalf("%s: %v", stream.name, err)
+		}
+		path := filepath.Join("testdata", stream.name+".pcapng")
+		if err := send(stream.codec, frames, path); err != nil {
+			log.Fatalf("%s: %v", stream.name, err)
+		}
+		entry := capture{Codec: stream.codec.MimeType, Capture: stream.name + ".pcapng", Source: stream.source}
+		for _, frame := range frames {
+			entry.Packets = append(entry.Packets, frame...)
+		}
+		corpus = append(corpus, entry)
+	}
+	data, err := json.MarshalIndent(corpus, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("testdata", "corpus.json"), append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+/*
+send writes the packets of frames on a track an SfuPeer sends to a peer connection,
+capturing them to path.
+*/
+func send(codec webrtc.RTPCodecCapability, frames [][]packet, path string) error {
+	peer, err := webrtcpeer.NewSfuPeerWithConfig(webrtcpeer.SfuPeerConfig{ID: "sfu", PeerConfig: &webrtc.Configuration{}})
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	remote.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "camera", "stream")
+	if err != nil {
+		return err
+	}
+	if _, err := peer.AddTrack(track); err != nil {
+		return err
+	}
+	if err := negotiate(peer.PeerConnection, remote); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for peer.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		if time.Now().After(deadline) {
+			return errors.New("peer not connected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// The sender starts once the transports have.
+	time.Sleep(500 * time.Millisecond)
+	if err := peer.StartCaptureFile(path, webrtcpeer.CaptureConfig{TrackIDs: []string{"camera"}}); err != nil {
+		return err
+	}
+	sequence := uint16(firstSequence)
+	for i, frame := range frames {
+		for _, p := range frame {
+			err := track.WriteRTP(&rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         p.marker,
+					SequenceNumber: sequence,
+					Timestamp:      uint32(i * frameDuration),
+				},
+				Payload: p.payload,
+			})
+			if err != nil {
+				return err
+			}
+			sequence++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	return peer.StopCapture()
+}
+
+func negotiate(offerer, answerer *webrtc.PeerConnection) error {
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		return err
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	<-gathered
+	return offerer.SetRemoteDescription(*answerer.LocalDescription())
+}
+
+/*
+ivfFile is the frame size and the frames of an IVF file.
+*/
+type ivfFile struct {
+	width  uint16
+	height uint16
+	frames [][]byte
+}
+
+func readIVF(path string) (*ivfFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 32 || string(data[:4]) != "DKIF" {
+		return nil, fmt.Errorf("%s is not an IVF file", path)
+	}
+	ivf := &ivfFile{width: binary.LittleEndian.Uint16(data[12:]), height: binary.LittleEndian.Uint16(data[14:])}
+	for i := int(binary.LittleEndian.Uint16(data[6:])); i < len(data); {
+		if i+12 > len(data) {
+			return nil, fmt.Errorf("%s: frame header cut short", path)
+		}
+		size := int(binary.LittleEndian.Uint32(data[i:]))
+		i += 12
+		if i+size > len(data) {
+			return nil, fmt.Errorf("%s: frame cut short", path)
+		}
+		ivf.frames = append(ivf.frames, data[i:i+size])
+		i += size
+	}
+	return ivf, nil
+}
+
+/*
+packetizeVP8 packetizes keyframes, which is all libwebp encodes: the first packet of
+each starts it and tells its size.
+*/
+func packetizeVP8(ivf *ivfFile) ([][]packet, error) {
+	payloader := &codecs.VP8Payloader{EnablePictureID: true}
+	var frames [][]packet
+	for i, data := range ivf.frames {
+		if data[0]&0x01 != 0 {
+			return nil, fmt.Errorf("frame %d is not a keyframe", i)
+		}
+		var frame []packet
+		payloads := payloader.Payload(mtu, data)
+		for j, payload := range payloads {
+			p := packet{Name: fmt.Sprintf("Keyframe %d, packet %d of %d", i, j+1, len(payloads)), payload: payload}
+			if j == 0 {
+				p.Want = want{Keyframe: true, FrameStart: true, Width: ivf.width, Height: ivf.height}
+			}
+			frame = append(frame, p)
+		}
+		frames = append(frames, endFrame(frame))
+	}
+	return frames, nil
+}
+
+/*
+packetizeH264 packetizes access units one NAL unit at a time, as the payloader
+holds back the parameter sets to aggregate them with the unit that follows. The
+first packet starts the access unit, and a keyframe every keyframeInterval frames;
+the SPS tells the size and prefix NAL units the temporal layer, which alternates.
+*/
+func packetizeH264(ivf *ivfFile) ([][]packet, error) {
+	payloader := &codecs.H264Payloader{}
+	var frames [][]packet
+	for i, data := range ivf.frames {
+		keyframe := i%keyframeInterval == 0
+		temporalID := uint8(i % temporalLayers)
+		var frame []packet
+		idr := false
+		for _, nalu := range splitAnnexB(data) {
+			naluType := nalu[0] & 0x1f
+			switch naluType {
+			case 5:
+				idr = true
+			case 14:
+				if len(nalu) < 4 || nalu[3]>>5 != temporalID {
+					return nil, fmt.Errorf("frame %d: prefix NAL unit not on temporal layer %d", i, temporalID)
+				}
+			}
+			payloads := payloader.Payload(mtu, nalu)
+			for j, payload := range payloads {
+				p := packet{Name: fmt.Sprintf("Frame %d, %s", i, describeH264(payload, j, len(payloads))), payload: payload}
+				switch payload[0] & 0x1f {
+				case 24:
+					// The aggregated SPS and PPS.
+					p.Want.Width, p.Want.Height = ivf.width, ivf.height
+				case 14:
+					p.Want.TemporalID = temporalID
+				}
+				frame = append(frame, p)
+			}
+		}
+		if idr != keyframe {
+			return nil, fmt.Errorf("frame %d: IDR %t, keyframe expected %t", i, idr, keyframe)
+		}
+		frame[0].Want.FrameStart = true
+		frame[0].Want.Keyframe = keyframe
+		frames = append(frames, endFrame(frame))
+	}
+	return frames, nil
+}
+
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	for _, nalu := range bytes.Split(data, []byte{0, 0, 1}) {
+		nalu = bytes.TrimRight(nalu, "\x00")
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+	}
+	return nalus
+}
+
+var h264NALUnitNames = map[byte]string{1: "slice", 5: "IDR slice", 7: "SPS", 8: "PPS", 14: "prefix NAL unit"}
+
+func describeH264(payload []byte, fragment, fragments int) string {
+	switch payload[0] & 0x1f {
+	case 24:
+		return "STAP-A of SPS and PPS"
+	case 28:
+		return fmt.Sprintf("FU-A %d of %d of %s", fragment+1, fragments, h264NALUnitNames[payload[1]&0x1f])
+	default:
+		return h264NALUnitNames[payload[0]&0x1f]
+	}
+}
+
+/*
+packetizeAV1 packetizes temporal units one OBU at a time without their temporal
+delimiters and size fields, as the payload format has them; the payloader holds
+back the sequence header to send it with the OBU that follows. The first packet
+starts the temporal unit, and a keyframe every keyframeInterval frames, and tells
+the size with its sequence header. Each temporal unit has a frame of both spatial
+layers, in order, on the temporal layer that alternates; the packets starting their
+OBU tell the layers.
+*/
+func packetizeAV1(ivf *ivfFile) ([][]packet, error) {
+	payloader := &codecs.AV1Payloader{}
+	var frames [][]packet
+	for i, data := range ivf.frames {
+		keyframe := i%keyframeInterval == 0
+		temporalID := uint8(i % temporalLayers)
+		obus, err := splitOBUs(data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		var frame []packet
+		spatialID := uint8(0)
+		sequenceHeader := false
+		for _, obu := range obus {
+			obuType := obu[0] >> 3 & 0x0f
+			switch obuType {
+			case 2:
+				continue
+			case 1:
+				sequenceHeader = true
+			case 6:
+				if spatialID >= spatialLayers {
+					return nil, fmt.Errorf("frame %d: more frames than spatial layers", i)
+				}
+				// libaom leaves the extension header out of the frames of the base layer.
+				extended := obu[0]&0x04 != 0
+				if extended && (obu[1]>>5 != temporalID || obu[1]>>3&0x03 != spatialID) || !extended && temporalID+spatialID != 0 {
+					return nil, fmt.Errorf("frame %d: frame OBU not on layers S%dT%d", i, spatialID, temporalID)
+				}
+			default:
+				return nil, fmt.Errorf("frame %d: unexpected OBU type %d", i, obuType)
+			}
+			payloads := payloader.Payload(mtu, obu)
+			for j, payload := range payloads {
+				p := packet{Name: fmt.Sprintf("Temporal unit %d, frame S%dT%d, packet %d of %d", i, spatialID, temporalID, j+1, len(payloads)), payload: payload}
+				if j == 0 {
+					p.Want.TemporalID, p.Want.SpatialID = temporalID, spatialID
+					if sequenceHeader {
+						p.Name = fmt.Sprintf("Temporal unit %d, sequence header and frame S%dT%d, packet %d of %d", i, spatialID, temporalID, j+1, len(payloads))
+						p.Want.Width, p.Want.Height = ivf.width, ivf.height
+						sequenceHeader = false
+					}
+				}
+				frame = append(frame, p)
+			}
+			if obuType == 6 {
+				spatialID++
+			}
+		}
+		if spatialID != spatialLayers {
+			return nil, fmt.Errorf("frame %d: %d spatial layers", i, spatialID)
+		}
+		frame[0].Want.FrameStart = true
+		frame[0].Want.Keyframe = keyframe
+		frames = append(frames, endFrame(frame))
+	}
+	return frames, nil
+}
+
+/*
+splitOBUs splits a temporal unit into its OBUs, leaving out their size fields.
+*/
+func splitOBUs(data []byte) ([][]byte, error) {
+	var obus [][]byte
+	for i := 0; i < len(data); {
+		header := data[i]
+		headerSize := 1
+		if header&0x04 != 0 {
+			headerSize = 2
+		}
+		if header&0x02 == 0 || i+headerSize >= len(data) {
+			return nil, errors.New("OBU without a size field")
+		}
+		size, n := uint64(0), 0
+		for ; ; n++ {
+			b := data[i+headerSize+n]
+			size |= uint64(b&0x7f) << (7 * n)
+			if b&0x80 == 0 {
+				n++
+				break
+			}
+		}
+		start := i + headerSize + n
+		if start+int(size) > len(data) {
+			return nil, errors.New("OBU cut short")
+		}
+		obu := append([]byte{header &^ 0x02}, data[i+1:i+headerSize]...)
+		obus = append(obus, append(obu, data[start:start+int(size)]...))
+		i = start + int(size)
+	}
+	return obus, nil
+}
+
+/*
+endFrame sets the marker bit on the last packet of a frame.
+*/
+func endFrame(frame []packet) []packet {
+	last := &frame[len(frame)-1]
+	last.marker = true
+	last.Want.FrameEnd = true
+	return frame
+}
@@ -0,0 +1,95 @@
+// Encodes a moving test pattern with libaom in L2T2 SVC into an IVF file of temporal units.
+// The libaom 3.6 runtime package has no headers, so the few entry points used are declared
+// by hand, with the layouts of its aom_codec_enc_cfg_t and aom_codec_cx_pkt_t on x86-64.
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+
+typedef struct aom_codec_iface aom_codec_iface_t;
+extern aom_codec_iface_t *aom_codec_av1_cx(void);
+extern int aom_codec_enc_config_default(aom_codec_iface_t *iface, void *cfg, unsigned int usage);
+extern int aom_codec_enc_init_ver(void *ctx, aom_codec_iface_t *iface, const void *cfg, long flags, int ver);
+extern int aom_codec_control(void *ctx, int id, ...);
+extern void *aom_img_wrap(void *img, int fmt, unsigned int w, unsigned int h, unsigned int align, unsigned char *data);
+extern int aom_codec_encode(void *ctx, const void *img, int64_t pts, unsigned long duration, long flags);
+extern const void *aom_codec_get_cx_data(void *ctx, const void **iter);
+extern const char *aom_codec_error_detail(void *ctx);
+
+#define AOME_SET_CPUUSED 13
+#define AV1E_SET_SVC_LAYER_ID 131
+#define AV1E_SET_SVC_PARAMS 132
+#define AV1E_SET_SVC_REF_FRAME_CONFIG 133
+#define AOM_EFLAG_FORCE_KF 1
+#define AOM_IMG_FMT_I420 0x102
+
+typedef struct { int number_spatial_layers, number_temporal_layers; int maxq[32], minq[32]; int snum[4], sden[4]; int bitrate[32]; int fr[8]; } svc_params;
+typedef struct { int sid, tid; } layer_id;
+typedef struct { int reference[7]; int ref_idx[7]; int refresh[8]; } ref_cfg;
+
+static void le16(FILE *f, int v) { fputc(v & 255, f); fputc(v >> 8 & 255, f); }
+static void le32(FILE *f, uint32_t v) { le16(f, v & 0xffff); le16(f, v >> 16); }
+
+int main(int argc, char **argv) {
+  const int W = 320, H = 240, FRAMES = 6, SL = 2, TL = 2;
+  unsigned int cfg[1024] = {0};
+  aom_codec_enc_config_default(aom_codec_av1_cx(), cfg, 1);
+  // g_w, g_h, g_lag_in_frames and rc_target_bitrate of aom_codec_enc_cfg_t, in kbit/s.
+  cfg[3] = W; cfg[4] = H; cfg[14] = 0; cfg[34] = 1000;
+  static char ctx[1024];
+  if (aom_codec_enc_init_ver(ctx, aom_codec_av1_cx(), cfg, 0, 25)) { fprintf(stderr, "init\n"); return 1; }
+  aom_codec_control(ctx, AOME_SET_CPUUSED, 8);
+  svc_params p; memset(&p, 0, sizeof p);
+  p.number_spatial_layers = SL; p.number_temporal_layers = TL;
+  for (int i = 0; i < 32; i++) { p.maxq[i] = 56; p.minq[i] = 2; }
+  p.snum[0] = 1; p.sden[0] = 2; p.snum[1] = 1; p.sden[1] = 1;
+  p.bitrate[0] = 150; p.bitrate[1] = 250; p.bitrate[2] = 600; p.bitrate[3] = 1000;
+  p.fr[0] = 2; p.fr[1] = 1;
+  if (aom_codec_control(ctx, AV1E_SET_SVC_PARAMS, &p)) { fprintf(stderr, "svc %s\n", aom_codec_error_detail(ctx)); return 1; }
+  FILE *out = fopen(argv[1], "wb");
+  fwrite("DKIF", 1, 4, out); le16(out, 0); le16(out, 32); fwrite("AV01", 1, 4, out);
+  le16(out, W); le16(out, H); le32(out, 30); le32(out, 1); le32(out, FRAMES); le32(out, 0);
+  unsigned char *yuv = malloc(W * H * 3 / 2);
+  static char img[512];
+  unsigned char *tu = malloc(1 << 20);
+  for (int f = 0; f < FRAMES; f++) {
+    // A gradient with a box moving across it, under a still strip of noise that makes
+    // keyframes span several packets.
+    for (int y = 0; y < H; y++)
+      for (int x = 0; x < W; x++)
+        yuv[y * W + x] = y < 12 ? (unsigned char)((x * 7919u + y * 104729u) * 2654435761u >> 24)
+                       : (x - 24 * f) / 16 % 4 == 0 && y / 32 == 3 ? 235 : (unsigned char)(16 + (x + y) / 3);
+    memset(yuv + W * H, 128, W * H / 2);
+    aom_img_wrap(img, AOM_IMG_FMT_I420, W, H, 1, yuv);
+    size_t tusize = 0;
+    int tid = f % 2;
+    for (int sid = 0; sid < SL; sid++) {
+      layer_id l = {sid, tid};
+      aom_codec_control(ctx, AV1E_SET_SVC_LAYER_ID, &l);
+      // Each spatial layer predicts from its own last frame, the upper one also from the
+      // lower layer of the same picture; only temporal layer 0 refreshes references.
+      ref_cfg rc; memset(&rc, 0, sizeof rc);
+      for (int i = 0; i < 7; i++) rc.ref_idx[i] = sid;
+      rc.reference[0] = 1;
+      if (sid > 0) { rc.ref_idx[3] = 0; rc.reference[3] = 1; }
+      if (tid == 0) rc.refresh[sid] = 1;
+      aom_codec_control(ctx, AV1E_SET_SVC_REF_FRAME_CONFIG, &rc);
+      long flags = (f % 4 == 0 && sid == 0) ? AOM_EFLAG_FORCE_KF : 0;
+      if (aom_codec_encode(ctx, img, f, 1, flags)) { fprintf(stderr, "encode %s\n", aom_codec_error_detail(ctx)); return 1; }
+      const void *iter = NULL;
+      const unsigned char *pkt;
+      while ((pkt = aom_codec_get_cx_data(ctx, &iter))) {
+        if (*(const int *)pkt != 0) continue;
+        const unsigned char *d = *(unsigned char *const *)(pkt + 8);
+        size_t sz = *(const size_t *)(pkt + 16);
+        fprintf(stderr, "frame %d sid %d tid %d size %zu flags %x\n", f, sid, tid, sz, *(const unsigned *)(pkt + 40));
+        memcpy(tu + tusize, d, sz);
+        tusize += sz;
+      }
+    }
+    le32(out, tusize); le32(out, f); le32(out, 0);
+    fwrite(tu, 1, tusize, out);
+  }
+  fclose(out);
+  return 0;
+}
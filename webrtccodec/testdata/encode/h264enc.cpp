@@ -0,0 +1,74 @@
+// Encodes a moving test pattern with OpenH264 2.1.1 into an IVF file of Annex B access units,
+// in 2 temporal layers with prefix NAL units and 2 slices per frame.
+#include <openh264/codec_api.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+
+static void le16(FILE *f, int v) { fputc(v & 255, f); fputc(v >> 8 & 255, f); }
+static void le32(FILE *f, uint32_t v) { le16(f, v & 0xffff); le16(f, v >> 16); }
+
+int main(int argc, char **argv) {
+  const int W = 320, H = 240, FRAMES = 6;
+  ISVCEncoder *enc;
+  if (WelsCreateSVCEncoder(&enc)) return 1;
+  SEncParamExt p;
+  enc->GetDefaultParams(&p);
+  p.iUsageType = CAMERA_VIDEO_REAL_TIME;
+  p.iPicWidth = W;
+  p.iPicHeight = H;
+  p.iTargetBitrate = 800000;
+  p.iMaxBitrate = 800000;
+  p.iRCMode = RC_BITRATE_MODE;
+  p.fMaxFrameRate = 30;
+  p.bEnableFrameSkip = false;
+  p.uiIntraPeriod = 4;
+  p.iTemporalLayerNum = 2;
+  p.iSpatialLayerNum = 1;
+  p.bPrefixNalAddingCtrl = true;
+  p.iMultipleThreadIdc = 1;
+  p.sSpatialLayers[0].iVideoWidth = W;
+  p.sSpatialLayers[0].iVideoHeight = H;
+  p.sSpatialLayers[0].fFrameRate = 30;
+  p.sSpatialLayers[0].iSpatialBitrate = 800000;
+  p.sSpatialLayers[0].iMaxSpatialBitrate = 800000;
+  p.sSpatialLayers[0].uiProfileIdc = PRO_BASELINE;
+  p.sSpatialLayers[0].sSliceArgument.uiSliceMode = SM_FIXEDSLCNUM_SLICE;
+  p.sSpatialLayers[0].sSliceArgument.uiSliceNum = 2;
+  if (enc->InitializeExt(&p)) { fprintf(stderr, "init\n"); return 1; }
+  FILE *out = fopen(argv[1], "wb");
+  fwrite("DKIF", 1, 4, out); le16(out, 0); le16(out, 32); fwrite("H264", 1, 4, out);
+  le16(out, W); le16(out, H); le32(out, 30); le32(out, 1); le32(out, FRAMES); le32(out, 0);
+  unsigned char *yuv = (unsigned char *)malloc(W * H * 3 / 2);
+  for (int f = 0; f < FRAMES; f++) {
+    // A gradient with a box moving across it, under a still strip of noise that makes
+    // keyframes span several packets.
+    for (int y = 0; y < H; y++)
+      for (int x = 0; x < W; x++)
+        yuv[y * W + x] = y < 12 ? (unsigned char)((x * 7919u + y * 104729u) * 2654435761u >> 24)
+                       : (x - 24 * f) / 16 % 4 == 0 && y / 32 == 3 ? 235 : (unsigned char)(16 + (x + y) / 3);
+    memset(yuv + W * H, 128, W * H / 2);
+    SSourcePicture pic = {0};
+    pic.iPicWidth = W; pic.iPicHeight = H; pic.iColorFormat = videoFormatI420;
+    pic.iStride[0] = W; pic.iStride[1] = pic.iStride[2] = W / 2;
+    pic.pData[0] = yuv; pic.pData[1] = yuv + W * H; pic.pData[2] = yuv + W * H * 5 / 4;
+    pic.uiTimeStamp = f * 33;
+    SFrameBSInfo info; memset(&info, 0, sizeof info);
+    if (enc->EncodeFrame(&pic, &info)) { fprintf(stderr, "encode\n"); return 1; }
+    int size = 0;
+    for (int l = 0; l < info.iLayerNum; l++)
+      for (int n = 0; n < info.sLayerInfo[l].iNalCount; n++) size += info.sLayerInfo[l].pNalLengthInByte[n];
+    le32(out, size); le32(out, f); le32(out, 0);
+    for (int l = 0; l < info.iLayerNum; l++) {
+      int lsize = 0;
+      for (int n = 0; n < info.sLayerInfo[l].iNalCount; n++) lsize += info.sLayerInfo[l].pNalLengthInByte[n];
+      fwrite(info.sLayerInfo[l].pBsBuf, 1, lsize, out);
+      fprintf(stderr, "frame %d layer %d type %d tid %d nals %d size %d\n", f, l, info.eFrameType, info.sLayerInfo[l].uiTemporalId, info.sLayerInfo[l].iNalCount, lsize);
+    }
+  }
+  fclose(out);
+  enc->Uninitialize();
+  WelsDestroySVCEncoder(enc);
+  return 0;
+}
@@ -0,0 +1,39 @@
+// Encodes a moving test pattern into VP8 keyframes with libwebp, the only VP8 encoder
+// at hand, into an IVF file. A lossy WebP image is a RIFF file around the VP8 keyframe.
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+
+extern size_t WebPEncodeRGB(const uint8_t *rgb, int width, int height, int stride, float quality, uint8_t **output);
+extern void WebPFree(void *ptr);
+
+static void le16(FILE *f, int v) { fputc(v & 255, f); fputc(v >> 8 & 255, f); }
+static void le32(FILE *f, uint32_t v) { le16(f, v & 0xffff); le16(f, v >> 16); }
+
+int main(int argc, char **argv) {
+  const int W = 320, H = 240, FRAMES = 3;
+  FILE *out = fopen(argv[1], "wb");
+  fwrite("DKIF", 1, 4, out); le16(out, 0); le16(out, 32); fwrite("VP80", 1, 4, out);
+  le16(out, W); le16(out, H); le32(out, 30); le32(out, 1); le32(out, FRAMES); le32(out, 0);
+  unsigned char *rgb = malloc(W * H * 3);
+  for (int f = 0; f < FRAMES; f++) {
+    // A gradient with a box moving across it, under a still strip of noise that makes
+    // keyframes span several packets.
+    for (int y = 0; y < H; y++)
+      for (int x = 0; x < W; x++)
+        memset(rgb + (y * W + x) * 3, y < 12 ? (unsigned char)((x * 7919u + y * 104729u) * 2654435761u >> 24)
+                                     : (x - 24 * f) / 16 % 4 == 0 && y / 32 == 3 ? 235 : (unsigned char)(16 + (x + y) / 3), 3);
+    uint8_t *webp;
+    size_t size = WebPEncodeRGB(rgb, W, H, W * 3, 75, &webp);
+    // RIFF header, then the "VP8 " chunk.
+    if (size < 20 || memcmp(webp + 12, "VP8 ", 4)) { fprintf(stderr, "not a lossy WebP\n"); return 1; }
+    uint32_t chunk = webp[16] | webp[17] << 8 | webp[18] << 16 | (uint32_t)webp[19] << 24;
+    le32(out, chunk); le32(out, f); le32(out, 0);
+    fwrite(webp + 20, 1, chunk, out);
+    fprintf(stderr, "frame %d size %u\n", f, chunk);
+    WebPFree(webp);
+  }
+  fclose(out);
+  return 0;
+}
@@ -0,0 +1,39 @@
+package webrtccodec
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+/*
+inspectVP8 reads the payload descriptor of RFC 7741 and, on keyframes, the frame
+size from the uncompressed data chunk of the frame.
+*/
+func inspectVP8(packet *rtp.Packet) (PacketInfo, error) {
+	vp8 := codecs.VP8Packet{}
+	data, err := vp8.Unmarshal(packet.Payload)
+	if err != nil {
+		return PacketInfo{}, ErrInvalidPayload
+	}
+	info := PacketInfo{
+		FrameStart: vp8.S == 1 && vp8.PID == 0,
+		FrameEnd:   packet.Marker,
+	}
+	if vp8.T == 1 {
+		info.TemporalID = vp8.TID
+	}
+	// The P bit of the frame tag is 0 on keyframes.
+	if !info.FrameStart || len(data) == 0 || data[0]&0x01 != 0 {
+		return info, nil
+	}
+	info.Keyframe = true
+	// A keyframe tag is followed by the start code 9d 01 2a and the 14 bit width
+	// and height, each with 2 bits of scaling.
+	if len(data) >= 10 && data[3] == 0x9d && data[4] == 0x01 && data[5] == 0x2a {
+		info.Width = binary.LittleEndian.Uint16(data[6:]) & 0x3fff
+		info.Height = binary.LittleEndian.Uint16(data[8:]) & 0x3fff
+	}
+	return info, nil
+}
@@ -0,0 +1,49 @@
+package webrtccodec
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/vp9"
+)
+
+/*
+inspectVP9 reads the payload descriptor of RFC 9628 and, at the start of a frame,
+its uncompressed header. The frame boundaries are those of layer frames, one per
+spatial layer of a picture.
+*/
+func inspectVP9(packet *rtp.Packet) (PacketInfo, error) {
+	descriptor := codecs.VP9Packet{}
+	data, err := descriptor.Unmarshal(packet.Payload)
+	if err != nil {
+		return PacketInfo{}, ErrInvalidPayload
+	}
+	info := PacketInfo{
+		FrameStart: descriptor.B,
+		FrameEnd:   descriptor.E,
+		TemporalID: descriptor.TID,
+		SpatialID:  descriptor.SID,
+	}
+	// The scalability structure announces the resolution of every spatial layer.
+	if descriptor.V && int(descriptor.SID) < len(descriptor.Width) && int(descriptor.SID) < len(descriptor.Height) {
+		info.Width, info.Height = descriptor.Width[descriptor.SID], descriptor.Height[descriptor.SID]
+	}
+	// A keyframe starts with a base layer frame that is not inter-picture predicted.
+	if !descriptor.B || descriptor.P || descriptor.SID != 0 {
+		return info, nil
+	}
+	header := vp9.Header{}
+	if err := header.Unmarshal(data); err != nil {
+		// The descriptor is enough to tell a keyframe; the header is only read for
+		// its frame size.
+		info.Keyframe = true
+		return info, nil
+	}
+	if header.ShowExistingFrame || header.NonKeyFrame {
+		return info, nil
+	}
+	info.Keyframe = true
+	if header.FrameSize != nil {
+		info.Width, info.Height = header.Width(), header.Height()
+	}
+	return info, nil
+}
@@ -0,0 +1,365 @@
+package webrtchttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/google/uuid"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultGatheringTimeout = 5 * time.Second
+	maxBodySize             = 1 << 20
+)
+
+/*
+resource is a session created by a POST and addressed by its Location afterwards.
+*/
+type resource struct {
+	id        string
+	ownerID   string
+	peer      *webrtcpeer.SfuPeer
+	mu        sync.Mutex
+	closeOnce sync.Once
+	// onClose holds cleanups run when the resource is closed.
+	onClose []func()
+}
+
+/*
+etag identifies the current ICE session of the resource by its local ICE ufrag.
+*/
+func (res *resource) etag() string {
+	description := res.peer.LocalDescription()
+	if description == nil {
+		return ""
+	}
+	parsed, err := description.Unmarshal()
+	if err != nil {
+		return ""
+	}
+	ufrag, _ := iceCredentials(parsed)
+	return `"` + ufrag + `"`
+}
+
+/*
+resourceHandler holds what WHIP and WHEP share: SfuPeer creation, one round trip
+answers, and the PATCH and DELETE handling of the created resources.
+*/
+type resourceHandler struct {
+	peerConfig       *webrtc.Configuration
+	peers            *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	authenticate     func(r *http.Request) (string, error)
+	gatheringTimeout time.Duration
+	resources        map[string]*resource
+	resourcesMu      sync.Mutex
+	loggerFactory    logging.LoggerFactory
+	log              logging.LeveledLogger
+}
+
+func newResourceHandler(scope string, peerConfig *webrtc.Configuration, peers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer], authenticate func(r *http.Request) (string, error), gatheringTimeout time.Duration, loggerFactory logging.LoggerFactory) *resourceHandler {
+	h := &resourceHandler{
+		peerConfig:       peerConfig,
+		peers:            peers,
+		authenticate:     authenticate,
+		gatheringTimeout: gatheringTimeout,
+		resources:        make(map[string]*resource),
+		loggerFactory:    loggerFactory,
+		log:              webrtclog.NewLogger(loggerFactory, scope),
+	}
+	if h.peerConfig == nil {
+		h.peerConfig = &webrtc.Configuration{}
+	}
+	if h.peers == nil {
+		h.peers = webrtcpeer.NewSfuPeerManager()
+	}
+	if h.authenticate == nil {
+		h.authenticate = func(r *http.Request) (string, error) {
+			return uuid.New().String(), nil
+		}
+	}
+	if h.gatheringTimeout == 0 {
+		h.gatheringTimeout = defaultGatheringTimeout
+	}
+	return h
+}
+
+/*
+route dispatches a request by method: POST creates a resource through create, PATCH
+and DELETE address the resource named by the last path element.
+*/
+func (h *resourceHandler) route(w http.ResponseWriter, r *http.Request, create func(w http.ResponseWriter, r *http.Request, ownerID string, offer webrtc.SessionDescription)) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Accept-Post", contentTypeSDP)
+		w.Header().Set("Accept-Patch", contentTypeSDPFrag)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		ownerID, err := h.authenticate(r)
+		if err != nil {
+			h.log.Warnf("Rejecting request: %v", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		body, ok := readBody(w, r, contentTypeSDP)
+		if !ok {
+			return
+		}
+		create(w, r, ownerID, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: body})
+	case http.MethodPatch, http.MethodDelete:
+		res, ok := h.authorize(w, r)
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			h.close(res)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		h.patch(w, r, res)
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST, PATCH, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+authorize looks up the resource addressed by the request and checks that the caller owns it.
+*/
+func (h *resourceHandler) authorize(w http.ResponseWriter, r *http.Request) (*resource, bool) {
+	h.resourcesMu.Lock()
+	res, ok := h.resources[path.Base(r.URL.Path)]
+	h.resourcesMu.Unlock()
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	}
+	ownerID, err := h.authenticate(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	if ownerID != res.ownerID {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	return res, true
+}
+
+/*
+newPeer creates an SfuPeer and registers it in the peer manager.
+*/
+func (h *resourceHandler) newPeer(id string) (*webrtcpeer.SfuPeer, error) {
+	peer, err := webrtcpeer.NewSfuPeerWithConfig(webrtcpeer.SfuPeerConfig{
+		ID:            id,
+		PeerConfig:    h.peerConfig,
+		LoggerFactory: h.loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.peers.AddPeer(peer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	return peer, nil
+}
+
+/*
+answer applies a remote offer and returns the local answer once ICE gathering has
+completed, so that it carries every local candidate. beforeAnswer, if not nil, runs
+between applying the offer and creating the answer.
+*/
+func (h *resourceHandler) answer(peer *webrtcpeer.SfuPeer, offer webrtc.SessionDescription, beforeAnswer func() error) (*webrtc.SessionDescription, error) {
+	if err := peer.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+	if beforeAnswer != nil {
+		if err := beforeAnswer(); err != nil {
+			return nil, err
+		}
+	}
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.gatheringTimeout)
+	defer cancel()
+	if err := peer.WaitForICEGatheringComplete(ctx); err != nil {
+		h.log.Warnf("ICE gathering did not complete in %s, answering with the candidates gathered so far", h.gatheringTimeout)
+	}
+	return peer.LocalDescription(), nil
+}
+
+/*
+add registers a resource for peer and writes the 201 response carrying the answer.
+The resource is closed when the peer connection fails or closes.
+*/
+func (h *resourceHandler) add(w http.ResponseWriter, r *http.Request, ownerID string, peer *webrtcpeer.SfuPeer, answer *webrtc.SessionDescription) *resource {
+	res := &resource{
+		id:      uuid.New().String(),
+		ownerID: ownerID,
+		peer:    peer,
+	}
+	h.resourcesMu.Lock()
+	h.resources[res.id] = res
+	h.resourcesMu.Unlock()
+	peer.AddOnConnectionStateChangeHandler(func(connectionState webrtc.PeerConnectionState) {
+		if connectionState == webrtc.PeerConnectionStateFailed || connectionState == webrtc.PeerConnectionStateClosed {
+			go h.close(res)
+		}
+	})
+
+	w.Header().Set("Content-Type", contentTypeSDP)
+	w.Header().Set("Location", path.Join(r.URL.Path, res.id))
+	w.Header().Set("ETag", res.etag())
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+	return res
+}
+
+/*
+patch handles trickle ICE and ICE restarts. Candidates for the current ICE session
+are added and answered with 204; new ICE credentials restart ICE on the peer and are
+answered with 200 and the new local credentials and candidates.
+*/
+func (h *resourceHandler) patch(w http.ResponseWriter, r *http.Request, res *resource) {
+	body, ok := readBody(w, r, contentTypeSDPFrag)
+	if !ok {
+		return
+	}
+	frag, err := parseSDPFragment(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != res.etag() {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	remote := res.peer.RemoteDescription()
+	if remote == nil {
+		http.Error(w, "no remote description", http.StatusConflict)
+		return
+	}
+	parsed, err := remote.Unmarshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	remoteUfrag, _ := iceCredentials(parsed)
+	if frag.ufrag == "" || frag.ufrag == remoteUfrag {
+		for _, candidate := range frag.candidates {
+			if err := res.peer.AddICECandidate(candidate); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if ifMatch != "*" {
+		http.Error(w, "ICE restart requires If-Match: *", http.StatusPreconditionRequired)
+		return
+	}
+	offer, err := restartOffer(remote, frag.ufrag, frag.pwd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer, err := h.answer(res.peer, offer, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ICE restart: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, candidate := range frag.candidates {
+		if err := res.peer.AddICECandidate(candidate); err != nil {
+			h.log.Warnf("Error adding ICE candidate after restart: %v", err)
+		}
+	}
+	fragment, err := sdpFragmentFromDescription(answer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeSDPFrag)
+	w.Header().Set("ETag", res.etag())
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, fragment)
+}
+
+/*
+close removes a resource and tears down its peer.
+*/
+func (h *resourceHandler) close(res *resource) {
+	res.closeOnce.Do(func() {
+		h.resourcesMu.Lock()
+		delete(h.resources, res.id)
+		h.resourcesMu.Unlock()
+		res.mu.Lock()
+		onClose := res.onClose
+		res.onClose = nil
+		res.mu.Unlock()
+		for _, cleanup := range onClose {
+			cleanup()
+		}
+		if err := h.peers.RemovePeer(res.peer); err != nil {
+			h.log.Warnf("Error removing peer %s: %v", res.peer.ID(), err)
+		}
+		res.peer.Shutdown()
+	})
+}
+
+/*
+CountResources returns the number of open resources.
+*/
+func (h *resourceHandler) CountResources() int {
+	h.resourcesMu.Lock()
+	defer h.resourcesMu.Unlock()
+	return len(h.resources)
+}
+
+/*
+Peers returns the peer manager the handler registers its peers in.
+*/
+func (h *resourceHandler) Peers() *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer] {
+	return h.peers
+}
+
+func readBody(w http.ResponseWriter, r *http.Request, contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.EqualFold(mediaType, contentType) {
+		http.Error(w, "expected "+contentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return "", false
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
@@ -0,0 +1,142 @@
+package webrtchttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	contentTypeSDP     = "application/sdp"
+	contentTypeSDPFrag = "application/trickle-ice-sdpfrag"
+)
+
+/*
+sdpFragment is the content of a trickle ICE SDP fragment (RFC 8840).
+*/
+type sdpFragment struct {
+	ufrag      string
+	pwd        string
+	candidates []webrtc.ICECandidateInit
+}
+
+func parseSDPFragment(body string) (sdpFragment, error) {
+	var frag sdpFragment
+	var mid *string
+	var mLineIndex uint16
+	mLines := 0
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+			mLineIndex = uint16(mLines)
+			mLines++
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			if mLines == 0 {
+				return frag, errors.New("candidate outside of a media section")
+			}
+			index := mLineIndex
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: &index,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return frag, err
+	}
+	return frag, nil
+}
+
+/*
+sdpFragmentFromDescription builds the fragment describing the ICE credentials and
+candidates of a local description, as returned after an ICE restart.
+*/
+func sdpFragmentFromDescription(description *webrtc.SessionDescription) (string, error) {
+	parsed, err := description.Unmarshal()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	ufrag, pwd := iceCredentials(parsed)
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", ufrag, pwd)
+	for _, media := range parsed.MediaDescriptions {
+		fmt.Fprintf(&b, "m=%s 9 %s %s\r\n", media.MediaName.Media, strings.Join(media.MediaName.Protos, "/"), strings.Join(media.MediaName.Formats, " "))
+		if mid, ok := media.Attribute("mid"); ok {
+			fmt.Fprintf(&b, "a=mid:%s\r\n", mid)
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key == "candidate" {
+				fmt.Fprintf(&b, "a=candidate:%s\r\n", attribute.Value)
+			}
+		}
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	return b.String(), nil
+}
+
+/*
+iceCredentials returns the ICE ufrag and password of a description, looking at the
+session level first and at the first media section otherwise.
+*/
+func iceCredentials(parsed *sdp.SessionDescription) (string, string) {
+	ufrag, _ := parsed.Attribute("ice-ufrag")
+	pwd, _ := parsed.Attribute("ice-pwd")
+	if ufrag == "" && len(parsed.MediaDescriptions) > 0 {
+		ufrag, _ = parsed.MediaDescriptions[0].Attribute("ice-ufrag")
+		pwd, _ = parsed.MediaDescriptions[0].Attribute("ice-pwd")
+	}
+	return ufrag, pwd
+}
+
+/*
+restartOffer rewrites a remote offer with new ICE credentials and without candidates,
+so that applying it again restarts ICE.
+*/
+func restartOffer(offer *webrtc.SessionDescription, ufrag string, pwd string) (webrtc.SessionDescription, error) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	parsed.Attributes = replaceICEAttributes(parsed.Attributes, ufrag, pwd, false)
+	for _, media := range parsed.MediaDescriptions {
+		media.Attributes = replaceICEAttributes(media.Attributes, ufrag, pwd, true)
+	}
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(raw)}, nil
+}
+
+func replaceICEAttributes(attributes []sdp.Attribute, ufrag string, pwd string, dropCandidates bool) []sdp.Attribute {
+	replaced := make([]sdp.Attribute, 0, len(attributes))
+	for _, attribute := range attributes {
+		switch attribute.Key {
+		case "ice-ufrag":
+			attribute.Value = ufrag
+		case "ice-pwd":
+			attribute.Value = pwd
+		case "candidate", "end-of-candidates":
+			if dropCandidates {
+				continue
+			}
+		}
+		replaced = append(replaced, attribute)
+	}
+	return replaced
+}
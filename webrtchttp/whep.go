@@ -0,0 +1,177 @@
+package webrtchttp
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/google/uuid"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+var errPublisherNotFound = errors.New("publisher not found")
+
+type WHEPHandlerConfig struct {
+	// PeerConfig is used for every SfuPeer the handler creates.
+	PeerConfig *webrtc.Configuration
+	// Publishers is where the publishers being watched are looked up, for example
+	// the Peers of a WHIPHandler.
+	Publishers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	// Viewers is where viewer SfuPeers are registered. Defaults to a new PeerManager.
+	Viewers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	// Authenticate returns the viewer ID for a request. A returned error answers 401.
+	// Defaults to a random ID.
+	Authenticate func(r *http.Request) (string, error)
+	// PublisherID returns the ID of the publisher a POST wants to watch. Defaults to
+	// the last element of the request path.
+	PublisherID func(r *http.Request) string
+	// GatheringTimeout bounds how long ICE gathering may delay the answer. Defaults to 5 seconds.
+	GatheringTimeout time.Duration
+	LoggerFactory    logging.LoggerFactory
+}
+
+/*
+WHEPHandler is an http.Handler implementing WebRTC-HTTP egress. A POST of an SDP
+offer creates a receive-only viewer SfuPeer carrying the requested publisher's local
+tracks and answers in a single round trip with every local candidate. PATCH trickles
+candidates or restarts ICE and DELETE ends the session. Viewers are closed when their
+publisher goes away.
+*/
+type WHEPHandler struct {
+	*resourceHandler
+	publishers  *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	publisherID func(r *http.Request) string
+}
+
+/*
+NewWHEPHandler creates a new WHEP handler. Resources are created under the path of
+the POST, so the handler should also receive the requests for its sub-paths.
+*/
+func NewWHEPHandler(config WHEPHandlerConfig) *WHEPHandler {
+	h := &WHEPHandler{
+		resourceHandler: newResourceHandler("whep", config.PeerConfig, config.Viewers, config.Authenticate, config.GatheringTimeout, config.LoggerFactory),
+		publishers:      config.Publishers,
+		publisherID:     config.PublisherID,
+	}
+	if h.publishers == nil {
+		h.publishers = webrtcpeer.NewSfuPeerManager()
+	}
+	if h.publisherID == nil {
+		h.publisherID = func(r *http.Request) string {
+			return path.Base(r.URL.Path)
+		}
+	}
+	return h
+}
+
+func (h *WHEPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.route(w, r, h.watch)
+}
+
+/*
+Publishers returns the peer manager publishers are looked up in.
+*/
+func (h *WHEPHandler) Publishers() *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer] {
+	return h.publishers
+}
+
+func (h *WHEPHandler) watch(w http.ResponseWriter, r *http.Request, viewerID string, offer webrtc.SessionDescription) {
+	publisherID := h.publisherID(r)
+	publisher, err := h.publishers.GetPeer(publisherID)
+	if err != nil {
+		http.Error(w, errPublisherNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	tracks := localTracks(*publisher)
+	if len(tracks) == 0 {
+		http.Error(w, "publisher has no tracks", http.StatusNotFound)
+		return
+	}
+
+	peer, err := h.newPeer(uuid.New().String())
+	if err != nil {
+		h.log.Errorf("Error creating viewer %s: %v", viewerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	answer, err := h.answer(peer, offer, func() error {
+		return attachTracks(peer, *publisher, tracks)
+	})
+	if err != nil {
+		h.log.Warnf("Error answering viewer %s: %v", viewerID, err)
+		h.peers.RemovePeer(peer)
+		peer.Shutdown()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := h.add(w, r, viewerID, peer, answer)
+
+	handlerID := (*publisher).AddOnConnectionStateChangeHandler(func(connectionState webrtc.PeerConnectionState) {
+		if connectionState == webrtc.PeerConnectionStateFailed || connectionState == webrtc.PeerConnectionStateClosed {
+			go h.close(res)
+		}
+	})
+	res.mu.Lock()
+	res.onClose = append(res.onClose, func() {
+		(*publisher).RemoveOnConnectionStateChangeHandler(handlerID)
+	})
+	res.mu.Unlock()
+}
+
+func localTracks(peer *webrtcpeer.SfuPeer) []*webrtc.TrackLocalStaticRTP {
+	peer.LocalTracksMu.Lock()
+	defer peer.LocalTracksMu.Unlock()
+	tracks := make([]*webrtc.TrackLocalStaticRTP, 0, len(peer.LocalTracks))
+	for _, track := range peer.LocalTracks {
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+/*
+attachTracks adds the tracks of publisher to the transceivers the viewer offered to
+receive on. Tracks of a kind the viewer did not offer to receive are skipped.
+*/
+func attachTracks(peer *webrtcpeer.SfuPeer, publisher *webrtcpeer.SfuPeer, tracks []*webrtc.TrackLocalStaticRTP) error {
+	attached := 0
+	for _, track := range tracks {
+		if !hasFreeTransceiver(peer, track.Kind()) {
+			continue
+		}
+		sender, err := peer.AddPublisherTrack(publisher, track.ID())
+		if err != nil {
+			return err
+		}
+		attached++
+		go drainRTCP(sender)
+	}
+	if attached == 0 {
+		return errors.New("offer does not receive any of the publisher's tracks")
+	}
+	return nil
+}
+
+func hasFreeTransceiver(peer *webrtcpeer.SfuPeer, kind webrtc.RTPCodecType) bool {
+	for _, transceiver := range peer.GetTransceivers() {
+		direction := transceiver.Direction()
+		if transceiver.Kind() == kind && transceiver.Sender() == nil && (direction == webrtc.RTPTransceiverDirectionSendonly || direction == webrtc.RTPTransceiverDirectionRecvonly) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+drainRTCP reads the RTCP of a sender so that its interceptors keep running.
+*/
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package webrtchttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+newViewer creates a client peer connection offering to receive video and reporting received tracks.
+*/
+func newViewer(t *testing.T) (*webrtc.PeerConnection, chan *webrtc.TrackRemote) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	tracks := make(chan *webrtc.TrackRemote, 1)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		tracks <- track
+	})
+	return pc, tracks
+}
+
+func TestWHEPHandler(t *testing.T) {
+	t.Run("Watch a WHIP publisher", func(t *testing.T) {
+		t.Parallel()
+		localTracks := make(chan *webrtc.TrackLocalStaticRTP, 1)
+		whip := NewWHIPHandler(WHIPHandlerConfig{
+			Authenticate: bearerAuthenticate,
+			OnLocalTrack: func(peer *webrtcpeer.SfuPeer, track *webrtc.TrackLocalStaticRTP) {
+				localTracks <- track
+			},
+		})
+		whep := NewWHEPHandler(WHEPHandlerConfig{Publishers: whip.Peers()})
+		mux := http.NewServeMux()
+		mux.Handle("/whip/", whip)
+		mux.Handle("/whep/", whep)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+
+		publisher := newPublisher(t)
+		resp := publishWHIP(t, server.URL+"/whip/", "publisher", publisher)
+		whipLocation := server.URL + resp.Header.Get("Location")
+		var published *webrtc.TrackLocalStaticRTP
+		select {
+		case published = <-localTracks:
+		case <-time.After(10 * time.Second):
+			t.Fatal("published track was not converted")
+		}
+
+		viewer, tracks := newViewer(t)
+		offer := gatheredOffer(t, viewer, nil)
+		resp, answer := doRequest(t, http.MethodPost, server.URL+"/whep/publisher", "", "application/sdp", offer.SDP, nil)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "/whep/publisher/"))
+		assert.Contains(t, answer, "a=candidate:")
+		assert.Nil(t, viewer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}))
+		select {
+		case track := <-tracks:
+			assert.Equal(t, published.ID(), track.ID())
+		case <-time.After(10 * time.Second):
+			t.Fatal("viewer did not receive the track")
+		}
+		assert.Equal(t, 1, whep.CountResources())
+
+		resp, _ = doRequest(t, http.MethodDelete, whipLocation, "publisher", "", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Eventually(t, func() bool {
+			return whep.CountResources() == 0 && whep.Peers().CountPeers() == 0
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+	t.Run("Unknown publisher", func(t *testing.T) {
+		t.Parallel()
+		whep := NewWHEPHandler(WHEPHandlerConfig{})
+		server := httptest.NewServer(whep)
+		t.Cleanup(server.Close)
+		viewer, _ := newViewer(t)
+		offer := gatheredOffer(t, viewer, nil)
+		resp, _ := doRequest(t, http.MethodPost, server.URL+"/missing", "", "application/sdp", offer.SDP, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, 0, whep.Peers().CountPeers())
+	})
+}
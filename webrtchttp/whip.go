@@ -0,0 +1,81 @@
+package webrtchttp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+type WHIPHandlerConfig struct {
+	// PeerConfig is used for every SfuPeer the handler creates.
+	PeerConfig *webrtc.Configuration
+	// Peers is where publishing SfuPeers are registered. Defaults to a new PeerManager.
+	Peers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	// Authenticate returns the publisher ID for a request, usually from its bearer
+	// token. The publisher ID becomes the SfuPeer ID. A returned error answers 401.
+	// Defaults to a random ID.
+	Authenticate func(r *http.Request) (string, error)
+	// GatheringTimeout bounds how long ICE gathering may delay the answer. Defaults to 5 seconds.
+	GatheringTimeout time.Duration
+	// OnLocalTrack is called for every published track once it has been converted to a local track.
+	OnLocalTrack  func(peer *webrtcpeer.SfuPeer, track *webrtc.TrackLocalStaticRTP)
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+WHIPHandler is an http.Handler implementing WebRTC-HTTP ingestion (RFC 9725). A POST
+of an SDP offer creates a publishing SfuPeer, answers with 201 and the resource
+Location, PATCH trickles candidates or restarts ICE and DELETE ends the session.
+Every received track is converted to a local track so it can be forwarded with
+AddPublisherTrack.
+*/
+type WHIPHandler struct {
+	*resourceHandler
+	onLocalTrack func(peer *webrtcpeer.SfuPeer, track *webrtc.TrackLocalStaticRTP)
+}
+
+/*
+NewWHIPHandler creates a new WHIP handler. Resources are created under the path the
+handler is mounted on, so it should also receive the requests for its sub-paths.
+*/
+func NewWHIPHandler(config WHIPHandlerConfig) *WHIPHandler {
+	return &WHIPHandler{
+		resourceHandler: newResourceHandler("whip", config.PeerConfig, config.Peers, config.Authenticate, config.GatheringTimeout, config.LoggerFactory),
+		onLocalTrack:    config.OnLocalTrack,
+	}
+}
+
+func (h *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.route(w, r, h.publish)
+}
+
+func (h *WHIPHandler) publish(w http.ResponseWriter, r *http.Request, publisherID string, offer webrtc.SessionDescription) {
+	peer, err := h.newPeer(publisherID)
+	if err != nil {
+		h.log.Warnf("Error creating publisher %s: %v", publisherID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	peer.AddOnTrackHandler(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		localTrack, err := peer.ConvertRemoteTrackToLocalTrack(remoteTrack)
+		if err != nil {
+			h.log.Errorf("Error converting track %s of publisher %s: %v", remoteTrack.ID(), publisherID, err)
+			return
+		}
+		if h.onLocalTrack != nil {
+			h.onLocalTrack(peer, localTrack)
+		}
+	})
+	answer, err := h.answer(peer, offer, nil)
+	if err != nil {
+		h.log.Warnf("Error answering publisher %s: %v", publisherID, err)
+		h.peers.RemovePeer(peer)
+		peer.Shutdown()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.add(w, r, publisherID, peer, answer)
+}
@@ -0,0 +1,216 @@
+package webrtchttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func bearerAuthenticate(r *http.Request) (string, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", errors.New("missing token")
+	}
+	return token, nil
+}
+
+func doRequest(t *testing.T, method string, url string, token string, contentType string, body string, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(respBody)
+}
+
+/*
+gatheredOffer creates an offer on pc and returns it once ICE gathering has completed.
+*/
+func gatheredOffer(t *testing.T, pc *webrtc.PeerConnection, options *webrtc.OfferOptions) *webrtc.SessionDescription {
+	t.Helper()
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatheringComplete
+	return pc.LocalDescription()
+}
+
+/*
+newPublisher creates a client peer connection sending a VP8 track and writing packets to it until the test ends.
+*/
+func newPublisher(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "obs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		pc.Close()
+	})
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}, Payload: []byte{0x10, 0x00, 0x00, 0x00}}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				packet.SequenceNumber++
+				packet.Timestamp += 1800
+				track.WriteRTP(packet)
+			}
+		}
+	}()
+	return pc
+}
+
+/*
+publishWHIP posts an offer from pc to the WHIP endpoint and applies the answer.
+*/
+func publishWHIP(t *testing.T, endpoint string, token string, pc *webrtc.PeerConnection) *http.Response {
+	t.Helper()
+	offer := gatheredOffer(t, pc, nil)
+	resp, answer := doRequest(t, http.MethodPost, endpoint, token, "application/sdp", offer.SDP, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, answer)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestWHIPHandler(t *testing.T) {
+	t.Run("Publish and delete", func(t *testing.T) {
+		t.Parallel()
+		localTracks := make(chan *webrtc.TrackLocalStaticRTP, 1)
+		peers := webrtcpeer.NewSfuPeerManager()
+		handler := NewWHIPHandler(WHIPHandlerConfig{
+			Peers:        peers,
+			Authenticate: bearerAuthenticate,
+			OnLocalTrack: func(peer *webrtcpeer.SfuPeer, track *webrtc.TrackLocalStaticRTP) {
+				localTracks <- track
+			},
+		})
+		mux := http.NewServeMux()
+		mux.Handle("/whip/", handler)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+
+		pc := newPublisher(t)
+		resp := publishWHIP(t, server.URL+"/whip/", "publisher", pc)
+		assert.Equal(t, "application/sdp", resp.Header.Get("Content-Type"))
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+		location := resp.Header.Get("Location")
+		assert.True(t, strings.HasPrefix(location, "/whip/"))
+
+		select {
+		case track := <-localTracks:
+			assert.Equal(t, "publisher", track.StreamID())
+		case <-time.After(10 * time.Second):
+			t.Fatal("published track was not converted")
+		}
+		publisher, err := peers.GetPeer("publisher")
+		assert.Nil(t, err)
+		(*publisher).LocalTracksMu.Lock()
+		assert.Len(t, (*publisher).LocalTracks, 1)
+		(*publisher).LocalTracksMu.Unlock()
+
+		resp, _ = doRequest(t, http.MethodDelete, server.URL+location, "someone-else", "", "", nil)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp, _ = doRequest(t, http.MethodDelete, server.URL+location, "publisher", "", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 0, peers.CountPeers())
+		assert.Equal(t, 0, handler.CountResources())
+		resp, _ = doRequest(t, http.MethodDelete, server.URL+location, "publisher", "", "", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+	t.Run("Trickle and ICE restart", func(t *testing.T) {
+		t.Parallel()
+		handler := NewWHIPHandler(WHIPHandlerConfig{Authenticate: bearerAuthenticate})
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+
+		pc := newPublisher(t)
+		resp := publishWHIP(t, server.URL, "publisher", pc)
+		location := server.URL + resp.Header.Get("Location")
+		etag := resp.Header.Get("ETag")
+
+		frag, err := sdpFragmentFromDescription(pc.LocalDescription())
+		assert.Nil(t, err)
+		resp, _ = doRequest(t, http.MethodPatch, location, "publisher", "application/trickle-ice-sdpfrag", frag, map[string]string{"If-Match": etag})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp, _ = doRequest(t, http.MethodPatch, location, "publisher", "application/trickle-ice-sdpfrag", frag, map[string]string{"If-Match": `"stale"`})
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+		restart := gatheredOffer(t, pc, &webrtc.OfferOptions{ICERestart: true})
+		frag, err = sdpFragmentFromDescription(restart)
+		assert.Nil(t, err)
+		resp, body := doRequest(t, http.MethodPatch, location, "publisher", "application/trickle-ice-sdpfrag", frag, map[string]string{"If-Match": "*"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/trickle-ice-sdpfrag", resp.Header.Get("Content-Type"))
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+		answerFrag, err := parseSDPFragment(body)
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Trim(resp.Header.Get("ETag"), `"`), answerFrag.ufrag)
+		assert.NotEmpty(t, answerFrag.pwd)
+	})
+	t.Run("Rejects invalid requests", func(t *testing.T) {
+		t.Parallel()
+		handler := NewWHIPHandler(WHIPHandlerConfig{Authenticate: bearerAuthenticate})
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+
+		resp, _ := doRequest(t, http.MethodPost, server.URL, "", "application/sdp", "v=0", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		resp, _ = doRequest(t, http.MethodPost, server.URL, "publisher", "text/plain", "v=0", nil)
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+		resp, _ = doRequest(t, http.MethodPost, server.URL, "publisher", "application/sdp", "not sdp", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, 0, handler.Peers().CountPeers())
+		resp, _ = doRequest(t, http.MethodGet, server.URL, "publisher", "", "", nil)
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
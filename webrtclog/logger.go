@@ -0,0 +1,92 @@
+package webrtclog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/logging"
+)
+
+/*
+FieldLogger is a leveled logger that can carry structured fields.
+*/
+type FieldLogger interface {
+	logging.LeveledLogger
+	With(args ...any) logging.LeveledLogger
+}
+
+/*
+DefaultLoggerFactory returns the pion default logger factory, used when no factory is configured.
+*/
+func DefaultLoggerFactory() logging.LoggerFactory {
+	return logging.NewDefaultLoggerFactory()
+}
+
+/*
+NewLogger creates a logger for the given scope from factory, falling back to the
+default factory when factory is nil, and attaches args as structured fields.
+*/
+func NewLogger(factory logging.LoggerFactory, scope string, args ...any) logging.LeveledLogger {
+	if factory == nil {
+		factory = DefaultLoggerFactory()
+	}
+	return With(factory.NewLogger(scope), args...)
+}
+
+/*
+With attaches key/value pairs to logger. Loggers implementing FieldLogger keep them
+as structured fields, other loggers get them prepended to every message as key=value.
+*/
+func With(logger logging.LeveledLogger, args ...any) logging.LeveledLogger {
+	if len(args) == 0 {
+		return logger
+	}
+	if fieldLogger, ok := logger.(FieldLogger); ok {
+		return fieldLogger.With(args...)
+	}
+	if prefixed, ok := logger.(*prefixLogger); ok {
+		return &prefixLogger{
+			logger: prefixed.logger,
+			prefix: prefixed.prefix + formatFields(args),
+		}
+	}
+	return &prefixLogger{logger: logger, prefix: formatFields(args)}
+}
+
+func formatFields(args []any) string {
+	var b strings.Builder
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, "%v=%v ", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, "%v ", args[i])
+		}
+	}
+	return b.String()
+}
+
+type prefixLogger struct {
+	logger logging.LeveledLogger
+	prefix string
+}
+
+func (l *prefixLogger) Trace(msg string) { l.logger.Trace(l.prefix + msg) }
+func (l *prefixLogger) Tracef(format string, args ...interface{}) {
+	l.logger.Trace(l.prefix + fmt.Sprintf(format, args...))
+}
+func (l *prefixLogger) Debug(msg string) { l.logger.Debug(l.prefix + msg) }
+func (l *prefixLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(l.prefix + fmt.Sprintf(format, args...))
+}
+func (l *prefixLogger) Info(msg string) { l.logger.Info(l.prefix + msg) }
+func (l *prefixLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(l.prefix + fmt.Sprintf(format, args...))
+}
+func (l *prefixLogger) Warn(msg string) { l.logger.Warn(l.prefix + msg) }
+func (l *prefixLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warn(l.prefix + fmt.Sprintf(format, args...))
+}
+func (l *prefixLogger) Error(msg string) { l.logger.Error(l.prefix + msg) }
+func (l *prefixLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(l.prefix + fmt.Sprintf(format, args...))
+}
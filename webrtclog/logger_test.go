@@ -0,0 +1,52 @@
+package webrtclog
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pion/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	logging.LeveledLogger
+	messages []string
+}
+
+func (l *recordingLogger) Info(msg string) { l.messages = append(l.messages, msg) }
+
+func TestLogger(t *testing.T) {
+	t.Run("Slog factory attaches fields", func(t *testing.T) {
+		t.Parallel()
+		buf := &bytes.Buffer{}
+		factory := NewSlogLoggerFactory(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: LevelTrace})))
+		logger := NewLogger(factory, "sfu-peer", "peer_id", "1")
+		With(logger, "track_id", "t1").Infof("hello %s", "world")
+		logger.Trace("trace message")
+		out := buf.String()
+		assert.Contains(t, out, "scope=sfu-peer")
+		assert.Contains(t, out, "peer_id=1")
+		assert.Contains(t, out, "track_id=t1")
+		assert.Contains(t, out, `msg="hello world"`)
+		assert.Equal(t, 2, strings.Count(out, "peer_id=1"))
+	})
+	t.Run("Slog factory respects level", func(t *testing.T) {
+		t.Parallel()
+		buf := &bytes.Buffer{}
+		factory := NewSlogLoggerFactory(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		logger := factory.NewLogger("sfu-peer")
+		logger.Debugf("dropped %d", 1)
+		logger.Errorf("kept %d", 2)
+		assert.NotContains(t, buf.String(), "dropped")
+		assert.Contains(t, buf.String(), "kept 2")
+	})
+	t.Run("Plain logger gets prefixed fields", func(t *testing.T) {
+		t.Parallel()
+		inner := &recordingLogger{}
+		logger := With(With(inner, "peer_id", "1"), "track_id", "t1")
+		logger.Info("hello")
+		assert.Equal(t, []string{"peer_id=1 track_id=t1 hello"}, inner.messages)
+	})
+}
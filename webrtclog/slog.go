@@ -0,0 +1,75 @@
+package webrtclog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/pion/logging"
+)
+
+// LevelTrace is the slog level used for pion trace messages.
+const LevelTrace = slog.LevelDebug - 4
+
+/*
+SlogLoggerFactory is a pion logging.LoggerFactory backed by a slog.Logger. The scope
+of each logger is attached as the "scope" field.
+*/
+type SlogLoggerFactory struct {
+	Logger *slog.Logger
+}
+
+/*
+NewSlogLoggerFactory creates a logger factory writing to logger, or to slog.Default() if logger is nil.
+*/
+func NewSlogLoggerFactory(logger *slog.Logger) *SlogLoggerFactory {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLoggerFactory{Logger: logger}
+}
+
+func (f *SlogLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return &slogLogger{logger: f.Logger.With("scope", scope)}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) With(args ...any) logging.LeveledLogger {
+	return &slogLogger{logger: l.logger.With(args...)}
+}
+
+func (l *slogLogger) log(level slog.Level, msg string) {
+	l.logger.Log(context.Background(), level, msg)
+}
+
+func (l *slogLogger) logf(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func (l *slogLogger) Trace(msg string) { l.log(LevelTrace, msg) }
+func (l *slogLogger) Tracef(format string, args ...interface{}) {
+	l.logf(LevelTrace, format, args...)
+}
+func (l *slogLogger) Debug(msg string) { l.log(slog.LevelDebug, msg) }
+func (l *slogLogger) Debugf(format string, args ...interface{}) {
+	l.logf(slog.LevelDebug, format, args...)
+}
+func (l *slogLogger) Info(msg string) { l.log(slog.LevelInfo, msg) }
+func (l *slogLogger) Infof(format string, args ...interface{}) {
+	l.logf(slog.LevelInfo, format, args...)
+}
+func (l *slogLogger) Warn(msg string) { l.log(slog.LevelWarn, msg) }
+func (l *slogLogger) Warnf(format string, args ...interface{}) {
+	l.logf(slog.LevelWarn, format, args...)
+}
+func (l *slogLogger) Error(msg string) { l.log(slog.LevelError, msg) }
+func (l *slogLogger) Errorf(format string, args ...interface{}) {
+	l.logf(slog.LevelError, format, args...)
+}
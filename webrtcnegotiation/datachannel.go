@@ -0,0 +1,141 @@
+package webrtcnegotiation
+
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// SignalingDataChannelLabel is the label of the reserved signaling data channel.
+	SignalingDataChannelLabel = "webrtcutil-signaling"
+	// SignalingDataChannelID is the SCTP stream ID reserved for the signaling data
+	// channel. Both sides create it as a negotiated channel with this ID.
+	SignalingDataChannelID uint16 = 1023
+)
+
+/*
+EnableDataChannelSignaling opens the reserved negotiated signaling data channel on
+the peer. Once it is open, offers, answers and candidates are exchanged over it
+instead of the outbound signaling callback, which is used again whenever the channel
+is closed. Both peers must enable it, and the channel is recreated along with the
+peer connection.
+
+The polite peer only creates its end once a local description has been set, so that
+enabling it on both sides before the first negotiation does not make both peers offer.
+*/
+func (n *SfuPeerNegotiator) EnableDataChannelSignaling() error {
+	n.dataChannelMu.Lock()
+	n.dataChannelSignaling = true
+	n.dataChannelMu.Unlock()
+	return n.maybeOpenSignalingDataChannel()
+}
+
+/*
+DataChannelSignalingOpen reports whether signaling currently goes over the data channel.
+*/
+func (n *SfuPeerNegotiator) DataChannelSignalingOpen() bool {
+	n.dataChannelMu.Lock()
+	defer n.dataChannelMu.Unlock()
+	return n.dataChannel != nil && n.dataChannelOpen
+}
+
+/*
+maybeOpenSignalingDataChannel opens the signaling data channel if it is enabled, not
+open yet and, for the polite peer, a local description has been set.
+*/
+func (n *SfuPeerNegotiator) maybeOpenSignalingDataChannel() error {
+	n.dataChannelMu.Lock()
+	defer n.dataChannelMu.Unlock()
+	if !n.dataChannelSignaling || n.dataChannel != nil {
+		return nil
+	}
+	if n.isPolite && n.peer.PeerConnection.CurrentLocalDescription() == nil {
+		return nil
+	}
+	negotiated := true
+	id := SignalingDataChannelID
+	dataChannel, err := n.peer.PeerConnection.CreateDataChannel(SignalingDataChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return err
+	}
+	n.dataChannel = dataChannel
+	n.dataChannelOpen = false
+
+	dataChannel.OnOpen(func() {
+		n.setDataChannelOpen(dataChannel, true)
+		n.log.Debug("Signaling data channel open")
+	})
+	dataChannel.OnClose(func() {
+		n.setDataChannelOpen(dataChannel, false)
+		n.log.Info("Signaling data channel closed, falling back to external signaling")
+	})
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message, err := ParseSignalMessage(msg.Data)
+		if err != nil {
+			n.log.Warnf("Invalid message on signaling data channel: %v", err)
+			n.reportError(err)
+			return
+		}
+		if err := n.HandleSignal(message); err != nil {
+			n.log.Debugf("Error handling %s on signaling data channel: %v", message.Type, err)
+		}
+	})
+	return nil
+}
+
+func (n *SfuPeerNegotiator) setDataChannelOpen(dataChannel *webrtc.DataChannel, open bool) {
+	n.dataChannelMu.Lock()
+	defer n.dataChannelMu.Unlock()
+	if n.dataChannel == dataChannel {
+		n.dataChannelOpen = open
+	}
+}
+
+/*
+signal sends a message over the signaling data channel when it is open and through
+the outbound signaling callback otherwise, or when the data channel fails.
+*/
+func (n *SfuPeerNegotiator) signal(message SignalMessage) error {
+	n.dataChannelMu.Lock()
+	dataChannel := n.dataChannel
+	open := n.dataChannelOpen
+	n.dataChannelMu.Unlock()
+	if dataChannel != nil && open {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		err = dataChannel.SendText(string(data))
+		if err == nil {
+			return nil
+		}
+		n.log.Warnf("Error sending %s on signaling data channel, falling back to external signaling: %v", message.Type, err)
+	}
+	return n.send(message)
+}
+
+/*
+resetDataChannel forgets the signaling data channel of a replaced peer connection and
+opens a new one if data channel signaling is enabled.
+*/
+func (n *SfuPeerNegotiator) resetDataChannel() {
+	n.dataChannelMu.Lock()
+	n.dataChannel = nil
+	n.dataChannelOpen = false
+	n.dataChannelMu.Unlock()
+	n.openDeferredDataChannel()
+}
+
+/*
+openDeferredDataChannel opens the signaling data channel if it is still waiting to be opened.
+*/
+func (n *SfuPeerNegotiator) openDeferredDataChannel() {
+	if err := n.maybeOpenSignalingDataChannel(); err != nil {
+		n.log.Errorf("Error opening signaling data channel: %v", err)
+		n.reportError(err)
+	}
+}
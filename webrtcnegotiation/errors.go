@@ -0,0 +1,69 @@
+package webrtcnegotiation
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNegotiatorNotFound = errors.New("negotiator not found")
+	ErrInvalidSignal      = errors.New("invalid signal message")
+	// ErrOfferInProgress is returned by SendOffer while an offer is being made.
+	ErrOfferInProgress = errors.New("offer already in progress")
+	// ErrOfferIgnored is returned by HandleOffer when a colliding remote offer is
+	// dropped: always by the impolite peer, and by a polite peer that cannot roll back.
+	ErrOfferIgnored = errors.New("offer ignored after collision")
+	// ErrGatheringUnsupported is returned in non-trickle mode without HandleGatheredLocalDescription.
+	ErrGatheringUnsupported = errors.New("non-trickle ICE requires HandleGatheredLocalDescription")
+)
+
+/*
+NegotiationPhase names the step of a negotiation an error occurred in.
+*/
+type NegotiationPhase string
+
+const (
+	NegotiationPhaseCreateOffer          NegotiationPhase = "create offer"
+	NegotiationPhaseSetLocalDescription  NegotiationPhase = "set local description"
+	NegotiationPhaseSetRemoteDescription NegotiationPhase = "set remote description"
+	NegotiationPhaseRollback             NegotiationPhase = "rollback"
+	NegotiationPhaseGatherCandidates     NegotiationPhase = "gather ICE candidates"
+	NegotiationPhaseSendOffer            NegotiationPhase = "send offer"
+	NegotiationPhaseAddCandidate         NegotiationPhase = "add ICE candidate"
+)
+
+/*
+NegotiationError is the error of a failed negotiation step. Sequence is the sequence
+number of the negotiation it belongs to, and Err the error of the step itself.
+*/
+type NegotiationError struct {
+	Phase    NegotiationPhase
+	Sequence uint64
+	Err      error
+}
+
+func (e *NegotiationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+}
+
+func (e *NegotiationError) Unwrap() error {
+	return e.Err
+}
+
+/*
+DispatchError is returned by WebRTCNegotiationManager.Dispatch. It wraps
+ErrNegotiatorNotFound, ErrInvalidSignal or the negotiator's own error.
+*/
+type DispatchError struct {
+	NegotiatorID string
+	Type         SignalType
+	Err          error
+}
+
+func (e *DispatchError) Error() string {
+	return fmt.Sprintf("dispatch %s to negotiator %q: %v", e.Type, e.NegotiatorID, e.Err)
+}
+
+func (e *DispatchError) Unwrap() error {
+	return e.Err
+}
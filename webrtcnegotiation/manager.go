@@ -1,7 +1,6 @@
 package webrtcnegotiation
 
 import (
-	"errors"
 	"slices"
 	"sync"
 )
@@ -37,7 +36,7 @@ func (hl *negotiatorList[T]) GetByID(id string) (T, error) {
 		}
 	}
 	var zero T
-	return zero, errors.New("negotiator not found")
+	return zero, ErrNegotiatorNotFound
 }
 
 func (hl *negotiatorList[T]) Count() int {
@@ -55,3 +54,25 @@ func NewWebRTCNegotiationManager() *WebRTCNegotiationManager {
 		Negotiators: negotiatorList[*WebRtcNegotiator]{},
 	}
 }
+
+/*
+Dispatch validates a signaling message and routes it to the negotiator it targets.
+A bye removes the negotiator from the manager after it has been notified.
+*/
+func (m *WebRTCNegotiationManager) Dispatch(message SignalMessage) error {
+	if err := message.Validate(); err != nil {
+		return &DispatchError{NegotiatorID: message.NegotiatorID, Type: message.Type, Err: err}
+	}
+	negotiator, err := m.Negotiators.GetByID(message.NegotiatorID)
+	if err != nil {
+		return &DispatchError{NegotiatorID: message.NegotiatorID, Type: message.Type, Err: err}
+	}
+	err = negotiator.HandleSignal(message)
+	if message.Type == SignalTypeBye {
+		m.Negotiators.Remove(negotiator)
+	}
+	if err != nil {
+		return &DispatchError{NegotiatorID: message.NegotiatorID, Type: message.Type, Err: err}
+	}
+	return nil
+}
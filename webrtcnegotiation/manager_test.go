@@ -0,0 +1,87 @@
+package webrtcnegotiation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebRTCNegotiationManager(t *testing.T) {
+	t.Run("Dispatch offer", func(t *testing.T) {
+		t.Parallel()
+		setRemoteDescriptionCalled := 0
+		manager := NewWebRTCNegotiationManager()
+		manager.Negotiators.Add(NewWebRtcNegotiator(WebRTCNegotiatorConfig{
+			ID:       "example-id",
+			IsPolite: true,
+			HandleSetRemoteDescription: func(description webrtc.SessionDescription) error {
+				setRemoteDescriptionCalled++
+				return nil
+			},
+		}))
+		err := manager.Dispatch(SignalMessage{
+			Type:         SignalTypeOffer,
+			NegotiatorID: "example-id",
+			Description:  &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, setRemoteDescriptionCalled)
+	})
+	t.Run("Dispatch candidate", func(t *testing.T) {
+		t.Parallel()
+		candidates := []webrtc.ICECandidateInit{}
+		manager := NewWebRTCNegotiationManager()
+		manager.Negotiators.Add(NewWebRtcNegotiator(WebRTCNegotiatorConfig{
+			ID: "example-id",
+			HandleAddICECandidate: func(candidate webrtc.ICECandidateInit) error {
+				candidates = append(candidates, candidate)
+				return nil
+			},
+		}))
+		message, err := ParseSignalMessage([]byte(`{"type":"candidate","negotiatorId":"example-id","candidate":{"candidate":"candidate:1 1 udp 1 127.0.0.1 5000 typ host"}}`))
+		assert.Nil(t, err)
+		assert.Nil(t, manager.Dispatch(message))
+		assert.Len(t, candidates, 1)
+		assert.Equal(t, "candidate:1 1 udp 1 127.0.0.1 5000 typ host", candidates[0].Candidate)
+	})
+	t.Run("Dispatch bye removes negotiator", func(t *testing.T) {
+		t.Parallel()
+		byeCalled := 0
+		manager := NewWebRTCNegotiationManager()
+		manager.Negotiators.Add(NewWebRtcNegotiator(WebRTCNegotiatorConfig{
+			ID:        "example-id",
+			HandleBye: func() { byeCalled++ },
+		}))
+		assert.Nil(t, manager.Dispatch(SignalMessage{Type: SignalTypeBye, NegotiatorID: "example-id"}))
+		assert.Equal(t, 1, byeCalled)
+		assert.Equal(t, 0, manager.Negotiators.Count())
+	})
+	t.Run("Dispatch to unknown negotiator", func(t *testing.T) {
+		t.Parallel()
+		manager := NewWebRTCNegotiationManager()
+		err := manager.Dispatch(SignalMessage{Type: SignalTypeRenegotiate, NegotiatorID: "missing"})
+		assert.ErrorIs(t, err, ErrNegotiatorNotFound)
+		var dispatchErr *DispatchError
+		assert.True(t, errors.As(err, &dispatchErr))
+		assert.Equal(t, "missing", dispatchErr.NegotiatorID)
+		assert.Equal(t, SignalTypeRenegotiate, dispatchErr.Type)
+	})
+	t.Run("Dispatch invalid message", func(t *testing.T) {
+		t.Parallel()
+		manager := NewWebRTCNegotiationManager()
+		invalid := []SignalMessage{
+			{Type: SignalTypeOffer, NegotiatorID: "example-id"},
+			{Type: SignalTypeOffer, NegotiatorID: "example-id", Description: &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "dummy sdp"}},
+			{Type: SignalTypeCandidate, NegotiatorID: "example-id"},
+			{Type: "unknown", NegotiatorID: "example-id"},
+			{Type: SignalTypeBye},
+		}
+		for _, message := range invalid {
+			assert.ErrorIs(t, manager.Dispatch(message), ErrInvalidSignal)
+		}
+		_, err := ParseSignalMessage([]byte(`not json`))
+		assert.ErrorIs(t, err, ErrInvalidSignal)
+	})
+}
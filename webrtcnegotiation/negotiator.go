@@ -1,29 +1,68 @@
 package webrtcnegotiation
 
 import (
-	"log"
+	"context"
 	"sync"
+	"time"
 
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/pion/logging"
 	"github.com/pion/webrtc/v3"
 )
 
+const defaultGatheringTimeout = 5 * time.Second
+
 type IWebRTCNegotiator interface {
 	ID() string
 }
 
 type WebRTCNegotiatorConfig struct {
-	ID                         string
-	IsPolite                   bool
+	ID       string
+	IsPolite bool
+	// HandleSetRemoteDescription applies a description of the remote peer: the offers
+	// passed to HandleOffer and the answers passed to HandleAnswer.
 	HandleSetRemoteDescription func(description webrtc.SessionDescription) error
-	HandleSetLocalDescription  func(description webrtc.SessionDescription) error
-	HandleAddICECandidate      func(candidate webrtc.ICECandidateInit) error
-	HandleSendOffer            func(description webrtc.SessionDescription) error
-	HandleCreateOffer          func() (webrtc.SessionDescription, error)
+	// HandleSetLocalDescription applies the offers the negotiator creates. Answers
+	// from the remote peer are not passed to it.
+	HandleSetLocalDescription func(description webrtc.SessionDescription) error
+	HandleAddICECandidate     func(candidate webrtc.ICECandidateInit) error
+	HandleSendOffer           func(description webrtc.SessionDescription) error
+	HandleCreateOffer         func() (webrtc.SessionDescription, error)
+	// HandleRollback rolls back a local offer. When set, a polite peer rolls back on
+	// collision and applies the remote offer instead of waiting for its own cycle.
+	HandleRollback func() error
+	// HandleBye is called when the remote peer ends the session.
+	HandleBye func()
+	// SignalingState reports the signaling state of the underlying peer connection.
+	// It is used when dispatching offers and defaults to stable.
+	SignalingState func() webrtc.SignalingState
+	// NonTrickleICE makes SendOffer wait for ICE gathering to complete and send the
+	// complete local description from HandleGatheredLocalDescription.
+	NonTrickleICE bool
+	// GatheringTimeout bounds the wait for ICE gathering. Defaults to 5 seconds.
+	GatheringTimeout time.Duration
+	// HandleGatheredLocalDescription returns the local description once ICE gathering
+	// has completed, or an error once ctx is done. Required with NonTrickleICE.
+	HandleGatheredLocalDescription func(ctx context.Context) (webrtc.SessionDescription, error)
+	// LoggerFactory creates the negotiator logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+	// OnStateChange is called after every state transition.
+	OnStateChange func(from NegotiationState, to NegotiationState)
+	// OnError is called with every error the negotiator encounters.
+	OnError func(err error)
+	// OnCollision is called when a remote offer collides with a local one.
+	OnCollision func(collision NegotiationCollision)
+	// OnNegotiationComplete is called with the record of every negotiation once it settles.
+	OnNegotiationComplete func(record NegotiationRecord)
 }
 
 type WebRtcNegotiator struct {
-	makingOffer                 bool
-	makingOfferMu               sync.Mutex
+	state                       NegotiationState
+	stateMu                     sync.Mutex
+	sequence                    uint64
+	current                     *NegotiationRecord
+	offerQueued                 bool
+	last                        NegotiationRecord
 	isPolite                    bool
 	id                          string
 	handleSetRemoteDescription  func(description webrtc.SessionDescription) error
@@ -31,6 +70,17 @@ type WebRtcNegotiator struct {
 	handleAddICECandidate       func(candidate webrtc.ICECandidateInit) error
 	handleCreateOffer           func() (webrtc.SessionDescription, error)
 	handleSendRemoteDescription func(description webrtc.SessionDescription) error
+	handleRollback              func() error
+	handleBye                   func()
+	signalingState              func() webrtc.SignalingState
+	nonTrickleICE               bool
+	gatheringTimeout            time.Duration
+	handleGatheredLocalDesc     func(ctx context.Context) (webrtc.SessionDescription, error)
+	onStateChange               func(from NegotiationState, to NegotiationState)
+	onError                     func(err error)
+	onCollision                 func(collision NegotiationCollision)
+	onNegotiationComplete       func(record NegotiationRecord)
+	log                         logging.LeveledLogger
 }
 
 /*
@@ -39,13 +89,24 @@ NewWebRtcNegotiator creates a new WebRTC negotiator.
 func NewWebRtcNegotiator(config WebRTCNegotiatorConfig) *WebRtcNegotiator {
 	return &WebRtcNegotiator{
 		isPolite:                    config.IsPolite,
-		makingOffer:                 false,
+		state:                       NegotiationStateIdle,
 		id:                          config.ID,
 		handleSetRemoteDescription:  config.HandleSetRemoteDescription,
 		handleSetLocalDescription:   config.HandleSetLocalDescription,
 		handleAddICECandidate:       config.HandleAddICECandidate,
 		handleSendRemoteDescription: config.HandleSendOffer,
 		handleCreateOffer:           config.HandleCreateOffer,
+		handleRollback:              config.HandleRollback,
+		handleBye:                   config.HandleBye,
+		signalingState:              config.SignalingState,
+		nonTrickleICE:               config.NonTrickleICE,
+		gatheringTimeout:            config.GatheringTimeout,
+		handleGatheredLocalDesc:     config.HandleGatheredLocalDescription,
+		onStateChange:               config.OnStateChange,
+		onError:                     config.OnError,
+		onCollision:                 config.OnCollision,
+		onNegotiationComplete:       config.OnNegotiationComplete,
+		log:                         webrtclog.NewLogger(config.LoggerFactory, "webrtc-negotiator", "negotiator_id", config.ID),
 	}
 }
 
@@ -54,80 +115,325 @@ func (n *WebRtcNegotiator) ID() string {
 }
 
 /*
-HandleOffer handles an offer from a remote peer.
+SignalingState returns the signaling state of the underlying peer connection.
+*/
+func (n *WebRtcNegotiator) SignalingState() webrtc.SignalingState {
+	if n.signalingState == nil {
+		return webrtc.SignalingStateStable
+	}
+	return n.signalingState()
+}
+
+/*
+State returns the current negotiation state.
+*/
+func (n *WebRtcNegotiator) State() NegotiationState {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.state
+}
+
+/*
+CurrentNegotiation returns the record of the negotiation in flight, if any.
+*/
+func (n *WebRtcNegotiator) CurrentNegotiation() (NegotiationRecord, bool) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	if n.current == nil {
+		return NegotiationRecord{}, false
+	}
+	return *n.current, true
+}
+
+/*
+LastNegotiation returns the record of the most recently settled negotiation.
+*/
+func (n *WebRtcNegotiator) LastNegotiation() NegotiationRecord {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.last
+}
+
+/*
+transition moves the negotiator to a new state and fires the hooks. A negotiation
+record is opened when leaving a settled state and closed when entering one.
+*/
+func (n *WebRtcNegotiator) transition(to NegotiationState, err error) {
+	n.transitionIf(nil, to, err)
+}
+
+/*
+transitionIf behaves like transition but only if guard, evaluated under the state
+lock, accepts the current state. It reports whether the transition happened.
+*/
+func (n *WebRtcNegotiator) transitionIf(guard func(from NegotiationState) bool, to NegotiationState, err error) bool {
+	n.stateMu.Lock()
+	from := n.state
+	if guard != nil && !guard(from) {
+		n.stateMu.Unlock()
+		return false
+	}
+	n.state = to
+	if from.isSettled() && !to.isSettled() {
+		n.sequence++
+		n.current = &NegotiationRecord{Sequence: n.sequence, StartedAt: time.Now()}
+	}
+	var completed *NegotiationRecord
+	if to.isSettled() && n.current != nil {
+		n.current.EndedAt = time.Now()
+		n.current.FinalState = to
+		n.current.Err = err
+		n.last = *n.current
+		completed = n.current
+		n.current = nil
+	}
+	sendQueued := to == NegotiationStateIdle && n.offerQueued
+	if sendQueued {
+		n.offerQueued = false
+	}
+	n.stateMu.Unlock()
+
+	if from != to && n.onStateChange != nil {
+		n.onStateChange(from, to)
+	}
+	if err != nil && n.onError != nil {
+		n.onError(err)
+	}
+	if completed != nil && n.onNegotiationComplete != nil {
+		n.onNegotiationComplete(*completed)
+	}
+	if sendQueued {
+		go n.SendOffer()
+	}
+	return true
+}
+
+func (n *WebRtcNegotiator) reportError(err error) {
+	if n.onError != nil {
+		n.onError(err)
+	}
+}
+
+/*
+negotiationError wraps err as a NegotiationError of the negotiation in flight.
 */
-func (n *WebRtcNegotiator) HandleOffer(offer *webrtc.SessionDescription, signalingState webrtc.SignalingState) {
-	offerCollision := n.makingOffer || signalingState != webrtc.SignalingStateStable
+func (n *WebRtcNegotiator) negotiationError(phase NegotiationPhase, err error) *NegotiationError {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return &NegotiationError{Phase: phase, Sequence: n.sequence, Err: err}
+}
+
+/*
+fail moves the negotiator to failed with err as the error of phase and returns it.
+*/
+func (n *WebRtcNegotiator) fail(phase NegotiationPhase, err error) error {
+	negotiationErr := n.negotiationError(phase, err)
+	n.log.Errorf("Negotiation failed: %v", negotiationErr)
+	n.transition(NegotiationStateFailed, negotiationErr)
+	return negotiationErr
+}
+
+/*
+HandleOffer handles an offer from a remote peer. A colliding offer that is not
+applied returns ErrOfferIgnored.
+*/
+func (n *WebRtcNegotiator) HandleOffer(offer *webrtc.SessionDescription, signalingState webrtc.SignalingState) error {
+	n.stateMu.Lock()
+	state := n.state
+	offerCollision := state == NegotiationStateMakingOffer || state == NegotiationStateAwaitingAnswer || signalingState != webrtc.SignalingStateStable
+	if offerCollision && n.current != nil {
+		n.current.Collisions++
+	}
+	n.stateMu.Unlock()
+
 	ignoreOffer := !n.isPolite && offerCollision
+	if offerCollision && n.onCollision != nil {
+		n.onCollision(NegotiationCollision{
+			State:          state,
+			SignalingState: signalingState,
+			Ignored:        ignoreOffer,
+		})
+	}
 	if ignoreOffer {
-		log.Println("Ignoring offer due to collision (impolite peer)")
+		n.log.Info("Ignoring offer due to collision (impolite peer)")
 		// retry message
-		return
+		return ErrOfferIgnored
 	}
-	if offerCollision {
-		log.Println("Offer collision detected: Polite peer waiting for current cycle to complete")
-		n.makingOfferMu.Lock()
-		n.makingOffer = false
-		n.makingOfferMu.Unlock()
+	if offerCollision && n.handleRollback == nil {
+		n.log.Info("Offer collision detected: Polite peer waiting for current cycle to complete")
+		// Nothing was rolled back: the local offer still awaits its answer.
 		// retry message
-		return
+		return ErrOfferIgnored
+	}
+	if offerCollision {
+		n.log.Info("Offer collision detected: Polite peer rolling back local offer")
+		if err := n.handleRollback(); err != nil {
+			return n.fail(NegotiationPhaseRollback, err)
+		}
+		n.transition(NegotiationStateRolledBack, nil)
 	}
 	// No collision or we're ready to handle the remote description
+	n.transition(NegotiationStateApplyingRemote, nil)
 	if err := n.handleSetRemoteDescription(*offer); err != nil {
-		log.Println("Error setting remote description:", err)
-		return
+		return n.fail(NegotiationPhaseSetRemoteDescription, err)
 	}
+	n.transition(NegotiationStateIdle, nil)
+	return nil
 }
 
 /*
-HandleAnswer handles an answer from a remote peer.
+HandleAnswer applies an answer from the remote peer with HandleSetRemoteDescription,
+completing the offer the negotiator sent.
 */
-func (n *WebRtcNegotiator) HandleAnswer(answer *webrtc.SessionDescription) {
-	if err := n.handleSetLocalDescription(*answer); err != nil {
-		log.Println("Error setting local description:", err)
-		n.makingOfferMu.Lock()
-		n.makingOffer = false
-		n.makingOfferMu.Unlock()
-		return
+func (n *WebRtcNegotiator) HandleAnswer(answer *webrtc.SessionDescription) error {
+	n.transition(NegotiationStateApplyingRemote, nil)
+	if err := n.handleSetRemoteDescription(*answer); err != nil {
+		return n.fail(NegotiationPhaseSetRemoteDescription, err)
 	}
+	n.transition(NegotiationStateIdle, nil)
+	return nil
 }
 
 /*
 HandleCandidate handles an ICE candidate from a remote peer.
 */
-func (n *WebRtcNegotiator) HandleCandidate(candidate *webrtc.ICECandidate) {
-	if err := n.handleAddICECandidate(candidate.ToJSON()); err != nil {
-		log.Println("Error adding ICE candidate:", err)
+func (n *WebRtcNegotiator) HandleCandidate(candidate *webrtc.ICECandidate) error {
+	return n.HandleCandidateInit(candidate.ToJSON())
+}
+
+/*
+HandleCandidateInit handles a serialized ICE candidate from a remote peer. A
+candidate that cannot be added is reported but does not fail the negotiation.
+*/
+func (n *WebRtcNegotiator) HandleCandidateInit(candidate webrtc.ICECandidateInit) error {
+	if err := n.handleAddICECandidate(candidate); err != nil {
+		negotiationErr := n.negotiationError(NegotiationPhaseAddCandidate, err)
+		n.log.Errorf("Error adding ICE candidate: %v", err)
+		n.reportError(negotiationErr)
+		return negotiationErr
 	}
+	return nil
 }
 
 /*
-SendOffer sends an offer to a remote peer.
+gatheredLocalDescription waits up to the gathering timeout for the complete local description.
 */
-func (n *WebRtcNegotiator) SendOffer() {
-	if n.makingOffer {
-		log.Println("Already making offer")
-		return
+func (n *WebRtcNegotiator) gatheredLocalDescription() (webrtc.SessionDescription, error) {
+	if n.handleGatheredLocalDesc == nil {
+		return webrtc.SessionDescription{}, ErrGatheringUnsupported
+	}
+	timeout := n.gatheringTimeout
+	if timeout == 0 {
+		timeout = defaultGatheringTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return n.handleGatheredLocalDesc(ctx)
+}
+
+/*
+HandleSignal handles a validated signaling message addressed to this negotiator
+and returns the error of the method handling it.
+*/
+func (n *WebRtcNegotiator) HandleSignal(message SignalMessage) error {
+	switch message.Type {
+	case SignalTypeOffer:
+		return n.HandleOffer(message.Description, n.SignalingState())
+	case SignalTypeAnswer:
+		return n.HandleAnswer(message.Description)
+	case SignalTypeCandidate:
+		return n.HandleCandidateInit(*message.Candidate)
+	case SignalTypeRenegotiate:
+		return n.SendOffer()
+	case SignalTypeBye:
+		n.HandleBye()
+	}
+	return nil
+}
+
+/*
+HandleBye handles the remote peer ending the session.
+*/
+func (n *WebRtcNegotiator) HandleBye() {
+	if n.handleBye != nil {
+		n.handleBye()
+	}
+}
+
+/*
+Reset abandons any negotiation in flight and returns the negotiator to idle, for
+example after the underlying peer connection has been recreated.
+*/
+func (n *WebRtcNegotiator) Reset() {
+	n.stateMu.Lock()
+	n.offerQueued = false
+	n.stateMu.Unlock()
+	n.transition(NegotiationStateIdle, nil)
+}
+
+/*
+RequestOffer sends an offer now if no negotiation is in flight, or queues one to be
+sent once the negotiation in flight completes. Requests made while an offer is
+queued share it, so a burst of changes leads to a single offer.
+*/
+func (n *WebRtcNegotiator) RequestOffer() error {
+	n.stateMu.Lock()
+	if !n.state.isSettled() {
+		n.offerQueued = true
+		n.stateMu.Unlock()
+		n.log.Debug("Queueing offer until the current negotiation completes")
+		return nil
+	}
+	n.stateMu.Unlock()
+	return n.SendOffer()
+}
+
+/*
+OfferQueued reports whether an offer is waiting for the negotiation in flight to complete.
+*/
+func (n *WebRtcNegotiator) OfferQueued() bool {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.offerQueued
+}
+
+/*
+SendOffer sends an offer to a remote peer. Calling it while an earlier offer is
+still awaiting its answer counts as a retry of the current negotiation, and while
+one is being made returns ErrOfferInProgress.
+*/
+func (n *WebRtcNegotiator) SendOffer() error {
+	started := n.transitionIf(func(from NegotiationState) bool {
+		if from == NegotiationStateMakingOffer {
+			return false
+		}
+		if n.current != nil {
+			n.current.Retries++
+		}
+		return true
+	}, NegotiationStateMakingOffer, nil)
+	if !started {
+		n.log.Debug("Already making offer")
+		return ErrOfferInProgress
 	}
-	n.makingOfferMu.Lock()
-	n.makingOffer = true
-	n.makingOfferMu.Unlock()
 	offer, err := n.handleCreateOffer()
 	if err != nil {
-		log.Println("Error creating offer:", err)
-		return
+		return n.fail(NegotiationPhaseCreateOffer, err)
 	}
 	err = n.handleSetLocalDescription(offer)
 	if err != nil {
-		log.Println("Error setting local description:", err)
-		n.makingOfferMu.Lock()
-		n.makingOffer = false
-		n.makingOfferMu.Unlock()
-		return
+		return n.fail(NegotiationPhaseSetLocalDescription, err)
+	}
+	if n.nonTrickleICE {
+		offer, err = n.gatheredLocalDescription()
+		if err != nil {
+			return n.fail(NegotiationPhaseGatherCandidates, err)
+		}
 	}
 	err = n.handleSendRemoteDescription(offer)
 	if err != nil {
-		log.Println("Error sending signal:", err)
-		return
+		return n.fail(NegotiationPhaseSendOffer, err)
 	}
+	n.transition(NegotiationStateAwaitingAnswer, nil)
+	return nil
 }
@@ -1,8 +1,11 @@
 package webrtcnegotiation
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/stretchr/testify/assert"
@@ -29,18 +32,18 @@ func ExampleWebRtcNegotiator_HandleOffer() {
 func TestWebRtcNegotiator(t *testing.T) {
 	t.Run("Handle answer", func(t *testing.T) {
 		t.Parallel()
-		setLocalDescriptionCalled := 0
-		handleSetLocalDescription := func(description webrtc.SessionDescription) error {
-			setLocalDescriptionCalled++
+		setRemoteDescriptionCalled := 0
+		handleSetRemoteDescription := func(description webrtc.SessionDescription) error {
+			setRemoteDescriptionCalled++
 			return nil
 		}
 
 		negotiatorConfig := WebRTCNegotiatorConfig{
 			ID:                         "example-id",
 			IsPolite:                   true,
-			HandleSetLocalDescription:  handleSetLocalDescription,
+			HandleSetLocalDescription:  nil,
 			HandleCreateOffer:          nil,
-			HandleSetRemoteDescription: nil,
+			HandleSetRemoteDescription: handleSetRemoteDescription,
 		}
 		negotiator := NewWebRtcNegotiator(negotiatorConfig)
 		answer := webrtc.SessionDescription{
@@ -48,7 +51,7 @@ func TestWebRtcNegotiator(t *testing.T) {
 			SDP:  "dummy sdp",
 		}
 		negotiator.HandleAnswer(&answer)
-		assert.Equal(t, 1, setLocalDescriptionCalled)
+		assert.Equal(t, 1, setRemoteDescriptionCalled)
 	})
 	t.Run("Handle offer", func(t *testing.T) {
 		t.Parallel()
@@ -106,8 +109,184 @@ func TestWebRtcNegotiator(t *testing.T) {
 			SDP:  "dummy sdp",
 		}
 		negotiator.SendOffer()
-		negotiator.HandleOffer(&offer, webrtc.SignalingStateStable)
+		err := negotiator.HandleOffer(&offer, webrtc.SignalingStateStable)
+		assert.ErrorIs(t, err, ErrOfferIgnored)
 		assert.Equal(t, 0, setRemoteDescriptionCalled)
 		assert.Equal(t, 1, setLocalDescriptionCalled)
+		// Without a rollback the local offer is still outstanding.
+		assert.Equal(t, NegotiationStateAwaitingAnswer, negotiator.State())
+		_, ok := negotiator.CurrentNegotiation()
+		assert.True(t, ok)
+	})
+	t.Run("State transitions", func(t *testing.T) {
+		t.Parallel()
+		transitions := []string{}
+		completed := []NegotiationRecord{}
+		negotiatorConfig := WebRTCNegotiatorConfig{
+			ID:                         "example-id",
+			IsPolite:                   true,
+			HandleSetLocalDescription:  func(description webrtc.SessionDescription) error { return nil },
+			HandleSetRemoteDescription: func(description webrtc.SessionDescription) error { return nil },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			HandleSendOffer: func(description webrtc.SessionDescription) error { return nil },
+			OnStateChange: func(from NegotiationState, to NegotiationState) {
+				transitions = append(transitions, from.String()+"->"+to.String())
+			},
+			OnNegotiationComplete: func(record NegotiationRecord) {
+				completed = append(completed, record)
+			},
+		}
+		negotiator := NewWebRtcNegotiator(negotiatorConfig)
+		negotiator.SendOffer()
+		assert.Equal(t, NegotiationStateAwaitingAnswer, negotiator.State())
+		negotiator.SendOffer()
+		current, ok := negotiator.CurrentNegotiation()
+		assert.True(t, ok)
+		assert.Equal(t, 1, current.Retries)
+		negotiator.HandleAnswer(&webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "dummy sdp"})
+		assert.Equal(t, NegotiationStateIdle, negotiator.State())
+		assert.Equal(t, []string{
+			"idle->making-offer",
+			"making-offer->awaiting-answer",
+			"awaiting-answer->making-offer",
+			"making-offer->awaiting-answer",
+			"awaiting-answer->applying-remote",
+			"applying-remote->idle",
+		}, transitions)
+		assert.Len(t, completed, 1)
+		assert.Equal(t, uint64(1), completed[0].Sequence)
+		assert.Equal(t, NegotiationStateIdle, completed[0].FinalState)
+		assert.Equal(t, completed[0], negotiator.LastNegotiation())
+		_, ok = negotiator.CurrentNegotiation()
+		assert.False(t, ok)
+	})
+	t.Run("Collision is recorded", func(t *testing.T) {
+		t.Parallel()
+		collisions := []NegotiationCollision{}
+		negotiatorConfig := WebRTCNegotiatorConfig{
+			ID:                        "example-id",
+			IsPolite:                  false,
+			HandleSetLocalDescription: func(description webrtc.SessionDescription) error { return nil },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			HandleSendOffer: func(description webrtc.SessionDescription) error { return nil },
+			OnCollision: func(collision NegotiationCollision) {
+				collisions = append(collisions, collision)
+			},
+		}
+		negotiator := NewWebRtcNegotiator(negotiatorConfig)
+		negotiator.SendOffer()
+		err := negotiator.HandleOffer(&webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, webrtc.SignalingStateHaveLocalOffer)
+		assert.ErrorIs(t, err, ErrOfferIgnored)
+		assert.Len(t, collisions, 1)
+		assert.True(t, collisions[0].Ignored)
+		assert.Equal(t, NegotiationStateAwaitingAnswer, negotiator.State())
+		current, _ := negotiator.CurrentNegotiation()
+		assert.Equal(t, 1, current.Collisions)
+	})
+	t.Run("Error moves to failed", func(t *testing.T) {
+		t.Parallel()
+		errs := []error{}
+		setLocalDescriptionErr := errors.New("boom")
+		negotiatorConfig := WebRTCNegotiatorConfig{
+			ID:                        "example-id",
+			IsPolite:                  true,
+			HandleSetLocalDescription: func(description webrtc.SessionDescription) error { return setLocalDescriptionErr },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			OnError: func(err error) {
+				errs = append(errs, err)
+			},
+		}
+		negotiator := NewWebRtcNegotiator(negotiatorConfig)
+		err := negotiator.SendOffer()
+		assert.ErrorIs(t, err, setLocalDescriptionErr)
+		var negotiationErr *NegotiationError
+		assert.ErrorAs(t, err, &negotiationErr)
+		assert.Equal(t, NegotiationPhaseSetLocalDescription, negotiationErr.Phase)
+		assert.Equal(t, uint64(1), negotiationErr.Sequence)
+		assert.Equal(t, NegotiationStateFailed, negotiator.State())
+		assert.Len(t, errs, 1)
+		assert.ErrorIs(t, errs[0], setLocalDescriptionErr)
+		assert.ErrorIs(t, negotiator.LastNegotiation().Err, setLocalDescriptionErr)
+	})
+	t.Run("Non-trickle offer", func(t *testing.T) {
+		t.Parallel()
+		sent := []webrtc.SessionDescription{}
+		negotiatorConfig := WebRTCNegotiatorConfig{
+			ID:                        "example-id",
+			NonTrickleICE:             true,
+			HandleSetLocalDescription: func(description webrtc.SessionDescription) error { return nil },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			HandleGatheredLocalDescription: func(ctx context.Context) (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "gathered sdp"}, nil
+			},
+			HandleSendOffer: func(description webrtc.SessionDescription) error {
+				sent = append(sent, description)
+				return nil
+			},
+		}
+		negotiator := NewWebRtcNegotiator(negotiatorConfig)
+		negotiator.SendOffer()
+		assert.Equal(t, NegotiationStateAwaitingAnswer, negotiator.State())
+		assert.Len(t, sent, 1)
+		assert.Equal(t, "gathered sdp", sent[0].SDP)
+	})
+	t.Run("Non-trickle gathering timeout", func(t *testing.T) {
+		t.Parallel()
+		negotiatorConfig := WebRTCNegotiatorConfig{
+			ID:                        "example-id",
+			NonTrickleICE:             true,
+			GatheringTimeout:          10 * time.Millisecond,
+			HandleSetLocalDescription: func(description webrtc.SessionDescription) error { return nil },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			HandleGatheredLocalDescription: func(ctx context.Context) (webrtc.SessionDescription, error) {
+				<-ctx.Done()
+				return webrtc.SessionDescription{}, ctx.Err()
+			},
+		}
+		negotiator := NewWebRtcNegotiator(negotiatorConfig)
+		negotiator.SendOffer()
+		assert.Equal(t, NegotiationStateFailed, negotiator.State())
+		assert.ErrorIs(t, negotiator.LastNegotiation().Err, context.DeadlineExceeded)
+	})
+	t.Run("Queues offers requested during a negotiation", func(t *testing.T) {
+		t.Parallel()
+		offers := make(chan struct{}, 8)
+		negotiator := NewWebRtcNegotiator(WebRTCNegotiatorConfig{
+			ID:                         "example-id",
+			HandleSetLocalDescription:  func(description webrtc.SessionDescription) error { return nil },
+			HandleSetRemoteDescription: func(description webrtc.SessionDescription) error { return nil },
+			HandleCreateOffer: func() (webrtc.SessionDescription, error) {
+				return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "dummy sdp"}, nil
+			},
+			HandleSendOffer: func(description webrtc.SessionDescription) error {
+				offers <- struct{}{}
+				return nil
+			},
+		})
+		negotiator.RequestOffer()
+		assert.Len(t, offers, 1)
+		negotiator.RequestOffer()
+		negotiator.RequestOffer()
+		assert.True(t, negotiator.OfferQueued())
+		assert.Len(t, offers, 1)
+		negotiator.HandleAnswer(&webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "dummy sdp"})
+		assert.Eventually(t, func() bool {
+			return negotiator.State() == NegotiationStateAwaitingAnswer
+		}, time.Second, 10*time.Millisecond)
+		assert.Len(t, offers, 2)
+		assert.False(t, negotiator.OfferQueued())
+		current, ok := negotiator.CurrentNegotiation()
+		assert.True(t, ok)
+		assert.Equal(t, uint64(2), current.Sequence)
 	})
 }
@@ -0,0 +1,248 @@
+package webrtcnegotiation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+SfuPeerNegotiator is a WebRtcNegotiator bound to an SfuPeer. Descriptions, offers and
+candidates are applied to the peer's current PeerConnection, and everything that has
+to reach the remote peer goes through a single outbound signaling callback.
+*/
+type SfuPeerNegotiator struct {
+	*WebRtcNegotiator
+	peer                *webrtcpeer.SfuPeer
+	send                func(message SignalMessage) error
+	candidatesMu        sync.Mutex
+	pendingCandidates   []webrtc.ICECandidateInit
+	canTrickle          bool
+	remoteCandidatesMu  sync.Mutex
+	remoteCandidates    []webrtc.ICECandidateInit
+	negotiationNeededID string
+	iceCandidateID      string
+	recreateID          string
+	// dataChannelMu guards the signaling data channel, see EnableDataChannelSignaling.
+	dataChannelMu        sync.Mutex
+	dataChannelSignaling bool
+	dataChannel          *webrtc.DataChannel
+	dataChannelOpen      bool
+}
+
+/*
+NewSfuPeerNegotiator creates a negotiator bound to peer. Handlers left nil in config
+are wired to the peer, the ID defaults to the peer ID and the logger factory to the
+peer's. Offers, answers and local ICE candidates are passed to send.
+
+Local candidates are held back until the description they belong to has been sent,
+so the remote peer never receives a candidate before its description. In non-trickle
+mode, enabled by the config or by the peer, descriptions are only sent once ICE
+gathering has completed and no candidates are sent at all.
+*/
+func NewSfuPeerNegotiator(peer *webrtcpeer.SfuPeer, config WebRTCNegotiatorConfig, send func(message SignalMessage) error) *SfuPeerNegotiator {
+	n := &SfuPeerNegotiator{
+		peer: peer,
+		send: send,
+	}
+	if config.ID == "" {
+		config.ID = peer.ID()
+	}
+	if config.LoggerFactory == nil {
+		config.LoggerFactory = peer.LoggerFactory()
+	}
+	if config.HandleSetLocalDescription == nil {
+		config.HandleSetLocalDescription = n.setLocalDescription
+	}
+	if config.HandleSetRemoteDescription == nil {
+		config.HandleSetRemoteDescription = n.setRemoteDescription
+	}
+	if config.HandleAddICECandidate == nil {
+		config.HandleAddICECandidate = n.addICECandidate
+	}
+	if config.HandleRollback == nil {
+		config.HandleRollback = func() error {
+			return n.peer.PeerConnection.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+		}
+	}
+	if config.HandleCreateOffer == nil {
+		config.HandleCreateOffer = func() (webrtc.SessionDescription, error) {
+			return n.peer.PeerConnection.CreateOffer(nil)
+		}
+	}
+	if config.HandleSendOffer == nil {
+		config.HandleSendOffer = func(description webrtc.SessionDescription) error {
+			return n.sendDescription(SignalTypeOffer, description)
+		}
+	}
+	config.NonTrickleICE = config.NonTrickleICE || peer.NonTrickleICE()
+	if config.GatheringTimeout == 0 {
+		config.GatheringTimeout = peer.GatheringTimeout()
+	}
+	if config.HandleGatheredLocalDescription == nil {
+		config.HandleGatheredLocalDescription = func(ctx context.Context) (webrtc.SessionDescription, error) {
+			description, err := n.peer.GatheredLocalDescription(ctx)
+			if err != nil {
+				return webrtc.SessionDescription{}, err
+			}
+			return *description, nil
+		}
+	}
+	if config.SignalingState == nil {
+		config.SignalingState = func() webrtc.SignalingState {
+			return n.peer.PeerConnection.SignalingState()
+		}
+	}
+	n.WebRtcNegotiator = NewWebRtcNegotiator(config)
+
+	n.negotiationNeededID = peer.AddOnNegotiationNeededHandler(func() {
+		n.RequestOffer()
+	})
+	n.iceCandidateID = peer.AddOnICECandidateHandler(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		n.trickle(candidate.ToJSON())
+	})
+	n.recreateID = peer.AddOnRecreateHandler(func(peerConnection *webrtc.PeerConnection) {
+		n.candidatesMu.Lock()
+		n.pendingCandidates = nil
+		n.canTrickle = false
+		n.candidatesMu.Unlock()
+		n.remoteCandidatesMu.Lock()
+		n.remoteCandidates = nil
+		n.remoteCandidatesMu.Unlock()
+		n.Reset()
+		n.resetDataChannel()
+	})
+	return n
+}
+
+/*
+Peer returns the SfuPeer the negotiator is bound to.
+*/
+func (n *SfuPeerNegotiator) Peer() *webrtcpeer.SfuPeer {
+	return n.peer
+}
+
+/*
+Unbind removes the handlers the negotiator registered on its peer.
+*/
+func (n *SfuPeerNegotiator) Unbind() {
+	n.peer.RemoveOnNegotiationNeededHandler(n.negotiationNeededID)
+	n.peer.RemoveOnICECandidateHandler(n.iceCandidateID)
+	n.peer.RemoveOnRecreateHandler(n.recreateID)
+}
+
+func (n *SfuPeerNegotiator) setLocalDescription(description webrtc.SessionDescription) error {
+	n.candidatesMu.Lock()
+	n.canTrickle = false
+	n.candidatesMu.Unlock()
+	return n.peer.PeerConnection.SetLocalDescription(description)
+}
+
+/*
+setRemoteDescription applies a remote description and, when it is an offer, answers it.
+*/
+func (n *SfuPeerNegotiator) setRemoteDescription(description webrtc.SessionDescription) error {
+	pc := n.peer.PeerConnection
+	if err := pc.SetRemoteDescription(description); err != nil {
+		return err
+	}
+	n.remoteCandidatesMu.Lock()
+	pending := n.remoteCandidates
+	n.remoteCandidates = nil
+	n.remoteCandidatesMu.Unlock()
+	for _, candidate := range pending {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			n.log.Warnf("Error adding buffered ICE candidate: %v", err)
+		}
+	}
+	if description.Type != webrtc.SDPTypeOffer {
+		n.openDeferredDataChannel()
+		return nil
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := n.setLocalDescription(answer); err != nil {
+		return err
+	}
+	if n.nonTrickleICE {
+		answer, err = n.gatheredLocalDescription()
+		if err != nil {
+			return fmt.Errorf("gather ICE candidates: %w", err)
+		}
+	}
+	if err := n.sendDescription(SignalTypeAnswer, answer); err != nil {
+		return err
+	}
+	n.openDeferredDataChannel()
+	return nil
+}
+
+/*
+addICECandidate adds a remote candidate, holding it back while no remote description
+is set, as happens when the offer it belongs to was ignored or has not arrived yet.
+*/
+func (n *SfuPeerNegotiator) addICECandidate(candidate webrtc.ICECandidateInit) error {
+	n.remoteCandidatesMu.Lock()
+	if n.peer.PeerConnection.RemoteDescription() == nil {
+		n.remoteCandidates = append(n.remoteCandidates, candidate)
+		n.remoteCandidatesMu.Unlock()
+		return nil
+	}
+	n.remoteCandidatesMu.Unlock()
+	return n.peer.PeerConnection.AddICECandidate(candidate)
+}
+
+/*
+sendDescription sends a local description and then releases the candidates gathered for it.
+*/
+func (n *SfuPeerNegotiator) sendDescription(signalType SignalType, description webrtc.SessionDescription) error {
+	if err := n.signal(SignalMessage{
+		Type:         signalType,
+		NegotiatorID: n.ID(),
+		Description:  &description,
+	}); err != nil {
+		return err
+	}
+	n.candidatesMu.Lock()
+	pending := n.pendingCandidates
+	n.pendingCandidates = nil
+	n.canTrickle = true
+	n.candidatesMu.Unlock()
+	for _, candidate := range pending {
+		n.sendCandidate(candidate)
+	}
+	return nil
+}
+
+func (n *SfuPeerNegotiator) trickle(candidate webrtc.ICECandidateInit) {
+	if n.nonTrickleICE {
+		return
+	}
+	n.candidatesMu.Lock()
+	if !n.canTrickle {
+		n.pendingCandidates = append(n.pendingCandidates, candidate)
+		n.candidatesMu.Unlock()
+		return
+	}
+	n.candidatesMu.Unlock()
+	n.sendCandidate(candidate)
+}
+
+func (n *SfuPeerNegotiator) sendCandidate(candidate webrtc.ICECandidateInit) {
+	if err := n.signal(SignalMessage{
+		Type:         SignalTypeCandidate,
+		NegotiatorID: n.ID(),
+		Candidate:    &candidate,
+	}); err != nil {
+		n.log.Errorf("Error sending ICE candidate: %v", err)
+		n.reportError(err)
+	}
+}
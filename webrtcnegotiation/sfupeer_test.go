@@ -0,0 +1,344 @@
+package webrtcnegotiation
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+connectedPair binds two SfuPeers to negotiators that signal each other through their managers.
+*/
+func connectedPair(t *testing.T) (*SfuPeerNegotiator, *SfuPeerNegotiator) {
+	t.Helper()
+	return connectedPairWithConfig(t, webrtcpeer.SfuPeerConfig{ID: "a"}, webrtcpeer.SfuPeerConfig{ID: "b"}, nil)
+}
+
+/*
+connectedPairWithConfig is connectedPair with explicit peer configs. observe, if not
+nil, sees every message before it is relayed.
+*/
+func connectedPairWithConfig(t *testing.T, configA webrtcpeer.SfuPeerConfig, configB webrtcpeer.SfuPeerConfig, observe func(message SignalMessage)) (*SfuPeerNegotiator, *SfuPeerNegotiator) {
+	t.Helper()
+	managerA := NewWebRTCNegotiationManager()
+	managerB := NewWebRTCNegotiationManager()
+	configA.PeerConfig = &webrtc.Configuration{}
+	configB.PeerConfig = &webrtc.Configuration{}
+	peerA, err := webrtcpeer.NewSfuPeerWithConfig(configA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerB, err := webrtcpeer.NewSfuPeerWithConfig(configB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		peerA.Close()
+		peerB.Close()
+	})
+	relay := func(manager *WebRTCNegotiationManager) func(message SignalMessage) error {
+		messages := make(chan SignalMessage, 64)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case message := <-messages:
+					if err := manager.Dispatch(message); err != nil && !errors.Is(err, ErrOfferIgnored) {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+		t.Cleanup(func() { close(done) })
+		return func(message SignalMessage) error {
+			if observe != nil {
+				observe(message)
+			}
+			select {
+			case messages <- message:
+			case <-done:
+			}
+			return nil
+		}
+	}
+	negotiatorA := NewSfuPeerNegotiator(peerA, WebRTCNegotiatorConfig{ID: "session"}, relay(managerB))
+	negotiatorB := NewSfuPeerNegotiator(peerB, WebRTCNegotiatorConfig{ID: "session", IsPolite: true}, relay(managerA))
+	managerA.Negotiators.Add(negotiatorA.WebRtcNegotiator)
+	managerB.Negotiators.Add(negotiatorB.WebRtcNegotiator)
+	return negotiatorA, negotiatorB
+}
+
+func waitConnected(t *testing.T, peer *webrtcpeer.SfuPeer) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return peer.ConnectionState() == webrtc.PeerConnectionStateConnected
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+func TestSfuPeerNegotiator(t *testing.T) {
+	t.Run("Negotiates on negotiation needed", func(t *testing.T) {
+		t.Parallel()
+		negotiatorA, negotiatorB := connectedPair(t)
+		_, err := negotiatorA.Peer().CreateDataChannel("data", nil)
+		assert.Nil(t, err)
+		waitConnected(t, negotiatorA.Peer())
+		waitConnected(t, negotiatorB.Peer())
+		assert.Eventually(t, func() bool {
+			return negotiatorA.State() == NegotiationStateIdle
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, uint64(1), negotiatorA.LastNegotiation().Sequence)
+	})
+	t.Run("Survives peer connection recreation", func(t *testing.T) {
+		t.Parallel()
+		negotiatorA, negotiatorB := connectedPair(t)
+		_, err := negotiatorA.Peer().CreateDataChannel("data", nil)
+		assert.Nil(t, err)
+		waitConnected(t, negotiatorA.Peer())
+
+		oldA := negotiatorA.Peer().PeerConnection
+		oldB := negotiatorB.Peer().PeerConnection
+		_, err = negotiatorA.Peer().RecreatePeerConnection()
+		assert.Nil(t, err)
+		_, err = negotiatorB.Peer().RecreatePeerConnection()
+		assert.Nil(t, err)
+		oldA.Close()
+		oldB.Close()
+		assert.Equal(t, NegotiationStateIdle, negotiatorA.State())
+
+		_, err = negotiatorA.Peer().CreateDataChannel("data", nil)
+		assert.Nil(t, err)
+		waitConnected(t, negotiatorA.Peer())
+		waitConnected(t, negotiatorB.Peer())
+	})
+	t.Run("Non-trickle mode sends complete descriptions", func(t *testing.T) {
+		t.Parallel()
+		var mu sync.Mutex
+		candidates := 0
+		descriptionsWithCandidates := 0
+		negotiatorA, negotiatorB := connectedPairWithConfig(t,
+			webrtcpeer.SfuPeerConfig{ID: "a", NonTrickleICE: true},
+			webrtcpeer.SfuPeerConfig{ID: "b", NonTrickleICE: true},
+			func(message SignalMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				if message.Type == SignalTypeCandidate {
+					candidates++
+				}
+				if message.Description != nil && strings.Contains(message.Description.SDP, "a=candidate:") {
+					descriptionsWithCandidates++
+				}
+			})
+		_, err := negotiatorA.Peer().CreateDataChannel("data", nil)
+		assert.Nil(t, err)
+		waitConnected(t, negotiatorA.Peer())
+		waitConnected(t, negotiatorB.Peer())
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 0, candidates)
+		assert.Equal(t, 2, descriptionsWithCandidates)
+	})
+	t.Run("Renegotiates over data channel", func(t *testing.T) {
+		t.Parallel()
+		var mu sync.Mutex
+		external := 0
+		negotiatorA, negotiatorB := connectedPairWithConfig(t,
+			webrtcpeer.SfuPeerConfig{ID: "a"},
+			webrtcpeer.SfuPeerConfig{ID: "b"},
+			func(message SignalMessage) {
+				mu.Lock()
+				external++
+				mu.Unlock()
+			})
+		externalCount := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return external
+		}
+		assert.Nil(t, negotiatorA.EnableDataChannelSignaling())
+		assert.Nil(t, negotiatorB.EnableDataChannelSignaling())
+		waitConnected(t, negotiatorA.Peer())
+		assert.Eventually(t, func() bool {
+			return negotiatorA.DataChannelSignalingOpen() && negotiatorB.DataChannelSignalingOpen() &&
+				negotiatorA.State() == NegotiationStateIdle && negotiatorB.State() == NegotiationStateIdle
+		}, 10*time.Second, 20*time.Millisecond)
+
+		before := externalCount()
+		_, err := negotiatorB.Peer().AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			return len(negotiatorA.Peer().GetTransceivers()) == 1 && negotiatorB.State() == NegotiationStateIdle &&
+				negotiatorB.Peer().SignalingState() == webrtc.SignalingStateStable
+		}, 10*time.Second, 20*time.Millisecond)
+		assert.Equal(t, before, externalCount())
+
+		negotiatorA.dataChannelMu.Lock()
+		dataChannel := negotiatorA.dataChannel
+		negotiatorA.dataChannelMu.Unlock()
+		assert.Nil(t, dataChannel.Close())
+		assert.Eventually(t, func() bool {
+			return !negotiatorA.DataChannelSignalingOpen() && !negotiatorB.DataChannelSignalingOpen()
+		}, 10*time.Second, 20*time.Millisecond)
+		_, err = negotiatorA.Peer().AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			return len(negotiatorB.Peer().GetTransceivers()) == 2 && externalCount() > before
+		}, 10*time.Second, 20*time.Millisecond)
+	})
+	t.Run("Reuses sender transceivers across track changes", func(t *testing.T) {
+		t.Parallel()
+		negotiatorA, negotiatorB := connectedPair(t)
+		received := make(chan string, 8)
+		negotiatorB.Peer().AddOnTrackHandler(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			received <- remoteTrack.ID()
+		})
+		settled := func() bool {
+			return negotiatorA.State() == NegotiationStateIdle && negotiatorA.Peer().SignalingState() == webrtc.SignalingStateStable &&
+				negotiatorB.Peer().SignalingState() == webrtc.SignalingStateStable
+		}
+		for _, trackID := range []string{"first", "second", "third"} {
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, trackID, "a")
+			assert.Nil(t, err)
+			_, err = negotiatorA.Peer().AddPeerTrack(track)
+			assert.Nil(t, err)
+			stop := writeRTP(track)
+			select {
+			case id := <-received:
+				assert.Equal(t, trackID, id)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("track %s was not received", trackID)
+			}
+			close(stop)
+			assert.Eventually(t, settled, 10*time.Second, 20*time.Millisecond)
+			assert.Nil(t, negotiatorA.Peer().RemoveSendingTrack(trackID))
+			assert.Eventually(t, settled, 10*time.Second, 20*time.Millisecond)
+			assert.Equal(t, 1, negotiatorA.Peer().IdleTransceivers(webrtc.RTPCodecTypeVideo))
+		}
+		assert.Len(t, negotiatorA.Peer().GetTransceivers(), 1)
+		assert.Len(t, negotiatorB.Peer().GetTransceivers(), 1)
+	})
+	t.Run("Negotiates batched track changes in one offer", func(t *testing.T) {
+		t.Parallel()
+		var mu sync.Mutex
+		offers := 0
+		negotiatorA, negotiatorB := connectedPairWithConfig(t,
+			webrtcpeer.SfuPeerConfig{ID: "a"},
+			webrtcpeer.SfuPeerConfig{ID: "b"},
+			func(message SignalMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				if message.Type == SignalTypeOffer {
+					offers++
+				}
+			})
+		changes := negotiatorA.Peer().BeginTrackChanges()
+		for _, trackID := range []string{"first", "second", "third"} {
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, trackID, "a")
+			assert.Nil(t, err)
+			_, err = changes.AddTrack(track)
+			assert.Nil(t, err)
+			time.Sleep(50 * time.Millisecond)
+		}
+		changes.Commit()
+		assert.Eventually(t, func() bool {
+			return len(negotiatorB.Peer().GetTransceivers()) == 3 && negotiatorA.State() == NegotiationStateIdle &&
+				negotiatorA.Peer().SignalingState() == webrtc.SignalingStateStable
+		}, 10*time.Second, 20*time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 1, offers)
+	})
+	t.Run("Switches sources without renegotiation", func(t *testing.T) {
+		t.Parallel()
+		var mu sync.Mutex
+		offers := 0
+		negotiatorA, negotiatorB := connectedPairWithConfig(t,
+			webrtcpeer.SfuPeerConfig{ID: "a"},
+			webrtcpeer.SfuPeerConfig{ID: "b"},
+			func(message SignalMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				if message.Type == SignalTypeOffer {
+					offers++
+				}
+			})
+		offerCount := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return offers
+		}
+		publisher, err := webrtcpeer.NewSfuPeer("publisher", &webrtc.Configuration{})
+		assert.Nil(t, err)
+		t.Cleanup(func() { publisher.Close() })
+		for _, id := range []string{"camera", "screen"} {
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, id, "publisher")
+			assert.Nil(t, err)
+			publisher.LocalTracks[id] = track
+			stop := writeRTP(track)
+			t.Cleanup(func() { close(stop) })
+		}
+		received := make(chan *webrtc.TrackRemote, 1)
+		negotiatorB.Peer().AddOnTrackHandler(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			received <- remoteTrack
+		})
+		_, err = negotiatorA.Peer().AddSwitchableTrack("spotlight", "spotlight", publisher, "camera")
+		assert.Nil(t, err)
+		var remoteTrack *webrtc.TrackRemote
+		select {
+		case remoteTrack = <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("spotlight track was not received")
+		}
+		assert.Eventually(t, func() bool {
+			return negotiatorA.State() == NegotiationStateIdle && negotiatorA.Peer().SignalingState() == webrtc.SignalingStateStable
+		}, 10*time.Second, 20*time.Millisecond)
+		before := offerCount()
+
+		readSequence := func() uint16 {
+			packet, _, err := remoteTrack.ReadRTP()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return packet.SequenceNumber
+		}
+		last := readSequence()
+		assert.Nil(t, negotiatorA.Peer().SwitchTrackSource("spotlight", publisher, "screen"))
+		for i := 0; i < 20; i++ {
+			sequence := readSequence()
+			assert.Equal(t, last+1, sequence)
+			last = sequence
+		}
+		assert.Equal(t, before, offerCount())
+	})
+}
+
+/*
+writeRTP writes VP8 packets to track until the returned channel is closed.
+*/
+func writeRTP(track *webrtc.TrackLocalStaticRTP) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}, Payload: []byte{0x10, 0x00, 0x00, 0x00}}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				packet.SequenceNumber++
+				packet.Timestamp += 1800
+				track.WriteRTP(packet)
+			}
+		}
+	}()
+	return stop
+}
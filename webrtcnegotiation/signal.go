@@ -0,0 +1,66 @@
+package webrtcnegotiation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type SignalType string
+
+const (
+	SignalTypeOffer       SignalType = "offer"
+	SignalTypeAnswer      SignalType = "answer"
+	SignalTypeCandidate   SignalType = "candidate"
+	SignalTypeRenegotiate SignalType = "renegotiate"
+	SignalTypeBye         SignalType = "bye"
+)
+
+/*
+SignalMessage is the signaling envelope exchanged with remote peers. NegotiatorID
+names the negotiator the message is addressed to.
+*/
+type SignalMessage struct {
+	Type         SignalType                 `json:"type"`
+	NegotiatorID string                     `json:"negotiatorId"`
+	Description  *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate    *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+/*
+ParseSignalMessage decodes and validates a JSON signaling envelope.
+*/
+func ParseSignalMessage(data []byte) (SignalMessage, error) {
+	var message SignalMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return message, fmt.Errorf("%w: %v", ErrInvalidSignal, err)
+	}
+	return message, message.Validate()
+}
+
+/*
+Validate checks that the message carries the payload its type requires.
+*/
+func (m SignalMessage) Validate() error {
+	if m.NegotiatorID == "" {
+		return fmt.Errorf("%w: missing negotiator id", ErrInvalidSignal)
+	}
+	switch m.Type {
+	case SignalTypeOffer, SignalTypeAnswer:
+		if m.Description == nil || m.Description.SDP == "" {
+			return fmt.Errorf("%w: %s without session description", ErrInvalidSignal, m.Type)
+		}
+		if m.Description.Type.String() != string(m.Type) {
+			return fmt.Errorf("%w: %s carries a %s description", ErrInvalidSignal, m.Type, m.Description.Type)
+		}
+	case SignalTypeCandidate:
+		if m.Candidate == nil {
+			return fmt.Errorf("%w: candidate without ICE candidate", ErrInvalidSignal)
+		}
+	case SignalTypeRenegotiate, SignalTypeBye:
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidSignal, m.Type)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package webrtcnegotiation
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type NegotiationState int
+
+const (
+	NegotiationStateIdle NegotiationState = iota
+	NegotiationStateMakingOffer
+	NegotiationStateAwaitingAnswer
+	NegotiationStateApplyingRemote
+	NegotiationStateRolledBack
+	NegotiationStateFailed
+)
+
+func (s NegotiationState) String() string {
+	switch s {
+	case NegotiationStateIdle:
+		return "idle"
+	case NegotiationStateMakingOffer:
+		return "making-offer"
+	case NegotiationStateAwaitingAnswer:
+		return "awaiting-answer"
+	case NegotiationStateApplyingRemote:
+		return "applying-remote"
+	case NegotiationStateRolledBack:
+		return "rolled-back"
+	case NegotiationStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+isSettled reports whether no negotiation is in flight in this state.
+*/
+func (s NegotiationState) isSettled() bool {
+	return s == NegotiationStateIdle || s == NegotiationStateRolledBack || s == NegotiationStateFailed
+}
+
+/*
+NegotiationRecord describes a single offer/answer cycle, from the first state
+leaving idle until the negotiator settles again.
+*/
+type NegotiationRecord struct {
+	Sequence   uint64
+	StartedAt  time.Time
+	EndedAt    time.Time
+	Collisions int
+	Retries    int
+	FinalState NegotiationState
+	Err        error
+}
+
+/*
+Duration returns how long the negotiation took, or how long it has been
+running if it has not ended yet.
+*/
+func (r NegotiationRecord) Duration() time.Duration {
+	if r.StartedAt.IsZero() {
+		return 0
+	}
+	if r.EndedAt.IsZero() {
+		return time.Since(r.StartedAt)
+	}
+	return r.EndedAt.Sub(r.StartedAt)
+}
+
+/*
+NegotiationCollision describes an offer that arrived while a local offer was in flight.
+*/
+type NegotiationCollision struct {
+	State          NegotiationState
+	SignalingState webrtc.SignalingState
+	Ignored        bool
+}
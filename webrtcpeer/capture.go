@@ -0,0 +1,427 @@
+package webrtcpeer
+
+import (
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultCaptureMaxSize     = 64 << 20
+	defaultCaptureMaxDuration = 10 * time.Minute
+	captureQueueSize          = 4096
+)
+
+/*
+CaptureConfig configures a packet capture of a peer started with StartCapture or
+StartCaptureFile.
+*/
+type CaptureConfig struct {
+	// TrackIDs limits the capture to the RTP and RTCP of these tracks: tracks the peer
+	// publishes, by remote or local track ID, and tracks it is sent. Empty captures
+	// every stream of the peer.
+	TrackIDs []string
+	// MaxSize stops the capture once the file reaches this many bytes. Defaults to
+	// 64 MiB; a negative value does not limit the size.
+	MaxSize int64
+	// MaxDuration stops the capture after this long. Defaults to 10 minutes; a
+	// negative value does not limit the duration.
+	MaxDuration time.Duration
+	// OnStop is called when the capture stops by itself, at one of its limits or on
+	// a write error, which it is passed.
+	OnStop func(err error)
+}
+
+/*
+packetCapture is the capture state of a peer, fed by its capture interceptor. The
+interceptor outlives recreated peer connections, so a capture does too.
+*/
+type packetCapture struct {
+	active    atomic.Bool
+	mu        sync.Mutex
+	session   *captureSession
+	streams   map[uint32][]string
+	streamsMu sync.RWMutex
+}
+
+/*
+captureSession is a running capture. Packets are queued for its writer goroutine, so
+the media of the peer does not wait on the file; when the writes fall behind, the
+packets that do not fit in the queue are left out of the capture.
+*/
+type captureSession struct {
+	writer  *pcapngWriter
+	closer  io.Closer
+	tracks  map[string]bool
+	maxSize int64
+	timer   *time.Timer
+	onStop  func(err error)
+	queue   chan queuedPacket
+	// done is closed once the writer goroutine has written or dropped every packet
+	// queued before the session was detached.
+	done chan struct{}
+}
+
+type queuedPacket struct {
+	at      time.Time
+	inbound bool
+	data    []byte
+}
+
+func newPacketCapture() *packetCapture {
+	return &packetCapture{streams: make(map[uint32][]string)}
+}
+
+/*
+nameStream records the IDs of the track the stream with ssrc carries, which is how
+captures limited to tracks select packets. A forwarded track goes by its remote and
+its local ID.
+*/
+func (c *packetCapture) nameStream(ssrc uint32, ids ...string) {
+	c.streamsMu.Lock()
+	c.streams[ssrc] = ids
+	c.streamsMu.Unlock()
+}
+
+/*
+nameSenderStreams names the streams of sender after the track it sends, once it is
+added or takes over an idle transceiver.
+*/
+func (c *packetCapture) nameSenderStreams(sender *webrtc.RTPSender, id string) {
+	for _, encoding := range sender.GetParameters().Encodings {
+		c.nameStream(uint32(encoding.SSRC), id)
+	}
+}
+
+func (c *packetCapture) forgetStream(ssrc uint32) {
+	c.streamsMu.Lock()
+	delete(c.streams, ssrc)
+	c.streamsMu.Unlock()
+}
+
+func (c *packetCapture) selected(session *captureSession, ssrcs ...uint32) bool {
+	if session.tracks == nil {
+		return true
+	}
+	c.streamsMu.RLock()
+	defer c.streamsMu.RUnlock()
+	for _, ssrc := range ssrcs {
+		for _, id := range c.streams[ssrc] {
+			if session.tracks[id] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *packetCapture) start(out io.Writer, closer io.Closer, config CaptureConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != nil {
+		return ErrCaptureActive
+	}
+	writer, err := newPcapngWriter(out)
+	if err != nil {
+		return err
+	}
+	session := &captureSession{
+		writer:  writer,
+		closer:  closer,
+		maxSize: config.MaxSize,
+		onStop:  config.OnStop,
+		queue:   make(chan queuedPacket, captureQueueSize),
+		done:    make(chan struct{}),
+	}
+	if session.maxSize == 0 {
+		session.maxSize = defaultCaptureMaxSize
+	}
+	if len(config.TrackIDs) > 0 {
+		session.tracks = make(map[string]bool)
+		for _, id := range config.TrackIDs {
+			session.tracks[id] = true
+		}
+	}
+	duration := config.MaxDuration
+	if duration == 0 {
+		duration = defaultCaptureMaxDuration
+	}
+	if duration > 0 {
+		session.timer = time.AfterFunc(duration, func() {
+			c.stopSession(session, nil)
+		})
+	}
+	c.session = session
+	c.active.Store(true)
+	go c.run(session)
+	return nil
+}
+
+/*
+run writes the packets queued for session until it is detached. A write error or
+reaching the size limit stops the capture, after which the rest of the queue is
+dropped.
+*/
+func (c *packetCapture) run(session *captureSession) {
+	defer close(session.done)
+	stopped := false
+	for packet := range session.queue {
+		if stopped {
+			continue
+		}
+		err := session.writer.writePacket(packet.at, packet.inbound, packet.data)
+		if err != nil || session.maxSize > 0 && session.writer.size >= session.maxSize {
+			stopped = true
+			// stopSession waits for this goroutine to end.
+			go c.stopSession(session, err)
+		}
+	}
+}
+
+/*
+stop ends the current capture. It returns ErrNoCapture when there is none.
+*/
+func (c *packetCapture) stop() error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session == nil {
+		return ErrNoCapture
+	}
+	return c.end(session)
+}
+
+/*
+stopSession ends a capture that stops by itself and reports it to OnStop.
+*/
+func (c *packetCapture) stopSession(session *captureSession, err error) {
+	c.mu.Lock()
+	detached := c.detach(session)
+	c.mu.Unlock()
+	if detached {
+		c.finish(session, err)
+	}
+}
+
+func (c *packetCapture) end(session *captureSession) error {
+	c.mu.Lock()
+	detached := c.detach(session)
+	c.mu.Unlock()
+	if !detached {
+		return nil
+	}
+	return session.close()
+}
+
+/*
+detach makes session no longer the current capture, reporting whether it was. The
+caller holds mu.
+*/
+func (c *packetCapture) detach(session *captureSession) bool {
+	if c.session != session {
+		return false
+	}
+	c.session = nil
+	c.active.Store(false)
+	return true
+}
+
+func (c *packetCapture) finish(session *captureSession, err error) {
+	if closeErr := session.close(); err == nil {
+		err = closeErr
+	}
+	if session.onStop != nil {
+		session.onStop(err)
+	}
+}
+
+/*
+close ends a detached session once its queued packets are written.
+*/
+func (s *captureSession) close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	close(s.queue)
+	<-s.done
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+func (c *packetCapture) writeRTP(inbound bool, ssrc uint32, packet []byte) {
+	if !c.active.Load() {
+		return
+	}
+	c.write(inbound, packet, func(session *captureSession) bool {
+		return c.selected(session, ssrc)
+	})
+}
+
+func (c *packetCapture) writeRTCP(inbound bool, packet []byte) {
+	if !c.active.Load() {
+		return
+	}
+	c.write(inbound, packet, func(session *captureSession) bool {
+		if session.tracks == nil {
+			return true
+		}
+		packets, err := rtcp.Unmarshal(packet)
+		if err != nil {
+			return false
+		}
+		for _, p := range packets {
+			if c.selected(session, p.DestinationSSRC()...) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+/*
+write queues a copy of packet for the current capture if selected picks it. The
+queue is only sent to while the session is current, under mu, so detaching the
+session under mu makes it safe to close.
+*/
+func (c *packetCapture) write(inbound bool, packet []byte, selected func(session *captureSession) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session := c.session
+	if session == nil || !selected(session) {
+		return
+	}
+	select {
+	case session.queue <- queuedPacket{at: time.Now(), inbound: inbound, data: slices.Clone(packet)}:
+	default:
+	}
+}
+
+/*
+captureInterceptorFactory adds a peer's capture to the interceptors of each of its
+peer connections. It is registered ahead of the default interceptors, so it is the
+innermost one: it sees RTP as it goes out after the others have added to it, and the
+RTCP they send.
+*/
+type captureInterceptorFactory struct {
+	capture *packetCapture
+}
+
+func (f *captureInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &captureInterceptor{capture: f.capture}, nil
+}
+
+/*
+captureInterceptor hands decrypted RTP and RTCP to the capture in both directions.
+*/
+type captureInterceptor struct {
+	interceptor.NoOp
+	capture *packetCapture
+}
+
+func (i *captureInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			i.capture.writeRTCP(true, b[:n])
+		}
+		return n, a, err
+	})
+}
+
+func (i *captureInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(packets []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		if i.capture.active.Load() {
+			if packet, err := rtcp.Marshal(packets); err == nil {
+				i.capture.writeRTCP(false, packet)
+			}
+		}
+		return writer.Write(packets, a)
+	})
+}
+
+func (i *captureInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		if i.capture.active.Load() {
+			packet := &rtp.Packet{Header: *header, Payload: payload}
+			if data, err := packet.Marshal(); err == nil {
+				i.capture.writeRTP(false, info.SSRC, data)
+			}
+		}
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (i *captureInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.capture.forgetStream(info.SSRC)
+}
+
+func (i *captureInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			i.capture.writeRTP(true, info.SSRC, b[:n])
+		}
+		return n, a, err
+	})
+}
+
+func (i *captureInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.capture.forgetStream(info.SSRC)
+}
+
+/*
+StartCapture writes the RTP and RTCP the peer sends and receives to out as pcapng,
+until StopCapture or one of the limits of the capture. Packets are captured
+decrypted, in synthetic IPv4 and UDP headers between 192.0.2.1, the remote peer, and
+198.51.100.1, the SFU, both on port 5004; Wireshark shows them as RTP with Decode As.
+*/
+func (p *SfuPeer) StartCapture(out io.Writer, config CaptureConfig) error {
+	if p.state.Load() == 0 {
+		return &PeerError{PeerID: p.id, Err: ErrPeerClosing}
+	}
+	return p.capture.start(out, nil, config)
+}
+
+/*
+StartCaptureFile starts a capture to the file at path, which is closed when the
+capture stops.
+*/
+func (p *SfuPeer) StartCaptureFile(path string, config CaptureConfig) error {
+	if p.state.Load() == 0 {
+		return &PeerError{PeerID: p.id, Err: ErrPeerClosing}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := p.capture.start(file, file, config); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+/*
+StopCapture stops the capture of the peer, returning ErrNoCapture when there is none.
+*/
+func (p *SfuPeer) StopCapture() error {
+	return p.capture.stop()
+}
+
+/*
+Capturing reports whether a capture is running.
+*/
+func (p *SfuPeer) Capturing() bool {
+	return p.capture.active.Load()
+}
@@ -0,0 +1,227 @@
+package webrtcpeer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+type capturedPacket struct {
+	inbound bool
+	source  [4]byte
+	payload []byte
+}
+
+/*
+readPcapng returns the packets of a capture, checking the blocks ahead of them.
+*/
+func readPcapng(t *testing.T, data []byte) []capturedPacket {
+	t.Helper()
+	var packets []capturedPacket
+	var blockTypes []uint32
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		assert.Zero(t, length%4)
+		assert.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:]))
+		blockTypes = append(blockTypes, blockType)
+		body := data[8 : length-4]
+		switch blockType {
+		case pcapngSectionHeaderBlock:
+			assert.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(body))
+		case pcapngInterfaceDescriptionBlock:
+			assert.Equal(t, uint16(pcapngLinkTypeRaw), binary.LittleEndian.Uint16(body))
+		case pcapngEnhancedPacketBlock:
+			captured := binary.LittleEndian.Uint32(body[12:])
+			packet := body[20 : 20+captured]
+			options := body[20+captured+uint32(padding(int(captured))):]
+			assert.Equal(t, uint16(pcapngOptionFlags), binary.LittleEndian.Uint16(options))
+			assert.Equal(t, byte(0x45), packet[0])
+			assert.Equal(t, uint16(len(packet)), binary.BigEndian.Uint16(packet[2:]))
+			assert.Zero(t, ipv4Checksum(packet[:ipv4HeaderSize]))
+			udp := packet[ipv4HeaderSize:]
+			assert.Equal(t, uint16(captureRTPPort), binary.BigEndian.Uint16(udp[2:]))
+			packets = append(packets, capturedPacket{
+				inbound: binary.LittleEndian.Uint32(options[4:]) == pcapngFlagsInbound,
+				source:  [4]byte(packet[12:16]),
+				payload: udp[udpHeaderSize:],
+			})
+		}
+		data = data[length:]
+	}
+	assert.Equal(t, []uint32{pcapngSectionHeaderBlock, pcapngInterfaceDescriptionBlock}, blockTypes[:2])
+	return packets
+}
+
+func rtpBytes(ssrc uint32, seq uint16) []byte {
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: ssrc, SequenceNumber: seq}, Payload: []byte{1, 2, 3}}
+	data, _ := packet.Marshal()
+	return data
+}
+
+/*
+bindCapture binds a capture interceptor to a remote stream with ssrc that reads the
+given packets, and to a local stream with ssrc+1.
+*/
+func bindCapture(capture *packetCapture, ssrc uint32, packets [][]byte) (interceptor.RTPReader, interceptor.RTPWriter) {
+	i := &captureInterceptor{capture: capture}
+	reader := i.BindRemoteStream(&interceptor.StreamInfo{SSRC: ssrc}, interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		if len(packets) == 0 {
+			return 0, a, errors.New("no packets")
+		}
+		n := copy(b, packets[0])
+		packets = packets[1:]
+		return n, a, nil
+	}))
+	writer := i.BindLocalStream(&interceptor.StreamInfo{SSRC: ssrc + 1}, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		return header.MarshalSize() + len(payload), nil
+	}))
+	return reader, writer
+}
+
+func TestPacketCapture(t *testing.T) {
+	t.Run("Captures both directions of RTP and RTCP", func(t *testing.T) {
+		t.Parallel()
+		capture := newPacketCapture()
+		var out bytes.Buffer
+		assert.Nil(t, capture.start(&out, nil, CaptureConfig{}))
+		reader, writer := bindCapture(capture, 10, [][]byte{rtpBytes(10, 1)})
+		i := &captureInterceptor{capture: capture}
+		rtcpWriter := i.BindRTCPWriter(interceptor.RTCPWriterFunc(func(_ []rtcp.Packet, _ interceptor.Attributes) (int, error) {
+			return 0, nil
+		}))
+
+		buf := make([]byte, 1500)
+		_, _, err := reader.Read(buf, nil)
+		assert.Nil(t, err)
+		_, err = writer.Write(&rtp.Header{Version: 2, SSRC: 11, SequenceNumber: 7}, []byte{4, 5}, nil)
+		assert.Nil(t, err)
+		_, err = rtcpWriter.Write([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 10}}, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, capture.stop())
+
+		packets := readPcapng(t, out.Bytes())
+		assert.Len(t, packets, 3)
+		assert.Equal(t, capturedPacket{inbound: true, source: captureRemoteAddress, payload: rtpBytes(10, 1)}, packets[0])
+		assert.False(t, packets[1].inbound)
+		assert.Equal(t, captureLocalAddress, packets[1].source)
+		sent := &rtp.Packet{}
+		assert.Nil(t, sent.Unmarshal(packets[1].payload))
+		assert.Equal(t, uint16(7), sent.SequenceNumber)
+		assert.Equal(t, []byte{4, 5}, sent.Payload)
+		pli, err := rtcp.Unmarshal(packets[2].payload)
+		assert.Nil(t, err)
+		assert.Equal(t, []uint32{10}, pli[0].DestinationSSRC())
+	})
+	t.Run("Captures only the selected tracks", func(t *testing.T) {
+		t.Parallel()
+		capture := newPacketCapture()
+		capture.nameStream(10, "mic", "mic::local")
+		capture.nameStream(20, "camera", "camera::local")
+		var out bytes.Buffer
+		assert.Nil(t, capture.start(&out, nil, CaptureConfig{TrackIDs: []string{"camera::local"}}))
+		buf := make([]byte, 1500)
+		for _, ssrc := range []uint32{10, 20} {
+			reader, _ := bindCapture(capture, ssrc, [][]byte{rtpBytes(ssrc, 1)})
+			_, _, err := reader.Read(buf, nil)
+			assert.Nil(t, err)
+		}
+		i := &captureInterceptor{capture: capture}
+		for _, ssrc := range []uint32{10, 20} {
+			report, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+			rtcpReader := i.BindRTCPReader(interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+				return copy(b, report), a, nil
+			}))
+			_, _, err := rtcpReader.Read(buf, nil)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, capture.stop())
+
+		packets := readPcapng(t, out.Bytes())
+		assert.Len(t, packets, 2)
+		assert.Equal(t, rtpBytes(20, 1), packets[0].payload)
+		reports, err := rtcp.Unmarshal(packets[1].payload)
+		assert.Nil(t, err)
+		assert.Equal(t, []uint32{20}, reports[0].DestinationSSRC())
+	})
+	t.Run("Stops at the maximum size", func(t *testing.T) {
+		t.Parallel()
+		capture := newPacketCapture()
+		stopped := make(chan error, 1)
+		var out bytes.Buffer
+		assert.Nil(t, capture.start(&out, nil, CaptureConfig{
+			MaxSize: 200,
+			OnStop:  func(err error) { stopped <- err },
+		}))
+		packets := make([][]byte, 10)
+		for i := range packets {
+			packets[i] = rtpBytes(10, uint16(i))
+		}
+		reader, _ := bindCapture(capture, 10, packets)
+		buf := make([]byte, 1500)
+		for range packets {
+			_, _, err := reader.Read(buf, nil)
+			assert.Nil(t, err)
+		}
+		select {
+		case err := <-stopped:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("capture did not stop")
+		}
+		assert.False(t, capture.active.Load())
+		assert.Less(t, len(readPcapng(t, out.Bytes())), len(packets))
+	})
+	t.Run("Stops after the maximum duration", func(t *testing.T) {
+		t.Parallel()
+		capture := newPacketCapture()
+		stopped := make(chan error, 1)
+		assert.Nil(t, capture.start(&bytes.Buffer{}, nil, CaptureConfig{
+			MaxDuration: 10 * time.Millisecond,
+			OnStop:      func(err error) { stopped <- err },
+		}))
+		select {
+		case err := <-stopped:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("capture did not stop")
+		}
+		assert.ErrorIs(t, capture.stop(), ErrNoCapture)
+	})
+}
+
+func TestSfuPeerCapture(t *testing.T) {
+	t.Run("Runs one capture at a time", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		assert.ErrorIs(t, peer.StopCapture(), ErrNoCapture)
+		assert.Nil(t, peer.StartCapture(&bytes.Buffer{}, CaptureConfig{}))
+		assert.True(t, peer.Capturing())
+		assert.ErrorIs(t, peer.StartCapture(&bytes.Buffer{}, CaptureConfig{}), ErrCaptureActive)
+		assert.Nil(t, peer.StopCapture())
+		assert.False(t, peer.Capturing())
+	})
+	t.Run("Names the streams of the tracks it sends", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		sender, err := peer.AddTrack(newTestTrack(t, "camera"))
+		assert.Nil(t, err)
+		ssrc := uint32(sender.GetParameters().Encodings[0].SSRC)
+		assert.Equal(t, []string{"camera"}, peer.capture.streams[ssrc])
+	})
+	t.Run("Stops the capture on shutdown", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		assert.Nil(t, peer.StartCapture(&bytes.Buffer{}, CaptureConfig{}))
+		peer.Shutdown()
+		assert.False(t, peer.Capturing())
+		assert.ErrorIs(t, peer.StartCapture(&bytes.Buffer{}, CaptureConfig{}), ErrPeerClosing)
+	})
+}
@@ -0,0 +1,59 @@
+package webrtcpeer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrPeerNotFound = errors.New("peer not found")
+	ErrPeerExists   = errors.New("peer already exists")
+	ErrPeerClosing  = errors.New("peer is closing")
+	// ErrTrackOwnedByPeer is returned when a peer is asked to send a track it publishes itself.
+	ErrTrackOwnedByPeer = errors.New("track belongs to this peer")
+	// ErrTrackNotOwned is returned when a peer is asked to convert a track it does not publish.
+	ErrTrackNotOwned  = errors.New("track does not belong to this peer")
+	ErrAlreadySending = errors.New("track is already being sent")
+	ErrNotSending     = errors.New("track is not being sent")
+	ErrTrackNotFound  = errors.New("track not found")
+	ErrNotSwitchable  = errors.New("track is not switchable")
+	ErrCodecMismatch  = errors.New("codec mismatch")
+	ErrNoSenderReport = errors.New("no sender report received")
+	ErrCaptureActive  = errors.New("capture already running")
+	ErrNoCapture      = errors.New("no capture running")
+)
+
+/*
+PeerError is an error concerning a peer as a whole. It wraps one of the sentinel
+errors, such as ErrPeerNotFound or ErrPeerClosing.
+*/
+type PeerError struct {
+	PeerID string
+	Err    error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %v", e.PeerID, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+/*
+TrackError is an error concerning a track of a peer. It wraps one of the sentinel
+errors, such as ErrAlreadySending or ErrTrackNotFound.
+*/
+type TrackError struct {
+	PeerID  string
+	TrackID string
+	Err     error
+}
+
+func (e *TrackError) Error() string {
+	return fmt.Sprintf("peer %s: track %s: %v", e.PeerID, e.TrackID, e.Err)
+}
+
+func (e *TrackError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,42 @@
+package webrtcpeer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackErrors(t *testing.T) {
+	t.Run("Sending the same track twice", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		track := newTestTrack(t, "first")
+		_, err := peer.AddPeerTrack(track)
+		assert.Nil(t, err)
+		_, err = peer.AddPeerTrack(track)
+		assert.ErrorIs(t, err, ErrAlreadySending)
+		var trackErr *TrackError
+		assert.ErrorAs(t, err, &trackErr)
+		assert.Equal(t, "peer", trackErr.PeerID)
+		assert.Equal(t, "first", trackErr.TrackID)
+	})
+	t.Run("Removing a track that is not sent", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		assert.ErrorIs(t, peer.RemoveSendingTrack("missing"), ErrNotSending)
+	})
+	t.Run("Adding a track to a closing peer", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		peer.Shutdown()
+		_, err := peer.AddPeerTrack(newTestTrack(t, "first"))
+		assert.ErrorIs(t, err, ErrPeerClosing)
+	})
+	t.Run("Switching to a missing source", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		_, err := peer.AddSwitchableTrack("spotlight", "spotlight", peer, "missing")
+		assert.ErrorIs(t, err, ErrTrackNotFound)
+		assert.ErrorIs(t, peer.SwitchTrackSource("spotlight", peer, "missing"), ErrNotSwitchable)
+	})
+}
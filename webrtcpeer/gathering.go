@@ -0,0 +1,63 @@
+package webrtcpeer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultGatheringTimeout = 5 * time.Second
+
+/*
+NonTrickleICE reports whether the peer signals complete descriptions instead of trickling candidates.
+*/
+func (p *SfuPeer) NonTrickleICE() bool {
+	return p.nonTrickleICE
+}
+
+/*
+GatheringTimeout returns how long the peer waits for ICE gathering in non-trickle mode.
+*/
+func (p *SfuPeer) GatheringTimeout() time.Duration {
+	if p.gatheringTimeout == 0 {
+		return defaultGatheringTimeout
+	}
+	return p.gatheringTimeout
+}
+
+/*
+WaitForICEGatheringComplete blocks until ICE gathering of the current PeerConnection
+has completed or ctx is done. It returns immediately if gathering already completed.
+*/
+func (p *SfuPeer) WaitForICEGatheringComplete(ctx context.Context) error {
+	complete := make(chan struct{})
+	var completeOnce sync.Once
+	handlerID := p.AddOnICEGatheringStateChangeHandler(func(gatheringState webrtc.ICEGathererState) {
+		if gatheringState == webrtc.ICEGathererStateComplete {
+			completeOnce.Do(func() { close(complete) })
+		}
+	})
+	defer p.RemoveOnICEGatheringStateChangeHandler(handlerID)
+	if p.ICEGatheringState() == webrtc.ICEGatheringStateComplete {
+		return nil
+	}
+	select {
+	case <-complete:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+GatheredLocalDescription waits for ICE gathering to complete and returns the local
+description, which then carries every local candidate.
+*/
+func (p *SfuPeer) GatheredLocalDescription(ctx context.Context) (*webrtc.SessionDescription, error) {
+	if err := p.WaitForICEGatheringComplete(ctx); err != nil {
+		return nil, err
+	}
+	return p.LocalDescription(), nil
+}
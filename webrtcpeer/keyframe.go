@@ -0,0 +1,22 @@
+package webrtcpeer
+
+import (
+	"github.com/aggregator-cloud/webrtcutil/webrtccodec"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+keyframeDetector returns the function telling whether an RTP packet of the codec
+starts a keyframe, or nil for codecs without keyframes such as audio.
+*/
+func keyframeDetector(codec webrtc.RTPCodecCapability) func(packet *rtp.Packet) bool {
+	inspector, err := webrtccodec.NewInspector(codec)
+	if err != nil {
+		return nil
+	}
+	return func(packet *rtp.Packet) bool {
+		info, err := inspector.Inspect(packet)
+		return err == nil && info.Keyframe
+	}
+}
@@ -0,0 +1,201 @@
+package webrtcpeer
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultKeyframeCacheSize = 2048
+
+/*
+keyframeCache keeps the packets of a published video track since its last keyframe.
+A subscriber attached between keyframes is sent them ahead of the live packets, so
+it decodes a picture at once instead of waiting for the next keyframe.
+*/
+type keyframeCache struct {
+	mu         sync.Mutex
+	clockRate  uint32
+	isKeyframe func(packet *rtp.Packet) bool
+	maxPackets int
+	packets    []*rtp.Packet
+	// frameStart is the index of the first packet of the newest frame.
+	frameStart int
+	// synced is true once the cache starts at a keyframe.
+	synced bool
+}
+
+/*
+newKeyframeCache creates the cache of a track of the codec, or returns nil when the
+codec has no keyframes to start at.
+*/
+func newKeyframeCache(codec webrtc.RTPCodecCapability, maxPackets int) *keyframeCache {
+	isKeyframe := keyframeDetector(codec)
+	if isKeyframe == nil || maxPackets <= 0 {
+		return nil
+	}
+	return &keyframeCache{clockRate: codec.ClockRate, isKeyframe: isKeyframe, maxPackets: maxPackets}
+}
+
+/*
+push adds a packet about to be written to the track, keeping a copy of it as the
+packet may share the read buffer. A keyframe drops the packets of the frames before
+it; until the first keyframe, only the newest frame is kept, in case its keyframe
+packet is not its first. A track whose keyframes are further apart than the cache
+holds is not cached until its next keyframe.
+*/
+func (c *keyframeCache) push(packet *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.packets); n == 0 || c.packets[n-1].Timestamp != packet.Timestamp {
+		if !c.synced {
+			c.packets = c.packets[:0]
+		}
+		c.frameStart = len(c.packets)
+	}
+	if c.isKeyframe(packet) {
+		c.packets = slices.Delete(c.packets, 0, c.frameStart)
+		c.frameStart = 0
+		c.synced = true
+	}
+	if len(c.packets) >= c.maxPackets {
+		c.packets = nil
+		c.frameStart = 0
+		c.synced = false
+		return
+	}
+	c.packets = append(c.packets, packet.Clone())
+}
+
+/*
+replay returns copies of the cached packets that precede live, the first packet
+written to a new subscriber, or nothing when the cache does not lead up to it. The
+timestamps of the cached frames are moved up to just before live, a millisecond
+apart, so the subscriber decodes through them at once and plays live without the
+delay of their original spacing.
+*/
+func (c *keyframeCache) replay(live *rtp.Header) []*rtp.Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.synced {
+		return nil
+	}
+	end := slices.IndexFunc(c.packets, func(packet *rtp.Packet) bool {
+		return packet.SequenceNumber == live.SequenceNumber
+	})
+	if end <= 0 {
+		return nil
+	}
+	cached := c.packets[:end]
+	frames := 0
+	for i, packet := range cached {
+		if i == 0 || packet.Timestamp != cached[i-1].Timestamp {
+			frames++
+		}
+	}
+	if cached[end-1].Timestamp != live.Timestamp {
+		// The newest cached frame is complete; it gets a timestamp of its own too.
+		frames++
+	}
+	step := max(c.clockRate/1000, 1)
+	replayed := make([]*rtp.Packet, 0, end)
+	frame := 0
+	for i, packet := range cached {
+		if i > 0 && packet.Timestamp != cached[i-1].Timestamp {
+			frame++
+		}
+		clone := &rtp.Packet{Header: packet.Header.Clone(), Payload: packet.Payload}
+		clone.Timestamp = live.Timestamp - uint32(frames-1-frame)*step
+		replayed = append(replayed, clone)
+	}
+	return replayed
+}
+
+/*
+keyframeReplays holds, by SSRC, the caches to replay to the streams of senders
+just given a track, until each stream writes its first packet.
+*/
+type keyframeReplays struct {
+	mu      sync.Mutex
+	pending map[uint32]*keyframeCache
+	// count lets streams skip the lock once their replay is done.
+	count atomic.Int32
+}
+
+func newKeyframeReplays() *keyframeReplays {
+	return &keyframeReplays{pending: make(map[uint32]*keyframeCache)}
+}
+
+/*
+expect replays cache to the streams of sender. A nil cache replays nothing.
+*/
+func (r *keyframeReplays) expect(sender *webrtc.RTPSender, cache *keyframeCache) {
+	if cache == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, encoding := range sender.GetParameters().Encodings {
+		if _, ok := r.pending[uint32(encoding.SSRC)]; !ok {
+			r.count.Add(1)
+		}
+		r.pending[uint32(encoding.SSRC)] = cache
+	}
+}
+
+/*
+take returns the cache to replay to the stream of ssrc, once.
+*/
+func (r *keyframeReplays) take(ssrc uint32) *keyframeCache {
+	if r.count.Load() == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cache, ok := r.pending[ssrc]
+	if ok {
+		delete(r.pending, ssrc)
+		r.count.Add(-1)
+	}
+	return cache
+}
+
+/*
+keyframeReplayInterceptorFactory adds a peer's keyframe replays to the interceptors
+of each of its peer connections. It is registered after the default interceptors,
+so it is the outermost one: replayed packets go through the others like any packet
+of the track, getting transport-wide sequence numbers and kept for retransmission.
+*/
+type keyframeReplayInterceptorFactory struct {
+	replays *keyframeReplays
+}
+
+func (f *keyframeReplayInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &keyframeReplayInterceptor{replays: f.replays}, nil
+}
+
+/*
+keyframeReplayInterceptor writes the cached packets of a track ahead of the first
+packet of the track a sender stream writes.
+*/
+type keyframeReplayInterceptor struct {
+	interceptor.NoOp
+	replays *keyframeReplays
+}
+
+func (i *keyframeReplayInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		if cache := i.replays.take(info.SSRC); cache != nil {
+			for _, packet := range cache.replay(header) {
+				packet.SSRC = header.SSRC
+				packet.PayloadType = header.PayloadType
+				writer.Write(&packet.Header, packet.Payload, interceptor.Attributes{})
+			}
+		}
+		return writer.Write(header, payload, a)
+	})
+}
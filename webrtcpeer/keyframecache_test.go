@@ -0,0 +1,231 @@
+package webrtcpeer
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	vp8KeyPayload   = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+	vp8DeltaPayload = []byte{0x10, 0x01}
+	vp8ContPayload  = []byte{0x00, 0xff}
+)
+
+func vp8Packet(seq uint16, timestamp uint32, payload []byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp}, Payload: payload}
+}
+
+func newTestKeyframeCache(t *testing.T, maxPackets int) *keyframeCache {
+	t.Helper()
+	cache := newKeyframeCache(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, maxPackets)
+	if cache == nil {
+		t.Fatal("no cache for VP8")
+	}
+	return cache
+}
+
+func sequenceNumbers(packets []*rtp.Packet) []uint16 {
+	seqs := make([]uint16, len(packets))
+	for i, packet := range packets {
+		seqs[i] = packet.SequenceNumber
+	}
+	return seqs
+}
+
+func timestamps(packets []*rtp.Packet) []uint32 {
+	values := make([]uint32, len(packets))
+	for i, packet := range packets {
+		values[i] = packet.Timestamp
+	}
+	return values
+}
+
+func TestKeyframeCache(t *testing.T) {
+	t.Run("Replays the frames since the last keyframe just before live", func(t *testing.T) {
+		t.Parallel()
+		cache := newTestKeyframeCache(t, 100)
+		packets := []*rtp.Packet{
+			vp8Packet(1, 0, vp8DeltaPayload),
+			vp8Packet(2, 3000, vp8KeyPayload),
+			vp8Packet(3, 3000, vp8ContPayload),
+			vp8Packet(4, 6000, vp8DeltaPayload),
+			vp8Packet(5, 9000, vp8DeltaPayload),
+			vp8Packet(6, 9000, vp8ContPayload),
+			vp8Packet(7, 12000, vp8DeltaPayload),
+		}
+		for _, packet := range packets[:6] {
+			cache.push(packet)
+		}
+		// Joining in the middle of a frame, the frame keeps its timestamp.
+		replayed := cache.replay(&packets[5].Header)
+		assert.Equal(t, []uint16{2, 3, 4, 5}, sequenceNumbers(replayed))
+		assert.Equal(t, []uint32{9000 - 180, 9000 - 180, 9000 - 90, 9000}, timestamps(replayed))
+		assert.Equal(t, uint32(3000), packets[1].Timestamp)
+
+		cache.push(packets[6])
+		replayed = cache.replay(&packets[6].Header)
+		assert.Equal(t, []uint16{2, 3, 4, 5, 6}, sequenceNumbers(replayed))
+		assert.Equal(t, []uint32{12000 - 270, 12000 - 270, 12000 - 180, 12000 - 90, 12000 - 90}, timestamps(replayed))
+
+		// A new keyframe needs nothing replayed.
+		keyframe := vp8Packet(8, 15000, vp8KeyPayload)
+		cache.push(keyframe)
+		assert.Empty(t, cache.replay(&keyframe.Header))
+		next := vp8Packet(9, 18000, vp8DeltaPayload)
+		cache.push(next)
+		assert.Equal(t, []uint16{8}, sequenceNumbers(cache.replay(&next.Header)))
+	})
+	t.Run("Replays nothing before the first keyframe", func(t *testing.T) {
+		t.Parallel()
+		cache := newTestKeyframeCache(t, 100)
+		first := vp8Packet(1, 0, vp8DeltaPayload)
+		second := vp8Packet(2, 3000, vp8DeltaPayload)
+		cache.push(first)
+		cache.push(second)
+		assert.Empty(t, cache.replay(&second.Header))
+	})
+	t.Run("Stops caching when keyframes are too far apart", func(t *testing.T) {
+		t.Parallel()
+		cache := newTestKeyframeCache(t, 3)
+		for i, payload := range [][]byte{vp8KeyPayload, vp8DeltaPayload, vp8DeltaPayload, vp8DeltaPayload} {
+			cache.push(vp8Packet(uint16(i), uint32(i)*3000, payload))
+		}
+		live := vp8Packet(4, 12000, vp8DeltaPayload)
+		cache.push(live)
+		assert.Empty(t, cache.replay(&live.Header))
+		keyframe := vp8Packet(5, 15000, vp8KeyPayload)
+		live = vp8Packet(6, 18000, vp8DeltaPayload)
+		cache.push(keyframe)
+		cache.push(live)
+		assert.Equal(t, []uint16{5}, sequenceNumbers(cache.replay(&live.Header)))
+	})
+	t.Run("Keeps copies of the packets", func(t *testing.T) {
+		t.Parallel()
+		cache := newTestKeyframeCache(t, 100)
+		buf := append([]byte(nil), vp8KeyPayload...)
+		cache.push(vp8Packet(1, 3000, buf))
+		clear(buf)
+		live := vp8Packet(2, 6000, vp8DeltaPayload)
+		cache.push(live)
+		replayed := cache.replay(&live.Header)
+		assert.Len(t, replayed, 1)
+		assert.Equal(t, vp8KeyPayload, replayed[0].Payload)
+	})
+	t.Run("Is only kept for video codecs with keyframes", func(t *testing.T) {
+		t.Parallel()
+		assert.Nil(t, newKeyframeCache(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}, 100))
+		assert.Nil(t, newKeyframeCache(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, -1))
+	})
+}
+
+func TestKeyframeReplay(t *testing.T) {
+	t.Run("Feeds a sink attached between keyframes the cached frames first", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		track := newVP8Track(t, "camera")
+		peer.LocalTracks["camera"] = track
+		cache := newTestKeyframeCache(t, 100)
+		peer.keyframeCaches["camera"] = cache
+		publish := func(packet *rtp.Packet) {
+			cache.push(packet)
+			assert.Nil(t, track.WriteRTP(packet))
+		}
+		publish(vp8Packet(10, 3000, vp8KeyPayload))
+		publish(vp8Packet(11, 6000, vp8DeltaPayload))
+
+		sink := &captureSink{}
+		assert.Nil(t, peer.AttachTrackSink("camera", sink))
+		publish(vp8Packet(12, 9000, vp8DeltaPayload))
+		publish(vp8Packet(13, 12000, vp8DeltaPayload))
+		// Detaching waits for the sink to be fed the queued packets.
+		assert.Nil(t, peer.DetachTrackSink("camera", sink))
+		assert.Equal(t, []uint16{10, 11, 12, 13}, sequenceNumbers(sink.packets))
+		assert.Equal(t, []uint32{9000 - 180, 9000 - 90, 9000, 12000}, timestamps(sink.packets))
+	})
+	t.Run("Replays the cache of the publisher to the senders of its tracks", func(t *testing.T) {
+		t.Parallel()
+		publisher := newTestPeer(t, 0)
+		publisher.LocalTracks["camera"] = newVP8Track(t, "camera")
+		cache := newTestKeyframeCache(t, 100)
+		publisher.keyframeCaches["camera"] = cache
+		publisher.LocalTracks["screen"] = newVP8Track(t, "screen")
+		subscriber := newTestPeer(t, 0)
+
+		sender, err := subscriber.AddPublisherTrack(publisher, "camera")
+		assert.Nil(t, err)
+		assert.Same(t, cache, subscriber.replays.take(uint32(sender.GetParameters().Encodings[0].SSRC)))
+		sender, err = subscriber.AddPublisherTrack(publisher, "screen")
+		assert.Nil(t, err)
+		assert.Nil(t, subscriber.replays.take(uint32(sender.GetParameters().Encodings[0].SSRC)))
+		_, err = subscriber.AddPublisherTrack(publisher, "missing")
+		assert.ErrorIs(t, err, ErrTrackNotFound)
+	})
+	t.Run("Writes the cached frames ahead of the first packet of a sender stream", func(t *testing.T) {
+		t.Parallel()
+		cache := newTestKeyframeCache(t, 100)
+		cache.push(vp8Packet(10, 3000, vp8KeyPayload))
+		live := vp8Packet(11, 6000, vp8DeltaPayload)
+		cache.push(live)
+
+		replays := newKeyframeReplays()
+		replays.pending[1234] = cache
+		replays.count.Add(1)
+		factory := &keyframeReplayInterceptorFactory{replays: replays}
+		i, err := factory.NewInterceptor("")
+		assert.Nil(t, err)
+		var written []rtp.Header
+		writer := i.BindLocalStream(&interceptor.StreamInfo{SSRC: 1234}, interceptor.RTPWriterFunc(
+			func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+				written = append(written, *header)
+				return len(payload), nil
+			}))
+		header := live.Header
+		header.SSRC, header.PayloadType = 1234, 96
+		_, err = writer.Write(&header, live.Payload, nil)
+		assert.Nil(t, err)
+		next := header
+		next.SequenceNumber, next.Timestamp = 12, 9000
+		_, err = writer.Write(&next, live.Payload, nil)
+		assert.Nil(t, err)
+
+		assert.Len(t, written, 3)
+		assert.Equal(t, rtp.Header{Version: 2, SequenceNumber: 10, Timestamp: 6000 - 90, SSRC: 1234, PayloadType: 96}, written[0])
+		assert.Equal(t, []uint16{10, 11, 12}, []uint16{written[0].SequenceNumber, written[1].SequenceNumber, written[2].SequenceNumber})
+		assert.Nil(t, replays.take(1234))
+	})
+}
+
+func TestKeyframeDetector(t *testing.T) {
+	cases := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		keyframe bool
+	}{
+		{"VP8 keyframe", webrtc.MimeTypeVP8, vp8KeyPayload, true},
+		{"VP8 keyframe with picture ID", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x02, 0x00}, true},
+		{"VP8 delta frame", webrtc.MimeTypeVP8, vp8DeltaPayload, false},
+		{"VP8 continuation", webrtc.MimeTypeVP8, vp8ContPayload, false},
+		{"VP9 keyframe", webrtc.MimeTypeVP9, []byte{0x08, 0x80}, true},
+		{"VP9 inter frame", webrtc.MimeTypeVP9, []byte{0x48, 0x80}, false},
+		{"H.264 IDR", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"H.264 STAP-A with SPS", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"H.264 STAP-A without SPS", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x06, 0x05, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"H.264 FU-A start of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"H.264 FU-A middle of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"H.264 non-IDR slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"AV1 new coded video sequence", webrtc.MimeTypeAV1, []byte{0x18, 0x0a}, true},
+		{"AV1 frame", webrtc.MimeTypeAV1, []byte{0x10, 0x32}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			isKeyframe := keyframeDetector(webrtc.RTPCodecCapability{MimeType: c.mimeType})
+			assert.Equal(t, c.keyframe, isKeyframe(&rtp.Packet{Payload: c.payload}))
+		})
+	}
+	assert.Nil(t, keyframeDetector(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}))
+}
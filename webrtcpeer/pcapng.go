@@ -0,0 +1,135 @@
+package webrtcpeer
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 1
+	pcapngEnhancedPacketBlock       = 6
+	pcapngByteOrderMagic            = 0x1a2b3c4d
+	// pcapngLinkTypeRaw carries packets starting with their IP header.
+	pcapngLinkTypeRaw = 101
+	pcapngOptionEnd   = 0
+	pcapngOptionFlags = 2
+	// pcapngFlagsInbound and pcapngFlagsOutbound are the packet directions of epb_flags.
+	pcapngFlagsInbound  = 1
+	pcapngFlagsOutbound = 2
+
+	ipv4HeaderSize = 20
+	udpHeaderSize  = 8
+	// captureRTPPort is the UDP port of both ends of a capture, as RTP and RTCP are multiplexed.
+	captureRTPPort = 5004
+)
+
+// The peer and the SFU end of a capture, from the documentation address ranges.
+var (
+	captureRemoteAddress = [4]byte{192, 0, 2, 1}
+	captureLocalAddress  = [4]byte{198, 51, 100, 1}
+)
+
+/*
+pcapngWriter writes packets to a pcapng file, each in a synthetic IPv4 and UDP
+header between the remote peer and the SFU, with its direction in the packet flags.
+*/
+type pcapngWriter struct {
+	out  io.Writer
+	size int64
+}
+
+func newPcapngWriter(out io.Writer) (*pcapngWriter, error) {
+	w := &pcapngWriter{out: out}
+	header := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	// The section length is not known up front.
+	header = binary.LittleEndian.AppendUint64(header, 0xffffffffffffffff)
+	if err := w.writeBlock(pcapngSectionHeaderBlock, header); err != nil {
+		return nil, err
+	}
+	description := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+	description = binary.LittleEndian.AppendUint16(description, 0)
+	description = binary.LittleEndian.AppendUint32(description, 0)
+	if err := w.writeBlock(pcapngInterfaceDescriptionBlock, description); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+/*
+writePacket writes a UDP payload sent or received at t, with microsecond precision.
+*/
+func (w *pcapngWriter) writePacket(t time.Time, inbound bool, payload []byte) error {
+	packet := udpPacket(inbound, payload)
+	micros := uint64(t.UnixMicro())
+	body := binary.LittleEndian.AppendUint32(nil, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = append(body, packet...)
+	body = append(body, make([]byte, padding(len(packet)))...)
+	flags := uint32(pcapngFlagsOutbound)
+	if inbound {
+		flags = pcapngFlagsInbound
+	}
+	body = binary.LittleEndian.AppendUint16(body, pcapngOptionFlags)
+	body = binary.LittleEndian.AppendUint16(body, 4)
+	body = binary.LittleEndian.AppendUint32(body, flags)
+	body = binary.LittleEndian.AppendUint32(body, pcapngOptionEnd)
+	return w.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+func (w *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	n, err := w.out.Write(block)
+	w.size += int64(n)
+	return err
+}
+
+func padding(length int) int {
+	return (4 - length%4) % 4
+}
+
+/*
+udpPacket wraps payload in the IPv4 and UDP headers of a packet from the remote peer
+to the SFU when inbound and back otherwise.
+*/
+func udpPacket(inbound bool, payload []byte) []byte {
+	source, destination := captureLocalAddress, captureRemoteAddress
+	if inbound {
+		source, destination = captureRemoteAddress, captureLocalAddress
+	}
+	packet := make([]byte, ipv4HeaderSize+udpHeaderSize, ipv4HeaderSize+udpHeaderSize+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)+len(payload)))
+	packet[6] = 0x40
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:], source[:])
+	copy(packet[16:], destination[:])
+	binary.BigEndian.PutUint16(packet[10:], ipv4Checksum(packet[:ipv4HeaderSize]))
+	// The UDP checksum is optional over IPv4 and left out.
+	binary.BigEndian.PutUint16(packet[20:], captureRTPPort)
+	binary.BigEndian.PutUint16(packet[22:], captureRTPPort)
+	binary.BigEndian.PutUint16(packet[24:], uint16(udpHeaderSize+len(payload)))
+	return append(packet, payload...)
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
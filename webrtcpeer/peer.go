@@ -1,29 +1,63 @@
 package webrtcpeer
 
 import (
-	"fmt"
+	"errors"
+	"maps"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
 	"github.com/google/uuid"
+	"github.com/pion/interceptor"
 	"github.com/pion/logging"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
+type SfuPeerConfig struct {
+	ID         string
+	PeerConfig *webrtc.Configuration
+	// LoggerFactory is used for the peer's own logs and for the underlying pion
+	// PeerConnection. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+	// NonTrickleICE makes the peer signal complete descriptions: local descriptions are
+	// only sent once ICE gathering has completed and candidates are not trickled.
+	NonTrickleICE bool
+	// GatheringTimeout bounds the wait for ICE gathering in non-trickle mode.
+	// Defaults to 5 seconds.
+	GatheringTimeout time.Duration
+	// MaxIdleTransceivers caps the sender transceivers per kind kept for reuse after
+	// their track is removed. Tracks removed beyond the cap stop their sender as
+	// pion does, which recycles the transceiver once it is negotiated inactive.
+	// Defaults to 8; a negative value disables reuse.
+	MaxIdleTransceivers int
+	// KeyframeCacheSize caps the packets kept per published video track since its
+	// last keyframe, which are sent to a subscriber added with AddPublisherTrack or a
+	// sink attached between keyframes so it shows video at once. Tracks whose keyframes are further apart are not cached.
+	// Defaults to 2048; a negative value disables the cache.
+	KeyframeCacheSize int
+}
+
 type SfuPeer struct {
 	*webrtc.PeerConnection
-	id string
-	// Conn       *websocket.Conn
+	id         string
+	api        *webrtc.API
+	capture    *packetCapture
+	replays    *keyframeReplays
 	PeerConfig *webrtc.Configuration
 	// state 1 active, 0 closing
-	state int
+	state atomic.Int32
 	// TrackMap maps remote track IDs to local track IDs
-	TrackMap                           map[string]string
-	TrackMapMu                         sync.Mutex
-	LocalTracks                        map[string]*webrtc.TrackLocalStaticRTP
-	LocalTracksMu                      sync.Mutex
+	TrackMap      map[string]string
+	TrackMapMu    sync.Mutex
+	LocalTracks   map[string]*webrtc.TrackLocalStaticRTP
+	LocalTracksMu sync.Mutex
+	// keyframeCaches holds, under LocalTracksMu, the keyframe cache of each local
+	// track converted from a remote video track.
+	keyframeCaches                     map[string]*keyframeCache
 	Negotiating                        bool
 	OnConnectionStateChangeHandlers    map[string]func(connectionState webrtc.PeerConnectionState)
 	OnDataChannelHandlers              map[string]func(dataChannel *webrtc.DataChannel)
@@ -34,24 +68,67 @@ type SfuPeer struct {
 	OnSignalingStateChangeHandlers     map[string]func(signalingState webrtc.SignalingState)
 	OnTrackHandlers                    map[string]func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
 	OnLocalTrackHandlers               map[string]func(localTrack *webrtc.TrackLocalStaticRTP)
+	OnRecreateHandlers                 map[string]func(peerConnection *webrtc.PeerConnection)
+	handlersMu                         sync.RWMutex
+	nonTrickleICE                      bool
+	gatheringTimeout                   time.Duration
+	idleTransceivers                   map[webrtc.RTPCodecType][]idleTransceiver
+	maxIdleTransceivers                int
+	keyframeCacheSize                  int
+	transceiversMu                     sync.Mutex
+	switchableTracks                   map[string]*SwitchableTrack
+	switchableTracksMu                 sync.Mutex
+	senderReports                      map[uint32]SenderReport
+	senderReportsMu                    sync.Mutex
+	trackSinks                         map[string][]*sinkTap
+	trackSinksMu                       sync.Mutex
+	openTrackChanges                   int
+	negotiationHeld                    bool
+	trackChangesMu                     sync.Mutex
+	loggerFactory                      logging.LoggerFactory
 	log                                logging.LeveledLogger
 }
 
 func NewSfuPeer(id string, PeerConfig *webrtc.Configuration) (*SfuPeer, error) {
-	peer, err := webrtc.NewPeerConnection(*PeerConfig)
+	return NewSfuPeerWithConfig(SfuPeerConfig{
+		ID:         id,
+		PeerConfig: PeerConfig,
+	})
+}
+
+/*
+NewSfuPeerWithConfig creates a new SfuPeer whose PeerConnection is built from an API
+carrying the configured logger factory.
+*/
+func NewSfuPeerWithConfig(config SfuPeerConfig) (*SfuPeer, error) {
+	loggerFactory := config.LoggerFactory
+	if loggerFactory == nil {
+		loggerFactory = webrtclog.DefaultLoggerFactory()
+	}
+	capture := newPacketCapture()
+	replays := newKeyframeReplays()
+	api, err := newAPI(loggerFactory, capture, replays)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := api.NewPeerConnection(*config.PeerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SfuPeer{
-		PeerConnection: peer,
-		id:             id,
-		// Conn:                               conn,
-		PeerConfig:                         PeerConfig,
+	id := config.ID
+	p := &SfuPeer{
+		PeerConnection:                     peer,
+		id:                                 id,
+		api:                                api,
+		capture:                            capture,
+		replays:                            replays,
+		PeerConfig:                         config.PeerConfig,
 		TrackMap:                           make(map[string]string),
 		TrackMapMu:                         sync.Mutex{},
 		LocalTracks:                        make(map[string]*webrtc.TrackLocalStaticRTP),
 		LocalTracksMu:                      sync.Mutex{},
+		keyframeCaches:                     make(map[string]*keyframeCache),
 		OnConnectionStateChangeHandlers:    make(map[string]func(connectionState webrtc.PeerConnectionState)),
 		OnDataChannelHandlers:              make(map[string]func(dataChannel *webrtc.DataChannel)),
 		OnICECandidateHandlers:             make(map[string]func(candidate *webrtc.ICECandidate)),
@@ -61,165 +138,232 @@ func NewSfuPeer(id string, PeerConfig *webrtc.Configuration) (*SfuPeer, error) {
 		OnSignalingStateChangeHandlers:     make(map[string]func(signalingState webrtc.SignalingState)),
 		OnTrackHandlers:                    make(map[string]func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)),
 		OnLocalTrackHandlers:               make(map[string]func(localTrack *webrtc.TrackLocalStaticRTP)),
-		log:                                logging.NewDefaultLoggerFactory().NewLogger("sfu-peer-" + id),
-		state:                              1,
-	}, nil
+		OnRecreateHandlers:                 make(map[string]func(peerConnection *webrtc.PeerConnection)),
+		nonTrickleICE:                      config.NonTrickleICE,
+		gatheringTimeout:                   config.GatheringTimeout,
+		idleTransceivers:                   make(map[webrtc.RTPCodecType][]idleTransceiver),
+		maxIdleTransceivers:                config.MaxIdleTransceivers,
+		keyframeCacheSize:                  config.KeyframeCacheSize,
+		switchableTracks:                   make(map[string]*SwitchableTrack),
+		senderReports:                      make(map[uint32]SenderReport),
+		trackSinks:                         make(map[string][]*sinkTap),
+		loggerFactory:                      loggerFactory,
+		log:                                webrtclog.NewLogger(loggerFactory, "sfu-peer", "peer_id", id),
+	}
+	if p.maxIdleTransceivers == 0 {
+		p.maxIdleTransceivers = defaultMaxIdleTransceivers
+	}
+	if p.keyframeCacheSize == 0 {
+		p.keyframeCacheSize = defaultKeyframeCacheSize
+	}
+	p.state.Store(1)
+	p.InitializePeerConnection()
+	return p, nil
+}
+
+/*
+newAPI mirrors webrtc.NewPeerConnection: default codecs and interceptors, plus the logger factory,
+the peer's packet capture and its keyframe replays.
+*/
+func newAPI(loggerFactory logging.LoggerFactory, capture *packetCapture, replays *keyframeReplays) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	i.Add(&captureInterceptorFactory{capture: capture})
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	i.Add(&keyframeReplayInterceptorFactory{replays: replays})
+	s := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
 }
 
 func (p *SfuPeer) ID() string {
 	return p.id
 }
 
+/*
+LoggerFactory returns the logger factory the peer was created with.
+*/
+func (p *SfuPeer) LoggerFactory() logging.LoggerFactory {
+	return p.loggerFactory
+}
+
 func (p *SfuPeer) RecreatePeerConnection() (*webrtc.PeerConnection, error) {
-	peer, err := webrtc.NewPeerConnection(*p.PeerConfig)
+	peer, err := p.api.NewPeerConnection(*p.PeerConfig)
 	if err != nil {
 		return nil, err
 	}
 	p.PeerConnection = peer
+	p.clearIdleTransceivers()
+	p.closeSwitchableTracks()
 	p.InitializePeerConnection()
+	for _, handler := range snapshotHandlers(p, p.OnRecreateHandlers) {
+		handler(peer)
+	}
 	return peer, nil
 }
 
 func (p *SfuPeer) InitializePeerConnection() {
 
 	p.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
-		for _, handler := range p.OnConnectionStateChangeHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnConnectionStateChangeHandlers) {
 			handler(connectionState)
 		}
 	})
 
 	p.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
-		for _, handler := range p.OnDataChannelHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnDataChannelHandlers) {
 			handler(dataChannel)
 		}
 	})
 
 	p.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		for _, handler := range p.OnICECandidateHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnICECandidateHandlers) {
 			handler(candidate)
 		}
 	})
 
 	p.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		for _, handler := range p.OnICEConnectionStateChangeHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnICEConnectionStateChangeHandlers) {
 			handler(connectionState)
 		}
 	})
 
 	p.OnICEGatheringStateChange(func(gatheringState webrtc.ICEGathererState) {
-		for _, handler := range p.OnICEGatheringStateChangeHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnICEGatheringStateChangeHandlers) {
 			handler(gatheringState)
 		}
 	})
 
 	p.OnNegotiationNeeded(func() {
-		for _, handler := range p.OnNegotiationNeededHandlers {
-			handler()
+		if !p.holdNegotiation() {
+			p.fireNegotiationNeeded()
 		}
 	})
 
 	p.OnSignalingStateChange(func(signalingState webrtc.SignalingState) {
-		for _, handler := range p.OnSignalingStateChangeHandlers {
+		for _, handler := range snapshotHandlers(p, p.OnSignalingStateChangeHandlers) {
 			handler(signalingState)
 		}
 	})
 
 	p.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		for _, handler := range p.OnTrackHandlers {
+		go p.readRTCP(receiver)
+		p.capture.nameStream(uint32(remoteTrack.SSRC()), remoteTrack.ID())
+		for _, handler := range snapshotHandlers(p, p.OnTrackHandlers) {
 			handler(remoteTrack, receiver)
 		}
 	})
 
 }
 
-func (p *SfuPeer) AddOnConnectionStateChangeHandler(handler func(connectionState webrtc.PeerConnectionState)) string {
+/*
+addHandler registers a handler in one of the peer's handler maps and returns its ID.
+*/
+func addHandler[H any](p *SfuPeer, handlers map[string]H, handler H) string {
 	id := uuid.New().String()
-	p.OnConnectionStateChangeHandlers[id] = handler
+	p.handlersMu.Lock()
+	handlers[id] = handler
+	p.handlersMu.Unlock()
 	return id
 }
 
+func removeHandler[H any](p *SfuPeer, handlers map[string]H, id string) {
+	p.handlersMu.Lock()
+	delete(handlers, id)
+	p.handlersMu.Unlock()
+}
+
+/*
+snapshotHandlers copies a handler map so handlers can run, and add or remove handlers, without holding the lock.
+*/
+func snapshotHandlers[H any](p *SfuPeer, handlers map[string]H) []H {
+	p.handlersMu.RLock()
+	defer p.handlersMu.RUnlock()
+	return slices.Collect(maps.Values(handlers))
+}
+
+func (p *SfuPeer) AddOnConnectionStateChangeHandler(handler func(connectionState webrtc.PeerConnectionState)) string {
+	return addHandler(p, p.OnConnectionStateChangeHandlers, handler)
+}
+
 func (p *SfuPeer) RemoveOnConnectionStateChangeHandler(id string) {
-	delete(p.OnConnectionStateChangeHandlers, id)
+	removeHandler(p, p.OnConnectionStateChangeHandlers, id)
 }
 
 func (p *SfuPeer) AddOnDataChannelHandler(handler func(dataChannel *webrtc.DataChannel)) string {
-	id := uuid.New().String()
-	p.OnDataChannelHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnDataChannelHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnDataChannelHandler(id string) {
-	delete(p.OnDataChannelHandlers, id)
+	removeHandler(p, p.OnDataChannelHandlers, id)
 }
 
 func (p *SfuPeer) AddOnICECandidateHandler(handler func(candidate *webrtc.ICECandidate)) string {
-	id := uuid.New().String()
-	p.OnICECandidateHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnICECandidateHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnICECandidateHandler(id string) {
-	delete(p.OnICECandidateHandlers, id)
+	removeHandler(p, p.OnICECandidateHandlers, id)
 }
 
 func (p *SfuPeer) AddOnICEConnectionStateChangeHandler(handler func(connectionState webrtc.ICEConnectionState)) string {
-	id := uuid.New().String()
-	p.OnICEConnectionStateChangeHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnICEConnectionStateChangeHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnICEConnectionStateChangeHandler(id string) {
-	delete(p.OnICEConnectionStateChangeHandlers, id)
+	removeHandler(p, p.OnICEConnectionStateChangeHandlers, id)
 }
 
 func (p *SfuPeer) AddOnICEGatheringStateChangeHandler(handler func(gatheringState webrtc.ICEGathererState)) string {
-	id := uuid.New().String()
-	p.OnICEGatheringStateChangeHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnICEGatheringStateChangeHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnICEGatheringStateChangeHandler(id string) {
-	delete(p.OnICEGatheringStateChangeHandlers, id)
+	removeHandler(p, p.OnICEGatheringStateChangeHandlers, id)
 }
 
 func (p *SfuPeer) AddOnNegotiationNeededHandler(handler func()) string {
-	id := uuid.New().String()
-	p.OnNegotiationNeededHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnNegotiationNeededHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnNegotiationNeededHandler(id string) {
-	delete(p.OnNegotiationNeededHandlers, id)
+	removeHandler(p, p.OnNegotiationNeededHandlers, id)
 }
 
 func (p *SfuPeer) AddOnSignalingStateChangeHandler(handler func(signalingState webrtc.SignalingState)) string {
-	id := uuid.New().String()
-	p.OnSignalingStateChangeHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnSignalingStateChangeHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnSignalingStateChangeHandler(id string) {
-	delete(p.OnSignalingStateChangeHandlers, id)
+	removeHandler(p, p.OnSignalingStateChangeHandlers, id)
 }
 
 func (p *SfuPeer) AddOnTrackHandler(handler func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)) string {
-	id := uuid.New().String()
-	p.OnTrackHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnTrackHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnTrackHandler(id string) {
-	delete(p.OnTrackHandlers, id)
+	removeHandler(p, p.OnTrackHandlers, id)
 }
 
 func (p *SfuPeer) AddOnLocalTrackHandler(handler func(localTrack *webrtc.TrackLocalStaticRTP)) string {
-	id := uuid.New().String()
-	p.OnLocalTrackHandlers[id] = handler
-	return id
+	return addHandler(p, p.OnLocalTrackHandlers, handler)
 }
 
 func (p *SfuPeer) RemoveOnLocalTrackHandler(id string) {
-	delete(p.OnLocalTrackHandlers, id)
+	removeHandler(p, p.OnLocalTrackHandlers, id)
+}
+
+func (p *SfuPeer) AddOnRecreateHandler(handler func(peerConnection *webrtc.PeerConnection)) string {
+	return addHandler(p, p.OnRecreateHandlers, handler)
+}
+
+func (p *SfuPeer) RemoveOnRecreateHandler(id string) {
+	removeHandler(p, p.OnRecreateHandlers, id)
 }
 
 func (p *SfuPeer) GetMyTrackIDs() []string {
@@ -272,14 +416,14 @@ func (p *SfuPeer) RemoveSendingTrack(trackID string) error {
 			return nil
 		}
 	}
-	return fmt.Errorf("track %s is not being sent by this peer", trackID)
+	return &TrackError{PeerID: p.id, TrackID: trackID, Err: ErrNotSending}
 }
 
 func (p *SfuPeer) GetLocalTrackID(remoteTrackID string) string {
 	return remoteTrackID + "::" + uuid.New().String()
 }
 
-/* Takes a remote track and converts it to a local track. Renegotiation for all peers should be fired following this. */
+/* Takes a remote track and converts it to a local track. Renegotiation for all peers should be fired following this; adding it to a peer inside BeginTrackChanges batches it with the peer's other changes. */
 func (p *SfuPeer) ConvertRemoteTrackToLocalTrack(remoteTrack *webrtc.TrackRemote) (*webrtc.TrackLocalStaticRTP, error) {
 
 	remoteTrackID := remoteTrack.ID()
@@ -287,47 +431,65 @@ func (p *SfuPeer) ConvertRemoteTrackToLocalTrack(remoteTrack *webrtc.TrackRemote
 	p.TrackMapMu.Lock()
 	p.TrackMap[remoteTrackID] = localTrackID
 	p.TrackMapMu.Unlock()
+	log := webrtclog.With(p.log, "remote_track_id", remoteTrackID, "local_track_id", localTrackID)
 	if !p.IsMyTrack(remoteTrackID) {
-		p.log.Warnf("This track does not belong to this peer %s", remoteTrackID)
-		return nil, fmt.Errorf("this track does not belong to this peer %s", remoteTrackID)
+		log.Warnf("This track does not belong to this peer %s", remoteTrackID)
+		return nil, &TrackError{PeerID: p.id, TrackID: remoteTrackID, Err: ErrTrackNotOwned}
 	}
 
 	codecCap := remoteTrack.Codec().RTPCodecCapability
 	codecCap.RTCPFeedback = nil // Clear RTCP feedback to avoid compatibility issues
 	localTrack, err := webrtc.NewTrackLocalStaticRTP(codecCap, localTrackID, p.id)
+	p.capture.nameStream(uint32(remoteTrack.SSRC()), remoteTrackID, localTrackID)
+	cache := newKeyframeCache(codecCap, p.keyframeCacheSize)
 
 	p.LocalTracksMu.Lock()
 	p.LocalTracks[localTrackID] = localTrack
+	if cache != nil {
+		p.keyframeCaches[localTrackID] = cache
+	}
 	p.LocalTracksMu.Unlock()
 
 	// Start copying packets from the remote track to the local track
 	go func(remoteTrack *webrtc.TrackRemote, localTrack *webrtc.TrackLocalStaticRTP) {
+		defer p.closeTrackSinks(localTrackID)
+		defer p.removeKeyframeCache(localTrackID, cache)
 		rtpBuf := make([]byte, 1500)
-		p.log.Infof("Copying packets from remote track [%s] to local track [%s]", remoteTrackID, localTrackID)
+		log.Infof("Copying packets from remote track [%s] to local track [%s]", remoteTrackID, localTrackID)
 		for {
-			if p.state == 0 {
+			if p.state.Load() == 0 {
 				return
 			}
 			i, _, err := remoteTrack.Read(rtpBuf)
 			if err != nil {
-				p.log.Errorf(" Error reading from remote track: %s", err)
+				log.Errorf("Error reading from remote track: %s", err)
 				return
 			}
 
-			// Remove debug logging and immediately write to local track
-			if _, err = localTrack.Write(rtpBuf[:i]); err != nil {
-				p.log.Errorf(" Error writing to local track: %s", err)
+			packet := &rtp.Packet{}
+			if err := packet.Unmarshal(rtpBuf[:i]); err != nil {
+				log.Errorf("Error parsing packet of remote track: %s", err)
+				return
+			}
+			if cache != nil {
+				cache.push(packet)
+			}
+			if err = localTrack.WriteRTP(packet); err != nil {
+				log.Errorf("Error writing to local track: %s", err)
 				return
 			}
 		}
 	}(remoteTrack, localTrack)
 
-	// TODO: Blindly sending keyframes helps connect a late viewer but it's not a good long term solution
+	// Late subscribers and sinks get a keyframe from the keyframe cache, but the
+	// periodic PLI is still needed: the PLIs of subscribers are not forwarded, so it
+	// is what recovers them from packet loss, and it covers tracks the cache does not
+	// hold, such as tracks whose keyframes are further apart than its size.
 	go func() {
 		for {
 			time.Sleep(time.Second * 3)
-			if p.state == 0 {
-				p.log.Infof("Peer %s is closing, stopping PLI", p.id)
+			if p.state.Load() == 0 {
+				log.Infof("Peer %s is closing, stopping PLI", p.id)
 				return
 			}
 			err := p.WriteRTCP([]rtcp.Packet{
@@ -336,13 +498,13 @@ func (p *SfuPeer) ConvertRemoteTrackToLocalTrack(remoteTrack *webrtc.TrackRemote
 				},
 			})
 			if err != nil {
-				p.log.Errorf("Error sending PLI: %v", err)
+				log.Errorf("Error sending PLI: %v", err)
 				return
 			}
 		}
 	}()
 
-	for _, handler := range p.OnLocalTrackHandlers {
+	for _, handler := range snapshotHandlers(p, p.OnLocalTrackHandlers) {
 		handler(localTrack)
 	}
 
@@ -352,6 +514,7 @@ func (p *SfuPeer) ConvertRemoteTrackToLocalTrack(remoteTrack *webrtc.TrackRemote
 func (p *SfuPeer) RemoveLocalTrack(remoteTrackID string) {
 	p.LocalTracksMu.Lock()
 	delete(p.LocalTracks, remoteTrackID)
+	delete(p.keyframeCaches, remoteTrackID)
 	p.LocalTracksMu.Unlock()
 	p.TrackMapMu.Lock()
 	delete(p.TrackMap, remoteTrackID)
@@ -359,59 +522,120 @@ func (p *SfuPeer) RemoveLocalTrack(remoteTrackID string) {
 }
 
 func (p *SfuPeer) AddPeerTrack(track *webrtc.TrackLocalStaticRTP) (*webrtc.RTPSender, error) {
-	if p.state == 0 {
-		return nil, fmt.Errorf("peer is closing")
+	if p.state.Load() == 0 {
+		return nil, &PeerError{PeerID: p.id, Err: ErrPeerClosing}
 	}
 	trackID := track.ID()
 	if p.IsMyTrack(trackID) {
-		p.log.Warnf("This track belongs to this peer %s", trackID)
-		return nil, fmt.Errorf("this track belongs to this peer %s", trackID)
+		webrtclog.With(p.log, "track_id", trackID).Warnf("This track belongs to this peer %s", trackID)
+		return nil, &TrackError{PeerID: p.id, TrackID: trackID, Err: ErrTrackOwnedByPeer}
 	}
 	if p.IsAlreadySendingTrack(trackID) {
-		p.log.Warnf("This track is already being sent by this peer %s", trackID)
-		return nil, fmt.Errorf("this track is already being sent by this peer %s", trackID)
+		webrtclog.With(p.log, "track_id", trackID).Warnf("This track is already being sent by this peer %s", trackID)
+		return nil, &TrackError{PeerID: p.id, TrackID: trackID, Err: ErrAlreadySending}
 	}
 	return p.AddTrack(track)
 }
 
 func (p *SfuPeer) Shutdown() {
-	p.state = 0
+	p.state.Store(0)
 	p.TrackMapMu.Lock()
-	defer p.TrackMapMu.Unlock()
-	for _, localTrackID := range p.TrackMap {
+	localTrackIDs := slices.Collect(maps.Values(p.TrackMap))
+	clear(p.TrackMap)
+	p.TrackMapMu.Unlock()
+	for _, localTrackID := range localTrackIDs {
 		p.RemoveLocalTrack(localTrackID)
 	}
+	p.clearIdleTransceivers()
+	p.closeSwitchableTracks()
+	p.closeAllTrackSinks()
+	if err := p.capture.stop(); err != nil && !errors.Is(err, ErrNoCapture) {
+		p.log.Warnf("Error stopping capture: %v", err)
+	}
 	p.Close()
 }
 
+/*
+AddPublisherTrack adds the local track localTrackID of publisher like AddPeerTrack.
+A video track the publisher converted from a remote track first sends the packets
+since its last keyframe, so the subscriber shows video at once.
+*/
+func (p *SfuPeer) AddPublisherTrack(publisher *SfuPeer, localTrackID string) (*webrtc.RTPSender, error) {
+	publisher.LocalTracksMu.Lock()
+	track := publisher.LocalTracks[localTrackID]
+	cache := publisher.keyframeCaches[localTrackID]
+	publisher.LocalTracksMu.Unlock()
+	if track == nil {
+		return nil, &TrackError{PeerID: publisher.id, TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	sender, err := p.AddPeerTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	p.replays.expect(sender, cache)
+	return sender, nil
+}
+
+/*
+keyframeCache returns the keyframe cache of the local track localTrackID, or nil
+when it has none.
+*/
+func (p *SfuPeer) keyframeCache(localTrackID string) *keyframeCache {
+	p.LocalTracksMu.Lock()
+	defer p.LocalTracksMu.Unlock()
+	return p.keyframeCaches[localTrackID]
+}
+
+/*
+removeKeyframeCache forgets cache once its track is no longer written, unless the
+local track ID was given another one since.
+*/
+func (p *SfuPeer) removeKeyframeCache(localTrackID string, cache *keyframeCache) {
+	p.LocalTracksMu.Lock()
+	defer p.LocalTracksMu.Unlock()
+	if cache != nil && p.keyframeCaches[localTrackID] == cache {
+		delete(p.keyframeCaches, localTrackID)
+	}
+}
+
 func (p *SfuPeer) AddTrack(track *webrtc.TrackLocalStaticRTP) (*webrtc.RTPSender, error) {
-	if p.state == 0 {
-		return nil, fmt.Errorf("peer is closing")
+	if p.state.Load() == 0 {
+		return nil, &PeerError{PeerID: p.id, Err: ErrPeerClosing}
 	}
 	trackID := track.ID()
 	if p.IsMyTrack(trackID) {
-		p.log.Warnf("This track belongs to this peer %s", trackID)
-		return nil, fmt.Errorf("this track belongs to this peer %s", trackID)
+		webrtclog.With(p.log, "track_id", trackID).Warnf("This track belongs to this peer %s", trackID)
+		return nil, &TrackError{PeerID: p.id, TrackID: trackID, Err: ErrTrackOwnedByPeer}
 	}
 	if p.IsAlreadySendingTrack(trackID) {
-		p.log.Warnf("This track is already being sent by this peer %s", trackID)
-		return nil, fmt.Errorf("this track is already being sent by this peer %s", trackID)
+		webrtclog.With(p.log, "track_id", trackID).Warnf("This track is already being sent by this peer %s", trackID)
+		return nil, &TrackError{PeerID: p.id, TrackID: trackID, Err: ErrAlreadySending}
 	}
-	// p.Conn.WriteJSON(map[string]interface{}{
-	// 	"type": "track_added",
-	// 	"id":   trackID,
-	// })
-	return p.AddTrack(track)
+	sender, err := p.reuseTransceiver(track)
+	if err != nil {
+		webrtclog.With(p.log, "track_id", trackID).Warnf("Error reusing transceiver: %v", err)
+	}
+	if sender == nil {
+		if sender, err = p.PeerConnection.AddTrack(track); err != nil {
+			return nil, err
+		}
+	}
+	p.capture.nameSenderStreams(sender, trackID)
+	return sender, nil
 }
 
 func (p *SfuPeer) RemoveTrack(track *webrtc.TrackLocalStaticRTP) error {
-	if p.state == 0 {
-		return fmt.Errorf("peer is closing")
-	}
-	// trackID := track.ID()
-	// p.Conn.WriteJSON(map[string]interface{}{
-	// 	"type": "track_removed",
-	// 	"id":   trackID,
-	// })
-	return p.RemoveTrack(track)
+	if p.state.Load() == 0 {
+		return &PeerError{PeerID: p.id, Err: ErrPeerClosing}
+	}
+	for _, sender := range p.GetSenders() {
+		if sender.Track() != track {
+			continue
+		}
+		if parked, err := p.parkSender(sender); parked || err != nil {
+			return err
+		}
+		return p.PeerConnection.RemoveTrack(sender)
+	}
+	return &TrackError{PeerID: p.id, TrackID: track.ID(), Err: ErrNotSending}
 }
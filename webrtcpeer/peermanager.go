@@ -1,7 +1,6 @@
 package webrtcpeer
 
 import (
-	"errors"
 	"maps"
 	"sync"
 
@@ -24,12 +23,21 @@ func NewPeerManager() *PeerManager[PeerLike] {
 	}
 }
 
+/*
+NewSfuPeerManager creates a PeerManager holding SfuPeers.
+*/
+func NewSfuPeerManager() *PeerManager[*SfuPeer] {
+	return &PeerManager[*SfuPeer]{
+		peers: make(map[string]*SfuPeer),
+	}
+}
+
 func (pm *PeerManager[T]) AddPeer(peer T) (*T, error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	peerID := peer.ID()
 	if _, ok := pm.peers[peerID]; ok {
-		return nil, errors.New("peer already exists")
+		return nil, &PeerError{PeerID: peerID, Err: ErrPeerExists}
 	}
 	pm.peers[peerID] = peer
 	return &peer, nil
@@ -39,7 +47,7 @@ func (pm *PeerManager[T]) RemovePeer(peer T) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	if _, ok := pm.peers[peer.ID()]; !ok {
-		return errors.New("peer not found")
+		return &PeerError{PeerID: peer.ID(), Err: ErrPeerNotFound}
 	}
 	delete(pm.peers, peer.ID())
 	return nil
@@ -50,7 +58,7 @@ func (pm *PeerManager[T]) GetPeer(id string) (*T, error) {
 	defer pm.mu.Unlock()
 	peer, ok := pm.peers[id]
 	if !ok {
-		return nil, errors.New("peer not found")
+		return nil, &PeerError{PeerID: id, Err: ErrPeerNotFound}
 	}
 	return &peer, nil
 }
@@ -54,7 +54,22 @@ func TestPeerManager(t *testing.T) {
 		pm := NewPeerManager()
 		peer, err := pm.GetPeer("1")
 		assert.Nil(t, peer)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrPeerNotFound)
+		var peerErr *PeerError
+		assert.ErrorAs(t, err, &peerErr)
+		assert.Equal(t, "1", peerErr.PeerID)
+	})
+	t.Run("Add existing peer", func(t *testing.T) {
+		t.Parallel()
+		peer, err := NewSfuPeer("1", &webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm := NewPeerManager()
+		_, err = pm.AddPeer(peer)
+		assert.Nil(t, err)
+		_, err = pm.AddPeer(peer)
+		assert.ErrorIs(t, err, ErrPeerExists)
 	})
 	t.Run("Get all peers", func(t *testing.T) {
 		t.Parallel()
@@ -0,0 +1,76 @@
+package webrtcpeer
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+SenderReport is the last RTCP Sender Report received for a remote track. It ties the
+track's RTP timestamps to the sender's NTP wallclock, which is common to all tracks
+of a sender and lets them be aligned with each other.
+*/
+type SenderReport struct {
+	SSRC       uint32
+	NTPTime    uint64
+	RTPTime    uint32
+	ReceivedAt time.Time
+}
+
+/*
+Time returns the sender wallclock time of an RTP timestamp of the track, clocked at clockRate.
+*/
+func (r SenderReport) Time(timestamp uint32, clockRate uint32) time.Time {
+	const ntpEpochOffset = 2208988800
+	seconds := int64(r.NTPTime>>32) - ntpEpochOffset
+	nanos := int64(((r.NTPTime&0xffffffff)*uint64(time.Second) + 1<<31) >> 32)
+	elapsed := time.Duration(int64(int32(timestamp-r.RTPTime)) * int64(time.Second) / int64(clockRate))
+	return time.Unix(seconds, nanos).Add(elapsed)
+}
+
+/*
+readRTCP drains the RTCP of a receiver, as pion expects of applications, and keeps
+the Sender Reports it carries.
+*/
+func (p *SfuPeer) readRTCP(receiver *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			report, ok := packet.(*rtcp.SenderReport)
+			if !ok {
+				continue
+			}
+			p.senderReportsMu.Lock()
+			p.senderReports[report.SSRC] = SenderReport{
+				SSRC:       report.SSRC,
+				NTPTime:    report.NTPTime,
+				RTPTime:    report.RTPTime,
+				ReceivedAt: time.Now(),
+			}
+			p.senderReportsMu.Unlock()
+		}
+	}
+}
+
+/*
+LastSenderReport returns the last Sender Report of the remote track the local track
+localTrackID was converted from.
+*/
+func (p *SfuPeer) LastSenderReport(localTrackID string) (SenderReport, error) {
+	remoteTrack, err := p.remoteTrackOf(localTrackID)
+	if err != nil {
+		return SenderReport{}, err
+	}
+	p.senderReportsMu.Lock()
+	defer p.senderReportsMu.Unlock()
+	report, ok := p.senderReports[uint32(remoteTrack.SSRC())]
+	if !ok {
+		return SenderReport{}, ErrNoSenderReport
+	}
+	return report, nil
+}
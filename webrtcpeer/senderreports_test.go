@@ -0,0 +1,27 @@
+package webrtcpeer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderReport(t *testing.T) {
+	t.Run("Maps RTP timestamps to the sender wallclock", func(t *testing.T) {
+		t.Parallel()
+		// 2026-01-01 12:00:00.5 UTC in NTP time.
+		report := SenderReport{NTPTime: uint64(1767268800+2208988800)<<32 | 1<<31, RTPTime: 4294966296}
+		at := time.Date(2026, 1, 1, 12, 0, 0, 500000000, time.UTC)
+		assert.True(t, report.Time(4294966296, 90000).Equal(at))
+		// Timestamps wrap around past the report and may come before it.
+		assert.True(t, report.Time(89000, 90000).Equal(at.Add(time.Second)))
+		assert.True(t, report.Time(4294876296, 90000).Equal(at.Add(-time.Second)))
+	})
+	t.Run("No report before one is received", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		_, err := peer.LastSenderReport("missing")
+		assert.ErrorIs(t, err, ErrTrackNotFound)
+	})
+}
@@ -0,0 +1,235 @@
+package webrtcpeer
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+TrackSink consumes the packets of a local track, such as a recorder. Close is called
+once when the sink is detached, the track ends or the peer shuts down.
+*/
+type TrackSink interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+const sinkQueueSize = 256
+
+/*
+sinkTap is the binding of a TrackSink on a local track, the way sourceTap binds a
+SwitchableTrack. The track hands packets over to a queue the sink is fed from on
+its own goroutine, so a slow sink does not hold up the track for the peers it is
+forwarded to: when the queue is full, packets are dropped for the sink alone.
+Errors of the sink are logged rather than returned.
+*/
+type sinkTap struct {
+	sink  TrackSink
+	track *webrtc.TrackLocalStaticRTP
+	id    string
+	// replay is the keyframe cache of the track to write ahead of the first packet.
+	replay atomic.Pointer[keyframeCache]
+	// queue holds the packets to feed the sink, the replayed ones and the live one
+	// they precede in one batch. done is closed once the sink is fed all of them.
+	queue   chan []*rtp.Packet
+	done    chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+	log     logging.LeveledLogger
+}
+
+func newSinkTap(sink TrackSink, track *webrtc.TrackLocalStaticRTP, log logging.LeveledLogger) *sinkTap {
+	tap := &sinkTap{
+		sink:  sink,
+		track: track,
+		id:    uuid.New().String(),
+		queue: make(chan []*rtp.Packet, sinkQueueSize),
+		done:  make(chan struct{}),
+		log:   log,
+	}
+	go tap.feed()
+	return tap
+}
+
+func (c *sinkTap) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: c.track.Codec()}}
+}
+
+func (c *sinkTap) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+	return nil
+}
+
+func (c *sinkTap) SSRC() webrtc.SSRC {
+	return 0
+}
+
+func (c *sinkTap) WriteStream() webrtc.TrackLocalWriter {
+	return c
+}
+
+func (c *sinkTap) ID() string {
+	return c.id
+}
+
+func (c *sinkTap) RTCPReader() interceptor.RTCPReader {
+	return nil
+}
+
+func (c *sinkTap) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.write(&rtp.Packet{Header: header.Clone(), Payload: slices.Clone(payload)})
+	return len(payload), nil
+}
+
+func (c *sinkTap) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(slices.Clone(b)); err != nil {
+		return 0, err
+	}
+	c.write(packet)
+	return len(b), nil
+}
+
+/*
+write queues packet for the sink, preceded by the packets replayed from the
+keyframe cache if it is the first one.
+*/
+func (c *sinkTap) write(packet *rtp.Packet) {
+	batch := []*rtp.Packet{packet}
+	if cache := c.replay.Swap(nil); cache != nil {
+		replayed := cache.replay(&packet.Header)
+		for _, replayedPacket := range replayed {
+			replayedPacket.SSRC = packet.SSRC
+			replayedPacket.PayloadType = packet.PayloadType
+		}
+		batch = append(replayed, packet)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- batch:
+		if c.dropped > 0 {
+			c.log.Warnf("Dropped %d packets of track %s for a slow sink", c.dropped, c.track.ID())
+			c.dropped = 0
+		}
+	default:
+		if c.dropped == 0 {
+			c.log.Warnf("Sink of track %s is too slow, dropping packets", c.track.ID())
+		}
+		c.dropped += len(batch)
+	}
+}
+
+func (c *sinkTap) feed() {
+	defer close(c.done)
+	for batch := range c.queue {
+		for _, packet := range batch {
+			if err := c.sink.WriteRTP(packet); err != nil {
+				c.log.Warnf("Error writing track %s to sink: %v", c.track.ID(), err)
+				break
+			}
+		}
+	}
+}
+
+/*
+close stops queueing packets and waits for the sink to be fed the queued ones.
+*/
+func (c *sinkTap) close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+/*
+AttachTrackSink feeds every packet of the local track localTrackID to sink until it
+is detached, the track ends or the peer shuts down. A video track converted from a
+remote track first feeds the packets since its last keyframe, with their timestamps
+moved up to the first live packet. The sink is fed on a goroutine of its own, with
+up to 256 writes queued; a sink falling further behind misses packets.
+*/
+func (p *SfuPeer) AttachTrackSink(localTrackID string, sink TrackSink) error {
+	if p.state.Load() == 0 {
+		return &PeerError{PeerID: p.id, Err: ErrPeerClosing}
+	}
+	track := p.localTrack(localTrackID)
+	if track == nil {
+		return &TrackError{PeerID: p.id, TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	tap := newSinkTap(sink, track, p.log)
+	if cache := p.keyframeCache(localTrackID); cache != nil {
+		tap.replay.Store(cache)
+	}
+	if _, err := track.Bind(tap); err != nil {
+		tap.close()
+		return err
+	}
+	p.trackSinksMu.Lock()
+	p.trackSinks[localTrackID] = append(p.trackSinks[localTrackID], tap)
+	p.trackSinksMu.Unlock()
+	return nil
+}
+
+/*
+DetachTrackSink stops feeding sink and closes it.
+*/
+func (p *SfuPeer) DetachTrackSink(localTrackID string, sink TrackSink) error {
+	p.trackSinksMu.Lock()
+	taps := p.trackSinks[localTrackID]
+	i := slices.IndexFunc(taps, func(tap *sinkTap) bool { return tap.sink == sink })
+	if i < 0 {
+		p.trackSinksMu.Unlock()
+		return &TrackError{PeerID: p.id, TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	tap := taps[i]
+	p.trackSinks[localTrackID] = slices.Delete(taps, i, i+1)
+	p.trackSinksMu.Unlock()
+	return p.closeSinkTap(tap)
+}
+
+/*
+closeTrackSinks detaches and closes the sinks of the local track localTrackID.
+*/
+func (p *SfuPeer) closeTrackSinks(localTrackID string) {
+	p.trackSinksMu.Lock()
+	taps := p.trackSinks[localTrackID]
+	delete(p.trackSinks, localTrackID)
+	p.trackSinksMu.Unlock()
+	for _, tap := range taps {
+		p.closeSinkTap(tap)
+	}
+}
+
+func (p *SfuPeer) closeAllTrackSinks() {
+	p.trackSinksMu.Lock()
+	sinks := p.trackSinks
+	p.trackSinks = make(map[string][]*sinkTap)
+	p.trackSinksMu.Unlock()
+	for _, taps := range sinks {
+		for _, tap := range taps {
+			p.closeSinkTap(tap)
+		}
+	}
+}
+
+func (p *SfuPeer) closeSinkTap(tap *sinkTap) error {
+	if err := tap.track.Unbind(tap); err != nil {
+		p.log.Warnf("Error unbinding sink from track %s: %v", tap.track.ID(), err)
+	}
+	tap.close()
+	return tap.sink.Close()
+}
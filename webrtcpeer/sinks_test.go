@@ -0,0 +1,100 @@
+package webrtcpeer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+type captureSink struct {
+	packets []*rtp.Packet
+	closed  int
+}
+
+func (s *captureSink) WriteRTP(packet *rtp.Packet) error {
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func (s *captureSink) Close() error {
+	s.closed++
+	return nil
+}
+
+/*
+blockingSink blocks every write until it is released.
+*/
+type blockingSink struct {
+	release chan struct{}
+	written atomic.Int32
+}
+
+func (s *blockingSink) WriteRTP(packet *rtp.Packet) error {
+	<-s.release
+	s.written.Add(1)
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestTrackSinks(t *testing.T) {
+	t.Run("Feeds a sink until it is detached", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		track := newTestTrack(t, "camera")
+		peer.LocalTracks["camera"] = track
+		sink := &captureSink{}
+		assert.Nil(t, peer.AttachTrackSink("camera", sink))
+		assert.Nil(t, track.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: []byte{1}}))
+		assert.Nil(t, peer.DetachTrackSink("camera", sink))
+		assert.Nil(t, track.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2}, Payload: []byte{2}}))
+		assert.Len(t, sink.packets, 1)
+		assert.Equal(t, uint16(1), sink.packets[0].SequenceNumber)
+		assert.Equal(t, 1, sink.closed)
+		assert.ErrorIs(t, peer.DetachTrackSink("camera", sink), ErrTrackNotFound)
+	})
+	t.Run("Closes sinks on shutdown", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		peer.LocalTracks["camera"] = newTestTrack(t, "camera")
+		sink := &captureSink{}
+		assert.Nil(t, peer.AttachTrackSink("camera", sink))
+		peer.Shutdown()
+		assert.Equal(t, 1, sink.closed)
+		assert.ErrorIs(t, peer.AttachTrackSink("camera", sink), ErrPeerClosing)
+	})
+	t.Run("Drops packets for a slow sink without holding up the track", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		track := newTestTrack(t, "camera")
+		peer.LocalTracks["camera"] = track
+		sink := &blockingSink{release: make(chan struct{})}
+		assert.Nil(t, peer.AttachTrackSink("camera", sink))
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			for i := 0; i < 2*sinkQueueSize; i++ {
+				track.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}, Payload: []byte{1}})
+			}
+		}()
+		select {
+		case <-written:
+		case <-time.After(5 * time.Second):
+			t.Fatal("track blocked by its sink")
+		}
+		close(sink.release)
+		assert.Nil(t, peer.DetachTrackSink("camera", sink))
+		assert.Less(t, int(sink.written.Load()), 2*sinkQueueSize)
+		assert.GreaterOrEqual(t, int(sink.written.Load()), sinkQueueSize)
+	})
+	t.Run("Rejects unknown tracks", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		assert.ErrorIs(t, peer.AttachTrackSink("missing", &captureSink{}), ErrTrackNotFound)
+	})
+}
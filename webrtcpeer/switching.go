@@ -0,0 +1,337 @@
+package webrtcpeer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+SwitchableTrack is a local track whose packets come from a source track that can be
+switched at any time. It binds to the source like a PeerConnection would and rewrites
+sequence numbers and timestamps, so the receiver sees one continuous stream and no
+renegotiation is needed. The embedded TrackLocalStaticRTP is what gets added to a peer.
+A video track keeps carrying its previous source until the new one reaches a keyframe,
+so receivers never decode frames of one source against the references of the other.
+*/
+type SwitchableTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	mu  sync.Mutex
+	tap *sourceTap
+	// pending is the source switched to, waiting for its keyframe. switchPoint tells
+	// the packet that starts one, and is nil for audio, which switches at once.
+	pending       *sourceTap
+	switchPoint   func(packet *rtp.Packet) bool
+	rebase        bool
+	started       bool
+	seqOffset     uint16
+	tsOffset      uint32
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastWrite     time.Time
+}
+
+func NewSwitchableTrack(codec webrtc.RTPCodecCapability, id string, streamID string) (*SwitchableTrack, error) {
+	output, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &SwitchableTrack{TrackLocalStaticRTP: output, switchPoint: keyframeDetector(codec)}, nil
+}
+
+/*
+Source returns the track feeding the switchable track, or the one it is switching to
+at its next keyframe, or nil.
+*/
+func (t *SwitchableTrack) Source() *webrtc.TrackLocalStaticRTP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.pending != nil:
+		return t.pending.source
+	case t.tap != nil:
+		return t.tap.source
+	default:
+		return nil
+	}
+}
+
+/*
+SwitchSource makes source feed the track from its next packet on, or for video from
+its next keyframe, until which the previous source goes on. The source must carry
+the codec the track was created with.
+*/
+func (t *SwitchableTrack) SwitchSource(source *webrtc.TrackLocalStaticRTP) error {
+	if !strings.EqualFold(source.Codec().MimeType, t.Codec().MimeType) {
+		return fmt.Errorf("%w: cannot switch %s track %s to %s source %s", ErrCodecMismatch, t.Codec().MimeType, t.ID(), source.Codec().MimeType, source.ID())
+	}
+	tap := &sourceTap{track: t, source: source, id: uuid.New().String()}
+	if _, err := source.Bind(tap); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	var previous *sourceTap
+	if t.switchPoint != nil {
+		previous = t.pending
+		t.pending = tap
+	} else {
+		previous = t.tap
+		t.tap = tap
+		t.rebase = true
+	}
+	t.mu.Unlock()
+	if previous != nil {
+		return previous.source.Unbind(previous)
+	}
+	return nil
+}
+
+/*
+Close detaches the track from its source.
+*/
+func (t *SwitchableTrack) Close() error {
+	t.mu.Lock()
+	previous, pending := t.tap, t.pending
+	t.tap, t.pending = nil, nil
+	t.mu.Unlock()
+	var err error
+	if pending != nil {
+		err = pending.source.Unbind(pending)
+	}
+	if previous != nil {
+		if unbindErr := previous.source.Unbind(previous); err == nil {
+			err = unbindErr
+		}
+	}
+	return err
+}
+
+/*
+forward rewrites a packet of the tap's source onto the track. The packets of a
+pending source are dropped until one starts a keyframe, which takes over from the
+previous source. The first packet after a switch continues the sequence numbers and
+advances the timestamp by the wall clock time since the previous packet.
+*/
+func (t *SwitchableTrack) forward(tap *sourceTap, header *rtp.Header, payload []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tap == t.pending {
+		if !t.switchPoint(&rtp.Packet{Header: *header, Payload: payload}) {
+			return len(payload), nil
+		}
+		if previous := t.tap; previous != nil {
+			// The previous source may be writing and waiting for mu, so it is unbound
+			// once this write is done.
+			go previous.source.Unbind(previous)
+		}
+		t.tap, t.pending = tap, nil
+		t.rebase = true
+	}
+	if tap != t.tap {
+		return len(payload), nil
+	}
+	if t.rebase {
+		t.rebase = false
+		if t.started {
+			elapsed := uint32(time.Since(t.lastWrite).Seconds() * float64(t.Codec().ClockRate))
+			t.seqOffset = t.lastSeq + 1 - header.SequenceNumber
+			t.tsOffset = t.lastTimestamp + max(elapsed, 1) - header.Timestamp
+		}
+	}
+	packet := &rtp.Packet{Header: *header, Payload: payload}
+	packet.SequenceNumber += t.seqOffset
+	packet.Timestamp += t.tsOffset
+	t.started = true
+	t.lastSeq = packet.SequenceNumber
+	t.lastTimestamp = packet.Timestamp
+	t.lastWrite = time.Now()
+	return len(payload), t.TrackLocalStaticRTP.WriteRTP(packet)
+}
+
+/*
+sourceTap is the binding of a SwitchableTrack on its source track. It is both the
+TrackLocalContext passed to Bind and the stream the source writes to.
+*/
+type sourceTap struct {
+	track  *SwitchableTrack
+	source *webrtc.TrackLocalStaticRTP
+	id     string
+}
+
+func (c *sourceTap) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: c.source.Codec()}}
+}
+
+func (c *sourceTap) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+	return nil
+}
+
+func (c *sourceTap) SSRC() webrtc.SSRC {
+	return 0
+}
+
+func (c *sourceTap) WriteStream() webrtc.TrackLocalWriter {
+	return c
+}
+
+func (c *sourceTap) ID() string {
+	return c.id
+}
+
+func (c *sourceTap) RTCPReader() interceptor.RTCPReader {
+	return nil
+}
+
+func (c *sourceTap) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	return c.track.forward(c, header, payload)
+}
+
+func (c *sourceTap) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return c.track.forward(c, &packet.Header, packet.Payload)
+}
+
+/*
+AddSwitchableTrack adds a sender to the peer that carries the local track localTrackID
+of publisher until it is switched with SwitchTrackSource.
+*/
+func (p *SfuPeer) AddSwitchableTrack(id string, streamID string, publisher *SfuPeer, localTrackID string) (*SwitchableTrack, error) {
+	source := publisher.localTrack(localTrackID)
+	if source == nil {
+		return nil, &TrackError{PeerID: publisher.ID(), TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	track, err := NewSwitchableTrack(source.Codec(), id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.AddPeerTrack(track.TrackLocalStaticRTP); err != nil {
+		return nil, err
+	}
+	p.switchableTracksMu.Lock()
+	p.switchableTracks[id] = track
+	p.switchableTracksMu.Unlock()
+	if err := p.SwitchTrackSource(id, publisher, localTrackID); err != nil {
+		p.RemoveSwitchableTrack(id)
+		return nil, err
+	}
+	return track, nil
+}
+
+/*
+SwitchTrackSource makes the switchable track id carry the local track localTrackID of
+publisher and asks the publisher for a keyframe so the switch shows without delay.
+*/
+func (p *SfuPeer) SwitchTrackSource(id string, publisher *SfuPeer, localTrackID string) error {
+	p.switchableTracksMu.Lock()
+	track, ok := p.switchableTracks[id]
+	p.switchableTracksMu.Unlock()
+	if !ok {
+		return &TrackError{PeerID: p.id, TrackID: id, Err: ErrNotSwitchable}
+	}
+	source := publisher.localTrack(localTrackID)
+	if source == nil {
+		return &TrackError{PeerID: publisher.ID(), TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	if err := track.SwitchSource(source); err != nil {
+		return err
+	}
+	if source.Kind() == webrtc.RTPCodecTypeVideo {
+		if err := publisher.RequestKeyframe(localTrackID); err != nil {
+			p.log.Warnf("Error requesting keyframe for %s: %v", localTrackID, err)
+		}
+	}
+	return nil
+}
+
+/*
+RemoveSwitchableTrack detaches the switchable track id from its source and stops sending it.
+*/
+func (p *SfuPeer) RemoveSwitchableTrack(id string) error {
+	p.switchableTracksMu.Lock()
+	track, ok := p.switchableTracks[id]
+	delete(p.switchableTracks, id)
+	p.switchableTracksMu.Unlock()
+	if !ok {
+		return &TrackError{PeerID: p.id, TrackID: id, Err: ErrNotSwitchable}
+	}
+	if err := track.Close(); err != nil {
+		p.log.Warnf("Error detaching switchable track %s: %v", id, err)
+	}
+	return p.RemoveSendingTrack(id)
+}
+
+func (p *SfuPeer) closeSwitchableTracks() {
+	p.switchableTracksMu.Lock()
+	tracks := p.switchableTracks
+	p.switchableTracks = make(map[string]*SwitchableTrack)
+	p.switchableTracksMu.Unlock()
+	for _, track := range tracks {
+		track.Close()
+	}
+}
+
+/*
+RequestKeyframe sends a PLI for the remote track the local track localTrackID was converted from.
+*/
+func (p *SfuPeer) RequestKeyframe(localTrackID string) error {
+	remoteTrack, err := p.remoteTrackOf(localTrackID)
+	if err != nil {
+		return err
+	}
+	return p.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())},
+	})
+}
+
+/*
+KeyframeRequester returns a function requesting a keyframe of the local track
+localTrackID, for consumers such as recorders that attach to a track and must start
+at a keyframe. Errors are dropped: a track not converted from a remote track has
+no keyframes to ask for, and a remote track not received yet gets the periodic PLI
+of the peer once it is.
+*/
+func (p *SfuPeer) KeyframeRequester(localTrackID string) func() {
+	return func() {
+		p.RequestKeyframe(localTrackID)
+	}
+}
+
+/*
+remoteTrackOf returns the received remote track the local track localTrackID was converted from.
+*/
+func (p *SfuPeer) remoteTrackOf(localTrackID string) (*webrtc.TrackRemote, error) {
+	p.TrackMapMu.Lock()
+	remoteTrackID := ""
+	for remoteID, localID := range p.TrackMap {
+		if localID == localTrackID {
+			remoteTrackID = remoteID
+			break
+		}
+	}
+	p.TrackMapMu.Unlock()
+	if remoteTrackID == "" {
+		return nil, &TrackError{PeerID: p.id, TrackID: localTrackID, Err: ErrTrackNotFound}
+	}
+	for _, receiver := range p.GetReceivers() {
+		if track := receiver.Track(); track != nil && track.ID() == remoteTrackID {
+			return track, nil
+		}
+	}
+	return nil, &TrackError{PeerID: p.id, TrackID: remoteTrackID, Err: ErrTrackNotFound}
+}
+
+func (p *SfuPeer) localTrack(localTrackID string) *webrtc.TrackLocalStaticRTP {
+	p.LocalTracksMu.Lock()
+	defer p.LocalTracksMu.Unlock()
+	return p.LocalTracks[localTrackID]
+}
@@ -0,0 +1,183 @@
+package webrtcpeer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+captureContext binds a track like a PeerConnection would and records what it writes.
+*/
+type captureContext struct {
+	mu      sync.Mutex
+	headers []rtp.Header
+}
+
+func (c *captureContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96}}
+}
+
+func (c *captureContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c *captureContext) SSRC() webrtc.SSRC                                      { return 1234 }
+func (c *captureContext) WriteStream() webrtc.TrackLocalWriter                   { return c }
+func (c *captureContext) ID() string                                             { return "capture" }
+func (c *captureContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+func (c *captureContext) Write(b []byte) (int, error)                            { return len(b), nil }
+
+func (c *captureContext) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = append(c.headers, *header)
+	return len(payload), nil
+}
+
+func (c *captureContext) captured() []rtp.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]rtp.Header(nil), c.headers...)
+}
+
+func newVP8Track(t *testing.T, id string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, id, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+/*
+writePackets writes count single packet VP8 keyframes to track.
+*/
+func writePackets(t *testing.T, track *webrtc.TrackLocalStaticRTP, seq uint16, timestamp uint32, count int) {
+	t.Helper()
+	writeFrames(t, track, seq, timestamp, count, true)
+}
+
+func writeFrames(t *testing.T, track *webrtc.TrackLocalStaticRTP, seq uint16, timestamp uint32, count int, keyframe bool) {
+	t.Helper()
+	// The P bit of the frame tag is 0 on keyframes.
+	tag := byte(0x01)
+	if keyframe {
+		tag = 0x00
+	}
+	for i := 0; i < count; i++ {
+		assert.Nil(t, track.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq + uint16(i), Timestamp: timestamp + uint32(i)*3000},
+			Payload: []byte{0x10, tag},
+		}))
+	}
+}
+
+func TestSwitchableTrack(t *testing.T) {
+	t.Run("Keeps sequence numbers and timestamps continuous across switches", func(t *testing.T) {
+		t.Parallel()
+		first := newVP8Track(t, "first")
+		second := newVP8Track(t, "second")
+		track, err := NewSwitchableTrack(first.Codec(), "slot", "stream")
+		assert.Nil(t, err)
+		capture := &captureContext{}
+		_, err = track.Bind(capture)
+		assert.Nil(t, err)
+
+		assert.Nil(t, track.SwitchSource(first))
+		writePackets(t, first, 65533, 1000, 5)
+		assert.Nil(t, track.SwitchSource(second))
+		assert.Equal(t, second, track.Source())
+		// The first source goes on until the second sends a keyframe.
+		writePackets(t, first, 2, 16000, 5)
+		writePackets(t, second, 40000, 4000000000, 5)
+		writePackets(t, first, 7, 31000, 5)
+
+		headers := capture.captured()
+		assert.Len(t, headers, 15)
+		for i := 1; i < len(headers); i++ {
+			assert.Equal(t, headers[i-1].SequenceNumber+1, headers[i].SequenceNumber)
+			assert.Greater(t, headers[i].Timestamp-headers[i-1].Timestamp, uint32(0))
+			assert.Less(t, headers[i].Timestamp-headers[i-1].Timestamp, uint32(90000))
+			assert.Equal(t, uint32(1234), headers[i].SSRC)
+		}
+	})
+	t.Run("Switches video at the keyframe of the new source", func(t *testing.T) {
+		t.Parallel()
+		first := newVP8Track(t, "first")
+		second := newVP8Track(t, "second")
+		track, err := NewSwitchableTrack(first.Codec(), "slot", "stream")
+		assert.Nil(t, err)
+		capture := &captureContext{}
+		_, err = track.Bind(capture)
+		assert.Nil(t, err)
+
+		assert.Nil(t, track.SwitchSource(first))
+		writeFrames(t, first, 100, 1000, 1, false)
+		writePackets(t, first, 101, 4000, 2)
+		assert.Nil(t, track.SwitchSource(second))
+		writeFrames(t, second, 500, 90000, 2, false)
+		writeFrames(t, first, 103, 10000, 1, false)
+		writePackets(t, second, 502, 96000, 1)
+		writeFrames(t, first, 104, 13000, 1, false)
+		writeFrames(t, second, 503, 99000, 1, false)
+
+		headers := capture.captured()
+		// The delta frame the first source started with, the delta frames the second
+		// sent before its keyframe and the first's frames after it are all dropped.
+		assert.Len(t, headers, 5)
+		for i := 1; i < len(headers); i++ {
+			assert.Equal(t, headers[i-1].SequenceNumber+1, headers[i].SequenceNumber)
+		}
+		assert.Eventually(t, func() bool {
+			writePackets(t, first, 105, 16000, 1)
+			return len(capture.captured()) == 5
+		}, time.Second, 10*time.Millisecond)
+	})
+	t.Run("Rejects sources with another codec", func(t *testing.T) {
+		t.Parallel()
+		track, err := NewSwitchableTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "slot", "stream")
+		assert.Nil(t, err)
+		opus, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "stream")
+		assert.Nil(t, err)
+		assert.Error(t, track.SwitchSource(opus))
+		assert.Nil(t, track.Source())
+	})
+	t.Run("Close detaches the source", func(t *testing.T) {
+		t.Parallel()
+		source := newVP8Track(t, "source")
+		track, err := NewSwitchableTrack(source.Codec(), "slot", "stream")
+		assert.Nil(t, err)
+		capture := &captureContext{}
+		_, err = track.Bind(capture)
+		assert.Nil(t, err)
+		assert.Nil(t, track.SwitchSource(source))
+		assert.Nil(t, track.Close())
+		writePackets(t, source, 0, 0, 3)
+		assert.Empty(t, capture.captured())
+	})
+	t.Run("Switches SfuPeer senders between publishers", func(t *testing.T) {
+		t.Parallel()
+		subscriber := newTestPeer(t, 0)
+		publishers := make([]*SfuPeer, 2)
+		for i, id := range []string{"alice", "bob"} {
+			publishers[i] = newTestPeer(t, 0)
+			publishers[i].LocalTracks[id] = newVP8Track(t, id)
+		}
+		track, err := subscriber.AddSwitchableTrack("spotlight", "spotlight", publishers[0], "alice")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"spotlight"}, subscriber.GetOthersTrackIDs())
+		assert.Equal(t, publishers[0].LocalTracks["alice"], track.Source())
+
+		assert.Nil(t, subscriber.SwitchTrackSource("spotlight", publishers[1], "bob"))
+		assert.Equal(t, publishers[1].LocalTracks["bob"], track.Source())
+		assert.Error(t, subscriber.SwitchTrackSource("spotlight", publishers[1], "alice"))
+		assert.Len(t, subscriber.GetTransceivers(), 1)
+
+		assert.Nil(t, subscriber.RemoveSwitchableTrack("spotlight"))
+		assert.Nil(t, track.Source())
+		assert.Empty(t, subscriber.GetOthersTrackIDs())
+	})
+}
@@ -0,0 +1,78 @@
+package webrtcpeer
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+TrackChanges batches track changes on an SfuPeer so they are negotiated together.
+While any batch of the peer is open, negotiation-needed events are held back, also
+for tracks added or removed directly on the peer; the last Commit fires a single
+one if any was held.
+*/
+type TrackChanges struct {
+	peer       *SfuPeer
+	commitOnce sync.Once
+}
+
+/*
+BeginTrackChanges opens a batch of track changes. Every batch must be committed.
+*/
+func (p *SfuPeer) BeginTrackChanges() *TrackChanges {
+	p.trackChangesMu.Lock()
+	p.openTrackChanges++
+	p.trackChangesMu.Unlock()
+	return &TrackChanges{peer: p}
+}
+
+func (c *TrackChanges) AddTrack(track *webrtc.TrackLocalStaticRTP) (*webrtc.RTPSender, error) {
+	return c.peer.AddPeerTrack(track)
+}
+
+func (c *TrackChanges) AddPublisherTrack(publisher *SfuPeer, localTrackID string) (*webrtc.RTPSender, error) {
+	return c.peer.AddPublisherTrack(publisher, localTrackID)
+}
+
+func (c *TrackChanges) RemoveTrack(trackID string) error {
+	return c.peer.RemoveSendingTrack(trackID)
+}
+
+/*
+Commit closes the batch. Committing again does nothing.
+*/
+func (c *TrackChanges) Commit() {
+	c.commitOnce.Do(func() {
+		p := c.peer
+		p.trackChangesMu.Lock()
+		p.openTrackChanges--
+		fire := p.openTrackChanges == 0 && p.negotiationHeld
+		if fire {
+			p.negotiationHeld = false
+		}
+		p.trackChangesMu.Unlock()
+		if fire && p.state.Load() == 1 {
+			p.fireNegotiationNeeded()
+		}
+	})
+}
+
+/*
+holdNegotiation reports whether a batch is open, and if so records that negotiation is needed.
+*/
+func (p *SfuPeer) holdNegotiation() bool {
+	p.trackChangesMu.Lock()
+	defer p.trackChangesMu.Unlock()
+	if p.openTrackChanges == 0 {
+		return false
+	}
+	p.negotiationHeld = true
+	return true
+}
+
+func (p *SfuPeer) fireNegotiationNeeded() {
+	for _, handler := range snapshotHandlers(p, p.OnNegotiationNeededHandlers) {
+		handler()
+	}
+}
@@ -0,0 +1,48 @@
+package webrtcpeer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackChanges(t *testing.T) {
+	t.Run("Fires negotiation needed once on commit", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		var fired atomic.Int32
+		peer.AddOnNegotiationNeededHandler(func() { fired.Add(1) })
+
+		changes := peer.BeginTrackChanges()
+		for _, id := range []string{"first", "second", "third"} {
+			_, err := changes.AddTrack(newTestTrack(t, id))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, changes.RemoveTrack("second"))
+		_, err := changes.AddTrack(newTestTrack(t, "fourth"))
+		assert.Nil(t, err)
+		assert.Never(t, func() bool { return fired.Load() > 0 }, 200*time.Millisecond, 10*time.Millisecond)
+
+		changes.Commit()
+		changes.Commit()
+		assert.Eventually(t, func() bool { return fired.Load() == 1 }, time.Second, 10*time.Millisecond)
+		assert.Never(t, func() bool { return fired.Load() > 1 }, 200*time.Millisecond, 10*time.Millisecond)
+	})
+	t.Run("Nested batches fire on the last commit", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		var fired atomic.Int32
+		peer.AddOnNegotiationNeededHandler(func() { fired.Add(1) })
+
+		outer := peer.BeginTrackChanges()
+		inner := peer.BeginTrackChanges()
+		_, err := inner.AddTrack(newTestTrack(t, "first"))
+		assert.Nil(t, err)
+		inner.Commit()
+		assert.Never(t, func() bool { return fired.Load() > 0 }, 200*time.Millisecond, 10*time.Millisecond)
+		outer.Commit()
+		assert.Eventually(t, func() bool { return fired.Load() == 1 }, time.Second, 10*time.Millisecond)
+	})
+}
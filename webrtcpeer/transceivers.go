@@ -0,0 +1,144 @@
+package webrtcpeer
+
+import (
+	"slices"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultMaxIdleTransceivers = 8
+
+/*
+idleTransceiver is a sender transceiver whose track was removed. Its sender is kept
+unstopped so a later track can take it over with ReplaceTrack.
+
+The pool only reuses m-lines; pion never removes one. It bounds the m-lines added
+by track churn between negotiations, when pion cannot recycle a transceiver yet.
+Tracks removed beyond the cap go through pion's RemoveTrack, and pion's AddTrack
+recycles those transceivers once they are negotiated inactive.
+*/
+type idleTransceiver struct {
+	transceiver *webrtc.RTPTransceiver
+	sender      *webrtc.RTPSender
+}
+
+/*
+IdleTransceivers returns the number of idle sender transceivers of the kind held for reuse.
+*/
+func (p *SfuPeer) IdleTransceivers(kind webrtc.RTPCodecType) int {
+	p.transceiversMu.Lock()
+	defer p.transceiversMu.Unlock()
+	return len(p.idleTransceivers[kind])
+}
+
+/*
+parkSender removes the track of sender and keeps its transceiver for reuse: the
+track is replaced with nil and the transceiver stops sending. It returns false when
+the pool for the kind is full or reuse is disabled, leaving the sender untouched.
+*/
+func (p *SfuPeer) parkSender(sender *webrtc.RTPSender) (bool, error) {
+	if p.maxIdleTransceivers < 0 {
+		return false, nil
+	}
+	transceiver := p.transceiverOf(sender)
+	if transceiver == nil {
+		return false, nil
+	}
+	kind := transceiver.Kind()
+	p.transceiversMu.Lock()
+	defer p.transceiversMu.Unlock()
+	if len(p.idleTransceivers[kind]) >= p.maxIdleTransceivers {
+		return false, nil
+	}
+	if err := transceiver.SetSender(sender, nil); err != nil {
+		return false, err
+	}
+	p.idleTransceivers[kind] = append(p.idleTransceivers[kind], idleTransceiver{
+		transceiver: transceiver,
+		sender:      sender,
+	})
+	p.negotiationNeeded()
+	return true, nil
+}
+
+/*
+reuseTransceiver sends track on an idle transceiver of its kind. The transceiver
+with the lowest m-line is taken, so active senders stay at the front of the SDP
+and the idle ones collect behind them. It returns nil when none is idle.
+
+A parked transceiver has no sender as far as pion knows, so once it is negotiated
+inactive a direct PeerConnection.AddTrack may take it over; such entries, and
+those of transceivers no longer on the connection, are dropped instead.
+*/
+func (p *SfuPeer) reuseTransceiver(track *webrtc.TrackLocalStaticRTP) (*webrtc.RTPSender, error) {
+	p.transceiversMu.Lock()
+	defer p.transceiversMu.Unlock()
+	transceivers := p.GetTransceivers()
+	idle := slices.DeleteFunc(p.idleTransceivers[track.Kind()], func(entry idleTransceiver) bool {
+		if entry.transceiver.Sender() == nil && slices.Contains(transceivers, entry.transceiver) {
+			return false
+		}
+		entry.sender.Stop()
+		return true
+	})
+	p.idleTransceivers[track.Kind()] = idle
+	if len(idle) == 0 {
+		return nil, nil
+	}
+	best := 0
+	for i := range idle {
+		if slices.Index(transceivers, idle[i].transceiver) < slices.Index(transceivers, idle[best].transceiver) {
+			best = i
+		}
+	}
+	reused := idle[best]
+	p.idleTransceivers[track.Kind()] = slices.Delete(idle, best, best+1)
+	if err := reused.transceiver.SetSender(reused.sender, track); err != nil {
+		reused.sender.Stop()
+		return nil, err
+	}
+	p.negotiationNeeded()
+	return reused.sender, nil
+}
+
+func (p *SfuPeer) transceiverOf(sender *webrtc.RTPSender) *webrtc.RTPTransceiver {
+	for _, transceiver := range p.GetTransceivers() {
+		if transceiver.Sender() == sender {
+			return transceiver
+		}
+	}
+	return nil
+}
+
+/*
+clearIdleTransceivers drops the pool, stopping the held senders.
+*/
+func (p *SfuPeer) clearIdleTransceivers() {
+	p.transceiversMu.Lock()
+	idle := p.idleTransceivers
+	p.idleTransceivers = make(map[webrtc.RTPCodecType][]idleTransceiver)
+	p.transceiversMu.Unlock()
+	for _, transceivers := range idle {
+		for _, transceiver := range transceivers {
+			transceiver.sender.Stop()
+		}
+	}
+}
+
+/*
+negotiationNeeded reports transceiver changes pion does not report itself. Inside a
+batch of track changes it is held for the commit; otherwise the handlers run in the
+background. Outside the stable state pion rechecks the transceivers when it gets
+back there.
+*/
+func (p *SfuPeer) negotiationNeeded() {
+	if p.holdNegotiation() {
+		return
+	}
+	go func() {
+		if p.state.Load() == 0 || p.SignalingState() != webrtc.SignalingStateStable {
+			return
+		}
+		p.fireNegotiationNeeded()
+	}()
+}
@@ -0,0 +1,151 @@
+package webrtcpeer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTrack(t *testing.T, id string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, id, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func newTestPeer(t *testing.T, maxIdleTransceivers int) *SfuPeer {
+	t.Helper()
+	peer, err := NewSfuPeerWithConfig(SfuPeerConfig{
+		ID:                  "peer",
+		PeerConfig:          &webrtc.Configuration{},
+		MaxIdleTransceivers: maxIdleTransceivers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+/*
+negotiate completes an offer and answer between peer and remote, so removed
+transceivers become negotiated inactive.
+*/
+func negotiate(t *testing.T, peer *SfuPeer, remote *webrtc.PeerConnection) {
+	t.Helper()
+	offer, err := peer.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.SetLocalDescription(offer))
+	assert.Nil(t, remote.SetRemoteDescription(offer))
+	answer, err := remote.CreateAnswer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, remote.SetLocalDescription(answer))
+	assert.Nil(t, peer.SetRemoteDescription(answer))
+}
+
+func newTestRemote(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	return remote
+}
+
+func TestTransceiverReuse(t *testing.T) {
+	t.Run("Reuses idle transceivers", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		_, err := peer.AddPeerTrack(newTestTrack(t, "first"))
+		assert.Nil(t, err)
+		assert.Nil(t, peer.RemoveSendingTrack("first"))
+		assert.Equal(t, 1, peer.IdleTransceivers(webrtc.RTPCodecTypeVideo))
+		assert.Equal(t, webrtc.RTPTransceiverDirectionRecvonly, peer.GetTransceivers()[0].Direction())
+		assert.Empty(t, peer.GetOthersTrackIDs())
+
+		sender, err := peer.AddPeerTrack(newTestTrack(t, "second"))
+		assert.Nil(t, err)
+		assert.Len(t, peer.GetTransceivers(), 1)
+		assert.Equal(t, sender, peer.GetTransceivers()[0].Sender())
+		assert.Equal(t, webrtc.RTPTransceiverDirectionSendrecv, peer.GetTransceivers()[0].Direction())
+		assert.Equal(t, []string{"second"}, peer.GetOthersTrackIDs())
+		assert.Equal(t, 0, peer.IdleTransceivers(webrtc.RTPCodecTypeVideo))
+	})
+	t.Run("Reuses the lowest m-line first", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		for _, id := range []string{"first", "second", "third"} {
+			_, err := peer.AddPeerTrack(newTestTrack(t, id))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, peer.RemoveSendingTrack("third"))
+		assert.Nil(t, peer.RemoveSendingTrack("first"))
+		sender, err := peer.AddPeerTrack(newTestTrack(t, "fourth"))
+		assert.Nil(t, err)
+		assert.Equal(t, sender, peer.GetTransceivers()[0].Sender())
+		assert.Len(t, peer.GetTransceivers(), 3)
+	})
+	t.Run("Caps idle transceivers", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 1)
+		for _, id := range []string{"first", "second"} {
+			_, err := peer.AddPeerTrack(newTestTrack(t, id))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, peer.RemoveSendingTrack("first"))
+		assert.Nil(t, peer.RemoveSendingTrack("second"))
+		assert.Equal(t, 1, peer.IdleTransceivers(webrtc.RTPCodecTypeVideo))
+		assert.Empty(t, peer.GetOthersTrackIDs())
+	})
+	t.Run("Disabled with a negative cap", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, -1)
+		_, err := peer.AddPeerTrack(newTestTrack(t, "first"))
+		assert.Nil(t, err)
+		assert.Nil(t, peer.RemoveSendingTrack("first"))
+		assert.Equal(t, 0, peer.IdleTransceivers(webrtc.RTPCodecTypeVideo))
+	})
+	t.Run("Recycles m-lines beyond the cap once negotiated", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 1)
+		remote := newTestRemote(t)
+		for round := 0; round < 3; round++ {
+			ids := []string{fmt.Sprint("a", round), fmt.Sprint("b", round), fmt.Sprint("c", round)}
+			for _, id := range ids {
+				_, err := peer.AddPeerTrack(newTestTrack(t, id))
+				assert.Nil(t, err)
+			}
+			negotiate(t, peer, remote)
+			for _, id := range ids {
+				assert.Nil(t, peer.RemoveSendingTrack(id))
+			}
+			negotiate(t, peer, remote)
+		}
+		assert.Len(t, peer.GetTransceivers(), 3)
+	})
+	t.Run("Drops idle transceivers taken over by AddTrack", func(t *testing.T) {
+		t.Parallel()
+		peer := newTestPeer(t, 0)
+		remote := newTestRemote(t)
+		_, err := peer.AddPeerTrack(newTestTrack(t, "first"))
+		assert.Nil(t, err)
+		negotiate(t, peer, remote)
+		assert.Nil(t, peer.RemoveSendingTrack("first"))
+		negotiate(t, peer, remote)
+
+		direct, err := peer.PeerConnection.AddTrack(newTestTrack(t, "direct"))
+		assert.Nil(t, err)
+		assert.Len(t, peer.GetTransceivers(), 1)
+		sender, err := peer.AddPeerTrack(newTestTrack(t, "second"))
+		assert.Nil(t, err)
+		assert.NotEqual(t, direct, sender)
+		assert.Equal(t, direct, peer.GetTransceivers()[0].Sender())
+		assert.Len(t, peer.GetTransceivers(), 2)
+		assert.Equal(t, 0, peer.IdleTransceivers(webrtc.RTPCodecTypeVideo))
+	})
+}
@@ -0,0 +1,102 @@
+package webrtcplayback
+
+import (
+	"github.com/pion/rtp/codecs/av1/obu"
+)
+
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+	av1OBUTileList          = 8
+	av1OBUPadding           = 15
+
+	av1AggregationZ = 0x80
+	av1AggregationY = 0x40
+	av1AggregationN = 0x08
+)
+
+/*
+av1Payloader packetizes AV1 temporal units in the low overhead bitstream format, as
+IVF files carry them, following the AV1 RTP payload format: OBUs lose their size
+field and go out as length-prefixed elements, fragmented across packets where they
+do not fit. Temporal delimiters, tile lists and padding are left out.
+*/
+type av1Payloader struct{}
+
+func (p *av1Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	elements, newSequence := av1Elements(payload)
+	if len(elements) == 0 || mtu < 3 {
+		return nil
+	}
+	var payloads [][]byte
+	packet := []byte{0}
+	if newSequence {
+		packet[0] |= av1AggregationN
+	}
+	for _, element := range elements {
+		for len(element) > 0 {
+			room := int(mtu) - len(packet)
+			// The length field of what fits takes some of the room.
+			size := min(len(element), room-len(obu.WriteToLeb128(uint(room))))
+			if size <= 0 {
+				payloads = append(payloads, packet)
+				packet = []byte{0}
+				continue
+			}
+			packet = append(packet, obu.WriteToLeb128(uint(size))...)
+			packet = append(packet, element[:size]...)
+			element = element[size:]
+			if len(element) > 0 {
+				packet[0] |= av1AggregationY
+				payloads = append(payloads, packet)
+				packet = []byte{av1AggregationZ}
+			}
+		}
+	}
+	if len(packet) > 1 {
+		payloads = append(payloads, packet)
+	}
+	return payloads
+}
+
+/*
+av1Elements splits a temporal unit into the OBUs it sends, without size fields, and
+reports whether it starts a coded video sequence with a sequence header.
+*/
+func av1Elements(data []byte) ([][]byte, bool) {
+	var elements [][]byte
+	newSequence := false
+	for len(data) > 0 {
+		header := data[0]
+		headerSize := 1
+		if header&0x04 != 0 {
+			headerSize = 2
+		}
+		if len(data) < headerSize {
+			break
+		}
+		size := uint(len(data) - headerSize)
+		sizeLength := uint(0)
+		if header&0x02 != 0 {
+			var err error
+			if size, sizeLength, err = obu.ReadLeb128(data[headerSize:]); err != nil {
+				break
+			}
+		}
+		end := uint(headerSize) + sizeLength + size
+		if end > uint(len(data)) {
+			break
+		}
+		switch (header >> 3) & 0x0f {
+		case av1OBUTemporalDelimiter, av1OBUTileList, av1OBUPadding:
+		default:
+			if (header>>3)&0x0f == av1OBUSequenceHeader {
+				newSequence = true
+			}
+			element := append([]byte{header &^ 0x02}, data[1:headerSize]...)
+			elements = append(elements, append(element, data[uint(headerSize)+sizeLength:end]...))
+		}
+		data = data[end:]
+	}
+	return elements, newSequence
+}
@@ -0,0 +1,12 @@
+/*
+Package webrtcplayback publishes media files into rooms as if they came from a peer.
+
+A FilePlayer reads VP8, VP9 or AV1 from an IVF file, Opus from an Ogg file, or an
+RTP stream from a pcap or pcapng capture, and writes it paced in real time to a
+webrtc.TrackLocalStaticRTP. The track is passed to SfuPeer.AddPeerTrack like the
+local tracks of converted remote tracks, and optionally loops at the end of the file.
+
+Files are played as they are: a subscriber added in the middle of a video shows it
+from the next keyframe of the file on.
+*/
+package webrtcplayback
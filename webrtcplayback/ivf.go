@@ -0,0 +1,101 @@
+package webrtcplayback
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+const videoClockRate = 90000
+
+/*
+ivfSource reads VP8, VP9 or AV1 frames from an IVF file, timed by the time base of
+its header, and packetizes them.
+*/
+type ivfSource struct {
+	file      *os.File
+	reader    *ivfreader.IVFReader
+	header    *ivfreader.IVFFileHeader
+	mimeType  string
+	payloader rtp.Payloader
+	mtu       uint16
+	firstPTS  uint64
+	sawFrame  bool
+}
+
+func newIVFSource(file *os.File, mtu uint16) (*ivfSource, error) {
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &ivfSource{file: file, reader: reader, header: header, mtu: mtu}
+	switch header.FourCC {
+	case "VP80":
+		s.mimeType = webrtc.MimeTypeVP8
+		s.payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	case "VP90":
+		s.mimeType = webrtc.MimeTypeVP9
+		s.payloader = &codecs.VP9Payloader{}
+	case "AV01":
+		s.mimeType = webrtc.MimeTypeAV1
+		s.payloader = &av1Payloader{}
+	default:
+		return nil, fmt.Errorf("%w: IVF with %q", ErrUnsupportedFile, header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 || header.TimebaseNumerator == 0 {
+		return nil, fmt.Errorf("%w: IVF without a time base", ErrUnsupportedFile)
+	}
+	return s, nil
+}
+
+func (s *ivfSource) codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: s.mimeType, ClockRate: videoClockRate}
+}
+
+func (s *ivfSource) next() (*mediaFrame, error) {
+	data, header, err := s.reader.ParseNextFrame()
+	if err != nil {
+		return nil, err
+	}
+	if !s.sawFrame {
+		s.sawFrame = true
+		s.firstPTS = header.Timestamp
+	}
+	pts := header.Timestamp - s.firstPTS
+	numerator, denominator := uint64(s.header.TimebaseNumerator), uint64(s.header.TimebaseDenominator)
+	frame := &mediaFrame{
+		at:        time.Duration(pts * numerator * uint64(time.Second) / denominator),
+		timestamp: uint32(pts * numerator * videoClockRate / denominator),
+	}
+	payloads := s.payloader.Payload(s.mtu, data)
+	for i, payload := range payloads {
+		frame.packets = append(frame.packets, &rtp.Packet{
+			Header:  rtp.Header{Marker: i == len(payloads)-1},
+			Payload: payload,
+		})
+	}
+	return frame, nil
+}
+
+func (s *ivfSource) rewind() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader, _, err := ivfreader.NewWith(s.file)
+	if err != nil {
+		return err
+	}
+	s.reader = reader
+	s.sawFrame = false
+	return nil
+}
+
+func (s *ivfSource) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,178 @@
+package webrtcplayback
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	oggPageHeaderSize = 27
+	opusClockRate     = 48000
+)
+
+/*
+oggSource reads the Opus packets of an Ogg file, one per frame, timed by the
+samples each packet holds. Packets are put together from the lacing values of the
+pages, so pages may hold several packets and packets span pages. Only the first
+logical stream is read.
+*/
+type oggSource struct {
+	file    *os.File
+	reader  *bufio.Reader
+	serial  uint32
+	sawPage bool
+	packet  []byte
+	// pending are the packets of the last page not returned yet.
+	pending [][]byte
+	samples uint64
+}
+
+func newOggSource(file *os.File) (*oggSource, error) {
+	s := &oggSource{file: file, reader: bufio.NewReader(file)}
+	head, err := s.nextPacket()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, fmt.Errorf("%w: Ogg without Opus", ErrUnsupportedFile)
+	}
+	return s, s.rewind()
+}
+
+func (s *oggSource) codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+}
+
+func (s *oggSource) next() (*mediaFrame, error) {
+	for {
+		packet, err := s.nextPacket()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags")) {
+			continue
+		}
+		samples := opusPacketSamples(packet)
+		if samples == 0 {
+			continue
+		}
+		frame := &mediaFrame{
+			at:        time.Duration(s.samples * uint64(time.Second) / opusClockRate),
+			timestamp: uint32(s.samples),
+			packets:   []*rtp.Packet{{Payload: packet}},
+		}
+		s.samples += uint64(samples)
+		return frame, nil
+	}
+}
+
+/*
+nextPacket returns the next packet of the stream, reading pages as needed.
+*/
+func (s *oggSource) nextPacket() ([]byte, error) {
+	for len(s.pending) == 0 {
+		if err := s.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := s.pending[0]
+	s.pending = s.pending[1:]
+	return packet, nil
+}
+
+func (s *oggSource) readPage() error {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return fmt.Errorf("%w: bad Ogg page", ErrUnsupportedFile)
+	}
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(s.reader, lacing); err != nil {
+		return io.EOF
+	}
+	size := 0
+	for _, value := range lacing {
+		size += int(value)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return io.EOF
+	}
+	serial := binary.LittleEndian.Uint32(header[14:])
+	if !s.sawPage {
+		s.sawPage = true
+		s.serial = serial
+	} else if serial != s.serial {
+		return nil
+	}
+	for _, value := range lacing {
+		s.packet = append(s.packet, body[:value]...)
+		body = body[value:]
+		// A lacing value of 255 continues the packet in the next segment.
+		if value < 255 {
+			s.pending = append(s.pending, s.packet)
+			s.packet = nil
+		}
+	}
+	return nil
+}
+
+func (s *oggSource) rewind() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader.Reset(s.file)
+	s.sawPage = false
+	s.packet = nil
+	s.pending = nil
+	s.samples = 0
+	return nil
+}
+
+func (s *oggSource) close() error {
+	return s.file.Close()
+}
+
+/*
+opusPacketSamples returns the number of 48 kHz samples in an Opus packet, from the
+frame size of its configuration and its frame count.
+*/
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frameSamples int
+	switch {
+	case config < 12:
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frameSamples = []int{480, 960}[config%2]
+	default:
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 0x03 {
+	case 0:
+		return frameSamples
+	case 1, 2:
+		return 2 * frameSamples
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return int(packet[1]&0x3f) * frameSamples
+	}
+}
@@ -0,0 +1,349 @@
+package webrtcplayback
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+	pcapHeaderSize        = 24
+	pcapRecordHeaderSize  = 16
+
+	pcapngSectionHeaderBlock        = 0x0a0d0d0a
+	pcapngInterfaceDescriptionBlock = 1
+	pcapngEnhancedPacketBlock       = 6
+	pcapngByteOrderMagic            = 0x1a2b3c4d
+	pcapngOptionTimestampResolution = 9
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	ipProtocolUDP = 17
+)
+
+func isPcapMagic(magic []byte) bool {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if value := order.Uint32(magic); value == pcapMagicMicroseconds || value == pcapMagicNanoseconds {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+pcapInterface is a capture interface of a pcapng file, or the single one of a pcap file.
+*/
+type pcapInterface struct {
+	linkType uint16
+	// unit is the duration of a timestamp tick.
+	unit time.Duration
+}
+
+/*
+pcapSource reads one RTP stream out of the UDP packets of a pcap or pcapng capture,
+such as SfuPeer.StartCapture writes, timed by when the packets were captured.
+Captured packets keep their payload and marker bit; RTCP, other streams and
+anything that is not UDP over IPv4 or IPv6 are skipped.
+*/
+type pcapSource struct {
+	file       *os.File
+	reader     *bufio.Reader
+	mediaCodec webrtc.RTPCodecCapability
+	ssrc       uint32
+	// pcapng is set for pcapng files, whose blocks are read by readBlock.
+	pcapng     bool
+	order      binary.ByteOrder
+	interfaces []pcapInterface
+	started    bool
+	firstTime  time.Duration
+	firstTS    uint32
+}
+
+func newPcapSource(file *os.File, codec webrtc.RTPCodecCapability, ssrc uint32) (*pcapSource, error) {
+	if codec.ClockRate == 0 {
+		return nil, fmt.Errorf("%w: codec without a clock rate", ErrCodecRequired)
+	}
+	s := &pcapSource{file: file, reader: bufio.NewReader(file), mediaCodec: codec, ssrc: ssrc}
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pcapSource) codec() webrtc.RTPCodecCapability {
+	return s.mediaCodec
+}
+
+/*
+readHeader reads the file header of a pcap file. A pcapng file starts with a Section
+Header Block, which readBlock reads like any other.
+*/
+func (s *pcapSource) readHeader() error {
+	header, err := s.reader.Peek(pcapHeaderSize)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedFile, err)
+	}
+	if binary.LittleEndian.Uint32(header) == pcapngSectionHeaderBlock {
+		s.pcapng = true
+		return nil
+	}
+	s.order = binary.LittleEndian
+	if value := binary.BigEndian.Uint32(header); value == pcapMagicMicroseconds || value == pcapMagicNanoseconds {
+		s.order = binary.BigEndian
+	}
+	unit := time.Microsecond
+	if s.order.Uint32(header) == pcapMagicNanoseconds {
+		unit = time.Nanosecond
+	}
+	s.interfaces = []pcapInterface{{linkType: uint16(s.order.Uint32(header[20:])), unit: unit}}
+	_, err = s.reader.Discard(pcapHeaderSize)
+	return err
+}
+
+func (s *pcapSource) next() (*mediaFrame, error) {
+	for {
+		at, data, linkType, err := s.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		payload := udpPayload(data, linkType)
+		if len(payload) < 2 || payload[0]>>6 != 2 || (payload[1] >= 192 && payload[1] <= 223) {
+			continue
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(payload); err != nil {
+			continue
+		}
+		if !s.started {
+			if s.ssrc == 0 {
+				s.ssrc = packet.SSRC
+			}
+			if packet.SSRC != s.ssrc {
+				continue
+			}
+			s.started = true
+			s.firstTime = at
+			s.firstTS = packet.Timestamp
+		}
+		if packet.SSRC != s.ssrc {
+			continue
+		}
+		return &mediaFrame{
+			at:        max(at-s.firstTime, 0),
+			timestamp: packet.Timestamp - s.firstTS,
+			// Header extensions were negotiated with the peer the stream was captured from.
+			packets: []*rtp.Packet{{Header: rtp.Header{Marker: packet.Marker}, Payload: packet.Payload}},
+		}, nil
+	}
+}
+
+/*
+readPacket returns the next captured packet with its capture time and link type.
+*/
+func (s *pcapSource) readPacket() (time.Duration, []byte, uint16, error) {
+	if !s.pcapng {
+		header := make([]byte, pcapRecordHeaderSize)
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return 0, nil, 0, truncatedEOF(err)
+		}
+		data := make([]byte, s.order.Uint32(header[8:]))
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return 0, nil, 0, truncatedEOF(err)
+		}
+		capture := s.interfaces[0]
+		at := time.Duration(s.order.Uint32(header))*time.Second + time.Duration(s.order.Uint32(header[4:]))*capture.unit
+		return at, data, capture.linkType, nil
+	}
+	for {
+		blockType, body, err := s.readBlock()
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		switch blockType {
+		case pcapngSectionHeaderBlock:
+			s.interfaces = nil
+		case pcapngInterfaceDescriptionBlock:
+			if len(body) >= 8 {
+				s.interfaces = append(s.interfaces, pcapInterface{
+					linkType: s.order.Uint16(body),
+					unit:     pcapngTimestampUnit(s.order, body[8:]),
+				})
+			}
+		case pcapngEnhancedPacketBlock:
+			if len(body) < 20 {
+				continue
+			}
+			id := s.order.Uint32(body)
+			length := s.order.Uint32(body[12:])
+			if id >= uint32(len(s.interfaces)) || 20+uint64(length) > uint64(len(body)) {
+				continue
+			}
+			capture := s.interfaces[id]
+			ticks := uint64(s.order.Uint32(body[4:]))<<32 | uint64(s.order.Uint32(body[8:]))
+			return time.Duration(ticks) * capture.unit, body[20 : 20+length], capture.linkType, nil
+		}
+	}
+}
+
+/*
+readBlock returns the type and body of the next pcapng block. The byte order of a
+section is that of its Section Header Block.
+*/
+func (s *pcapSource) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return 0, nil, truncatedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(header) == pcapngSectionHeaderBlock {
+		magic, err := s.reader.Peek(4)
+		if err != nil {
+			return 0, nil, truncatedEOF(err)
+		}
+		s.order = binary.LittleEndian
+		if binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic {
+			s.order = binary.BigEndian
+		}
+	}
+	length := s.order.Uint32(header[4:])
+	if length < 12 || length%4 != 0 {
+		return 0, nil, fmt.Errorf("%w: bad pcapng block", ErrUnsupportedFile)
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return 0, nil, truncatedEOF(err)
+	}
+	return s.order.Uint32(header), body[:len(body)-4], nil
+}
+
+/*
+pcapngTimestampUnit reads the if_tsresol option of an Interface Description Block,
+which defaults to microseconds.
+*/
+func pcapngTimestampUnit(order binary.ByteOrder, options []byte) time.Duration {
+	for len(options) >= 4 {
+		code, length := order.Uint16(options), int(order.Uint16(options[2:]))
+		if 4+length > len(options) {
+			break
+		}
+		if code == pcapngOptionTimestampResolution && length >= 1 {
+			resolution := options[4]
+			if resolution&0x80 != 0 {
+				// A power of two, which Go durations do not need finer than nanoseconds.
+				return max(time.Second>>(resolution&0x7f), time.Nanosecond)
+			}
+			unit := time.Second
+			for range resolution {
+				unit /= 10
+			}
+			return max(unit, time.Nanosecond)
+		}
+		options = options[4+(length+3)&^3:]
+	}
+	return time.Microsecond
+}
+
+/*
+udpPayload returns the UDP payload of a captured packet, or nil if it is not a UDP
+datagram of the link types captures of RTP come in.
+*/
+func udpPayload(data []byte, linkType uint16) []byte {
+	switch linkType {
+	case linkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// A VLAN tag comes ahead of the actual type.
+		if etherType == 0x8100 && len(data) >= 4 {
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		data = data[16:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return nil
+	}
+	return ipUDPPayload(data)
+}
+
+func ipUDPPayload(data []byte) []byte {
+	if len(data) < 1 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		headerSize := int(data[0]&0x0f) * 4
+		// Fragments other than the first do not start with a UDP header.
+		if len(data) < 20 || headerSize < 20 || data[9] != ipProtocolUDP || binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+			return nil
+		}
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if total < headerSize || total > len(data) {
+			total = len(data)
+		}
+		return udpDatagramPayload(data[headerSize:total])
+	case 6:
+		if len(data) < 40 || data[6] != ipProtocolUDP {
+			return nil
+		}
+		return udpDatagramPayload(data[40:])
+	default:
+		return nil
+	}
+}
+
+func udpDatagramPayload(data []byte) []byte {
+	if len(data) < 8 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length < 8 || length > len(data) {
+		length = len(data)
+	}
+	return data[8:length]
+}
+
+/*
+truncatedEOF treats a file cut off in the middle of a record as ended there.
+*/
+func truncatedEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+func (s *pcapSource) rewind() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader.Reset(s.file)
+	s.started = false
+	return s.readHeader()
+}
+
+func (s *pcapSource) close() error {
+	return s.file.Close()
+}
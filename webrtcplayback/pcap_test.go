@@ -0,0 +1,209 @@
+package webrtcplayback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var opusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+type capturedDatagram struct {
+	at      time.Duration
+	payload []byte
+}
+
+/*
+ipv4UDP wraps payload in IPv4 and UDP headers.
+*/
+func ipv4UDP(payload []byte) []byte {
+	packet := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, ipProtocolUDP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(packet[2:], uint16(28+len(payload)))
+	packet = binary.BigEndian.AppendUint16(packet, 5004)
+	packet = binary.BigEndian.AppendUint16(packet, 5004)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(8+len(payload)))
+	packet = binary.BigEndian.AppendUint16(packet, 0)
+	return append(packet, payload...)
+}
+
+/*
+writePcap writes datagrams to a big endian, nanosecond pcap file of Ethernet frames.
+*/
+func writePcap(t *testing.T, path string, datagrams []capturedDatagram) {
+	t.Helper()
+	data := binary.BigEndian.AppendUint32(nil, pcapMagicNanoseconds)
+	data = binary.BigEndian.AppendUint16(data, 2)
+	data = binary.BigEndian.AppendUint16(data, 4)
+	data = append(data, make([]byte, 8)...)
+	data = binary.BigEndian.AppendUint32(data, 65535)
+	data = binary.BigEndian.AppendUint32(data, linkTypeEthernet)
+	for _, datagram := range datagrams {
+		frame := append(make([]byte, 12), 0x08, 0x00)
+		frame = append(frame, ipv4UDP(datagram.payload)...)
+		at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC).Add(datagram.at)
+		data = binary.BigEndian.AppendUint32(data, uint32(at.Unix()))
+		data = binary.BigEndian.AppendUint32(data, uint32(at.Nanosecond()))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(frame)))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(frame)))
+		data = append(data, frame...)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	body = append(body, make([]byte, (4-len(body)%4)%4)...)
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(body)+12))
+	block = append(block, body...)
+	return binary.LittleEndian.AppendUint32(block, uint32(len(body)+12))
+}
+
+/*
+writePcapng writes datagrams to a pcapng file of raw IP packets the way
+SfuPeer.StartCapture does, with a millisecond timestamp resolution.
+*/
+func writePcapng(t *testing.T, path string, datagrams []capturedDatagram) {
+	t.Helper()
+	header := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	header = binary.LittleEndian.AppendUint64(header, 0xffffffffffffffff)
+	data := pcapngBlock(pcapngSectionHeaderBlock, header)
+	description := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	description = append(description, make([]byte, 6)...)
+	description = binary.LittleEndian.AppendUint16(description, pcapngOptionTimestampResolution)
+	description = binary.LittleEndian.AppendUint16(description, 1)
+	description = append(description, 3, 0, 0, 0)
+	data = append(data, pcapngBlock(pcapngInterfaceDescriptionBlock, description)...)
+	for _, datagram := range datagrams {
+		packet := ipv4UDP(datagram.payload)
+		ticks := uint64(1767268800000 + datagram.at/time.Millisecond)
+		body := binary.LittleEndian.AppendUint32(nil, 0)
+		body = binary.LittleEndian.AppendUint32(body, uint32(ticks>>32))
+		body = binary.LittleEndian.AppendUint32(body, uint32(ticks))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+		data = append(data, pcapngBlock(pcapngEnhancedPacketBlock, append(body, packet...))...)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rtpDatagram(at time.Duration, ssrc uint32, seq uint16, timestamp uint32, payload byte) capturedDatagram {
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 111, SSRC: ssrc, SequenceNumber: seq, Timestamp: timestamp, Marker: true},
+		Payload: []byte{payload},
+	}
+	packet.Header.SetExtension(1, []byte{0x30})
+	data, _ := packet.Marshal()
+	return capturedDatagram{at: at, payload: data}
+}
+
+/*
+capturedStream is a capture of two streams with RTCP and a STUN binding request in
+between, where stream 1 has timestamps 480 ticks apart every 10ms.
+*/
+func capturedStream() []capturedDatagram {
+	report, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: 1}})
+	return []capturedDatagram{
+		{at: 0, payload: []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}},
+		rtpDatagram(5*time.Millisecond, 2, 100, 9000, 0xb0),
+		rtpDatagram(10*time.Millisecond, 1, 500, 48000, 0xa0),
+		{at: 15 * time.Millisecond, payload: report},
+		rtpDatagram(20*time.Millisecond, 1, 501, 48480, 0xa1),
+		rtpDatagram(25*time.Millisecond, 2, 101, 12000, 0xb1),
+		rtpDatagram(30*time.Millisecond, 1, 502, 48960, 0xa2),
+	}
+}
+
+func readFrames(t *testing.T, source mediaSource) []*mediaFrame {
+	t.Helper()
+	var frames []*mediaFrame
+	for {
+		frame, err := source.next()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestPcapSource(t *testing.T) {
+	for _, format := range []struct {
+		name  string
+		write func(t *testing.T, path string, datagrams []capturedDatagram)
+	}{
+		{"pcap", writePcap},
+		{"pcapng", writePcapng},
+	} {
+		t.Run("Reads the first RTP stream of a "+format.name+" file", func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "call."+format.name)
+			format.write(t, path, capturedStream())
+			file, err := os.Open(path)
+			assert.Nil(t, err)
+			source, err := newPcapSource(file, opusCodec, 0)
+			assert.Nil(t, err)
+			defer source.close()
+
+			frames := readFrames(t, source)
+			assert.Len(t, frames, 2)
+			assert.Equal(t, time.Duration(0), frames[0].at)
+			assert.Equal(t, 20*time.Millisecond, frames[1].at)
+			assert.Equal(t, uint32(3000), frames[1].timestamp)
+			assert.Equal(t, &rtp.Packet{Header: rtp.Header{Marker: true}, Payload: []byte{0xb1}}, frames[1].packets[0])
+
+			assert.Nil(t, source.rewind())
+			assert.Len(t, readFrames(t, source), 2)
+		})
+	}
+	t.Run("Reads the stream of the configured SSRC", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "call.pcapng")
+		writePcapng(t, path, capturedStream())
+		file, err := os.Open(path)
+		assert.Nil(t, err)
+		source, err := newPcapSource(file, opusCodec, 1)
+		assert.Nil(t, err)
+		defer source.close()
+
+		var payloads []byte
+		var timestamps []uint32
+		for _, frame := range readFrames(t, source) {
+			payloads = append(payloads, frame.packets[0].Payload...)
+			timestamps = append(timestamps, frame.timestamp)
+		}
+		assert.Equal(t, []byte{0xa0, 0xa1, 0xa2}, payloads)
+		assert.Equal(t, []uint32{0, 480, 960}, timestamps)
+	})
+}
+
+func TestUDPPayload(t *testing.T) {
+	t.Run("Skips what is not UDP", func(t *testing.T) {
+		t.Parallel()
+		packet := ipv4UDP([]byte{1, 2, 3})
+		assert.Equal(t, []byte{1, 2, 3}, udpPayload(packet, linkTypeRaw))
+		tcp := bytes.Clone(packet)
+		tcp[9] = 6
+		assert.Nil(t, udpPayload(tcp, linkTypeRaw))
+		fragment := bytes.Clone(packet)
+		fragment[7] = 0x10
+		assert.Nil(t, udpPayload(fragment, linkTypeRaw))
+		assert.Nil(t, udpPayload(packet, 147))
+	})
+}
@@ -0,0 +1,272 @@
+package webrtcplayback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultStreamID = "playback"
+	defaultMTU      = 1200
+	// defaultFrameDuration separates the last frame of a looped file from the first
+	// one when the file has a single frame.
+	defaultFrameDuration = 20 * time.Millisecond
+)
+
+var (
+	ErrUnsupportedFile = errors.New("unsupported media file")
+	ErrCodecRequired   = errors.New("codec required to play a packet capture")
+	ErrPlayerStarted   = errors.New("player already started")
+	ErrPlayerClosed    = errors.New("player closed")
+)
+
+type PlayerConfig struct {
+	// TrackID is the ID of the published track. Defaults to the file name without its
+	// extension.
+	TrackID string
+	// StreamID is the stream ID of the published track. Defaults to "playback".
+	StreamID string
+	// Codec is the codec of the stream of a pcap or pcapng capture, which it is
+	// required for. IVF and Ogg files carry their codec.
+	Codec *webrtc.RTPCodecCapability
+	// SSRC selects the stream of a capture. Defaults to the first RTP stream in it.
+	SSRC uint32
+	// MTU is the largest RTP payload frames of IVF and Ogg files are packetized into.
+	// Defaults to 1200 bytes.
+	MTU int
+	// Loop starts the file over at its end, continuing sequence numbers and timestamps.
+	Loop bool
+	// OnEnd is called when playback stops by itself: at the end of a file that does
+	// not loop, with a nil error, or on a read error.
+	OnEnd func(err error)
+	// LoggerFactory creates the player logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+mediaFrame is a frame of a file and the packets it is sent in. at and timestamp are
+its position from the start of the file, the latter in units of the clock rate.
+Packets carry their payload and marker bit; the player stamps the rest.
+*/
+type mediaFrame struct {
+	at        time.Duration
+	timestamp uint32
+	packets   []*rtp.Packet
+}
+
+/*
+mediaSource reads the frames of a file in order, returning io.EOF at its end.
+*/
+type mediaSource interface {
+	codec() webrtc.RTPCodecCapability
+	next() (*mediaFrame, error)
+	rewind() error
+	close() error
+}
+
+/*
+FilePlayer publishes a media file as a local track, paced at the speed it was
+recorded at.
+*/
+type FilePlayer struct {
+	track          *webrtc.TrackLocalStaticRTP
+	source         mediaSource
+	clockRate      uint32
+	loop           bool
+	onEnd          func(err error)
+	sequenceNumber uint16
+	timestamp      uint32
+	mu             sync.Mutex
+	started        bool
+	closed         bool
+	stop           chan struct{}
+	done           chan struct{}
+	log            logging.LeveledLogger
+}
+
+/*
+NewFilePlayer opens the file at path, recognizing its format by its contents, and
+creates the track it is played to. Playback starts with Start.
+*/
+func NewFilePlayer(path string, config PlayerConfig) (*FilePlayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	source, err := openSource(file, config)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	trackID := config.TrackID
+	if trackID == "" {
+		trackID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	streamID := config.StreamID
+	if streamID == "" {
+		streamID = defaultStreamID
+	}
+	codec := source.codec()
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, trackID, streamID)
+	if err != nil {
+		source.close()
+		return nil, err
+	}
+	return &FilePlayer{
+		track:          track,
+		source:         source,
+		clockRate:      codec.ClockRate,
+		loop:           config.Loop,
+		onEnd:          config.OnEnd,
+		sequenceNumber: uint16(rand.Uint32()),
+		timestamp:      rand.Uint32(),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		log:            webrtclog.NewLogger(config.LoggerFactory, "file-player", "track_id", trackID, "path", path),
+	}, nil
+}
+
+/*
+openSource picks the reader of file by its first bytes.
+*/
+func openSource(file *os.File, config PlayerConfig) (mediaSource, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFile, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	switch {
+	case string(magic) == "DKIF":
+		return newIVFSource(file, uint16(mtu))
+	case string(magic) == "OggS":
+		return newOggSource(file)
+	case bytes.Equal(magic, binary.LittleEndian.AppendUint32(nil, pcapngSectionHeaderBlock)) || isPcapMagic(magic):
+		if config.Codec == nil {
+			return nil, ErrCodecRequired
+		}
+		return newPcapSource(file, *config.Codec, config.SSRC)
+	default:
+		return nil, ErrUnsupportedFile
+	}
+}
+
+/*
+Track returns the track the file is played to, to pass to SfuPeer.AddPeerTrack.
+*/
+func (p *FilePlayer) Track() *webrtc.TrackLocalStaticRTP {
+	return p.track
+}
+
+/*
+Start starts playing the file. A player starts once.
+*/
+func (p *FilePlayer) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPlayerClosed
+	}
+	if p.started {
+		return ErrPlayerStarted
+	}
+	p.started = true
+	go p.play()
+	return nil
+}
+
+/*
+Close stops playback and closes the file. Closing again does nothing.
+*/
+func (p *FilePlayer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	started := p.started
+	close(p.stop)
+	p.mu.Unlock()
+	if started {
+		<-p.done
+	}
+	return p.source.close()
+}
+
+/*
+play writes the frames of the file to the track, each when its time has come since
+the start. A looped file goes on one frame duration after its last frame.
+*/
+func (p *FilePlayer) play() {
+	defer close(p.done)
+	p.log.Infof("Playing file")
+	start := time.Now()
+	var loopTimestamp uint64
+	var last *mediaFrame
+	frameDuration := uint32(uint64(p.clockRate) * uint64(defaultFrameDuration) / uint64(time.Second))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		frame, err := p.source.next()
+		if errors.Is(err, io.EOF) && p.loop && last != nil {
+			loopTimestamp += uint64(last.timestamp) + uint64(frameDuration)
+			last = nil
+			if err = p.source.rewind(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+				p.log.Infof("Playback ended")
+			} else {
+				p.log.Warnf("Error reading file: %v", err)
+			}
+			if p.onEnd != nil {
+				p.onEnd(err)
+			}
+			return
+		}
+		if last != nil && frame.timestamp != last.timestamp {
+			frameDuration = frame.timestamp - last.timestamp
+		}
+		last = frame
+
+		loopOffset := time.Duration(loopTimestamp * uint64(time.Second) / uint64(p.clockRate))
+		timer.Reset(time.Until(start.Add(loopOffset + frame.at)))
+		select {
+		case <-p.stop:
+			return
+		case <-timer.C:
+		}
+		for _, packet := range frame.packets {
+			packet.Version = 2
+			packet.SequenceNumber = p.sequenceNumber
+			packet.Timestamp = p.timestamp + uint32(loopTimestamp) + frame.timestamp
+			p.sequenceNumber++
+			if err := p.track.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				p.log.Warnf("Error writing packet: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package webrtcplayback
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/frame"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type packetSink struct {
+	mu      sync.Mutex
+	packets []*rtp.Packet
+	arrived []time.Time
+}
+
+func (s *packetSink) WriteRTP(packet *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, packet)
+	s.arrived = append(s.arrived, time.Now())
+	return nil
+}
+
+func (s *packetSink) Close() error {
+	return nil
+}
+
+func (s *packetSink) received() ([]*rtp.Packet, []time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*rtp.Packet(nil), s.packets...), append([]time.Time(nil), s.arrived...)
+}
+
+/*
+writeIVF writes frames to an IVF file with a millisecond time base, one every interval.
+*/
+func writeIVF(t *testing.T, path string, fourcc string, frames [][]byte, interval time.Duration) {
+	t.Helper()
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	data := header
+	for i, frame := range frames {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(frame)))
+		data = binary.LittleEndian.AppendUint64(data, uint64(time.Duration(i)*interval/time.Millisecond))
+		data = append(data, frame...)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+oggPage returns an Ogg page of the stream serial carrying the given segments of
+packets, whose lacing values the caller lays out.
+*/
+func oggPage(serial uint32, headerType byte, lacing []byte, body []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0, headerType)
+	page = binary.LittleEndian.AppendUint64(page, 0)
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = binary.LittleEndian.AppendUint32(page, 0)
+	page = binary.LittleEndian.AppendUint32(page, 0)
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+func vp8Frame(keyframe bool) []byte {
+	frame := []byte{0x01, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01, 0xaa, 0xbb}
+	if keyframe {
+		frame[0] = 0x00
+	}
+	return frame
+}
+
+/*
+playToSink plays the file at path to a sink attached to the player's track on a
+peer, the way subscribers receive it.
+*/
+func playToSink(t *testing.T, path string, config PlayerConfig) (*FilePlayer, *packetSink) {
+	t.Helper()
+	player, err := NewFilePlayer(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { player.Close() })
+	peer, err := webrtcpeer.NewSfuPeer("playback", &webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Shutdown)
+	track := player.Track()
+	peer.LocalTracks[track.ID()] = track
+	sink := &packetSink{}
+	assert.Nil(t, peer.AttachTrackSink(track.ID(), sink))
+	assert.Nil(t, player.Start())
+	return player, sink
+}
+
+func TestFilePlayer(t *testing.T) {
+	t.Run("Plays an IVF file paced by its timestamps", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "intro.ivf")
+		writeIVF(t, path, "VP80", [][]byte{vp8Frame(true), vp8Frame(false), vp8Frame(false), vp8Frame(false)}, 40*time.Millisecond)
+		ended := make(chan error, 1)
+		player, sink := playToSink(t, path, PlayerConfig{OnEnd: func(err error) { ended <- err }})
+		assert.Equal(t, "intro", player.Track().ID())
+		assert.Equal(t, "playback", player.Track().StreamID())
+		select {
+		case err := <-ended:
+			assert.Nil(t, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("playback did not end")
+		}
+
+		// The sink is fed on its own goroutine, which may still hold the last packet.
+		assert.Eventually(t, func() bool {
+			packets, _ := sink.received()
+			return len(packets) == 4
+		}, 2*time.Second, 10*time.Millisecond)
+		packets, arrived := sink.received()
+		assert.Len(t, packets, 4)
+		for i, packet := range packets {
+			assert.Equal(t, packets[0].SequenceNumber+uint16(i), packet.SequenceNumber)
+			assert.Equal(t, packets[0].Timestamp+uint32(i)*3600, packet.Timestamp)
+			assert.True(t, packet.Marker)
+			vp8 := codecs.VP8Packet{}
+			data, err := vp8.Unmarshal(packet.Payload)
+			assert.Nil(t, err)
+			assert.Equal(t, vp8Frame(i == 0), data)
+		}
+		assert.GreaterOrEqual(t, arrived[3].Sub(arrived[0]), 100*time.Millisecond)
+		assert.ErrorIs(t, player.Start(), ErrPlayerStarted)
+	})
+	t.Run("Loops with continuous timestamps", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "hold.ivf")
+		writeIVF(t, path, "VP80", [][]byte{vp8Frame(true), vp8Frame(false)}, 20*time.Millisecond)
+		player, sink := playToSink(t, path, PlayerConfig{Loop: true})
+		assert.Eventually(t, func() bool {
+			packets, _ := sink.received()
+			return len(packets) >= 6
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Nil(t, player.Close())
+
+		packets, _ := sink.received()
+		for i, packet := range packets[:6] {
+			assert.Equal(t, packets[0].Timestamp+uint32(i)*1800, packet.Timestamp)
+			assert.Equal(t, packets[0].SequenceNumber+uint16(i), packet.SequenceNumber)
+		}
+		assert.ErrorIs(t, player.Start(), ErrPlayerClosed)
+	})
+	t.Run("Plays Opus from Ogg pages", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "music.ogg")
+		head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0)
+		tags := append([]byte("OpusTags"), 0, 0, 0, 0, 0, 0, 0, 0)
+		// A 20ms packet, a 300 byte 20ms packet spanning two segments and two pages, and
+		// a packet of three 10ms frames.
+		long := append([]byte{0xfc}, make([]byte, 299)...)
+		var data []byte
+		data = append(data, oggPage(7, 0x02, []byte{19}, head)...)
+		data = append(data, oggPage(7, 0, []byte{16}, tags)...)
+		data = append(data, oggPage(7, 0, []byte{3, 255}, append([]byte{0xfc, 0xff, 0xfe}, long[:255]...))...)
+		data = append(data, oggPage(7, 0x01, []byte{45, 3}, append(long[255:], 0xf3, 0x03, 0x03))...)
+		// A page of another logical stream is skipped.
+		data = append(data, oggPage(8, 0x02, []byte{1}, []byte{0xfc})...)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ended := make(chan error, 1)
+		player, sink := playToSink(t, path, PlayerConfig{OnEnd: func(err error) { ended <- err }})
+		assert.Equal(t, webrtc.MimeTypeOpus, player.Track().Codec().MimeType)
+		select {
+		case err := <-ended:
+			assert.Nil(t, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("playback did not end")
+		}
+		assert.Eventually(t, func() bool {
+			packets, _ := sink.received()
+			return len(packets) == 3
+		}, 2*time.Second, 10*time.Millisecond)
+		packets, _ := sink.received()
+		assert.Len(t, packets, 3)
+		assert.Equal(t, long, packets[1].Payload)
+		assert.Equal(t, []uint32{0, 960, 1920}, []uint32{
+			packets[0].Timestamp - packets[0].Timestamp,
+			packets[1].Timestamp - packets[0].Timestamp,
+			packets[2].Timestamp - packets[0].Timestamp,
+		})
+	})
+	t.Run("Rejects files it cannot play", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		text := filepath.Join(dir, "notes.txt")
+		assert.Nil(t, os.WriteFile(text, []byte("not media"), 0o644))
+		_, err := NewFilePlayer(text, PlayerConfig{})
+		assert.ErrorIs(t, err, ErrUnsupportedFile)
+		h264 := filepath.Join(dir, "camera.ivf")
+		writeIVF(t, h264, "H264", nil, 0)
+		_, err = NewFilePlayer(h264, PlayerConfig{})
+		assert.ErrorIs(t, err, ErrUnsupportedFile)
+		capture := filepath.Join(dir, "call.pcap")
+		writePcap(t, capture, nil)
+		_, err = NewFilePlayer(capture, PlayerConfig{})
+		assert.ErrorIs(t, err, ErrCodecRequired)
+	})
+}
+
+func TestAV1Payloader(t *testing.T) {
+	t.Run("Packetizes the OBUs of a temporal unit", func(t *testing.T) {
+		t.Parallel()
+		sequenceHeader := []byte{0x0a, 0x03, 0x00, 0x00, 0x00}
+		frameOBU := append([]byte{0x32, 0x90, 0x03}, make([]byte, 400)...)
+		for i := range frameOBU[3:] {
+			frameOBU[3+i] = byte(i)
+		}
+		// A temporal delimiter, then the sequence header and a frame with size fields.
+		unit := append([]byte{0x12, 0x00}, sequenceHeader...)
+		unit = append(unit, frameOBU...)
+
+		payloads := (&av1Payloader{}).Payload(150, unit)
+		assert.Len(t, payloads, 3)
+		assert.Equal(t, byte(av1AggregationN|av1AggregationY), payloads[0][0])
+		assert.Equal(t, byte(av1AggregationZ|av1AggregationY), payloads[1][0])
+		assert.Equal(t, byte(av1AggregationZ), payloads[2][0])
+
+		var assembler frame.AV1
+		var obus [][]byte
+		for _, payload := range payloads {
+			assert.LessOrEqual(t, len(payload), 150)
+			packet := codecs.AV1Packet{}
+			_, err := packet.Unmarshal(payload)
+			assert.Nil(t, err)
+			frames, err := assembler.ReadFrames(&packet)
+			assert.Nil(t, err)
+			obus = append(obus, frames...)
+		}
+		// OBUs go out without their size field.
+		assert.Equal(t, [][]byte{{0x08, 0x00, 0x00, 0x00}, append([]byte{0x30}, frameOBU[3:]...)}, obus)
+	})
+}
@@ -0,0 +1,18 @@
+/*
+Package webrtcrecord records the tracks of SfuPeers to files.
+
+A TrackRecorder is a webrtcpeer.TrackSink: RecordTrack attaches one to a local
+track of a peer, where it sees the same packets the track forwards to its
+subscribers. Packets pass through a reorder buffer before they are written, video
+recordings start at a keyframe and resume at the next one after packet loss, and
+the file is finalized when the track ends, the peer shuts down or the recorder is
+closed.
+
+A WebMRecorder muxes the audio and video tracks of a publisher into WebM files,
+aligning them on the sender's wallclock with RTCP Sender Reports. RecordWebM
+attaches one to a pair of local tracks.
+
+An FMP4Writer muxes H.264 video and Opus audio into fragmented MP4, written to a
+file by RecordFMP4 or handed over fragment by fragment to build HLS or DASH on.
+*/
+package webrtcrecord
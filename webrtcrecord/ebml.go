@@ -0,0 +1,147 @@
+package webrtcrecord
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/*
+Matroska element IDs written by the WebM recorder, with their length marker bits.
+*/
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	ebmlIDVoid               = 0xEC
+
+	mkvIDSegment            = 0x18538067
+	mkvIDSeekHead           = 0x114D9B74
+	mkvIDSeek               = 0x4DBB
+	mkvIDSeekID             = 0x53AB
+	mkvIDSeekPosition       = 0x53AC
+	mkvIDInfo               = 0x1549A966
+	mkvIDTimecodeScale      = 0x2AD7B1
+	mkvIDMuxingApp          = 0x4D80
+	mkvIDWritingApp         = 0x5741
+	mkvIDDuration           = 0x4489
+	mkvIDTracks             = 0x1654AE6B
+	mkvIDTrackEntry         = 0xAE
+	mkvIDTrackNumber        = 0xD7
+	mkvIDTrackUID           = 0x73C5
+	mkvIDTrackType          = 0x83
+	mkvIDCodecID            = 0x86
+	mkvIDCodecPrivate       = 0x63A2
+	mkvIDCodecDelay         = 0x56AA
+	mkvIDSeekPreRoll        = 0x56BB
+	mkvIDVideo              = 0xE0
+	mkvIDPixelWidth         = 0xB0
+	mkvIDPixelHeight        = 0xBA
+	mkvIDAudio              = 0xE1
+	mkvIDSamplingFrequency  = 0xB5
+	mkvIDChannels           = 0x9F
+	mkvIDCluster            = 0x1F43B675
+	mkvIDTimecode           = 0xE7
+	mkvIDSimpleBlock        = 0xA3
+	mkvIDCues               = 0x1C53BB6B
+	mkvIDCuePoint           = 0xBB
+	mkvIDCueTime            = 0xB3
+	mkvIDCueTrackPositions  = 0xB7
+	mkvIDCueTrack           = 0xF7
+	mkvIDCueClusterPosition = 0xF1
+)
+
+// ebmlUnknownSize is the reserved 8 byte size of an element whose size is not known yet.
+var ebmlUnknownSize = []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+/*
+ebmlSize encodes an element size as a variable length integer of the fewest bytes.
+The all ones value of each length is reserved, so it takes the next length.
+*/
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	return ebmlSizeOfLength(size, length)
+}
+
+func ebmlSizeOfLength(size uint64, length int) []byte {
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(size)
+		size >>= 8
+	}
+	data[0] |= 0x80 >> (length - 1)
+	return data
+}
+
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	size := 0
+	for _, d := range data {
+		size += len(d)
+	}
+	element := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, d := range data {
+		element = append(element, d...)
+	}
+	return element
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	length := 1
+	for length < 8 && value >= 1<<(8*length) {
+		length++
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return ebmlElement(id, data[8-length:])
+}
+
+/*
+ebmlFixedUint encodes an unsigned integer in 8 bytes, so it can be overwritten in place.
+*/
+func ebmlFixedUint(id uint32, value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(value))
+	return ebmlElement(id, data)
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+/*
+ebmlVoid returns a Void element taking up exactly size bytes, which must be at least 2.
+*/
+func ebmlVoid(size int) []byte {
+	length := 1
+	if size-2 >= 1<<7-1 {
+		length = 8
+	}
+	element := append(ebmlID(ebmlIDVoid), ebmlSizeOfLength(uint64(size-1-length), length)...)
+	return append(element, make([]byte, size-1-length)...)
+}
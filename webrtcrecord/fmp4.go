@@ -0,0 +1,599 @@
+package webrtcrecord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtccodec"
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultFragmentDuration = time.Second
+
+/*
+FMP4Fragment is a piece of a fragmented MP4 stream: an initialization segment, or a
+fragment of media that follows the last one.
+*/
+type FMP4Fragment struct {
+	// Init is true for an initialization segment, the ftyp and moov boxes a player
+	// needs before the fragments after it. A new one follows when the video
+	// parameters change; it is only passed to OnFragment, as players of a file
+	// expect a single one.
+	Init bool
+	Data []byte
+	// Codecs is the RFC 6381 codecs parameter of an initialization segment, such as
+	// "avc1.42e01f,opus".
+	Codecs string
+	// Sequence numbers the fragments from 1.
+	Sequence uint32
+	// Start is the time of the fragment from the start of the stream.
+	Start    time.Duration
+	Duration time.Duration
+	// Independent is true for a fragment that starts with a video keyframe or has
+	// no video, where playback can start.
+	Independent bool
+}
+
+type FMP4Config struct {
+	// ReorderBufferSize is the number of packets of a track held back waiting for a
+	// missing one. Defaults to 64; a negative value writes packets in arrival order.
+	ReorderBufferSize int
+	// FragmentDuration is the longest a fragment gets. Fragments also end before every
+	// video keyframe. Defaults to 1 second.
+	FragmentDuration time.Duration
+	// SenderReport returns the last Sender Report of the track of the kind, used to
+	// align the tracks. RecordFMP4 reads it from the publisher. Without it, or
+	// until there is one for both tracks, tracks are aligned by packet arrival time.
+	SenderReport func(kind webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool)
+	// OnFragment is called with every initialization segment and fragment, in order.
+	// The data may be kept.
+	OnFragment func(fragment FMP4Fragment)
+	// OnKeyframeNeeded is called when the video waits for a keyframe: when the
+	// stream starts and after packet loss. RecordFMP4 asks the publisher for one.
+	OnKeyframeNeeded func()
+	// LoggerFactory creates the writer logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+type fmp4Track struct {
+	mp4        *mp4Track
+	kind       webrtc.RTPCodecType
+	buffer     *reorderBuffer
+	frames     *frameAssembler
+	timestamps timestampUnwrapper
+	sink       *fmp4Sink
+	closed     bool
+	// started is set by the first sample, whose timestamp is at baseTime on the
+	// timeline of the stream.
+	started        bool
+	firstTimestamp uint64
+	baseTime       uint64
+	// pending is the last sample, whose duration is known once the next one arrives.
+	pending      *mp4Sample
+	samples      []mp4Sample
+	lastDuration uint32
+	sps          []byte
+	pps          []byte
+}
+
+func (t *fmp4Track) duration(ticks uint64) time.Duration {
+	return time.Duration(ticks * uint64(time.Second) / uint64(t.mp4.timescale))
+}
+
+/*
+FMP4Writer muxes an H.264 video and an Opus audio track into a fragmented MP4
+stream, written to an io.Writer, passed to OnFragment, or both. Fragments hold the
+samples of both tracks and end before every video keyframe or once they reach
+FragmentDuration, which makes them usable as the segments and parts of HLS or DASH.
+Keyframes keep their SPS and PPS in-band, so the io.Writer keeps the first
+initialization segment when the video parameters change.
+
+The stream starts at the first video keyframe carrying its SPS and PPS. Packets are
+written through the sinks returned by AudioSink and VideoSink, and the stream ends
+with a last fragment once both are closed, or by Close.
+*/
+type FMP4Writer struct {
+	mu         sync.Mutex
+	config     FMP4Config
+	out        io.Writer
+	closer     io.Closer
+	tracks     []*fmp4Track
+	video      *fmp4Track
+	started    bool
+	origin     time.Time
+	originWall time.Time
+	sequence   uint32
+	fragments  []FMP4Fragment
+	closed     bool
+	err        error
+	now        func() time.Time
+	log        logging.LeveledLogger
+}
+
+/*
+NewFMP4Writer creates a writer of a stream with an Opus audio track and an H.264
+video track, either of which may be nil. out may be nil to only pass the stream to
+OnFragment.
+*/
+func NewFMP4Writer(audio, video *webrtc.RTPCodecCapability, out io.Writer, config FMP4Config) (*FMP4Writer, error) {
+	if audio == nil && video == nil {
+		return nil, fmt.Errorf("%w: no tracks", ErrUnsupportedCodec)
+	}
+	if config.FragmentDuration <= 0 {
+		config.FragmentDuration = defaultFragmentDuration
+	}
+	size := config.ReorderBufferSize
+	if size == 0 {
+		size = defaultReorderBufferSize
+	}
+	w := &FMP4Writer{
+		config: config,
+		out:    out,
+		now:    time.Now,
+		log:    webrtclog.NewLogger(config.LoggerFactory, "fmp4-writer"),
+	}
+	if video != nil {
+		if !strings.EqualFold(video.MimeType, webrtc.MimeTypeH264) {
+			return nil, unsupportedCodec(*video)
+		}
+		frames, err := newFrameAssembler(*video, w.keyframeNeeded)
+		if err != nil {
+			return nil, err
+		}
+		w.video = &fmp4Track{
+			mp4:    &mp4Track{id: 1, timescale: clockRateOr(*video, 90000), video: true},
+			kind:   webrtc.RTPCodecTypeVideo,
+			buffer: newReorderBuffer(max(size, 0)),
+			frames: frames,
+		}
+		w.tracks = append(w.tracks, w.video)
+	}
+	if audio != nil {
+		sampleRate, channels, err := opusParameters(*audio)
+		if err != nil {
+			return nil, err
+		}
+		w.tracks = append(w.tracks, &fmp4Track{
+			mp4: &mp4Track{
+				id:         uint32(len(w.tracks) + 1),
+				timescale:  sampleRate,
+				channels:   channels,
+				sampleRate: sampleRate,
+			},
+			kind:   webrtc.RTPCodecTypeAudio,
+			buffer: newReorderBuffer(max(size, 0)),
+		})
+	}
+	for _, track := range w.tracks {
+		track.sink = &fmp4Sink{writer: w, track: track}
+	}
+	return w, nil
+}
+
+/*
+RecordFMP4 records the local tracks audioTrackID and videoTrackID of peer to a
+fragmented MP4 file at path until both tracks end, the peer shuts down or the writer
+is closed. Either track ID may be empty to record only the other track.
+*/
+func RecordFMP4(peer *webrtcpeer.SfuPeer, audioTrackID string, videoTrackID string, path string, config FMP4Config) (*FMP4Writer, error) {
+	codecs, err := localTrackCodecs(peer, audioTrackID, videoTrackID)
+	if err != nil {
+		return nil, err
+	}
+	if config.SenderReport == nil {
+		config.SenderReport = publisherSenderReports(peer, audioTrackID, videoTrackID)
+	}
+	if config.OnKeyframeNeeded == nil && videoTrackID != "" {
+		config.OnKeyframeNeeded = peer.KeyframeRequester(videoTrackID)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewFMP4Writer(codecs[audioTrackID], codecs[videoTrackID], file, config)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	writer.closer = file
+	if err := attachSinks(peer, audioTrackID, writer.AudioSink(), videoTrackID, writer.VideoSink()); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+/*
+fmp4Sink feeds one track of an FMP4Writer.
+*/
+type fmp4Sink struct {
+	writer *FMP4Writer
+	track  *fmp4Track
+}
+
+func (s *fmp4Sink) WriteRTP(packet *rtp.Packet) error {
+	return s.writer.writeRTP(s.track, packet)
+}
+
+func (s *fmp4Sink) Close() error {
+	return s.writer.closeTrack(s.track)
+}
+
+/*
+AudioSink returns the sink of the audio track, or nil when the writer has none.
+*/
+func (w *FMP4Writer) AudioSink() webrtcpeer.TrackSink {
+	return w.sink(webrtc.RTPCodecTypeAudio)
+}
+
+/*
+VideoSink returns the sink of the video track, or nil when the writer has none.
+*/
+func (w *FMP4Writer) VideoSink() webrtcpeer.TrackSink {
+	return w.sink(webrtc.RTPCodecTypeVideo)
+}
+
+func (w *FMP4Writer) sink(kind webrtc.RTPCodecType) webrtcpeer.TrackSink {
+	for _, track := range w.tracks {
+		if track.kind == kind {
+			return track.sink
+		}
+	}
+	return nil
+}
+
+func (w *FMP4Writer) writeRTP(track *fmp4Track, packet *rtp.Packet) error {
+	w.mu.Lock()
+	if w.closed || track.closed {
+		w.mu.Unlock()
+		return ErrRecorderClosed
+	}
+	if w.err == nil {
+		w.err = track.buffer.push(packet, func(packet *rtp.Packet, gap bool) error {
+			return w.depacketize(track, packet, gap)
+		})
+	}
+	err := w.err
+	fragments := w.takeFragments()
+	w.mu.Unlock()
+	w.notifyFragments(fragments)
+	return err
+}
+
+func (w *FMP4Writer) depacketize(track *fmp4Track, packet *rtp.Packet, gap bool) error {
+	if track.frames == nil {
+		if len(packet.Payload) == 0 {
+			return nil
+		}
+		return w.addSample(track, packet.Timestamp, mp4Sample{data: append([]byte(nil), packet.Payload...), sync: true}, nil)
+	}
+	return track.frames.push(packet, gap, func(data []byte, timestamp uint32, keyframe bool) error {
+		return w.addVideoFrame(track, data, timestamp, keyframe)
+	})
+}
+
+/*
+addVideoFrame converts an access unit to a sample, keeping the SPS and PPS it
+carries. The stream starts at the first keyframe after both are known, and a
+keyframe changing them starts a fragment after a new initialization segment for
+OnFragment.
+*/
+func (w *FMP4Writer) addVideoFrame(track *fmp4Track, data []byte, timestamp uint32, keyframe bool) error {
+	nalus := h264NALUnits(data)
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1f {
+		case h264NALUnitSPS:
+			track.sps = append([]byte(nil), nalu...)
+		case h264NALUnitPPS:
+			track.pps = append([]byte(nil), nalu...)
+		}
+	}
+	sample := mp4Sample{data: h264AVCSample(nalus), sync: keyframe}
+	if !keyframe || track.sps == nil || track.pps == nil ||
+		(bytes.Equal(track.sps, track.mp4.sps) && bytes.Equal(track.pps, track.mp4.pps)) {
+		if track.mp4.sps == nil {
+			if keyframe {
+				w.keyframeNeeded()
+			}
+			return nil
+		}
+		return w.addSample(track, timestamp, sample, nil)
+	}
+	sps, err := webrtccodec.ParseH264SPS(track.sps)
+	if err != nil {
+		w.log.Warnf("Dropping keyframe: %v", err)
+		w.keyframeNeeded()
+		return nil
+	}
+	reinit := func() error {
+		track.mp4.sps, track.mp4.pps = track.sps, track.pps
+		track.mp4.width, track.mp4.height = sps.Width, sps.Height
+		return w.start()
+	}
+	if !w.started {
+		if err := reinit(); err != nil {
+			return err
+		}
+		return w.addSample(track, timestamp, sample, nil)
+	}
+	return w.addSample(track, timestamp, sample, func() error {
+		if err := w.cut(); err != nil {
+			return err
+		}
+		return reinit()
+	})
+}
+
+/*
+start writes an initialization segment, to the output only if it is the first.
+*/
+func (w *FMP4Writer) start() error {
+	restart := w.started
+	w.started = true
+	var tracks []*mp4Track
+	var codecs []string
+	for _, track := range w.tracks {
+		tracks = append(tracks, track.mp4)
+		codecs = append(codecs, track.mp4.codec())
+	}
+	init, err := mp4InitSegment(tracks)
+	if err != nil {
+		return err
+	}
+	fragment := FMP4Fragment{Init: true, Data: init, Codecs: strings.Join(codecs, ",")}
+	if restart {
+		w.queueFragment(fragment)
+		return nil
+	}
+	return w.emit(fragment)
+}
+
+/*
+addSample places a sample on the timeline of the stream and adds the sample before
+it, now that its duration is known, then calls before, if set, ahead of the sample.
+The first sample of a track is placed by its Sender Report when there are reports,
+and by its arrival time otherwise.
+*/
+func (w *FMP4Writer) addSample(track *fmp4Track, timestamp uint32, sample mp4Sample, before func() error) error {
+	unwrapped := track.timestamps.unwrap(timestamp)
+	if !w.started {
+		if w.video != nil {
+			return nil
+		}
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if !track.started {
+		now := w.now()
+		if w.origin.IsZero() {
+			w.origin = now
+		}
+		offset := now.Sub(w.origin)
+		if w.config.SenderReport != nil {
+			if report, ok := w.config.SenderReport(track.kind); ok {
+				wall := report.Time(timestamp, track.mp4.timescale)
+				if w.originWall.IsZero() {
+					w.originWall = wall.Add(-offset)
+				}
+				offset = wall.Sub(w.originWall)
+			}
+		}
+		if offset < 0 {
+			return nil
+		}
+		track.started = true
+		track.firstTimestamp = unwrapped
+		track.baseTime = uint64(offset) * uint64(track.mp4.timescale) / uint64(time.Second)
+	}
+	if unwrapped < track.firstTimestamp {
+		return nil
+	}
+	sample.decodeTime = track.baseTime + unwrapped - track.firstTimestamp
+	if track.pending != nil {
+		if sample.decodeTime < track.pending.decodeTime {
+			sample.decodeTime = track.pending.decodeTime
+		}
+		track.pending.duration = uint32(sample.decodeTime - track.pending.decodeTime)
+		track.lastDuration = track.pending.duration
+		if err := w.appendSample(track, *track.pending); err != nil {
+			return err
+		}
+	}
+	if before != nil {
+		if err := before(); err != nil {
+			return err
+		}
+	}
+	track.pending = &sample
+	return nil
+}
+
+/*
+leader returns the track whose samples decide where fragments end: the video while
+it is open, the audio otherwise.
+*/
+func (w *FMP4Writer) leader() *fmp4Track {
+	if w.video != nil && !w.video.closed {
+		return w.video
+	}
+	for _, track := range w.tracks {
+		if !track.closed {
+			return track
+		}
+	}
+	return w.tracks[0]
+}
+
+func (w *FMP4Writer) appendSample(track *fmp4Track, sample mp4Sample) error {
+	if leader := w.leader(); track == leader && len(track.samples) > 0 {
+		elapsed := track.duration(sample.decodeTime - track.samples[0].decodeTime)
+		if (sample.sync && track.mp4.video) || elapsed >= w.config.FragmentDuration {
+			if err := w.cut(); err != nil {
+				return err
+			}
+		}
+	}
+	track.samples = append(track.samples, sample)
+	return nil
+}
+
+/*
+cut ends the current fragment with the samples of the leader and the samples of the
+other tracks before its end.
+*/
+func (w *FMP4Writer) cut() error {
+	leader := w.leader()
+	if len(leader.samples) == 0 {
+		return nil
+	}
+	first, last := leader.samples[0], leader.samples[len(leader.samples)-1]
+	start := leader.duration(first.decodeTime)
+	end := leader.duration(last.decodeTime + uint64(last.duration))
+	var tracks []*mp4Track
+	var samples [][]mp4Sample
+	for _, track := range w.tracks {
+		n := len(track.samples)
+		if track != leader {
+			n = 0
+			for n < len(track.samples) && track.duration(track.samples[n].decodeTime) < end {
+				n++
+			}
+		}
+		tracks = append(tracks, track.mp4)
+		samples = append(samples, track.samples[:n])
+		track.samples = track.samples[n:]
+	}
+	w.sequence++
+	return w.emit(FMP4Fragment{
+		Data:        mp4Fragment(w.sequence, tracks, samples),
+		Sequence:    w.sequence,
+		Start:       start,
+		Duration:    end - start,
+		Independent: first.sync,
+	})
+}
+
+func (w *FMP4Writer) emit(fragment FMP4Fragment) error {
+	if w.out != nil {
+		if _, err := w.out.Write(fragment.Data); err != nil {
+			return err
+		}
+	}
+	w.queueFragment(fragment)
+	return nil
+}
+
+/*
+queueFragment keeps a fragment for OnFragment, which is called once the lock is released.
+*/
+func (w *FMP4Writer) queueFragment(fragment FMP4Fragment) {
+	if w.config.OnFragment != nil {
+		w.fragments = append(w.fragments, fragment)
+	}
+}
+
+func (w *FMP4Writer) takeFragments() []FMP4Fragment {
+	fragments := w.fragments
+	w.fragments = nil
+	return fragments
+}
+
+func (w *FMP4Writer) notifyFragments(fragments []FMP4Fragment) {
+	for _, fragment := range fragments {
+		w.config.OnFragment(fragment)
+	}
+}
+
+func (w *FMP4Writer) keyframeNeeded() {
+	if w.config.OnKeyframeNeeded != nil {
+		w.config.OnKeyframeNeeded()
+	}
+}
+
+/*
+closeTrack writes what is left of a track and ends the stream once every track is closed.
+*/
+func (w *FMP4Writer) closeTrack(track *fmp4Track) error {
+	w.mu.Lock()
+	if w.closed || track.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.flushTrack(track)
+	for _, track := range w.tracks {
+		if !track.closed {
+			err := w.err
+			fragments := w.takeFragments()
+			w.mu.Unlock()
+			w.notifyFragments(fragments)
+			return err
+		}
+	}
+	w.mu.Unlock()
+	return w.Close()
+}
+
+/*
+flushTrack writes the packets held back by the reorder buffer and the last sample,
+which is given the duration of the one before it.
+*/
+func (w *FMP4Writer) flushTrack(track *fmp4Track) {
+	if w.err == nil {
+		w.err = track.buffer.flush(func(packet *rtp.Packet, gap bool) error {
+			return w.depacketize(track, packet, gap)
+		})
+	}
+	if w.err == nil && track.pending != nil {
+		track.pending.duration = track.lastDuration
+		w.err = w.appendSample(track, *track.pending)
+		track.pending = nil
+	}
+	if w.err == nil && track == w.leader() && w.started {
+		// Samples of the other tracks past the end of this one are cut against the
+		// next leader once it closes.
+		w.err = w.cut()
+	}
+	track.closed = true
+}
+
+/*
+Close writes the last fragment and closes the output if RecordFMP4 opened it.
+Closing again does nothing.
+*/
+func (w *FMP4Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	for _, track := range w.tracks {
+		if !track.closed {
+			w.flushTrack(track)
+		}
+	}
+	w.closed = true
+	err := w.err
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	fragments := w.takeFragments()
+	w.mu.Unlock()
+	if err != nil {
+		w.log.Warnf("Error finishing fragmented MP4: %v", err)
+	}
+	w.notifyFragments(fragments)
+	return err
+}
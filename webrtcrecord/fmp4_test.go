@@ -0,0 +1,229 @@
+package webrtcrecord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var h264Codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+
+// testSPS is a 1920x1080 Constrained Baseline SPS with emulation prevention bytes.
+var (
+	testSPS, _ = hex.DecodeString("6742c01fda01e0089f96101000000300100000030320f1831960")
+	testPPS    = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+/*
+h264Packets returns the packets of an H.264 access unit: a keyframe is a STAP-A with
+sps and the PPS followed by an IDR slice in two FU-A fragments, an interframe a
+single slice.
+*/
+func h264Packets(seq uint16, timestamp uint32, keyframe bool, sps []byte) []*rtp.Packet {
+	if !keyframe {
+		return []*rtp.Packet{{Header: rtp.Header{SequenceNumber: seq, Timestamp: timestamp, Marker: true}, Payload: []byte{0x41, 0x9a, 0x01}}}
+	}
+	stap := []byte{0x18}
+	for _, nalu := range [][]byte{sps, testPPS} {
+		stap = binary.BigEndian.AppendUint16(stap, uint16(len(nalu)))
+		stap = append(stap, nalu...)
+	}
+	return []*rtp.Packet{
+		{Header: rtp.Header{SequenceNumber: seq, Timestamp: timestamp}, Payload: stap},
+		{Header: rtp.Header{SequenceNumber: seq + 1, Timestamp: timestamp}, Payload: []byte{0x7c, 0x85, 0x88, 0x84}},
+		{Header: rtp.Header{SequenceNumber: seq + 2, Timestamp: timestamp, Marker: true}, Payload: []byte{0x7c, 0x45, 0x00, 0x33}},
+	}
+}
+
+type mp4TestBox struct {
+	boxType string
+	body    []byte
+}
+
+func readMP4Boxes(data []byte) []mp4TestBox {
+	var boxes []mp4TestBox
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data)
+		boxes = append(boxes, mp4TestBox{boxType: string(data[4:8]), body: data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+/*
+findMP4Box returns the body of the first box at path, which lists box types from
+the top level down. Full box headers are not skipped.
+*/
+func findMP4Box(data []byte, path ...string) []byte {
+	for _, box := range readMP4Boxes(data) {
+		if box.boxType != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return box.body
+		}
+		return findMP4Box(box.body, path[1:]...)
+	}
+	return nil
+}
+
+func TestFMP4Writer(t *testing.T) {
+	t.Run("Writes fragments of both tracks", func(t *testing.T) {
+		t.Parallel()
+		wallclock := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		var fragments []FMP4Fragment
+		var out bytes.Buffer
+		writer, err := NewFMP4Writer(&opusCodec, &h264Codec, &out, FMP4Config{
+			FragmentDuration: 500 * time.Millisecond,
+			// The audio timestamp 5000 was sampled 200ms after the video timestamp 0.
+			SenderReport: func(kind webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool) {
+				if kind == webrtc.RTPCodecTypeVideo {
+					return senderReport(0, wallclock), true
+				}
+				return senderReport(5000, wallclock.Add(200*time.Millisecond)), true
+			},
+			OnFragment: func(fragment FMP4Fragment) { fragments = append(fragments, fragment) },
+		})
+		assert.Nil(t, err)
+
+		// 2 seconds at 10 frames per second with a keyframe every second.
+		seq := uint16(0)
+		for i := 0; i < 20; i++ {
+			packets := h264Packets(seq, uint32(i)*9000, i%10 == 0, testSPS)
+			seq += uint16(len(packets))
+			for _, packet := range packets {
+				assert.Nil(t, writer.VideoSink().WriteRTP(packet))
+			}
+			for j := 0; j < 5; j++ {
+				assert.Nil(t, writer.AudioSink().WriteRTP(opusPacket(uint16(5*i+j), 5000+uint32(5*i+j)*960)))
+			}
+		}
+		assert.Nil(t, writer.Close())
+
+		// The audio after the end of the video comes in a last fragment of its own.
+		assert.Len(t, fragments, 6)
+		assert.True(t, fragments[0].Init)
+		assert.Equal(t, "avc1.42c01f,opus", fragments[0].Codecs)
+		var independent []bool
+		var starts []time.Duration
+		for i, fragment := range fragments[1:5] {
+			assert.Equal(t, uint32(i+1), fragment.Sequence)
+			assert.Equal(t, 500*time.Millisecond, fragment.Duration)
+			independent = append(independent, fragment.Independent)
+			starts = append(starts, fragment.Start)
+		}
+		assert.Equal(t, []bool{true, false, true, false}, independent)
+		assert.Equal(t, []time.Duration{0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond}, starts)
+		assert.Equal(t, 2*time.Second, fragments[5].Start)
+		assert.Equal(t, 200*time.Millisecond, fragments[5].Duration)
+
+		var stream []byte
+		for _, fragment := range fragments {
+			stream = append(stream, fragment.Data...)
+		}
+		assert.Equal(t, stream, out.Bytes())
+		var types []string
+		for _, box := range readMP4Boxes(stream) {
+			types = append(types, box.boxType)
+		}
+		assert.Equal(t, []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat"}, types)
+
+		avc1 := findMP4Box(fragments[0].Data, "moov", "trak", "mdia", "minf", "stbl", "stsd")[8:]
+		assert.Equal(t, "avc1", string(avc1[4:8]))
+		assert.Equal(t, uint16(1920), binary.BigEndian.Uint16(avc1[8+24:]))
+		assert.Equal(t, uint16(1080), binary.BigEndian.Uint16(avc1[8+26:]))
+
+		// The first fragment has 5 video frames and the audio from 200ms to 500ms.
+		moof := fragments[1].Data
+		trafs := readMP4Boxes(findMP4Box(moof, "moof"))[1:]
+		assert.Len(t, trafs, 2)
+		audioTfdt := findMP4Box(trafs[1].body, "tfdt")
+		assert.Equal(t, uint64(9600), binary.BigEndian.Uint64(audioTfdt[4:]))
+		videoTrun := findMP4Box(trafs[0].body, "trun")
+		assert.Equal(t, uint32(5), binary.BigEndian.Uint32(videoTrun[4:]))
+		assert.Equal(t, uint32(9000), binary.BigEndian.Uint32(videoTrun[12:]))
+		assert.Equal(t, uint32(mp4SampleFlagsSync), binary.BigEndian.Uint32(videoTrun[20:]))
+		audioTrun := findMP4Box(trafs[1].body, "trun")
+		assert.Equal(t, uint32(15), binary.BigEndian.Uint32(audioTrun[4:]))
+		// The first video sample is the SPS, the PPS and the IDR slice, each with its length.
+		offset := binary.BigEndian.Uint32(videoTrun[8:])
+		assert.Equal(t, append([]byte{0, 0, 0, byte(len(testSPS))}, testSPS...), moof[offset:offset+4+uint32(len(testSPS))])
+		audioOffset := binary.BigEndian.Uint32(audioTrun[8:])
+		assert.Equal(t, []byte{0xfc, 0xff, 0xfe}, moof[audioOffset:audioOffset+3])
+	})
+	t.Run("Starts at a keyframe with its parameter sets", func(t *testing.T) {
+		t.Parallel()
+		keyframesNeeded := 0
+		var fragments []FMP4Fragment
+		writer, err := NewFMP4Writer(nil, &h264Codec, nil, FMP4Config{
+			OnKeyframeNeeded: func() { keyframesNeeded++ },
+			OnFragment:       func(fragment FMP4Fragment) { fragments = append(fragments, fragment) },
+		})
+		assert.Nil(t, err)
+		var packets []*rtp.Packet
+		packets = append(packets, h264Packets(0, 0, false, testSPS)...)
+		packets = append(packets, h264Packets(1, 3000, true, testSPS)...)
+		packets = append(packets, h264Packets(4, 6000, false, testSPS)...)
+		for _, packet := range packets {
+			assert.Nil(t, writer.VideoSink().WriteRTP(packet))
+		}
+		assert.Nil(t, writer.VideoSink().Close())
+		assert.Equal(t, 1, keyframesNeeded)
+		assert.Len(t, fragments, 2)
+		assert.True(t, fragments[1].Independent)
+		assert.Equal(t, 2*3000*time.Second/90000, fragments[1].Duration)
+	})
+	t.Run("Announces new parameter sets with an initialization segment to OnFragment", func(t *testing.T) {
+		t.Parallel()
+		var fragments []FMP4Fragment
+		var out bytes.Buffer
+		writer, err := NewFMP4Writer(nil, &h264Codec, &out, FMP4Config{
+			OnFragment: func(fragment FMP4Fragment) { fragments = append(fragments, fragment) },
+		})
+		assert.Nil(t, err)
+		// A 640x480 Constrained Baseline SPS.
+		sps, _ := hex.DecodeString("6742c01eda0280f6c044000003000400000300c83c58ba80")
+		seq := uint16(0)
+		for i, keyframe := range []bool{true, false, true, false} {
+			frameSPS := testSPS
+			if i >= 2 {
+				frameSPS = sps
+			}
+			packets := h264Packets(seq, uint32(i)*3000, keyframe, frameSPS)
+			seq += uint16(len(packets))
+			for _, packet := range packets {
+				assert.Nil(t, writer.VideoSink().WriteRTP(packet))
+			}
+		}
+		assert.Nil(t, writer.Close())
+		var inits []bool
+		for _, fragment := range fragments {
+			inits = append(inits, fragment.Init)
+		}
+		assert.Equal(t, []bool{true, false, true, false}, inits)
+		avc1 := findMP4Box(fragments[2].Data, "moov", "trak", "mdia", "minf", "stbl", "stsd")[8:]
+		assert.Equal(t, uint16(640), binary.BigEndian.Uint16(avc1[8+24:]))
+		assert.Equal(t, uint16(480), binary.BigEndian.Uint16(avc1[8+26:]))
+
+		// The output keeps the first initialization segment and gets the new SPS in-band.
+		var boxTypes []string
+		for _, box := range readMP4Boxes(out.Bytes()) {
+			boxTypes = append(boxTypes, box.boxType)
+		}
+		assert.Equal(t, []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}, boxTypes)
+		assert.Equal(t, bytes.Join([][]byte{fragments[0].Data, fragments[1].Data, fragments[3].Data}, nil), out.Bytes())
+		assert.True(t, bytes.Contains(fragments[3].Data, sps))
+	})
+	t.Run("Rejects codecs other than H.264 and Opus", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewFMP4Writer(nil, &vp8Codec, nil, FMP4Config{})
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+	})
+}
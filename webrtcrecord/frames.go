@@ -0,0 +1,201 @@
+package webrtcrecord
+
+import (
+	"strings"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtccodec"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/frame"
+	"github.com/pion/rtp/codecs/av1/obu"
+	"github.com/pion/webrtc/v3"
+)
+
+const av1OBUTemporalDelimiter = 2
+
+/*
+frameAssembler puts the video frames of a track together from its packets in
+sequence order: the packets of one timestamp up to the marker bit. It starts at a
+keyframe and, after packet loss, drops frames until the next keyframe. AV1 frames
+are temporal units in the low overhead bitstream format and H.264 frames access
+units in Annex B format. Keyframes and the frame size are told by the inspector of
+the codec.
+*/
+type frameAssembler struct {
+	mimeType     string
+	inspector    *webrtccodec.Inspector
+	frame        []byte
+	timestamp    uint32
+	keyframe     bool
+	inFrame      bool
+	waitKeyframe bool
+	av1          frame.AV1
+	h264         codecs.H264Packet
+	width        uint16
+	height       uint16
+	onKeyframe   func()
+}
+
+func newFrameAssembler(codec webrtc.RTPCodecCapability, onKeyframeNeeded func()) (*frameAssembler, error) {
+	inspector, err := webrtccodec.NewInspector(codec)
+	if err != nil {
+		return nil, unsupportedCodec(codec)
+	}
+	a := &frameAssembler{
+		mimeType:     strings.ToLower(codec.MimeType),
+		inspector:    inspector,
+		waitKeyframe: true,
+		onKeyframe:   onKeyframeNeeded,
+	}
+	a.keyframeNeeded()
+	return a, nil
+}
+
+/*
+push adds a packet released by the reorder buffer and calls emit with every frame
+it completes.
+*/
+func (a *frameAssembler) push(packet *rtp.Packet, gap bool, emit func(data []byte, timestamp uint32, keyframe bool) error) error {
+	if gap {
+		a.inFrame = false
+		a.av1 = frame.AV1{}
+		a.h264 = codecs.H264Packet{}
+		if !a.waitKeyframe {
+			a.waitKeyframe = true
+			a.keyframeNeeded()
+		}
+	}
+	data, start, keyframe, err := a.depacketize(packet)
+	if err != nil {
+		return err
+	}
+	if start {
+		a.frame = a.frame[:0]
+		a.timestamp = packet.Timestamp
+		a.keyframe = keyframe
+		a.inFrame = true
+	} else if !a.inFrame || packet.Timestamp != a.timestamp {
+		a.inFrame = false
+		return nil
+	} else {
+		a.keyframe = a.keyframe || keyframe
+	}
+	a.frame = append(a.frame, data...)
+	if !packet.Marker {
+		return nil
+	}
+	a.inFrame = false
+	if a.waitKeyframe && !a.keyframe {
+		return nil
+	}
+	a.waitKeyframe = false
+	return emit(a.frame, a.timestamp, a.keyframe)
+}
+
+/*
+depacketize returns the frame data carried by packet and whether it starts a frame,
+and a keyframe at that. The frame size is kept from the packets that announce it.
+*/
+func (a *frameAssembler) depacketize(packet *rtp.Packet) ([]byte, bool, bool, error) {
+	info, err := a.inspector.Inspect(packet)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if info.Width != 0 && info.Height != 0 {
+		a.width, a.height = info.Width, info.Height
+	}
+	switch a.mimeType {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		vp8 := codecs.VP8Packet{}
+		data, err := vp8.Unmarshal(packet.Payload)
+		if err != nil {
+			return nil, false, false, err
+		}
+		return data, info.FrameStart, info.Keyframe, nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		vp9 := codecs.VP9Packet{}
+		data, err := vp9.Unmarshal(packet.Payload)
+		if err != nil {
+			return nil, false, false, err
+		}
+		return data, info.FrameStart, info.Keyframe, nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		// The packetizer buffers fragmented NAL units and returns them whole.
+		data, err := a.h264.Unmarshal(packet.Payload)
+		if err != nil {
+			return nil, false, false, err
+		}
+		start := !a.inFrame || packet.Timestamp != a.timestamp
+		return data, start, info.Keyframe, nil
+	default:
+		av1 := codecs.AV1Packet{}
+		if _, err := av1.Unmarshal(packet.Payload); err != nil {
+			return nil, false, false, err
+		}
+		obus, err := a.av1.ReadFrames(&av1)
+		if err != nil {
+			return nil, false, false, err
+		}
+		start := !a.inFrame || packet.Timestamp != a.timestamp
+		var data []byte
+		if start {
+			data = append(data, av1OBUTemporalDelimiter<<3|0x02, 0)
+		}
+		for _, o := range obus {
+			data = appendSizedOBU(data, o)
+		}
+		return data, start, info.Keyframe, nil
+	}
+}
+
+func (a *frameAssembler) keyframeNeeded() {
+	if a.onKeyframe != nil {
+		a.onKeyframe()
+	}
+}
+
+/*
+appendSizedOBU appends an OBU in the low overhead bitstream format, adding the size
+field RTP leaves out. Temporal delimiters are dropped, since one is written at the
+start of every temporal unit.
+*/
+func appendSizedOBU(data []byte, o []byte) []byte {
+	if len(o) == 0 || (o[0]>>3)&0x0f == av1OBUTemporalDelimiter {
+		return data
+	}
+	if o[0]&0x02 != 0 {
+		return append(data, o...)
+	}
+	headerSize := 1
+	if o[0]&0x04 != 0 {
+		headerSize = 2
+	}
+	if len(o) < headerSize {
+		return data
+	}
+	data = append(data, o[0]|0x02)
+	data = append(data, o[1:headerSize]...)
+	data = append(data, obu.WriteToLeb128(uint(len(o)-headerSize))...)
+	return append(data, o[headerSize:]...)
+}
+
+/*
+timestampUnwrapper extends 32 bit RTP timestamps to 64 bits across wraparounds.
+*/
+type timestampUnwrapper struct {
+	started bool
+	last    uint32
+	value   uint64
+}
+
+func (u *timestampUnwrapper) unwrap(timestamp uint32) uint64 {
+	if !u.started {
+		u.started = true
+		u.last = timestamp
+		u.value = uint64(timestamp)
+		return u.value
+	}
+	u.value = uint64(int64(u.value) + int64(int32(timestamp-u.last)))
+	u.last = timestamp
+	return u.value
+}
@@ -0,0 +1,52 @@
+package webrtcrecord
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	h264NALUnitSPS = 7
+	h264NALUnitPPS = 8
+	h264NALUnitAUD = 9
+)
+
+/*
+h264NALUnits splits an Annex B byte stream into its NAL units.
+*/
+func h264NALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte{0, 0, 1})
+		if start < 0 {
+			break
+		}
+		data = data[start+3:]
+		end := bytes.Index(data, []byte{0, 0, 1})
+		if end < 0 {
+			end = len(data)
+		}
+		nalu := bytes.TrimRight(data[:end], "\x00")
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+		data = data[end:]
+	}
+	return nalus
+}
+
+/*
+h264AVCSample converts the NAL units of an access unit to an AVC sample, each
+prefixed with its 4 byte length. Access unit delimiters are left out.
+*/
+func h264AVCSample(nalus [][]byte) []byte {
+	var sample []byte
+	for _, nalu := range nalus {
+		if nalu[0]&0x1f == h264NALUnitAUD {
+			continue
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	return sample
+}
@@ -0,0 +1,117 @@
+package webrtcrecord
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	ivfFileHeaderSize  = 32
+	ivfFrameHeaderSize = 12
+)
+
+/*
+ivfWriter writes VP8, VP9 or AV1 to an IVF file. Frames are stamped with their RTP
+timestamp, using the clock rate as the IVF time base.
+*/
+type ivfWriter struct {
+	out         io.Writer
+	fourcc      string
+	clockRate   uint32
+	frames      *frameAssembler
+	wroteHeader bool
+	count       uint32
+	firstPTS    uint64
+	timestamps  timestampUnwrapper
+}
+
+func newIVFWriter(out io.Writer, codec webrtc.RTPCodecCapability, onKeyframeNeeded func()) (*ivfWriter, error) {
+	w := &ivfWriter{out: out, clockRate: codec.ClockRate}
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		w.fourcc = "VP80"
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		w.fourcc = "VP90"
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		w.fourcc = "AV01"
+	default:
+		return nil, unsupportedCodec(codec)
+	}
+	frames, err := newFrameAssembler(codec, onKeyframeNeeded)
+	if err != nil {
+		return nil, err
+	}
+	w.frames = frames
+	if w.clockRate == 0 {
+		w.clockRate = 90000
+	}
+	return w, nil
+}
+
+func (w *ivfWriter) writeRTP(packet *rtp.Packet, gap bool) error {
+	return w.frames.push(packet, gap, w.writeFrame)
+}
+
+func (w *ivfWriter) writeFrame(data []byte, timestamp uint32, keyframe bool) error {
+	pts := w.timestamps.unwrap(timestamp)
+	if !w.wroteHeader {
+		w.firstPTS = pts
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(header[4:], pts-w.firstPTS)
+	if _, err := w.out.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(data); err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+func (w *ivfWriter) writeHeader() error {
+	w.wroteHeader = true
+	header := make([]byte, ivfFileHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], ivfFileHeaderSize)
+	copy(header[8:], w.fourcc)
+	binary.LittleEndian.PutUint16(header[12:], w.frames.width)
+	binary.LittleEndian.PutUint16(header[14:], w.frames.height)
+	binary.LittleEndian.PutUint32(header[16:], w.clockRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	_, err := w.out.Write(header)
+	return err
+}
+
+/*
+close writes the frame count into the header when the output can seek, and writes
+the header of an empty file.
+*/
+func (w *ivfWriter) close() error {
+	if !w.wroteHeader {
+		return w.writeHeader()
+	}
+	seeker, ok := w.out.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.count)
+	if _, err := seeker.Seek(24, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := seeker.Write(count); err != nil {
+		return err
+	}
+	_, err := seeker.Seek(0, io.SeekEnd)
+	return err
+}
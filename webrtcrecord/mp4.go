@@ -0,0 +1,223 @@
+package webrtcrecord
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtccodec"
+)
+
+const (
+	mp4MovieTimescale = 1000
+	// mp4SampleFlagsSync marks a sample that does not depend on others and
+	// mp4SampleFlagsNonSync one that does.
+	mp4SampleFlagsSync    = 0x02000000
+	mp4SampleFlagsNonSync = 0x01010000
+)
+
+var mp4Matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	box = append(box, boxType...)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+/*
+mp4Fields encodes integers big endian in the width of their type.
+*/
+func mp4Fields(values ...any) []byte {
+	var data []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case uint8:
+			data = append(data, v)
+		case uint16:
+			data = binary.BigEndian.AppendUint16(data, v)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, v)
+		case uint64:
+			data = binary.BigEndian.AppendUint64(data, v)
+		case []byte:
+			data = append(data, v...)
+		case string:
+			data = append(data, v...)
+		default:
+			panic(fmt.Sprintf("unsupported mp4 field %T", value))
+		}
+	}
+	return data
+}
+
+/*
+mp4Track describes a track of a fragmented MP4 file. Video tracks carry the SPS and
+PPS of their H.264 stream; audio tracks are Opus.
+*/
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	video     bool
+	sps       []byte
+	pps       []byte
+	width     uint16
+	height    uint16
+	channels  uint16
+	// sampleRate is the input sample rate of the Opus stream.
+	sampleRate uint32
+}
+
+/*
+codec returns the codec of the track as named by the RFC 6381 codecs parameter.
+*/
+func (t *mp4Track) codec() string {
+	if t.video {
+		return fmt.Sprintf("avc1.%02x%02x%02x", t.sps[1], t.sps[2], t.sps[3])
+	}
+	return "opus"
+}
+
+/*
+mp4InitSegment returns the ftyp and moov boxes of a fragmented MP4 file. The moov
+box describes the tracks but holds no samples; they follow in fragments.
+*/
+func mp4InitSegment(tracks []*mp4Track) ([]byte, error) {
+	traks := [][]byte{mp4FullBox("mvhd", 0, 0, mp4Fields(
+		uint32(0), uint32(0), uint32(mp4MovieTimescale), uint32(0),
+		uint32(0x00010000), uint16(0x0100), make([]byte, 10), mp4MatrixBytes(),
+		make([]byte, 24), uint32(len(tracks)+1),
+	))}
+	var trexs [][]byte
+	for _, track := range tracks {
+		trak, err := mp4Trak(track)
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak)
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4Fields(track.id, uint32(1), uint32(0), uint32(0), uint32(0))))
+	}
+	moov := mp4Box("moov", append(traks, mp4Box("mvex", trexs...))...)
+	ftyp := mp4Box("ftyp", mp4Fields("isom", uint32(0x200), "isom", "iso6", "mp41"))
+	return append(ftyp, moov...), nil
+}
+
+func mp4MatrixBytes() []byte {
+	var data []byte
+	for _, v := range mp4Matrix {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+func mp4Trak(track *mp4Track) ([]byte, error) {
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	header := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if !track.video {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		header = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	entry, err := mp4SampleEntry(track)
+	if err != nil {
+		return nil, err
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3, mp4Fields(
+		uint32(0), uint32(0), track.id, uint32(0), uint32(0), make([]byte, 8),
+		uint16(0), uint16(0), volume, uint16(0), mp4MatrixBytes(),
+		uint32(track.width)<<16, uint32(track.height)<<16,
+	))
+	mdhd := mp4FullBox("mdhd", 0, 0, mp4Fields(uint32(0), uint32(0), track.timescale, uint32(0), uint16(0x55c4), uint16(0)))
+	hdlr := mp4FullBox("hdlr", 0, 0, mp4Fields(uint32(0), handler, make([]byte, 12), name, uint8(0)))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Fields(uint32(1)), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Fields(uint32(1)), entry),
+		mp4FullBox("stts", 0, 0, mp4Fields(uint32(0))),
+		mp4FullBox("stsc", 0, 0, mp4Fields(uint32(0))),
+		mp4FullBox("stsz", 0, 0, mp4Fields(uint32(0), uint32(0))),
+		mp4FullBox("stco", 0, 0, mp4Fields(uint32(0))),
+	)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", header, dinf, stbl))), nil
+}
+
+func mp4SampleEntry(track *mp4Track) ([]byte, error) {
+	if !track.video {
+		dOps := mp4Box("dOps", mp4Fields(uint8(0), uint8(track.channels), uint16(0), track.sampleRate, uint16(0), uint8(0)))
+		return mp4Box("Opus", mp4Fields(
+			make([]byte, 6), uint16(1), make([]byte, 8),
+			track.channels, uint16(16), uint16(0), uint16(0), uint32(48000)<<16,
+		), dOps), nil
+	}
+	sps, err := webrtccodec.ParseH264SPS(track.sps)
+	if err != nil {
+		return nil, err
+	}
+	avcC := mp4Fields(
+		uint8(1), sps.Profile, sps.Compatibility, sps.Level, uint8(0xff),
+		uint8(0xe1), uint16(len(track.sps)), track.sps,
+		uint8(1), uint16(len(track.pps)), track.pps,
+	)
+	if sps.HighProfile {
+		avcC = append(avcC, 0xfc|byte(sps.ChromaFormat), 0xf8|byte(sps.BitDepthLuma), 0xf8|byte(sps.BitDepthChroma), 0)
+	}
+	return mp4Box("avc1", mp4Fields(
+		make([]byte, 6), uint16(1), make([]byte, 16),
+		track.width, track.height, uint32(0x00480000), uint32(0x00480000), uint32(0),
+		uint16(1), make([]byte, 32), uint16(0x0018), uint16(0xffff),
+	), mp4Box("avcC", avcC)), nil
+}
+
+/*
+mp4Sample is a sample of a fragment, with its decode time and duration in the
+timescale of its track.
+*/
+type mp4Sample struct {
+	data       []byte
+	decodeTime uint64
+	duration   uint32
+	sync       bool
+}
+
+/*
+mp4Fragment returns the moof and mdat boxes of a fragment with the samples of each
+track, in the order of tracks. Tracks without samples are left out.
+*/
+func mp4Fragment(sequence uint32, tracks []*mp4Track, samples [][]mp4Sample) []byte {
+	build := func(moofSize int) ([]byte, []byte) {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, mp4Fields(sequence))}
+		var mdat []byte
+		for i, track := range tracks {
+			if len(samples[i]) == 0 {
+				continue
+			}
+			trun := mp4Fields(uint32(len(samples[i])), uint32(moofSize+8+len(mdat)))
+			for _, sample := range samples[i] {
+				flags := uint32(mp4SampleFlagsNonSync)
+				if sample.sync {
+					flags = mp4SampleFlagsSync
+				}
+				trun = append(trun, mp4Fields(sample.duration, uint32(len(sample.data)), flags)...)
+				mdat = append(mdat, sample.data...)
+			}
+			trafs = append(trafs, mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, mp4Fields(track.id)),
+				mp4FullBox("tfdt", 1, 0, mp4Fields(samples[i][0].decodeTime)),
+				mp4FullBox("trun", 0, 0x000701, trun),
+			))
+		}
+		return mp4Box("moof", trafs...), mdat
+	}
+	// The data offsets count from the start of the moof box, whose size they do not change.
+	moof, _ := build(0)
+	moof, mdat := build(len(moof))
+	return append(moof, mp4Box("mdat", mdat)...)
+}
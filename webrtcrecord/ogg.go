@@ -0,0 +1,42 @@
+package webrtcrecord
+
+import (
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+const defaultOpusChannels = 2
+
+/*
+oggWriter writes Opus to an Ogg file through pion's writer, which only marks the
+end of stream when it opened the file itself.
+*/
+type oggWriter struct {
+	writer *oggwriter.OggWriter
+}
+
+func opusParameters(codec webrtc.RTPCodecCapability) (uint32, uint16, error) {
+	if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+		return 0, 0, unsupportedCodec(codec)
+	}
+	sampleRate := codec.ClockRate
+	if sampleRate == 0 {
+		sampleRate = 48000
+	}
+	channels := codec.Channels
+	if channels == 0 {
+		channels = defaultOpusChannels
+	}
+	return sampleRate, channels, nil
+}
+
+func (w *oggWriter) writeRTP(packet *rtp.Packet, gap bool) error {
+	return w.writer.WriteRTP(packet)
+}
+
+func (w *oggWriter) close() error {
+	return w.writer.Close()
+}
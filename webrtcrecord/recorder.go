@@ -0,0 +1,254 @@
+package webrtcrecord
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("codec cannot be recorded")
+	ErrRecorderClosed   = errors.New("recorder closed")
+)
+
+func unsupportedCodec(codec webrtc.RTPCodecCapability) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedCodec, codec.MimeType)
+}
+
+type RecorderConfig struct {
+	// ReorderBufferSize is the number of packets held back waiting for a missing one
+	// before it is given up as lost. Defaults to 64; a negative value writes packets
+	// in arrival order.
+	ReorderBufferSize int
+	// OnKeyframeNeeded is called when a video recording waits for a keyframe: when
+	// it starts and after packet loss. RecordTrack asks the publisher for one.
+	OnKeyframeNeeded func()
+	// LoggerFactory creates the recorder logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+mediaWriter is a container format written from packets in sequence order.
+*/
+type mediaWriter interface {
+	writeRTP(packet *rtp.Packet, gap bool) error
+	close() error
+}
+
+/*
+TrackRecorder writes the packets of a track to a file: VP8, VP9 and AV1 to IVF and
+Opus to Ogg. It is a webrtcpeer.TrackSink, so it can be attached to any local track
+of an SfuPeer, and finalizes the file when closed.
+*/
+type TrackRecorder struct {
+	mu     sync.Mutex
+	buffer *reorderBuffer
+	writer mediaWriter
+	closer io.Closer
+	closed bool
+	err    error
+	log    logging.LeveledLogger
+}
+
+/*
+NewTrackRecorder creates a recorder writing a track of the codec to out. Ogg files
+written to an io.Writer are not marked as ended; RecordTrack writes complete ones.
+*/
+func NewTrackRecorder(codec webrtc.RTPCodecCapability, out io.Writer, config RecorderConfig) (*TrackRecorder, error) {
+	var writer mediaWriter
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		sampleRate, channels, err := opusParameters(codec)
+		if err != nil {
+			return nil, err
+		}
+		ogg, err := oggwriter.NewWith(out, sampleRate, channels)
+		if err != nil {
+			return nil, err
+		}
+		writer = &oggWriter{writer: ogg}
+	} else {
+		ivf, err := newIVFWriter(out, codec, config.OnKeyframeNeeded)
+		if err != nil {
+			return nil, err
+		}
+		writer = ivf
+	}
+	return newTrackRecorder(writer, nil, config), nil
+}
+
+func newTrackRecorder(writer mediaWriter, closer io.Closer, config RecorderConfig) *TrackRecorder {
+	size := config.ReorderBufferSize
+	if size == 0 {
+		size = defaultReorderBufferSize
+	}
+	return &TrackRecorder{
+		buffer: newReorderBuffer(max(size, 0)),
+		writer: writer,
+		closer: closer,
+		log:    webrtclog.NewLogger(config.LoggerFactory, "track-recorder"),
+	}
+}
+
+/*
+RecordTrack records the local track localTrackID of peer to the file at path until
+the track ends, the peer shuts down or the recorder is detached with
+SfuPeer.DetachTrackSink. The file should be named .ivf for video and .ogg for audio.
+*/
+func RecordTrack(peer *webrtcpeer.SfuPeer, localTrackID string, path string, config RecorderConfig) (*TrackRecorder, error) {
+	peer.LocalTracksMu.Lock()
+	track := peer.LocalTracks[localTrackID]
+	peer.LocalTracksMu.Unlock()
+	if track == nil {
+		return nil, &webrtcpeer.TrackError{PeerID: peer.ID(), TrackID: localTrackID, Err: webrtcpeer.ErrTrackNotFound}
+	}
+	if config.OnKeyframeNeeded == nil {
+		config.OnKeyframeNeeded = peer.KeyframeRequester(localTrackID)
+	}
+	recorder, err := createRecorder(track.Codec(), path, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.AttachTrackSink(localTrackID, recorder); err != nil {
+		recorder.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return recorder, nil
+}
+
+/*
+localTrackCodecs returns the codecs of the local tracks of peer by ID, skipping empty IDs.
+*/
+func localTrackCodecs(peer *webrtcpeer.SfuPeer, localTrackIDs ...string) (map[string]*webrtc.RTPCodecCapability, error) {
+	codecs := map[string]*webrtc.RTPCodecCapability{}
+	peer.LocalTracksMu.Lock()
+	defer peer.LocalTracksMu.Unlock()
+	for _, id := range localTrackIDs {
+		if id == "" {
+			continue
+		}
+		track := peer.LocalTracks[id]
+		if track == nil {
+			return nil, &webrtcpeer.TrackError{PeerID: peer.ID(), TrackID: id, Err: webrtcpeer.ErrTrackNotFound}
+		}
+		codec := track.Codec()
+		codecs[id] = &codec
+	}
+	return codecs, nil
+}
+
+/*
+publisherSenderReports returns the last Sender Reports of the audio and video tracks
+of peer by kind.
+*/
+func publisherSenderReports(peer *webrtcpeer.SfuPeer, audioTrackID string, videoTrackID string) func(webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool) {
+	return func(kind webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool) {
+		id := audioTrackID
+		if kind == webrtc.RTPCodecTypeVideo {
+			id = videoTrackID
+		}
+		report, err := peer.LastSenderReport(id)
+		return report, err == nil
+	}
+}
+
+/*
+attachSinks attaches the audio and video sinks of a recording to their local tracks,
+skipping empty IDs, and detaches the audio sink again if the video one fails.
+*/
+func attachSinks(peer *webrtcpeer.SfuPeer, audioTrackID string, audio webrtcpeer.TrackSink, videoTrackID string, video webrtcpeer.TrackSink) error {
+	if audioTrackID != "" {
+		if err := peer.AttachTrackSink(audioTrackID, audio); err != nil {
+			return err
+		}
+	}
+	if videoTrackID != "" {
+		if err := peer.AttachTrackSink(videoTrackID, video); err != nil {
+			if audioTrackID != "" {
+				peer.DetachTrackSink(audioTrackID, audio)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func createRecorder(codec webrtc.RTPCodecCapability, path string, config RecorderConfig) (*TrackRecorder, error) {
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		sampleRate, channels, err := opusParameters(codec)
+		if err != nil {
+			return nil, err
+		}
+		ogg, err := oggwriter.New(path, sampleRate, channels)
+		if err != nil {
+			return nil, err
+		}
+		return newTrackRecorder(&oggWriter{writer: ogg}, nil, config), nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	ivf, err := newIVFWriter(file, codec, config.OnKeyframeNeeded)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return newTrackRecorder(ivf, file, config), nil
+}
+
+/*
+WriteRTP records packet. After the first write error the recorder drops packets and
+Close returns that error.
+*/
+func (r *TrackRecorder) WriteRTP(packet *rtp.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	if r.err != nil {
+		return nil
+	}
+	r.err = r.buffer.push(packet, r.writer.writeRTP)
+	return r.err
+}
+
+/*
+Close writes the packets still held back and finalizes the file. Closing again does nothing.
+*/
+func (r *TrackRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.err
+	if err == nil {
+		err = r.buffer.flush(r.writer.writeRTP)
+	}
+	if closeErr := r.writer.close(); err == nil {
+		err = closeErr
+	}
+	if r.closer != nil {
+		if closeErr := r.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		r.log.Warnf("Error finalizing recording: %v", err)
+	}
+	return err
+}
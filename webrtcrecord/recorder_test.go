@@ -0,0 +1,166 @@
+package webrtcrecord
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/stretchr/testify/assert"
+)
+
+var vp8Codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+/*
+vp8Packets returns the packets of a VP8 frame split in two, a 640x480 keyframe or an interframe.
+The first packet carries the frame tag and the keyframe header, as packetizers send them.
+*/
+func vp8Packets(seq uint16, timestamp uint32, keyframe bool) []*rtp.Packet {
+	frame := []byte{0x01, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01, 0xaa, 0xbb}
+	if keyframe {
+		frame[0] = 0x00
+	}
+	return []*rtp.Packet{
+		{Header: rtp.Header{SequenceNumber: seq, Timestamp: timestamp}, Payload: append([]byte{0x10}, frame[:10]...)},
+		{Header: rtp.Header{SequenceNumber: seq + 1, Timestamp: timestamp, Marker: true}, Payload: append([]byte{0x00}, frame[10:]...)},
+	}
+}
+
+func readIVF(t *testing.T, r io.Reader) (*ivfreader.IVFFileHeader, []uint64) {
+	t.Helper()
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []uint64
+	for {
+		_, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			break
+		}
+		timestamps = append(timestamps, frameHeader.Timestamp)
+	}
+	return header, timestamps
+}
+
+func TestTrackRecorder(t *testing.T) {
+	t.Run("Records VP8 from a keyframe on", func(t *testing.T) {
+		t.Parallel()
+		keyframesNeeded := 0
+		var out bytes.Buffer
+		recorder, err := NewTrackRecorder(vp8Codec, &out, RecorderConfig{
+			OnKeyframeNeeded: func() { keyframesNeeded++ },
+		})
+		assert.Nil(t, err)
+		var packets []*rtp.Packet
+		packets = append(packets, vp8Packets(1, 1000, false)...)
+		packets = append(packets, vp8Packets(3, 4000, true)...)
+		interframe := vp8Packets(5, 7000, false)
+		packets = append(packets, interframe[1], interframe[0])
+		for _, packet := range packets {
+			assert.Nil(t, recorder.WriteRTP(packet))
+		}
+		assert.Nil(t, recorder.Close())
+		assert.Equal(t, 1, keyframesNeeded)
+
+		header, timestamps := readIVF(t, &out)
+		assert.Equal(t, "VP80", header.FourCC)
+		assert.Equal(t, uint16(640), header.Width)
+		assert.Equal(t, uint16(480), header.Height)
+		assert.Equal(t, uint32(90000), header.TimebaseDenominator)
+		assert.Equal(t, []uint64{0, 3000}, timestamps)
+	})
+	t.Run("Waits for a keyframe after packet loss", func(t *testing.T) {
+		t.Parallel()
+		keyframesNeeded := 0
+		var out bytes.Buffer
+		recorder, err := NewTrackRecorder(vp8Codec, &out, RecorderConfig{
+			ReorderBufferSize: -1,
+			OnKeyframeNeeded:  func() { keyframesNeeded++ },
+		})
+		assert.Nil(t, err)
+		var packets []*rtp.Packet
+		packets = append(packets, vp8Packets(1, 1000, true)...)
+		packets = append(packets, vp8Packets(5, 7000, false)...)
+		packets = append(packets, vp8Packets(7, 10000, false)...)
+		packets = append(packets, vp8Packets(9, 13000, true)...)
+		for _, packet := range packets {
+			assert.Nil(t, recorder.WriteRTP(packet))
+		}
+		assert.Nil(t, recorder.Close())
+		assert.Equal(t, 2, keyframesNeeded)
+		_, timestamps := readIVF(t, &out)
+		assert.Equal(t, []uint64{0, 12000}, timestamps)
+	})
+	t.Run("Records Opus to Ogg", func(t *testing.T) {
+		t.Parallel()
+		var out bytes.Buffer
+		recorder, err := NewTrackRecorder(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, &out, RecorderConfig{})
+		assert.Nil(t, err)
+		for i := uint16(0); i < 3; i++ {
+			assert.Nil(t, recorder.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: 100 + i, Timestamp: 960 * uint32(i)},
+				Payload: []byte{0xfc, 0x01, 0x02},
+			}))
+		}
+		assert.Nil(t, recorder.Close())
+		reader, header, err := oggreader.NewWith(&out)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(48000), header.SampleRate)
+		assert.Equal(t, uint8(2), header.Channels)
+		var granules []uint64
+		for {
+			_, pageHeader, err := reader.ParseNextPage()
+			if err != nil {
+				break
+			}
+			granules = append(granules, pageHeader.GranulePosition)
+		}
+		// The comment header page comes first.
+		assert.Len(t, granules, 4)
+		assert.Equal(t, uint64(960), granules[2]-granules[1])
+		assert.Equal(t, uint64(1920), granules[3]-granules[1])
+	})
+	t.Run("Rejects other codecs", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewTrackRecorder(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, io.Discard, RecorderConfig{})
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+	})
+	t.Run("Records a local track until the peer shuts down", func(t *testing.T) {
+		t.Parallel()
+		peer, err := webrtcpeer.NewSfuPeer("publisher", &webrtc.Configuration{})
+		assert.Nil(t, err)
+		track, err := webrtc.NewTrackLocalStaticRTP(vp8Codec, "camera", "publisher")
+		assert.Nil(t, err)
+		peer.LocalTracks["camera"] = track
+		path := filepath.Join(t.TempDir(), "camera.ivf")
+		_, err = RecordTrack(peer, "camera", path, RecorderConfig{})
+		assert.Nil(t, err)
+		for _, timestamp := range []uint32{3000, 6000} {
+			for _, packet := range vp8Packets(uint16(timestamp/1000), timestamp, true) {
+				assert.Nil(t, track.WriteRTP(packet))
+			}
+		}
+		peer.Shutdown()
+
+		file, err := os.Open(path)
+		assert.Nil(t, err)
+		defer file.Close()
+		header, timestamps := readIVF(t, file)
+		assert.Equal(t, uint32(2), header.NumFrames)
+		assert.Equal(t, []uint64{0, 3000}, timestamps)
+	})
+}
+
+func TestAppendSizedOBU(t *testing.T) {
+	t.Parallel()
+	frameOBU := []byte{6 << 3, 0xaa, 0xbb}
+	assert.Equal(t, []byte{6<<3 | 0x02, 0x02, 0xaa, 0xbb}, appendSizedOBU(nil, frameOBU))
+	assert.Empty(t, appendSizedOBU(nil, []byte{av1OBUTemporalDelimiter << 3}))
+}
@@ -0,0 +1,123 @@
+package webrtcrecord
+
+import (
+	"github.com/pion/rtp"
+)
+
+const (
+	defaultReorderBufferSize = 64
+	// reorderMaxDropout and reorderMaxMisorder bound, as in RFC 3550 A.1, how far
+	// ahead and how late a packet of the same sequence may be. Any other packet is
+	// taken for a restart of the sender's sequence numbers.
+	reorderMaxDropout  = 3000
+	reorderMaxMisorder = 100
+)
+
+/*
+reorderBuffer puts packets back in sequence number order. It holds up to size
+packets waiting for a missing one; once more arrive it gives up on the missing
+packets and releases from the oldest held one, reporting the gap. Packets older
+than the last released one are dropped.
+
+Two consecutive packets far from the sequence, as when the sender restarts its
+encoder, start a new one: the held packets are flushed and the new sequence is
+released from its first packet, reporting a gap. A single stray packet is dropped.
+*/
+type reorderBuffer struct {
+	size    int
+	packets map[uint16]*rtp.Packet
+	next    uint16
+	started bool
+	// probation is the last packet far from the sequence, which starts a new one
+	// if the packet after it follows it.
+	probation *rtp.Packet
+	// restarted reports a gap on the first packet released after a restart.
+	restarted bool
+}
+
+func newReorderBuffer(size int) *reorderBuffer {
+	return &reorderBuffer{size: size, packets: make(map[uint16]*rtp.Packet)}
+}
+
+/*
+push adds packet and calls emit for every packet that is released by it, in order.
+gap is true for a packet released after skipping lost ones.
+*/
+func (b *reorderBuffer) push(packet *rtp.Packet, emit func(packet *rtp.Packet, gap bool) error) error {
+	if !b.started {
+		b.started = true
+		b.next = packet.SequenceNumber
+	}
+	switch distance := packet.SequenceNumber - b.next; {
+	case distance < reorderMaxDropout:
+	case distance >= 1<<16-reorderMaxMisorder:
+		return nil
+	default:
+		return b.restart(packet, emit)
+	}
+	if _, ok := b.packets[packet.SequenceNumber]; ok {
+		return nil
+	}
+	b.packets[packet.SequenceNumber] = packet
+	return b.release(b.size, emit)
+}
+
+/*
+restart handles a packet far from the sequence. The second of two consecutive ones
+flushes the held packets and starts a new sequence at the first.
+*/
+func (b *reorderBuffer) restart(packet *rtp.Packet, emit func(packet *rtp.Packet, gap bool) error) error {
+	probation := b.probation
+	if probation == nil || packet.SequenceNumber != probation.SequenceNumber+1 {
+		b.probation = packet
+		return nil
+	}
+	b.probation = nil
+	if err := b.flush(emit); err != nil {
+		return err
+	}
+	b.next = probation.SequenceNumber
+	b.restarted = true
+	b.packets[probation.SequenceNumber] = probation
+	b.packets[packet.SequenceNumber] = packet
+	return b.release(b.size, emit)
+}
+
+/*
+flush releases every held packet, skipping over the missing ones.
+*/
+func (b *reorderBuffer) flush(emit func(packet *rtp.Packet, gap bool) error) error {
+	return b.release(0, emit)
+}
+
+func (b *reorderBuffer) release(hold int, emit func(packet *rtp.Packet, gap bool) error) error {
+	gap := b.restarted
+	for {
+		if packet, ok := b.packets[b.next]; ok {
+			delete(b.packets, b.next)
+			b.next++
+			b.restarted = false
+			if err := emit(packet, gap); err != nil {
+				return err
+			}
+			gap = false
+			continue
+		}
+		if len(b.packets) == 0 || len(b.packets) <= hold {
+			return nil
+		}
+		b.next = b.oldest()
+		gap = true
+	}
+}
+
+func (b *reorderBuffer) oldest() uint16 {
+	oldest := b.next
+	distance := -1
+	for seq := range b.packets {
+		if d := int(seq - b.next); distance < 0 || d < distance {
+			oldest, distance = seq, d
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,81 @@
+package webrtcrecord
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+type released struct {
+	seq uint16
+	gap bool
+}
+
+func pushAll(b *reorderBuffer, seqs ...uint16) []released {
+	var out []released
+	emit := func(packet *rtp.Packet, gap bool) error {
+		out = append(out, released{packet.SequenceNumber, gap})
+		return nil
+	}
+	for _, seq := range seqs {
+		b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, emit)
+	}
+	return out
+}
+
+func TestReorderBuffer(t *testing.T) {
+	t.Run("Releases packets in order", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(4)
+		out := pushAll(b, 10, 12, 11, 13)
+		assert.Equal(t, []released{{10, false}, {11, false}, {12, false}, {13, false}}, out)
+	})
+	t.Run("Skips lost packets once the buffer is full", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(2)
+		out := pushAll(b, 10, 12, 13)
+		assert.Equal(t, []released{{10, false}}, out)
+		out = pushAll(b, 14)
+		assert.Equal(t, []released{{12, true}, {13, false}, {14, false}}, out)
+	})
+	t.Run("Drops late and duplicate packets", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(0)
+		out := pushAll(b, 10, 11, 10, 9, 12)
+		assert.Equal(t, []released{{10, false}, {11, false}, {12, false}}, out)
+	})
+	t.Run("Handles sequence number wraparound", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(4)
+		out := pushAll(b, 65534, 0, 65535, 1)
+		assert.Equal(t, []released{{65534, false}, {65535, false}, {0, false}, {1, false}}, out)
+	})
+	t.Run("Starts a new sequence after a large jump", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(4)
+		out := pushAll(b, 10, 12, 40000)
+		assert.Equal(t, []released{{10, false}}, out)
+		out = pushAll(b, 40001, 40002)
+		assert.Equal(t, []released{{12, true}, {40000, true}, {40001, false}, {40002, false}}, out)
+		// The old sequence is now far behind.
+		assert.Empty(t, pushAll(b, 13))
+	})
+	t.Run("Drops a single stray packet", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(4)
+		out := pushAll(b, 10, 20000, 11, 5000, 12)
+		assert.Equal(t, []released{{10, false}, {11, false}, {12, false}}, out)
+	})
+	t.Run("Flushes held packets", func(t *testing.T) {
+		t.Parallel()
+		b := newReorderBuffer(8)
+		pushAll(b, 10, 12, 15)
+		var out []released
+		b.flush(func(packet *rtp.Packet, gap bool) error {
+			out = append(out, released{packet.SequenceNumber, gap})
+			return nil
+		})
+		assert.Equal(t, []released{{12, true}, {15, true}}, out)
+	})
+}
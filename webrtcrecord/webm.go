@@ -0,0 +1,303 @@
+package webrtcrecord
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	webmMuxingApp = "webrtcutil"
+	// webmSeekHeadSize is the space reserved at the start of the segment for the
+	// SeekHead, written once the position of the Cues is known.
+	webmSeekHeadSize = 96
+	// webmMaxClusterDuration keeps block timecodes, relative to their cluster, within
+	// their 16 bit range.
+	webmMaxClusterDuration = 30 * time.Second
+	webmOpusSeekPreRoll    = 80 * time.Millisecond
+)
+
+/*
+webmTrackInfo describes a track of a WebM file.
+*/
+type webmTrackInfo struct {
+	number uint64
+	codec  webrtc.RTPCodecCapability
+	width  uint16
+	height uint16
+}
+
+func webmCodecID(codec webrtc.RTPCodecCapability) (string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return "V_VP8", nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return "V_VP9", nil
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "A_OPUS", nil
+	default:
+		return "", unsupportedCodec(codec)
+	}
+}
+
+type webmCue struct {
+	timecode uint64
+	track    uint64
+	position uint64
+}
+
+/*
+webmFile writes one WebM file. Blocks are gathered into a cluster in memory, so each
+cluster is written with its size, and a cue is kept for every cluster starting with
+a keyframe of the cue track. Closing writes the cues and fills in the segment size,
+the duration and the SeekHead.
+*/
+type webmFile struct {
+	file             *os.File
+	path             string
+	origin           time.Time
+	cueTrack         uint64
+	segmentStart     int64
+	durationPosition int64
+	infoPosition     int64
+	tracksPosition   int64
+	size             int64
+	cluster          []byte
+	clusterTimecode  uint64
+	clusterOpen      bool
+	lastTimecode     uint64
+	cues             []webmCue
+}
+
+/*
+createWebMFile creates the file at path and writes the header for the tracks. Block
+timecodes count from origin. Keyframes of cueTrack start clusters and are indexed.
+*/
+func createWebMFile(path string, origin time.Time, tracks []webmTrackInfo, cueTrack uint64) (*webmFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &webmFile{file: file, path: path, origin: origin, cueTrack: cueTrack}
+	if err := f.writeHeader(tracks); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *webmFile) writeHeader(tracks []webmTrackInfo) error {
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+	header = append(header, ebmlID(mkvIDSegment)...)
+	header = append(header, ebmlUnknownSize...)
+	f.segmentStart = int64(len(header))
+	header = append(header, ebmlVoid(webmSeekHeadSize)...)
+
+	f.infoPosition = int64(len(header)) - f.segmentStart
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, uint64(time.Millisecond)),
+		ebmlString(mkvIDMuxingApp, webmMuxingApp),
+		ebmlString(mkvIDWritingApp, webmMuxingApp),
+		ebmlFloat(mkvIDDuration, 0),
+	)
+	f.durationPosition = int64(len(header)+len(info)) - 8
+	header = append(header, info...)
+
+	f.tracksPosition = int64(len(header)) - f.segmentStart
+	var entries [][]byte
+	for _, track := range tracks {
+		entry, err := webmTrackEntry(track)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	header = append(header, ebmlElement(mkvIDTracks, entries...)...)
+	return f.write(header)
+}
+
+func webmTrackEntry(track webmTrackInfo) ([]byte, error) {
+	codecID, err := webmCodecID(track.codec)
+	if err != nil {
+		return nil, err
+	}
+	fields := [][]byte{
+		ebmlUint(mkvIDTrackNumber, track.number),
+		ebmlUint(mkvIDTrackUID, track.number),
+		ebmlString(mkvIDCodecID, codecID),
+	}
+	if codecID != "A_OPUS" {
+		fields = append(fields,
+			ebmlUint(mkvIDTrackType, 1),
+			ebmlElement(mkvIDVideo,
+				ebmlUint(mkvIDPixelWidth, uint64(track.width)),
+				ebmlUint(mkvIDPixelHeight, uint64(track.height)),
+			),
+		)
+		return ebmlElement(mkvIDTrackEntry, fields...), nil
+	}
+	sampleRate, channels, err := opusParameters(track.codec)
+	if err != nil {
+		return nil, err
+	}
+	return ebmlElement(mkvIDTrackEntry, append(fields,
+		ebmlUint(mkvIDTrackType, 2),
+		ebmlElement(mkvIDCodecPrivate, opusHead(sampleRate, channels)),
+		ebmlUint(mkvIDCodecDelay, 0),
+		ebmlUint(mkvIDSeekPreRoll, uint64(webmOpusSeekPreRoll)),
+		ebmlElement(mkvIDAudio,
+			ebmlFloat(mkvIDSamplingFrequency, float64(sampleRate)),
+			ebmlUint(mkvIDChannels, uint64(channels)),
+		),
+	)...), nil
+}
+
+/*
+opusHead returns the Opus identification header Matroska stores as the codec private data.
+*/
+func opusHead(sampleRate uint32, channels uint16) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], 0)
+	binary.LittleEndian.PutUint32(head[12:], sampleRate)
+	return head
+}
+
+/*
+timecode returns the timecode of t in milliseconds from the origin, never before the
+last block written, so blocks stay in order across tracks.
+*/
+func (f *webmFile) timecode(t time.Time) uint64 {
+	timecode := uint64(max(t.Sub(f.origin), 0) / time.Millisecond)
+	return max(timecode, f.lastTimecode)
+}
+
+/*
+writeBlock adds a frame of track at time t to the file, starting a new cluster at
+a keyframe of the cue track or when the cluster has grown too long.
+*/
+func (f *webmFile) writeBlock(track uint64, t time.Time, data []byte, keyframe bool) error {
+	timecode := f.timecode(t)
+	cue := keyframe && track == f.cueTrack
+	if !f.clusterOpen || cue || timecode-f.clusterTimecode >= uint64(webmMaxClusterDuration/time.Millisecond) {
+		if err := f.flushCluster(); err != nil {
+			return err
+		}
+		f.clusterOpen = true
+		f.clusterTimecode = timecode
+		if cue {
+			f.cues = append(f.cues, webmCue{timecode: timecode, track: track, position: uint64(f.size - f.segmentStart)})
+		}
+	}
+	f.lastTimecode = timecode
+	block := append(ebmlSize(track), 0, 0, 0)
+	binary.BigEndian.PutUint16(block[len(block)-3:], uint16(timecode-f.clusterTimecode))
+	if keyframe {
+		block[len(block)-1] = 0x80
+	}
+	f.cluster = append(f.cluster, ebmlElement(mkvIDSimpleBlock, block, data)...)
+	return nil
+}
+
+func (f *webmFile) flushCluster() error {
+	if !f.clusterOpen {
+		return nil
+	}
+	f.clusterOpen = false
+	cluster := ebmlElement(mkvIDCluster, ebmlUint(mkvIDTimecode, f.clusterTimecode), f.cluster)
+	f.cluster = f.cluster[:0]
+	return f.write(cluster)
+}
+
+/*
+pendingSize returns the size of the file including the cluster not written yet.
+*/
+func (f *webmFile) pendingSize() int64 {
+	return f.size + int64(len(f.cluster))
+}
+
+func (f *webmFile) duration() time.Duration {
+	return time.Duration(f.lastTimecode) * time.Millisecond
+}
+
+func (f *webmFile) write(data []byte) error {
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+/*
+close writes the last cluster and the cues, fills in what was not known while
+writing and closes the file.
+*/
+func (f *webmFile) close() error {
+	err := f.finalize()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f *webmFile) finalize() error {
+	if err := f.flushCluster(); err != nil {
+		return err
+	}
+	cuesPosition := f.size - f.segmentStart
+	if len(f.cues) > 0 {
+		var points [][]byte
+		for _, cue := range f.cues {
+			points = append(points, ebmlElement(mkvIDCuePoint,
+				ebmlUint(mkvIDCueTime, cue.timecode),
+				ebmlElement(mkvIDCueTrackPositions,
+					ebmlUint(mkvIDCueTrack, cue.track),
+					ebmlUint(mkvIDCueClusterPosition, cue.position),
+				),
+			))
+		}
+		if err := f.write(ebmlElement(mkvIDCues, points...)); err != nil {
+			return err
+		}
+	}
+	seeks := [][]byte{webmSeek(mkvIDInfo, f.infoPosition), webmSeek(mkvIDTracks, f.tracksPosition)}
+	if len(f.cues) > 0 {
+		seeks = append(seeks, webmSeek(mkvIDCues, cuesPosition))
+	}
+	seekHead := ebmlElement(mkvIDSeekHead, seeks...)
+	seekHead = append(seekHead, ebmlVoid(webmSeekHeadSize-len(seekHead))...)
+	segmentSize := ebmlSizeOfLength(uint64(f.size-f.segmentStart), 8)
+	duration := ebmlFloat(mkvIDDuration, float64(f.lastTimecode))
+	for _, patch := range []struct {
+		position int64
+		data     []byte
+	}{
+		{f.segmentStart - 8, segmentSize},
+		{f.segmentStart, seekHead},
+		{f.durationPosition, duration[len(duration)-8:]},
+	} {
+		if _, err := f.file.WriteAt(patch.data, patch.position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func webmSeek(id uint32, position int64) []byte {
+	return ebmlElement(mkvIDSeek,
+		ebmlElement(mkvIDSeekID, ebmlID(id)),
+		ebmlFixedUint(mkvIDSeekPosition, uint64(position)),
+	)
+}
@@ -0,0 +1,529 @@
+package webrtcrecord
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultWebMSyncTimeout = 2 * time.Second
+	// webmMaxInterleaveDelay is how long a frame waits for the other track before it
+	// is written anyway, so a stalled track does not hold back the recording.
+	webmMaxInterleaveDelay = 500 * time.Millisecond
+)
+
+type WebMConfig struct {
+	// ReorderBufferSize is the number of packets of a track held back waiting for a
+	// missing one. Defaults to 64; a negative value writes packets in arrival order.
+	ReorderBufferSize int
+	// MaxDuration starts a new file once the current one is this long. Zero records to
+	// a single file.
+	MaxDuration time.Duration
+	// MaxSize starts a new file once the current one has grown to this many bytes.
+	// Zero records to a single file.
+	MaxSize int64
+	// SyncTimeout is how long the recording waits for a Sender Report of every track
+	// before it aligns the tracks by packet arrival time instead. Defaults to 2
+	// seconds; a negative value does not wait.
+	SyncTimeout time.Duration
+	// SenderReport returns the last Sender Report of the track of the kind.
+	// RecordWebM reads it from the publisher. Without it tracks are aligned by
+	// packet arrival time.
+	SenderReport func(kind webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool)
+	// OnKeyframeNeeded is called when the video waits for a keyframe: when the
+	// recording starts, after packet loss and when a new file is due. RecordWebM
+	// asks the publisher for one.
+	OnKeyframeNeeded func()
+	// OnFileComplete is called with the path of every file once it is finalized.
+	OnFileComplete func(path string)
+	// LoggerFactory creates the recorder logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+webmFrame is a frame of a track waiting to be written. at is its time on the
+timeline common to the tracks, set once the tracks are aligned.
+*/
+type webmFrame struct {
+	data      []byte
+	timestamp uint64
+	keyframe  bool
+	arrival   time.Time
+	at        time.Time
+}
+
+type webmTrack struct {
+	info       webmTrackInfo
+	kind       webrtc.RTPCodecType
+	clockRate  uint32
+	buffer     *reorderBuffer
+	frames     *frameAssembler
+	timestamps timestampUnwrapper
+	queue      []webmFrame
+	closed     bool
+	sink       *webmSink
+	// anchor ties an unwrapped RTP timestamp of the track to the common timeline.
+	anchored        bool
+	anchorTimestamp uint64
+	anchorTime      time.Time
+}
+
+/*
+WebMRecorder muxes the audio and video of a publisher into WebM files. The tracks
+are aligned on the sender's wallclock using their RTCP Sender Reports, so they stay
+in sync however their RTP timestamps start. Each file starts at a video keyframe,
+and a new file is started once the current one is longer than MaxDuration or larger
+than MaxSize; files after the first are named with a sequence number.
+
+Packets are written through the sinks returned by AudioSink and VideoSink, and the
+last file is finalized once both are closed, or by Close.
+*/
+type WebMRecorder struct {
+	mu          sync.Mutex
+	config      WebMConfig
+	path        string
+	tracks      []*webmTrack
+	video       *webmTrack
+	synced      bool
+	firstFrame  time.Time
+	file        *webmFile
+	files       int
+	rotationDue bool
+	completed   []string
+	closed      bool
+	err         error
+	now         func() time.Time
+	log         logging.LeveledLogger
+}
+
+/*
+NewWebMRecorder creates a recorder writing to path with an Opus audio track and a
+VP8 or VP9 video track. Either may be nil to record only the other.
+*/
+func NewWebMRecorder(audio, video *webrtc.RTPCodecCapability, path string, config WebMConfig) (*WebMRecorder, error) {
+	if audio == nil && video == nil {
+		return nil, fmt.Errorf("%w: no tracks", ErrUnsupportedCodec)
+	}
+	if config.SyncTimeout == 0 {
+		config.SyncTimeout = defaultWebMSyncTimeout
+	}
+	size := config.ReorderBufferSize
+	if size == 0 {
+		size = defaultReorderBufferSize
+	}
+	r := &WebMRecorder{
+		config: config,
+		path:   path,
+		now:    time.Now,
+		log:    webrtclog.NewLogger(config.LoggerFactory, "webm-recorder", "path", path),
+	}
+	if video != nil {
+		if _, err := webmCodecID(*video); err != nil || strings.HasPrefix(strings.ToLower(video.MimeType), "audio/") {
+			return nil, unsupportedCodec(*video)
+		}
+		frames, err := newFrameAssembler(*video, r.keyframeNeeded)
+		if err != nil {
+			return nil, err
+		}
+		r.video = &webmTrack{
+			info:      webmTrackInfo{number: 1, codec: *video},
+			kind:      webrtc.RTPCodecTypeVideo,
+			clockRate: clockRateOr(*video, 90000),
+			buffer:    newReorderBuffer(max(size, 0)),
+			frames:    frames,
+		}
+		r.tracks = append(r.tracks, r.video)
+	}
+	if audio != nil {
+		if _, _, err := opusParameters(*audio); err != nil {
+			return nil, err
+		}
+		r.tracks = append(r.tracks, &webmTrack{
+			info:      webmTrackInfo{number: uint64(len(r.tracks) + 1), codec: *audio},
+			kind:      webrtc.RTPCodecTypeAudio,
+			clockRate: clockRateOr(*audio, 48000),
+			buffer:    newReorderBuffer(max(size, 0)),
+		})
+	}
+	for _, track := range r.tracks {
+		track.sink = &webmSink{recorder: r, track: track}
+	}
+	return r, nil
+}
+
+func clockRateOr(codec webrtc.RTPCodecCapability, clockRate uint32) uint32 {
+	if codec.ClockRate != 0 {
+		return codec.ClockRate
+	}
+	return clockRate
+}
+
+/*
+RecordWebM records the local tracks audioTrackID and videoTrackID of peer to WebM
+files at path until both tracks end, the peer shuts down or the recorder is closed.
+Either track ID may be empty to record only the other track.
+*/
+func RecordWebM(peer *webrtcpeer.SfuPeer, audioTrackID string, videoTrackID string, path string, config WebMConfig) (*WebMRecorder, error) {
+	codecs, err := localTrackCodecs(peer, audioTrackID, videoTrackID)
+	if err != nil {
+		return nil, err
+	}
+	if config.SenderReport == nil {
+		config.SenderReport = publisherSenderReports(peer, audioTrackID, videoTrackID)
+	}
+	if config.OnKeyframeNeeded == nil && videoTrackID != "" {
+		config.OnKeyframeNeeded = peer.KeyframeRequester(videoTrackID)
+	}
+	recorder, err := NewWebMRecorder(codecs[audioTrackID], codecs[videoTrackID], path, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := attachSinks(peer, audioTrackID, recorder.AudioSink(), videoTrackID, recorder.VideoSink()); err != nil {
+		recorder.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+/*
+webmSink feeds one track of a WebMRecorder.
+*/
+type webmSink struct {
+	recorder *WebMRecorder
+	track    *webmTrack
+}
+
+func (s *webmSink) WriteRTP(packet *rtp.Packet) error {
+	return s.recorder.writeRTP(s.track, packet)
+}
+
+func (s *webmSink) Close() error {
+	return s.recorder.closeTrack(s.track)
+}
+
+/*
+AudioSink returns the sink of the audio track, or nil when the recorder has none.
+*/
+func (r *WebMRecorder) AudioSink() webrtcpeer.TrackSink {
+	return r.sink(webrtc.RTPCodecTypeAudio)
+}
+
+/*
+VideoSink returns the sink of the video track, or nil when the recorder has none.
+*/
+func (r *WebMRecorder) VideoSink() webrtcpeer.TrackSink {
+	return r.sink(webrtc.RTPCodecTypeVideo)
+}
+
+func (r *WebMRecorder) sink(kind webrtc.RTPCodecType) webrtcpeer.TrackSink {
+	for _, track := range r.tracks {
+		if track.kind == kind {
+			return track.sink
+		}
+	}
+	return nil
+}
+
+/*
+Files returns the number of files started so far.
+*/
+func (r *WebMRecorder) Files() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.files
+}
+
+func (r *WebMRecorder) writeRTP(track *webmTrack, packet *rtp.Packet) error {
+	r.mu.Lock()
+	if r.closed || track.closed {
+		r.mu.Unlock()
+		return ErrRecorderClosed
+	}
+	if r.err == nil {
+		r.err = track.buffer.push(packet, func(packet *rtp.Packet, gap bool) error {
+			return r.depacketize(track, packet, gap)
+		})
+	}
+	if r.err == nil {
+		r.release()
+	}
+	err := r.err
+	completed := r.takeCompleted()
+	r.mu.Unlock()
+	r.notifyCompleted(completed)
+	return err
+}
+
+/*
+depacketize queues the frames completed by a packet: every Opus packet is a frame,
+and video frames come from the track's frame assembler.
+*/
+func (r *WebMRecorder) depacketize(track *webmTrack, packet *rtp.Packet, gap bool) error {
+	if track.frames == nil {
+		if len(packet.Payload) > 0 {
+			r.queue(track, packet.Payload, packet.Timestamp, true)
+		}
+		return nil
+	}
+	return track.frames.push(packet, gap, func(data []byte, timestamp uint32, keyframe bool) error {
+		track.info.width, track.info.height = track.frames.width, track.frames.height
+		r.queue(track, append([]byte(nil), data...), timestamp, keyframe)
+		return nil
+	})
+}
+
+func (r *WebMRecorder) queue(track *webmTrack, data []byte, timestamp uint32, keyframe bool) {
+	now := r.now()
+	if r.firstFrame.IsZero() {
+		r.firstFrame = now
+	}
+	frame := webmFrame{data: data, timestamp: track.timestamps.unwrap(timestamp), keyframe: keyframe, arrival: now}
+	if r.synced {
+		r.place(track, &frame)
+	}
+	track.queue = append(track.queue, frame)
+}
+
+/*
+sync aligns the tracks once every track has a Sender Report, or by arrival time when
+the sync timeout expires or the tracks end first.
+*/
+func (r *WebMRecorder) sync(force bool) {
+	if r.synced || r.firstFrame.IsZero() {
+		return
+	}
+	reports := r.config.SenderReport != nil
+	for _, track := range r.tracks {
+		if reports {
+			_, reports = r.config.SenderReport(track.kind)
+		}
+	}
+	if !reports {
+		if !force && r.config.SyncTimeout > 0 && r.now().Sub(r.firstFrame) < r.config.SyncTimeout {
+			return
+		}
+		r.log.Warn("No Sender Reports, aligning tracks by arrival time")
+		r.config.SenderReport = nil
+	}
+	r.synced = true
+	for _, track := range r.tracks {
+		for i := range track.queue {
+			r.place(track, &track.queue[i])
+		}
+	}
+}
+
+/*
+place puts a frame on the common timeline, anchoring the track to its latest Sender
+Report when there is one and to the arrival of its first frame otherwise.
+*/
+func (r *WebMRecorder) place(track *webmTrack, frame *webmFrame) {
+	if r.config.SenderReport != nil {
+		if report, ok := r.config.SenderReport(track.kind); ok {
+			track.anchored = true
+			track.anchorTimestamp = frame.timestamp
+			track.anchorTime = report.Time(uint32(frame.timestamp), track.clockRate)
+		}
+	}
+	if !track.anchored {
+		track.anchored = true
+		track.anchorTimestamp = frame.timestamp
+		track.anchorTime = frame.arrival
+	}
+	elapsed := int64(frame.timestamp - track.anchorTimestamp)
+	frame.at = track.anchorTime.Add(time.Duration(elapsed * int64(time.Second) / int64(track.clockRate)))
+}
+
+/*
+release writes queued frames in timeline order. A frame waits while another track
+that is still open has nothing queued, unless it has waited too long.
+*/
+func (r *WebMRecorder) release() {
+	r.sync(false)
+	if !r.synced {
+		return
+	}
+	now := r.now()
+	for r.err == nil {
+		var next *webmTrack
+		for _, track := range r.tracks {
+			if len(track.queue) > 0 && (next == nil || track.queue[0].at.Before(next.queue[0].at)) {
+				next = track
+			}
+		}
+		if next == nil {
+			return
+		}
+		for _, track := range r.tracks {
+			if track != next && len(track.queue) == 0 && !track.closed && now.Sub(next.queue[0].arrival) < webmMaxInterleaveDelay {
+				return
+			}
+		}
+		frame := next.queue[0]
+		next.queue = next.queue[1:]
+		r.err = r.writeFrame(next, frame)
+	}
+}
+
+/*
+writeFrame writes a frame to the current file, starting the first file at a video
+keyframe and a new one at a keyframe once the current file is full.
+*/
+func (r *WebMRecorder) writeFrame(track *webmTrack, frame webmFrame) error {
+	startsFile := r.video == nil || (track == r.video && frame.keyframe)
+	if r.file == nil && !startsFile {
+		return nil
+	}
+	if r.file != nil && r.full(frame.at) {
+		if startsFile {
+			if err := r.finishFile(); err != nil {
+				return err
+			}
+		} else if !r.rotationDue && r.video != nil {
+			r.rotationDue = true
+			r.keyframeNeeded()
+		}
+	}
+	if r.file == nil {
+		if err := r.startFile(frame.at); err != nil {
+			return err
+		}
+	}
+	return r.file.writeBlock(track.info.number, frame.at, frame.data, frame.keyframe)
+}
+
+func (r *WebMRecorder) full(at time.Time) bool {
+	if r.config.MaxDuration > 0 && at.Sub(r.file.origin) >= r.config.MaxDuration {
+		return true
+	}
+	return r.config.MaxSize > 0 && r.file.pendingSize() >= r.config.MaxSize
+}
+
+func (r *WebMRecorder) startFile(origin time.Time) error {
+	path := r.path
+	if r.files > 0 {
+		extension := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, extension), r.files, extension)
+	}
+	var tracks []webmTrackInfo
+	for _, track := range r.tracks {
+		tracks = append(tracks, track.info)
+	}
+	cueTrack := tracks[0].number
+	file, err := createWebMFile(path, origin, tracks, cueTrack)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.files++
+	r.rotationDue = false
+	r.log.Debugf("Recording to %s", path)
+	return nil
+}
+
+func (r *WebMRecorder) finishFile() error {
+	file := r.file
+	r.file = nil
+	if err := file.close(); err != nil {
+		return err
+	}
+	r.completed = append(r.completed, file.path)
+	return nil
+}
+
+func (r *WebMRecorder) keyframeNeeded() {
+	if r.config.OnKeyframeNeeded != nil {
+		r.config.OnKeyframeNeeded()
+	}
+}
+
+func (r *WebMRecorder) takeCompleted() []string {
+	completed := r.completed
+	r.completed = nil
+	return completed
+}
+
+func (r *WebMRecorder) notifyCompleted(completed []string) {
+	if r.config.OnFileComplete == nil {
+		return
+	}
+	for _, path := range completed {
+		r.config.OnFileComplete(path)
+	}
+}
+
+/*
+closeTrack writes what is left of a track and finalizes the recording once every
+track is closed.
+*/
+func (r *WebMRecorder) closeTrack(track *webmTrack) error {
+	r.mu.Lock()
+	if r.closed || track.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.flushTrack(track)
+	for _, track := range r.tracks {
+		if !track.closed {
+			r.release()
+			err := r.err
+			completed := r.takeCompleted()
+			r.mu.Unlock()
+			r.notifyCompleted(completed)
+			return err
+		}
+	}
+	r.mu.Unlock()
+	return r.Close()
+}
+
+func (r *WebMRecorder) flushTrack(track *webmTrack) {
+	track.closed = true
+	if r.err == nil {
+		r.err = track.buffer.flush(func(packet *rtp.Packet, gap bool) error {
+			return r.depacketize(track, packet, gap)
+		})
+	}
+}
+
+/*
+Close writes the frames still held back and finalizes the last file. Closing again
+does nothing.
+*/
+func (r *WebMRecorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	for _, track := range r.tracks {
+		if !track.closed {
+			r.flushTrack(track)
+		}
+	}
+	r.sync(true)
+	r.release()
+	r.closed = true
+	err := r.err
+	if r.file != nil {
+		if closeErr := r.finishFile(); err == nil {
+			err = closeErr
+		}
+	}
+	completed := r.takeCompleted()
+	r.mu.Unlock()
+	if err != nil {
+		r.log.Warnf("Error finalizing recording: %v", err)
+	}
+	r.notifyCompleted(completed)
+	return err
+}
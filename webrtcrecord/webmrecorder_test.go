@@ -0,0 +1,254 @@
+package webrtcrecord
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var opusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+type webmBlock struct {
+	track    uint64
+	timecode uint64
+	keyframe bool
+}
+
+/*
+webmContents is what a test reads back from a WebM file.
+*/
+type webmContents struct {
+	codecIDs []string
+	duration float64
+	blocks   []webmBlock
+	cues     int
+	seeks    map[uint32]uint64
+	// elements maps the position of every top-level element of the segment to its ID.
+	elements map[uint64]uint32
+}
+
+func readEBMLVint(data []byte, keepMarker bool) (uint64, int) {
+	length := 1
+	for length <= 8 && data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= 0xff >> length
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+func readEBMLUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+/*
+walkEBML calls visit with every element in data, descending into those it returns true for.
+*/
+func walkEBML(data []byte, visit func(id uint32, position int, data []byte) bool) {
+	for position := 0; position < len(data); {
+		id, idLength := readEBMLVint(data[position:], true)
+		size, sizeLength := readEBMLVint(data[position+idLength:], false)
+		start := position + idLength + sizeLength
+		body := data[start : start+int(size)]
+		if visit(uint32(id), position, body) {
+			walkEBML(body, visit)
+		}
+		position = start + int(size)
+	}
+}
+
+func readWebM(t *testing.T, path string) webmContents {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := webmContents{seeks: map[uint32]uint64{}, elements: map[uint64]uint32{}}
+	var clusterTimecode uint64
+	var seekID uint32
+	walkEBML(data, func(id uint32, position int, body []byte) bool {
+		switch id {
+		case mkvIDSegment:
+			walkEBML(body, func(id uint32, position int, body []byte) bool {
+				contents.elements[uint64(position)] = id
+				return false
+			})
+			return true
+		case mkvIDSeekHead, mkvIDSeek, mkvIDInfo, mkvIDTracks, mkvIDTrackEntry, mkvIDCluster, mkvIDCues:
+			return true
+		case mkvIDSeekID:
+			seekID = uint32(readEBMLUint(body))
+		case mkvIDSeekPosition:
+			contents.seeks[seekID] = readEBMLUint(body)
+		case mkvIDCodecID:
+			contents.codecIDs = append(contents.codecIDs, string(body))
+		case mkvIDDuration:
+			contents.duration = math.Float64frombits(binary.BigEndian.Uint64(body))
+		case mkvIDTimecode:
+			clusterTimecode = readEBMLUint(body)
+		case mkvIDSimpleBlock:
+			track, length := readEBMLVint(body, false)
+			contents.blocks = append(contents.blocks, webmBlock{
+				track:    track,
+				timecode: clusterTimecode + uint64(int16(binary.BigEndian.Uint16(body[length:]))),
+				keyframe: body[length+2]&0x80 != 0,
+			})
+		case mkvIDCuePoint:
+			contents.cues++
+		}
+		return false
+	})
+	return contents
+}
+
+func (c webmContents) timecodes(track uint64) []uint64 {
+	var timecodes []uint64
+	for _, block := range c.blocks {
+		if block.track == track {
+			timecodes = append(timecodes, block.timecode)
+		}
+	}
+	return timecodes
+}
+
+func opusPacket(seq uint16, timestamp uint32) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: timestamp}, Payload: []byte{0xfc, 0xff, 0xfe}}
+}
+
+/*
+senderReport returns a Sender Report tying timestamp to the wallclock time at.
+*/
+func senderReport(timestamp uint32, at time.Time) webrtcpeer.SenderReport {
+	seconds := uint64(at.Unix() + 2208988800)
+	fraction := uint64(at.Nanosecond()) << 32 / uint64(time.Second)
+	return webrtcpeer.SenderReport{NTPTime: seconds<<32 | fraction, RTPTime: timestamp}
+}
+
+func TestWebMRecorder(t *testing.T) {
+	t.Run("Aligns audio and video on Sender Reports", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "call.webm")
+		wallclock := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		var completed []string
+		recorder, err := NewWebMRecorder(&opusCodec, &vp8Codec, path, WebMConfig{
+			// The audio timestamp 5000 was sampled 200ms after the video timestamp 1000000.
+			SenderReport: func(kind webrtc.RTPCodecType) (webrtcpeer.SenderReport, bool) {
+				if kind == webrtc.RTPCodecTypeVideo {
+					return senderReport(1000000, wallclock), true
+				}
+				return senderReport(5000, wallclock.Add(200*time.Millisecond)), true
+			},
+			OnFileComplete: func(path string) { completed = append(completed, path) },
+		})
+		assert.Nil(t, err)
+		recorder.now = func() time.Time { return wallclock }
+
+		for i := 0; i < 30; i++ {
+			for _, packet := range vp8Packets(uint16(2*i), 1000000+uint32(i)*3000, i%10 == 0) {
+				assert.Nil(t, recorder.VideoSink().WriteRTP(packet))
+			}
+		}
+		for i := 0; i < 40; i++ {
+			assert.Nil(t, recorder.AudioSink().WriteRTP(opusPacket(uint16(i), 5000+uint32(i)*960)))
+		}
+		assert.Nil(t, recorder.VideoSink().Close())
+		assert.Nil(t, recorder.AudioSink().Close())
+		assert.Equal(t, []string{path}, completed)
+		assert.ErrorIs(t, recorder.AudioSink().WriteRTP(opusPacket(40, 0)), ErrRecorderClosed)
+
+		contents := readWebM(t, path)
+		assert.Equal(t, []string{"V_VP8", "A_OPUS"}, contents.codecIDs)
+		video := contents.timecodes(1)
+		audio := contents.timecodes(2)
+		assert.Len(t, video, 30)
+		assert.Len(t, audio, 40)
+		assert.Equal(t, []uint64{0, 33, 66}, video[:3])
+		assert.Equal(t, []uint64{200, 220, 240}, audio[:3])
+		for i := 1; i < len(contents.blocks); i++ {
+			assert.LessOrEqual(t, contents.blocks[i-1].timecode, contents.blocks[i].timecode)
+		}
+		assert.Equal(t, 3, contents.cues)
+		assert.InDelta(t, 980, contents.duration, 1)
+		assert.Equal(t, uint32(mkvIDCues), contents.elements[contents.seeks[mkvIDCues]])
+		assert.Equal(t, uint32(mkvIDTracks), contents.elements[contents.seeks[mkvIDTracks]])
+	})
+	t.Run("Aligns by arrival time without Sender Reports", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "call.webm")
+		recorder, err := NewWebMRecorder(&opusCodec, &vp8Codec, path, WebMConfig{SyncTimeout: -1})
+		assert.Nil(t, err)
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		recorder.now = func() time.Time { return now }
+
+		for i := 0; i < 10; i++ {
+			for _, packet := range vp8Packets(uint16(2*i), uint32(i)*9000, i == 0) {
+				assert.Nil(t, recorder.VideoSink().WriteRTP(packet))
+			}
+			if i == 5 {
+				now = now.Add(500 * time.Millisecond)
+				assert.Nil(t, recorder.AudioSink().WriteRTP(opusPacket(0, 123456)))
+			}
+		}
+		assert.Nil(t, recorder.Close())
+
+		contents := readWebM(t, path)
+		assert.Equal(t, []uint64{0, 100, 200, 300, 400, 500, 600, 700, 800, 900}, contents.timecodes(1))
+		assert.Equal(t, []uint64{500}, contents.timecodes(2))
+	})
+	t.Run("Starts a new file at a keyframe past the maximum duration", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		keyframesNeeded := 0
+		var completed []string
+		recorder, err := NewWebMRecorder(nil, &vp8Codec, filepath.Join(dir, "call.webm"), WebMConfig{
+			MaxDuration:      time.Second,
+			OnKeyframeNeeded: func() { keyframesNeeded++ },
+			OnFileComplete:   func(path string) { completed = append(completed, filepath.Base(path)) },
+		})
+		assert.Nil(t, err)
+
+		// 3 seconds at 10 frames per second with a keyframe every 1.5 seconds.
+		for i := 0; i < 30; i++ {
+			for _, packet := range vp8Packets(uint16(2*i), uint32(i)*9000, i%15 == 0) {
+				assert.Nil(t, recorder.VideoSink().WriteRTP(packet))
+			}
+		}
+		assert.Nil(t, recorder.Close())
+		assert.Equal(t, []string{"call.webm", "call-1.webm"}, completed)
+		assert.Equal(t, 2, recorder.Files())
+		// At the start and once each file is past the maximum duration.
+		assert.Equal(t, 3, keyframesNeeded)
+
+		first := readWebM(t, filepath.Join(dir, "call.webm"))
+		assert.Len(t, first.blocks, 15)
+		assert.Equal(t, uint64(1400), first.blocks[14].timecode)
+		second := readWebM(t, filepath.Join(dir, "call-1.webm"))
+		assert.Len(t, second.blocks, 15)
+		assert.Equal(t, webmBlock{track: 1, timecode: 0, keyframe: true}, second.blocks[0])
+	})
+	t.Run("Rejects codecs WebM cannot carry", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "call.webm")
+		_, err := NewWebMRecorder(nil, &webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1}, path, WebMConfig{})
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+		_, err = NewWebMRecorder(&webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, nil, path, WebMConfig{})
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+	})
+}
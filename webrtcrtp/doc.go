@@ -0,0 +1,14 @@
+/*
+Package webrtcrtp bridges SfuPeer tracks and plain RTP, as hardware
+encoders, ffmpeg and GStreamer speak it.
+
+An Ingest listens on a local UDP port for the RTP of one source and writes it to a
+webrtc.TrackLocalStaticRTP, which SfuPeer.AddPeerTrack forwards to WebRTC
+subscribers like any converted remote track. It keeps the track continuous when the
+source restarts with a new SSRC and sends RTCP Receiver Reports back to the source.
+
+An Egress goes the other way: attached to a local track with StartEgress, it sends
+the track as plain RTP over UDP, or over TCP framed as in RFC 4571, with Sender
+Reports, and writes an SDP file the receiving pipeline can open.
+*/
+package webrtcrtp
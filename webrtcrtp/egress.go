@@ -0,0 +1,503 @@
+package webrtcrtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultDynamicPayloadType   = 96
+	defaultSenderReportInterval = time.Second
+	defaultSessionName          = "webrtcutil"
+	redialInterval              = time.Second
+	// egressQueueSize is how many framed packets may wait for a slow TCP receiver
+	// before packets are dropped, rather than holding up the publisher's forwarding.
+	egressQueueSize = 512
+	ntpEpochOffset  = 2208988800
+)
+
+var (
+	ErrAddressRequired = errors.New("egress address required")
+	ErrEgressClosed    = errors.New("egress closed")
+)
+
+/*
+EgressTransport is how an Egress sends RTP.
+*/
+type EgressTransport string
+
+const (
+	// EgressUDP sends RTP over UDP to the egress address and RTCP to the next port up.
+	EgressUDP EgressTransport = "udp"
+	// EgressTCP connects to the egress address and sends RTP and RTCP framed as in RFC
+	// 4571, each packet preceded by its 16 bit length.
+	EgressTCP EgressTransport = "tcp"
+)
+
+type EgressConfig struct {
+	// Address is where RTP goes, such as "127.0.0.1:5004". Required.
+	Address string
+	// Transport is EgressUDP or EgressTCP. Defaults to EgressUDP.
+	Transport EgressTransport
+	// PayloadType is the payload type of the packets sent. Defaults to the static
+	// payload type of the codec, or 96.
+	PayloadType uint8
+	// SSRC is the SSRC of the packets sent. Defaults to a random one.
+	SSRC uint32
+	// SDPPath is where the SDP describing the stream is written, for the receiving
+	// pipeline to open. No file is written when empty.
+	SDPPath string
+	// SenderReportInterval is how often Sender Reports are sent for receivers to
+	// synchronize on. Defaults to 1 second; a negative value sends none.
+	SenderReportInterval time.Duration
+	// OnKeyframeNeeded is called when the egress starts and when a TCP egress has
+	// reconnected, for the receiver to start decoding at once. StartEgress asks the
+	// publisher for a keyframe.
+	OnKeyframeNeeded func()
+	// LoggerFactory creates the egress logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+Egress sends the packets of a track as plain RTP. It is a webrtcpeer.TrackSink, so it
+can be attached to any local track of an SfuPeer.
+*/
+type Egress struct {
+	codec            webrtc.RTPCodecCapability
+	address          string
+	transport        EgressTransport
+	payloadType      uint8
+	ssrc             uint32
+	sdp              string
+	onKeyframeNeeded func()
+	mu               sync.Mutex
+	conn             net.Conn
+	rtcpConn         net.Conn
+	redialing        bool
+	out              chan []byte
+	// refused is set while UDP sends are refused for want of a receiver.
+	refused       atomic.Bool
+	packetCount   uint32
+	octetCount    uint32
+	lastTimestamp uint32
+	lastWriteAt   time.Time
+	closed        chan struct{}
+	closeOnce     sync.Once
+	wg            sync.WaitGroup
+	log           logging.LeveledLogger
+}
+
+/*
+NewEgress creates an egress of a track of the codec and connects it to the
+configured address.
+*/
+func NewEgress(codec webrtc.RTPCodecCapability, config EgressConfig) (*Egress, error) {
+	if config.Address == "" {
+		return nil, ErrAddressRequired
+	}
+	if codec.ClockRate == 0 {
+		return nil, ErrCodecRequired
+	}
+	e := &Egress{
+		codec:            codec,
+		address:          config.Address,
+		transport:        config.Transport,
+		payloadType:      config.PayloadType,
+		ssrc:             config.SSRC,
+		onKeyframeNeeded: config.OnKeyframeNeeded,
+		closed:           make(chan struct{}),
+		log:              webrtclog.NewLogger(config.LoggerFactory, "rtp-egress", "address", config.Address),
+	}
+	if e.transport == "" {
+		e.transport = EgressUDP
+	}
+	if e.payloadType == 0 {
+		e.payloadType = StaticPayloadType(codec)
+	}
+	if e.ssrc == 0 {
+		e.ssrc = rand.Uint32()
+	}
+	if err := e.dial(); err != nil {
+		return nil, err
+	}
+	if e.transport == EgressTCP {
+		e.out = make(chan []byte, egressQueueSize)
+		e.wg.Add(1)
+		go e.write()
+	}
+	e.sdp = e.describe()
+	if config.SDPPath != "" {
+		if err := os.WriteFile(config.SDPPath, []byte(e.sdp), 0o644); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	interval := config.SenderReportInterval
+	if interval == 0 {
+		interval = defaultSenderReportInterval
+	}
+	if interval > 0 {
+		e.wg.Add(1)
+		go e.sendSenderReports(interval)
+	}
+	e.log.Infof("Sending RTP over %s", e.transport)
+	e.keyframeNeeded()
+	return e, nil
+}
+
+/*
+StartEgress sends the local track localTrackID of peer as plain RTP until the track
+ends, the peer shuts down or the egress is detached with SfuPeer.DetachTrackSink.
+*/
+func StartEgress(peer *webrtcpeer.SfuPeer, localTrackID string, config EgressConfig) (*Egress, error) {
+	peer.LocalTracksMu.Lock()
+	track := peer.LocalTracks[localTrackID]
+	peer.LocalTracksMu.Unlock()
+	if track == nil {
+		return nil, &webrtcpeer.TrackError{PeerID: peer.ID(), TrackID: localTrackID, Err: webrtcpeer.ErrTrackNotFound}
+	}
+	if config.OnKeyframeNeeded == nil {
+		config.OnKeyframeNeeded = peer.KeyframeRequester(localTrackID)
+	}
+	// The keyframe is asked for once the egress receives the track.
+	onKeyframeNeeded := config.OnKeyframeNeeded
+	config.OnKeyframeNeeded = nil
+	egress, err := NewEgress(track.Codec(), config)
+	if err != nil {
+		return nil, err
+	}
+	egress.onKeyframeNeeded = onKeyframeNeeded
+	if err := peer.AttachTrackSink(localTrackID, egress); err != nil {
+		egress.Close()
+		return nil, err
+	}
+	egress.keyframeNeeded()
+	return egress, nil
+}
+
+/*
+StaticPayloadType returns the payload type RFC 3551 assigns to the codec, or the
+first dynamic one.
+*/
+func StaticPayloadType(codec webrtc.RTPCodecCapability) uint8 {
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU):
+		return 0
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMA):
+		return 8
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeG722):
+		return 9
+	default:
+		return defaultDynamicPayloadType
+	}
+}
+
+func (e *Egress) dial() error {
+	if e.transport == EgressTCP {
+		conn, err := net.Dial("tcp", e.address)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+		return nil
+	}
+	if e.transport != EgressUDP {
+		return fmt.Errorf("unknown egress transport %q", e.transport)
+	}
+	host, port, err := net.SplitHostPort(e.address)
+	if err != nil {
+		return err
+	}
+	rtpPort, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", e.address)
+	if err != nil {
+		return err
+	}
+	rtcpConn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(rtpPort+1)))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	e.conn, e.rtcpConn = conn, rtcpConn
+	return nil
+}
+
+/*
+SDP returns the session description of the stream, as written to SDPPath.
+*/
+func (e *Egress) SDP() string {
+	return e.sdp
+}
+
+/*
+describe builds the SDP of the stream from where it is sent.
+*/
+func (e *Egress) describe() string {
+	local := e.conn.LocalAddr().String()
+	remote := e.conn.RemoteAddr().String()
+	localHost, _, _ := net.SplitHostPort(local)
+	remoteHost, remotePort, _ := net.SplitHostPort(remote)
+	kind := "video"
+	if strings.HasPrefix(strings.ToLower(e.codec.MimeType), "audio/") {
+		kind = "audio"
+	}
+	_, encoding, _ := strings.Cut(e.codec.MimeType, "/")
+	rtpmap := fmt.Sprintf("%s/%d", encoding, e.codec.ClockRate)
+	if e.codec.Channels > 1 {
+		rtpmap += "/" + strconv.Itoa(int(e.codec.Channels))
+	}
+	var sdp strings.Builder
+	fmt.Fprintf(&sdp, "v=0\r\n")
+	fmt.Fprintf(&sdp, "o=- %d 0 IN %s %s\r\n", e.ssrc, addressType(localHost), localHost)
+	fmt.Fprintf(&sdp, "s=%s\r\n", defaultSessionName)
+	fmt.Fprintf(&sdp, "c=IN %s %s\r\n", addressType(remoteHost), remoteHost)
+	fmt.Fprintf(&sdp, "t=0 0\r\n")
+	if e.transport == EgressTCP {
+		fmt.Fprintf(&sdp, "m=%s %s TCP/RTP/AVP %d\r\n", kind, remotePort, e.payloadType)
+		// The receiver accepts the connection the egress makes, and RTCP comes in the same stream.
+		fmt.Fprintf(&sdp, "a=setup:passive\r\n")
+		fmt.Fprintf(&sdp, "a=connection:new\r\n")
+		fmt.Fprintf(&sdp, "a=rtcp-mux\r\n")
+	} else {
+		fmt.Fprintf(&sdp, "m=%s %s RTP/AVP %d\r\n", kind, remotePort, e.payloadType)
+	}
+	fmt.Fprintf(&sdp, "a=rtpmap:%d %s\r\n", e.payloadType, rtpmap)
+	if e.codec.SDPFmtpLine != "" {
+		fmt.Fprintf(&sdp, "a=fmtp:%d %s\r\n", e.payloadType, e.codec.SDPFmtpLine)
+	}
+	fmt.Fprintf(&sdp, "a=recvonly\r\n")
+	return sdp.String()
+}
+
+func addressType(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+/*
+WriteRTP sends packet with the payload type and SSRC of the egress. A TCP egress
+whose connection failed drops packets until it has reconnected.
+*/
+func (e *Egress) WriteRTP(packet *rtp.Packet) error {
+	select {
+	case <-e.closed:
+		return ErrEgressClosed
+	default:
+	}
+	header := packet.Header.Clone()
+	header.PayloadType = e.payloadType
+	header.SSRC = e.ssrc
+	// Header extensions were negotiated with the publisher, not the receiver.
+	header.Extension = false
+	header.Extensions = nil
+	data, err := (&rtp.Packet{Header: header, Payload: packet.Payload}).Marshal()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.packetCount++
+	e.octetCount += uint32(len(packet.Payload))
+	e.lastTimestamp = packet.Timestamp
+	e.lastWriteAt = time.Now()
+	e.mu.Unlock()
+	return e.send(data, false)
+}
+
+/*
+send writes an RTP or RTCP packet, RTCP to the next port up over UDP. Over TCP the
+packet is framed and queued for the writer, and dropped when the receiver is too slow
+to take it. Over UDP a send refused while nothing listens at the address is not an
+error; it is logged once until the receiver shows up.
+*/
+func (e *Egress) send(data []byte, isRTCP bool) error {
+	if e.transport == EgressTCP {
+		select {
+		case e.out <- append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...):
+		case <-e.closed:
+		default:
+			e.log.Debugf("Dropped packet for a slow receiver")
+		}
+		return nil
+	}
+	e.mu.Lock()
+	conn := e.conn
+	if isRTCP {
+		conn = e.rtcpConn
+	}
+	e.mu.Unlock()
+	if _, err := conn.Write(data); err != nil {
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		// Receivers often leave the RTCP port closed.
+		if !isRTCP && !e.refused.Swap(true) {
+			e.log.Warnf("Nothing receiving, sending on regardless")
+		}
+		return nil
+	}
+	if !isRTCP && e.refused.Swap(false) {
+		e.log.Infof("Receiving again")
+	}
+	return nil
+}
+
+/*
+write sends the packets queued over TCP, dropping them while the connection is being
+redialed.
+*/
+func (e *Egress) write() {
+	defer e.wg.Done()
+	for {
+		select {
+		case <-e.closed:
+			return
+		case data := <-e.out:
+			e.mu.Lock()
+			conn := e.conn
+			e.mu.Unlock()
+			if conn == nil {
+				continue
+			}
+			if _, err := conn.Write(data); err != nil {
+				e.redial(conn)
+			}
+		}
+	}
+}
+
+/*
+redial replaces a failed TCP connection, trying again every second until it
+connects or the egress is closed.
+*/
+func (e *Egress) redial(failed net.Conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != failed || e.redialing {
+		return
+	}
+	select {
+	case <-e.closed:
+		return
+	default:
+	}
+	failed.Close()
+	e.conn = nil
+	e.redialing = true
+	e.log.Warnf("Connection lost, reconnecting")
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for {
+			select {
+			case <-e.closed:
+				return
+			case <-time.After(redialInterval):
+			}
+			conn, err := net.DialTimeout("tcp", e.address, redialInterval)
+			if err != nil {
+				continue
+			}
+			e.mu.Lock()
+			e.conn = conn
+			e.redialing = false
+			e.mu.Unlock()
+			e.log.Infof("Reconnected")
+			e.keyframeNeeded()
+			return
+		}
+	}()
+}
+
+func (e *Egress) keyframeNeeded() {
+	if e.onKeyframeNeeded != nil {
+		e.onKeyframeNeeded()
+	}
+}
+
+func (e *Egress) sendSenderReports(interval time.Duration) {
+	defer e.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closed:
+			return
+		case now := <-ticker.C:
+			e.mu.Lock()
+			if e.packetCount == 0 {
+				e.mu.Unlock()
+				continue
+			}
+			// The RTP time of now, going on from the last packet sent.
+			elapsed := uint32(now.Sub(e.lastWriteAt).Seconds() * float64(e.codec.ClockRate))
+			report := &rtcp.SenderReport{
+				SSRC:        e.ssrc,
+				NTPTime:     ntpTime(now),
+				RTPTime:     e.lastTimestamp + elapsed,
+				PacketCount: e.packetCount,
+				OctetCount:  e.octetCount,
+			}
+			e.mu.Unlock()
+			data, err := rtcp.Marshal([]rtcp.Packet{report, &rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+				Source: e.ssrc,
+				Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: defaultSessionName}},
+			}}}})
+			if err == nil {
+				err = e.send(data, true)
+			}
+			if err != nil {
+				e.log.Warnf("Error sending Sender Report: %v", err)
+			}
+		}
+	}
+}
+
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+/*
+Close stops sending and closes the connections. Closing again does nothing.
+*/
+func (e *Egress) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.mu.Lock()
+		if e.conn != nil {
+			err = e.conn.Close()
+		}
+		if e.rtcpConn != nil {
+			if closeErr := e.rtcpConn.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		e.mu.Unlock()
+		e.wg.Wait()
+	})
+	return err
+}
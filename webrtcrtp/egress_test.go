@@ -0,0 +1,268 @@
+package webrtcrtp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+listenUDPPair listens on a free UDP port and the next one up, for RTP and RTCP.
+*/
+func listenUDPPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	for range 10 {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := *rtpConn.LocalAddr().(*net.UDPAddr)
+		address.Port++
+		rtcpConn, err := net.ListenUDP("udp", &address)
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			rtpConn.Close()
+			rtcpConn.Close()
+		})
+		return rtpConn, rtcpConn
+	}
+	t.Fatal("no free port pair")
+	return nil, nil
+}
+
+func readRTP(t *testing.T, conn *net.UDPConn) *rtp.Packet {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := &rtp.Packet{}
+	assert.Nil(t, packet.Unmarshal(buf[:n]))
+	return packet
+}
+
+/*
+readFramed reads one RFC 4571 framed packet from conn.
+*/
+func readFramed(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeTestPacket(t *testing.T, track *webrtc.TrackLocalStaticRTP, seq uint16, timestamp uint32) {
+	t.Helper()
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 111, SSRC: 1, SequenceNumber: seq, Timestamp: timestamp},
+		Payload: []byte{byte(seq)},
+	}
+	packet.Header.SetExtension(1, []byte{1})
+	assert.Nil(t, track.WriteRTP(packet))
+}
+
+func newPublisher(t *testing.T, codec webrtc.RTPCodecCapability) (*webrtcpeer.SfuPeer, *webrtc.TrackLocalStaticRTP) {
+	t.Helper()
+	peer, err := webrtcpeer.NewSfuPeer("publisher", &webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Shutdown)
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "camera", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.LocalTracks[track.ID()] = track
+	return peer, track
+}
+
+func TestEgress(t *testing.T) {
+	t.Run("Sends a track over UDP with its own SSRC and payload type", func(t *testing.T) {
+		t.Parallel()
+		rtpConn, rtcpConn := listenUDPPair(t)
+		peer, track := newPublisher(t, vp8Codec)
+		var keyframes atomic.Int32
+		egress, err := StartEgress(peer, "camera", EgressConfig{
+			Address:              rtpConn.LocalAddr().String(),
+			SSRC:                 1234,
+			SenderReportInterval: 50 * time.Millisecond,
+			OnKeyframeNeeded:     func() { keyframes.Add(1) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		assert.Equal(t, int32(1), keyframes.Load())
+
+		writeTestPacket(t, track, 10, 3000)
+		packet := readRTP(t, rtpConn)
+		assert.Equal(t, uint32(1234), packet.SSRC)
+		assert.Equal(t, uint8(96), packet.PayloadType)
+		assert.Equal(t, uint16(10), packet.SequenceNumber)
+		assert.Equal(t, uint32(3000), packet.Timestamp)
+		assert.False(t, packet.Extension)
+		assert.Equal(t, []byte{10}, packet.Payload)
+
+		report := readRTCP[*rtcp.SenderReport](t, rtcpConn)
+		assert.Equal(t, uint32(1234), report.SSRC)
+		assert.Equal(t, uint32(1), report.PacketCount)
+		assert.Equal(t, uint32(1), report.OctetCount)
+		assert.GreaterOrEqual(t, report.RTPTime, uint32(3000))
+	})
+	t.Run("Frames packets over TCP and reconnects", func(t *testing.T) {
+		t.Parallel()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		var keyframes atomic.Int32
+		egress, err := NewEgress(vp8Codec, EgressConfig{
+			Address:              listener.Addr().String(),
+			Transport:            EgressTCP,
+			SenderReportInterval: -1,
+			OnKeyframeNeeded:     func() { keyframes.Add(1) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, Timestamp: 90}, Payload: []byte{1, 2, 3}}
+		assert.Nil(t, egress.WriteRTP(source))
+		packet := &rtp.Packet{}
+		assert.Nil(t, packet.Unmarshal(readFramed(t, conn)))
+		assert.Equal(t, []byte{1, 2, 3}, packet.Payload)
+		assert.Equal(t, uint8(96), packet.PayloadType)
+
+		// Once the receiver drops the connection the egress connects again and asks for a keyframe.
+		conn.Close()
+		assert.Eventually(t, func() bool {
+			egress.WriteRTP(source)
+			return keyframes.Load() == 2
+		}, 3*time.Second, 10*time.Millisecond)
+		conn, err = listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		assert.Nil(t, egress.WriteRTP(source))
+		assert.Nil(t, packet.Unmarshal(readFramed(t, conn)))
+		assert.Equal(t, uint16(1), packet.SequenceNumber)
+	})
+	t.Run("Drops packets for a TCP receiver that does not read", func(t *testing.T) {
+		t.Parallel()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		egress, err := NewEgress(vp8Codec, EgressConfig{
+			Address:              listener.Addr().String(),
+			Transport:            EgressTCP,
+			SenderReportInterval: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			source := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: make([]byte, 1200)}
+			for i := 0; i < 20*egressQueueSize; i++ {
+				source.SequenceNumber = uint16(i)
+				egress.WriteRTP(source)
+			}
+		}()
+		select {
+		case <-written:
+		case <-time.After(5 * time.Second):
+			t.Fatal("egress blocked by its receiver")
+		}
+	})
+	t.Run("Sends over UDP while nothing receives", func(t *testing.T) {
+		t.Parallel()
+		rtpConn, rtcpConn := listenUDPPair(t)
+		address := rtpConn.LocalAddr().String()
+		rtpConn.Close()
+		rtcpConn.Close()
+		egress, err := NewEgress(vp8Codec, EgressConfig{Address: address, SenderReportInterval: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		source := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{1}}
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, egress.WriteRTP(source))
+		}
+	})
+	t.Run("Writes an SDP describing the stream", func(t *testing.T) {
+		t.Parallel()
+		rtpConn, _ := listenUDPPair(t)
+		path := filepath.Join(t.TempDir(), "stream.sdp")
+		opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+		egress, err := NewEgress(opus, EgressConfig{Address: rtpConn.LocalAddr().String(), PayloadType: 111, SDPPath: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		sdp := string(data)
+		assert.Equal(t, egress.SDP(), sdp)
+		_, port, _ := net.SplitHostPort(rtpConn.LocalAddr().String())
+		assert.Contains(t, sdp, "c=IN IP4 127.0.0.1\r\n")
+		assert.Contains(t, sdp, "m=audio "+port+" RTP/AVP 111\r\n")
+		assert.Contains(t, sdp, "a=rtpmap:111 opus/48000/2\r\n")
+		assert.Contains(t, sdp, "a=fmtp:111 minptime=10;useinbandfec=1\r\n")
+
+		pcmu := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}
+		egress, err = NewEgress(pcmu, EgressConfig{Address: rtpConn.LocalAddr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer egress.Close()
+		assert.Contains(t, egress.SDP(), "m=audio "+port+" RTP/AVP 0\r\n")
+		assert.Contains(t, egress.SDP(), "a=rtpmap:0 PCMU/8000\r\n")
+	})
+	t.Run("Rejects a missing address or track", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewEgress(vp8Codec, EgressConfig{})
+		assert.ErrorIs(t, err, ErrAddressRequired)
+		peer, _ := newPublisher(t, vp8Codec)
+		_, err = StartEgress(peer, "screen", EgressConfig{Address: "127.0.0.1:5004"})
+		assert.ErrorIs(t, err, webrtcpeer.ErrTrackNotFound)
+	})
+}
@@ -0,0 +1,434 @@
+package webrtcrtp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultIngestAddress          = "127.0.0.1:0"
+	defaultIngestStreamID         = "ingest"
+	defaultSourceTimeout          = 500 * time.Millisecond
+	defaultReceiverReportInterval = time.Second
+	// maxDatagramSize is the largest UDP payload.
+	maxDatagramSize = 65535
+	// rtcpPortAttempts bounds the search for a free pair of ports.
+	rtcpPortAttempts = 10
+)
+
+var (
+	ErrCodecRequired = errors.New("codec with a clock rate required")
+	ErrNoSource      = errors.New("no RTP source yet")
+)
+
+type IngestConfig struct {
+	// Address is the local UDP address RTP is received on, such as ":5004". Defaults
+	// to a free port on the loopback interface.
+	Address string
+	// Codec is the codec of the stream, with its clock rate. Required.
+	Codec webrtc.RTPCodecCapability
+	// PayloadType points to the payload type of accepted packets; packets of other
+	// payload types are dropped. Nil accepts any payload type. It is a pointer as
+	// zero is a payload type, PCMU.
+	PayloadType *uint8
+	// RTCPMux receives and sends RTCP on the RTP port. Otherwise RTCP uses the next
+	// port up, as RTP senders do by default.
+	RTCPMux bool
+	// TrackID is the ID of the track. Defaults to "rtp-" and the RTP port.
+	TrackID string
+	// StreamID is the stream ID of the track. Defaults to "ingest".
+	StreamID string
+	// SourceTimeout is how long the source may go silent before packets of another
+	// SSRC take over the track, as when an encoder restarts. Defaults to 500ms.
+	SourceTimeout time.Duration
+	// ReceiverReportInterval is how often Receiver Reports are sent to the source.
+	// Defaults to 1 second; a negative value sends none.
+	ReceiverReportInterval time.Duration
+	// LoggerFactory creates the ingest logger. Defaults to the pion default logger factory.
+	LoggerFactory logging.LoggerFactory
+}
+
+/*
+ingestSource is the SSRC the track is currently fed from and where it sends from.
+*/
+type ingestSource struct {
+	ssrc         uint32
+	address      *net.UDPAddr
+	rtcpAddress  *net.UDPAddr
+	stats        *receptionStats
+	lastPacketAt time.Time
+	// seqOffset and timestampOffset carry the track on from the previous source.
+	seqOffset       uint16
+	timestampOffset uint32
+}
+
+/*
+Ingest receives the plain RTP of one source over UDP and writes it to a local track.
+*/
+type Ingest struct {
+	track           *webrtc.TrackLocalStaticRTP
+	rtpConn         *net.UDPConn
+	rtcpConn        *net.UDPConn
+	clockRate       uint32
+	payloadType     *uint8
+	rtcpMux         bool
+	sourceTimeout   time.Duration
+	ssrc            uint32
+	mu              sync.Mutex
+	source          *ingestSource
+	senderReport    webrtcpeer.SenderReport
+	hasSenderReport bool
+	wrote           bool
+	lastSeq         uint16
+	lastTimestamp   uint32
+	lastWriteAt     time.Time
+	closeOnce       sync.Once
+	closed          chan struct{}
+	wg              sync.WaitGroup
+	log             logging.LeveledLogger
+}
+
+/*
+NewIngest starts listening for RTP as configured.
+*/
+func NewIngest(config IngestConfig) (*Ingest, error) {
+	if config.Codec.MimeType == "" || config.Codec.ClockRate == 0 {
+		return nil, ErrCodecRequired
+	}
+	address := config.Address
+	if address == "" {
+		address = defaultIngestAddress
+	}
+	rtpConn, rtcpConn, err := ListenPair(address, config.RTCPMux)
+	if err != nil {
+		return nil, err
+	}
+	port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	trackID := config.TrackID
+	if trackID == "" {
+		trackID = "rtp-" + strconv.Itoa(port)
+	}
+	streamID := config.StreamID
+	if streamID == "" {
+		streamID = defaultIngestStreamID
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(config.Codec, trackID, streamID)
+	if err != nil {
+		rtpConn.Close()
+		if rtcpConn != nil {
+			rtcpConn.Close()
+		}
+		return nil, err
+	}
+	i := &Ingest{
+		track:         track,
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		clockRate:     config.Codec.ClockRate,
+		payloadType:   config.PayloadType,
+		rtcpMux:       config.RTCPMux,
+		sourceTimeout: config.SourceTimeout,
+		ssrc:          rand.Uint32(),
+		closed:        make(chan struct{}),
+		log:           webrtclog.NewLogger(config.LoggerFactory, "rtp-ingest", "track_id", trackID, "port", port),
+	}
+	if i.sourceTimeout == 0 {
+		i.sourceTimeout = defaultSourceTimeout
+	}
+	i.wg.Add(1)
+	go i.read(rtpConn)
+	if rtcpConn != nil {
+		i.wg.Add(1)
+		go i.read(rtcpConn)
+	}
+	interval := config.ReceiverReportInterval
+	if interval == 0 {
+		interval = defaultReceiverReportInterval
+	}
+	if interval > 0 {
+		i.wg.Add(1)
+		go i.sendReceiverReports(interval)
+	}
+	i.log.Infof("Receiving RTP on %s", rtpConn.LocalAddr())
+	return i, nil
+}
+
+/*
+ListenPair listens on address for RTP and, without RTCP multiplexing, on the next
+port for RTCP. A free pair is searched for when address has port 0.
+*/
+func ListenPair(address string, rtcpMux bool) (*net.UDPConn, *net.UDPConn, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		rtpConn, err := net.ListenUDP("udp", udpAddress)
+		if err != nil || rtcpMux {
+			return rtpConn, nil, err
+		}
+		rtcpAddress := *rtpConn.LocalAddr().(*net.UDPAddr)
+		rtcpAddress.Port++
+		rtcpConn, err := net.ListenUDP("udp", &rtcpAddress)
+		if err == nil {
+			return rtpConn, rtcpConn, nil
+		}
+		rtpConn.Close()
+		if udpAddress.Port != 0 || attempt+1 == rtcpPortAttempts {
+			return nil, nil, fmt.Errorf("listening for RTCP: %w", err)
+		}
+	}
+}
+
+/*
+Track returns the track the stream is written to, to pass to SfuPeer.AddPeerTrack.
+*/
+func (i *Ingest) Track() *webrtc.TrackLocalStaticRTP {
+	return i.track
+}
+
+/*
+LocalAddr returns the address RTP is received on.
+*/
+func (i *Ingest) LocalAddr() *net.UDPAddr {
+	return i.rtpConn.LocalAddr().(*net.UDPAddr)
+}
+
+/*
+LastSenderReport returns the last Sender Report of the current source, in the form
+recorders align tracks with.
+*/
+func (i *Ingest) LastSenderReport() (webrtcpeer.SenderReport, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.senderReport, i.hasSenderReport
+}
+
+/*
+RequestKeyframe sends a Picture Loss Indication to the source, which encoders that
+read RTCP answer with a keyframe.
+*/
+func (i *Ingest) RequestKeyframe() error {
+	i.mu.Lock()
+	source := i.source
+	i.mu.Unlock()
+	if source == nil {
+		return ErrNoSource
+	}
+	return i.writeRTCP(source, []rtcp.Packet{&rtcp.PictureLossIndication{SenderSSRC: i.ssrc, MediaSSRC: source.ssrc}})
+}
+
+/*
+Close stops receiving. Closing again does nothing.
+*/
+func (i *Ingest) Close() error {
+	var err error
+	i.closeOnce.Do(func() {
+		close(i.closed)
+		err = i.rtpConn.Close()
+		if i.rtcpConn != nil {
+			if closeErr := i.rtcpConn.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		i.wg.Wait()
+	})
+	return err
+}
+
+func (i *Ingest) read(conn *net.UDPConn) {
+	defer i.wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-i.closed:
+			default:
+				i.log.Warnf("Error reading: %v", err)
+			}
+			return
+		}
+		data := buf[:n]
+		// RTCP packet types take the place of the RTP marker bit and payload type.
+		if n >= 2 && data[1] >= 192 && data[1] <= 223 {
+			i.handleRTCP(data, from)
+			continue
+		}
+		if conn == i.rtpConn {
+			i.handleRTP(data, from)
+		}
+	}
+}
+
+func (i *Ingest) handleRTP(data []byte, from *net.UDPAddr) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(data); err != nil || packet.Version != 2 {
+		return
+	}
+	if i.payloadType != nil && packet.PayloadType != *i.payloadType {
+		return
+	}
+	now := time.Now()
+	i.mu.Lock()
+	source := i.source
+	if source == nil || (packet.SSRC != source.ssrc && now.Sub(source.lastPacketAt) >= i.sourceTimeout) {
+		source = i.takeOver(packet, from, now)
+	} else if packet.SSRC != source.ssrc {
+		i.mu.Unlock()
+		return
+	}
+	source.lastPacketAt = now
+	source.stats.update(&packet.Header, now)
+	packet.SequenceNumber += source.seqOffset
+	packet.Timestamp += source.timestampOffset
+	i.wrote = true
+	i.lastSeq = packet.SequenceNumber
+	i.lastTimestamp = packet.Timestamp
+	i.lastWriteAt = now
+	i.mu.Unlock()
+
+	// Header extensions were not negotiated with the subscribers.
+	packet.Extension = false
+	packet.Extensions = nil
+	if err := i.track.WriteRTP(packet); err != nil {
+		i.log.Warnf("Error writing packet: %v", err)
+	}
+}
+
+/*
+takeOver makes the SSRC of packet the source of the track, continuing the sequence
+numbers and timestamps of the previous source. The caller holds mu.
+*/
+func (i *Ingest) takeOver(packet *rtp.Packet, from *net.UDPAddr, now time.Time) *ingestSource {
+	source := &ingestSource{
+		ssrc:    packet.SSRC,
+		address: from,
+		stats:   newReceptionStats(packet.SSRC, i.clockRate),
+	}
+	if i.wrote {
+		elapsed := uint32(now.Sub(i.lastWriteAt).Seconds() * float64(i.clockRate))
+		source.seqOffset = i.lastSeq + 1 - packet.SequenceNumber
+		source.timestampOffset = i.lastTimestamp + max(elapsed, 1) - packet.Timestamp
+		i.log.Infof("Source changed from SSRC %d to %d", i.source.ssrc, packet.SSRC)
+	} else {
+		i.log.Infof("Receiving SSRC %d from %s", packet.SSRC, from)
+	}
+	i.source = source
+	i.hasSenderReport = false
+	return source
+}
+
+func (i *Ingest) handleRTCP(data []byte, from *net.UDPAddr) {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	source := i.source
+	if source == nil {
+		return
+	}
+	for _, packet := range packets {
+		switch packet := packet.(type) {
+		case *rtcp.SenderReport:
+			if packet.SSRC != source.ssrc {
+				continue
+			}
+			source.rtcpAddress = from
+			source.stats.senderReport(packet, now)
+			i.senderReport = webrtcpeer.SenderReport{
+				SSRC:    packet.SSRC,
+				NTPTime: packet.NTPTime,
+				// Sender Reports are in the timestamps of the source, the track in its own.
+				RTPTime:    packet.RTPTime + source.timestampOffset,
+				ReceivedAt: now,
+			}
+			i.hasSenderReport = true
+		case *rtcp.Goodbye:
+			// Another source may take over at once.
+			if slices.Contains(packet.Sources, source.ssrc) {
+				source.lastPacketAt = time.Time{}
+			}
+		}
+	}
+}
+
+/*
+rtcpAddress returns where RTCP for source goes: where its Sender Reports come
+from, or else its RTP address, on the next port up without RTCP multiplexing.
+*/
+func (i *Ingest) rtcpAddress(source *ingestSource) *net.UDPAddr {
+	if source.rtcpAddress != nil {
+		return source.rtcpAddress
+	}
+	address := *source.address
+	if !i.rtcpMux {
+		address.Port++
+	}
+	return &address
+}
+
+func (i *Ingest) writeRTCP(source *ingestSource, packets []rtcp.Packet) error {
+	data, err := rtcp.Marshal(packets)
+	if err != nil {
+		return err
+	}
+	conn := i.rtcpConn
+	if conn == nil {
+		conn = i.rtpConn
+	}
+	i.mu.Lock()
+	address := i.rtcpAddress(source)
+	i.mu.Unlock()
+	_, err = conn.WriteToUDP(data, address)
+	return err
+}
+
+func (i *Ingest) sendReceiverReports(interval time.Duration) {
+	defer i.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.closed:
+			return
+		case now := <-ticker.C:
+			i.mu.Lock()
+			source := i.source
+			var report rtcp.ReceptionReport
+			if source != nil {
+				report = source.stats.report(now)
+			}
+			i.mu.Unlock()
+			if source == nil {
+				continue
+			}
+			err := i.writeRTCP(source, []rtcp.Packet{
+				&rtcp.ReceiverReport{SSRC: i.ssrc, Reports: []rtcp.ReceptionReport{report}},
+				&rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+					Source: i.ssrc,
+					Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: i.track.StreamID()}},
+				}}},
+			})
+			if err != nil {
+				i.log.Warnf("Error sending Receiver Report: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package webrtcrtp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var vp8Codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+type packetSink struct {
+	mu      sync.Mutex
+	packets []*rtp.Packet
+}
+
+func (s *packetSink) WriteRTP(packet *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func (s *packetSink) Close() error {
+	return nil
+}
+
+func (s *packetSink) received() []*rtp.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*rtp.Packet(nil), s.packets...)
+}
+
+/*
+attachSink attaches a sink to track on a peer, the way subscribers receive it.
+*/
+func attachSink(t *testing.T, track *webrtc.TrackLocalStaticRTP) *packetSink {
+	t.Helper()
+	peer, err := webrtcpeer.NewSfuPeer("rtp", &webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Shutdown)
+	peer.LocalTracks[track.ID()] = track
+	sink := &packetSink{}
+	assert.Nil(t, peer.AttachTrackSink(track.ID(), sink))
+	return sink
+}
+
+func newTestIngest(t *testing.T, config IngestConfig) *Ingest {
+	t.Helper()
+	if config.Codec.MimeType == "" {
+		config.Codec = vp8Codec
+	}
+	ingest, err := NewIngest(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ingest.Close() })
+	return ingest
+}
+
+func dialUDP(t *testing.T, address *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendRTP(t *testing.T, conn *net.UDPConn, ssrc uint32, payloadType uint8, seq uint16, timestamp uint32) {
+	t.Helper()
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: payloadType, SSRC: ssrc, SequenceNumber: seq, Timestamp: timestamp},
+		Payload: []byte{byte(seq)},
+	}
+	data, _ := packet.Marshal()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+readRTCP reads RTCP from conn until it has a packet of type T.
+*/
+func readRTCP[T rtcp.Packet](t *testing.T, conn *net.UDPConn) T {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			if packet, ok := packet.(T); ok {
+				return packet
+			}
+		}
+	}
+}
+
+func TestIngest(t *testing.T) {
+	t.Run("Forwards packets of the configured payload type", func(t *testing.T) {
+		t.Parallel()
+		payloadType := uint8(96)
+		ingest := newTestIngest(t, IngestConfig{PayloadType: &payloadType, RTCPMux: true, TrackID: "encoder"})
+		assert.Equal(t, "encoder", ingest.Track().ID())
+		sink := attachSink(t, ingest.Track())
+		conn := dialUDP(t, ingest.LocalAddr())
+		sendRTP(t, conn, 1, 96, 10, 1000)
+		sendRTP(t, conn, 1, 97, 11, 1000)
+		sendRTP(t, conn, 1, 96, 12, 4000)
+		assert.Eventually(t, func() bool { return len(sink.received()) == 2 }, time.Second, 10*time.Millisecond)
+		packets := sink.received()
+		assert.Equal(t, []uint16{10, 12}, []uint16{packets[0].SequenceNumber, packets[1].SequenceNumber})
+		assert.Equal(t, []uint32{1000, 4000}, []uint32{packets[0].Timestamp, packets[1].Timestamp})
+	})
+	t.Run("Filters on payload type zero", func(t *testing.T) {
+		t.Parallel()
+		pcmu := uint8(0)
+		ingest := newTestIngest(t, IngestConfig{Codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: &pcmu})
+		sink := attachSink(t, ingest.Track())
+		conn := dialUDP(t, ingest.LocalAddr())
+		sendRTP(t, conn, 1, 8, 10, 160)
+		sendRTP(t, conn, 1, 0, 11, 320)
+		assert.Eventually(t, func() bool { return len(sink.received()) == 1 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, uint16(11), sink.received()[0].SequenceNumber)
+	})
+	t.Run("Continues the track when the source restarts", func(t *testing.T) {
+		t.Parallel()
+		ingest := newTestIngest(t, IngestConfig{RTCPMux: true, SourceTimeout: 50 * time.Millisecond})
+		sink := attachSink(t, ingest.Track())
+		conn := dialUDP(t, ingest.LocalAddr())
+		sendRTP(t, conn, 1, 96, 100, 1000)
+		assert.Eventually(t, func() bool { return len(sink.received()) == 1 }, time.Second, 10*time.Millisecond)
+		// Another SSRC does not take over while the source is live.
+		sendRTP(t, conn, 2, 96, 5000, 700000)
+		time.Sleep(100 * time.Millisecond)
+		// Once the source is silent it does, and the old one no longer gets through.
+		sendRTP(t, conn, 2, 96, 5001, 703000)
+		sendRTP(t, conn, 1, 96, 101, 4000)
+		sendRTP(t, conn, 2, 96, 5002, 706000)
+		assert.Eventually(t, func() bool { return len(sink.received()) == 3 }, time.Second, 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+
+		packets := sink.received()
+		assert.Len(t, packets, 3)
+		assert.Equal(t, []byte{byte(5001 & 0xff)}, packets[1].Payload)
+		assert.Equal(t, []uint16{101, 102}, []uint16{packets[1].SequenceNumber, packets[2].SequenceNumber})
+		// The timestamp goes on by the time the source was silent.
+		assert.GreaterOrEqual(t, packets[1].Timestamp, uint32(1000+9000))
+		assert.Less(t, packets[1].Timestamp, uint32(1000+90000))
+		assert.Equal(t, packets[1].Timestamp+3000, packets[2].Timestamp)
+	})
+	t.Run("Sends Receiver Reports to where Sender Reports come from", func(t *testing.T) {
+		t.Parallel()
+		ingest := newTestIngest(t, IngestConfig{ReceiverReportInterval: 50 * time.Millisecond})
+		rtcpAddress := *ingest.LocalAddr()
+		rtcpAddress.Port++
+		rtpConn := dialUDP(t, ingest.LocalAddr())
+		rtcpConn := dialUDP(t, &rtcpAddress)
+		for _, seq := range []uint16{65534, 65535, 2, 3} {
+			sendRTP(t, rtpConn, 7, 96, seq, uint32(seq)*3000)
+		}
+		report, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.SenderReport{SSRC: 7, NTPTime: 0x1122334455667788, RTPTime: 9000}})
+		assert.Eventually(t, func() bool {
+			rtcpConn.Write(report)
+			_, ok := ingest.LastSenderReport()
+			return ok
+		}, time.Second, 10*time.Millisecond)
+		senderReport, _ := ingest.LastSenderReport()
+		assert.Equal(t, uint32(9000), senderReport.RTPTime)
+
+		receiverReport := readRTCP[*rtcp.ReceiverReport](t, rtcpConn)
+		assert.Len(t, receiverReport.Reports, 1)
+		block := receiverReport.Reports[0]
+		assert.Equal(t, uint32(7), block.SSRC)
+		assert.Equal(t, uint32(1<<16|3), block.LastSequenceNumber)
+		assert.Equal(t, uint32(2), block.TotalLost)
+		assert.Equal(t, uint32(0x33445566), block.LastSenderReport)
+
+		assert.Nil(t, ingest.RequestKeyframe())
+		pli := readRTCP[*rtcp.PictureLossIndication](t, rtcpConn)
+		assert.Equal(t, uint32(7), pli.MediaSSRC)
+	})
+	t.Run("Requires a codec", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewIngest(IngestConfig{Codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}})
+		assert.ErrorIs(t, err, ErrCodecRequired)
+		ingest := newTestIngest(t, IngestConfig{})
+		assert.ErrorIs(t, ingest.RequestKeyframe(), ErrNoSource)
+	})
+}
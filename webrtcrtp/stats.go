@@ -0,0 +1,108 @@
+package webrtcrtp
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+/*
+receptionStats keeps the reception statistics of one source SSRC that Receiver
+Reports carry, computed as in RFC 3550 appendix A.
+*/
+type receptionStats struct {
+	ssrc          uint32
+	clockRate     uint32
+	started       bool
+	baseSeq       uint16
+	maxSeq        uint16
+	cycles        uint32
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	firstArrival  time.Time
+	lastTransit   uint32
+	jitter        float64
+	// lastSR is the middle 32 bits of the NTP time of the last Sender Report.
+	lastSR   uint32
+	lastSRAt time.Time
+}
+
+func newReceptionStats(ssrc uint32, clockRate uint32) *receptionStats {
+	return &receptionStats{ssrc: ssrc, clockRate: clockRate}
+}
+
+/*
+update counts a packet received at arrival and updates the interarrival jitter.
+*/
+func (s *receptionStats) update(header *rtp.Header, arrival time.Time) {
+	if !s.started {
+		s.firstArrival = arrival
+	}
+	// Transit times are compared with each other only, so arrivals count from the
+	// first one and wrap like timestamps.
+	transit := uint32(uint64(arrival.Sub(s.firstArrival).Seconds()*float64(s.clockRate))) - header.Timestamp
+	if !s.started {
+		s.started = true
+		s.baseSeq = header.SequenceNumber
+		s.maxSeq = header.SequenceNumber
+		s.lastTransit = transit
+		s.received = 1
+		return
+	}
+	if delta := header.SequenceNumber - s.maxSeq; delta != 0 && delta < 0x8000 {
+		if header.SequenceNumber < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = header.SequenceNumber
+	}
+	s.received++
+	d := int64(int32(transit - s.lastTransit))
+	s.lastTransit = transit
+	if d < 0 {
+		d = -d
+	}
+	s.jitter += (float64(d) - s.jitter) / 16
+}
+
+/*
+senderReport keeps the time of a Sender Report of the source for the LSR and DLSR
+fields of the next reports.
+*/
+func (s *receptionStats) senderReport(report *rtcp.SenderReport, arrival time.Time) {
+	s.lastSR = uint32(report.NTPTime >> 16)
+	s.lastSRAt = arrival
+}
+
+/*
+report returns the report block of the source at now and starts a new interval.
+*/
+func (s *receptionStats) report(now time.Time) rtcp.ReceptionReport {
+	extendedMax := s.cycles + uint32(s.maxSeq)
+	expected := extendedMax - uint32(s.baseSeq) + 1
+	lost := int64(expected) - int64(s.received)
+	// The cumulative number of packets lost is a signed 24 bit field.
+	lost = max(min(lost, 0x7fffff), 0)
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.received - s.receivedPrior
+	s.expectedPrior = expected
+	s.receivedPrior = s.received
+	var fraction uint8
+	if expectedInterval > 0 && expectedInterval > receivedInterval {
+		fraction = uint8((expectedInterval - receivedInterval) << 8 / expectedInterval)
+	}
+	var delay uint32
+	if !s.lastSRAt.IsZero() {
+		delay = uint32(now.Sub(s.lastSRAt) * 65536 / time.Second)
+	}
+	return rtcp.ReceptionReport{
+		SSRC:               s.ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost),
+		LastSequenceNumber: extendedMax,
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSR,
+		Delay:              delay,
+	}
+}
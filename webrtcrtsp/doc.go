@@ -0,0 +1,14 @@
+/*
+Package webrtcrtsp serves the tracks of SfuPeer publishers over RTSP, for players
+and security-camera style consumers that do not speak WebRTC.
+
+A Server exposes each publisher of a PeerManager as an RTSP path: rtsp://host/cam1
+describes every local track of the publisher "cam1". Clients set tracks up over UDP
+or interleaved in the RTSP connection (RTP/AVP/TCP), then PLAY attaches each track
+to its local track with SfuPeer.AttachTrackSink, the same fan-out AddPeerTrack
+forwards to WebRTC subscribers with, and asks the publisher for a keyframe.
+Sessions end with TEARDOWN, when the publisher's track ends, when the connection of
+an interleaved session closes, or when a UDP client has sent neither requests nor
+RTCP for the session timeout. OPTIONS and GET_PARAMETER are answered for keepalive.
+*/
+package webrtcrtsp
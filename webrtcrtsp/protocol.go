@@ -0,0 +1,223 @@
+package webrtcrtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtspVersion = "RTSP/1.0"
+	// interleavedMagic starts an RTP or RTCP packet interleaved in the RTSP connection.
+	interleavedMagic = '$'
+	maxBodySize      = 64 * 1024
+)
+
+var (
+	errMalformedRequest   = errors.New("malformed RTSP request")
+	errUnsupportedVersion = errors.New("unsupported RTSP version")
+)
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	505: "RTSP Version Not Supported",
+}
+
+type request struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+/*
+readRequest reads a request from r, which must not be at an interleaved packet.
+*/
+func readRequest(r *bufio.Reader) (*request, error) {
+	reader := textproto.NewReader(r)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, version, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !strings.HasPrefix(version, "RTSP/") {
+		return nil, fmt.Errorf("%w: %q", errMalformedRequest, line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	req := &request{method: method, header: header}
+	if target == "*" {
+		req.url = &url.URL{Path: "*"}
+	} else if req.url, err = url.Parse(target); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	if version != rtspVersion {
+		return req, errUnsupportedVersion
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > maxBodySize {
+			return nil, fmt.Errorf("%w: Content-Length %q", errMalformedRequest, length)
+		}
+		req.body = make([]byte, n)
+		if _, err := io.ReadFull(r, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+/*
+readInterleaved reads an interleaved packet and returns its channel and data.
+*/
+func readInterleaved(r *bufio.Reader) (uint8, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[1], data, nil
+}
+
+/*
+interleavedFrame frames data for the interleaved channel.
+*/
+func interleavedFrame(channel uint8, data []byte) []byte {
+	frame := make([]byte, 4, 4+len(data))
+	frame[0] = interleavedMagic
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+	return append(frame, data...)
+}
+
+type headerField struct {
+	key   string
+	value string
+}
+
+type response struct {
+	status int
+	header []headerField
+	body   []byte
+}
+
+func newResponse(status int) *response {
+	return &response{status: status}
+}
+
+/*
+set adds a header field. Fields are written in the order they were set, with the
+exact spelling given, as some clients expect "CSeq".
+*/
+func (r *response) set(key, value string) *response {
+	r.header = append(r.header, headerField{key, value})
+	return r
+}
+
+func (r *response) marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s\r\n", rtspVersion, r.status, statusText[r.status])
+	for _, field := range r.header {
+		fmt.Fprintf(&b, "%s: %s\r\n", field.key, field.value)
+	}
+	if len(r.body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(r.body))
+	}
+	b.WriteString("\r\n")
+	b.Write(r.body)
+	return b.Bytes()
+}
+
+/*
+transport is one transport specification of a Transport header.
+*/
+type transport struct {
+	// interleaved is true for RTP/AVP/TCP, where channels are the RTP and RTCP channels.
+	interleaved bool
+	channels    [2]int
+	// clientPorts are the RTP and RTCP ports of the client for RTP/AVP over UDP.
+	clientPorts [2]int
+	hasChannels bool
+}
+
+/*
+parseTransports parses the transport specifications of a Transport header, in the
+client's order of preference, skipping those the server does not support: anything
+but unicast RTP/AVP over UDP with client ports, or over TCP.
+*/
+func parseTransports(header string) []transport {
+	var transports []transport
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		var t transport
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			t.interleaved = true
+		default:
+			continue
+		}
+		supported, hasPorts := true, false
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.ToLower(key) {
+			case "multicast":
+				supported = false
+			case "interleaved":
+				if t.channels, supported = parseRange(value, 255); supported {
+					t.hasChannels = true
+				}
+			case "client_port":
+				t.clientPorts, hasPorts = parseRange(value, 65535)
+				supported = hasPorts
+			}
+			if !supported {
+				break
+			}
+		}
+		if supported && (t.interleaved || hasPorts) {
+			transports = append(transports, t)
+		}
+	}
+	return transports
+}
+
+/*
+parseRange parses "a-b" or "a", which stands for "a-(a+1)".
+*/
+func parseRange(value string, limit int) ([2]int, bool) {
+	first, second, ok := strings.Cut(value, "-")
+	a, err := strconv.Atoi(first)
+	if err != nil || a < 0 || a > limit {
+		return [2]int{}, false
+	}
+	b := a + 1
+	if ok {
+		if b, err = strconv.Atoi(second); err != nil || b < 0 || b > limit {
+			return [2]int{}, false
+		}
+	}
+	return [2]int{a, b}, b <= limit
+}
@@ -0,0 +1,746 @@
+package webrtcrtsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/aggregator-cloud/webrtcutil/webrtcrtp"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultSessionTimeout       = time.Minute
+	defaultSenderReportInterval = time.Second
+	// connQueueSize is how many interleaved packets may wait for a slow client before
+	// packets are dropped, rather than holding up the publisher's other subscribers.
+	connQueueSize   = 512
+	maxDatagramSize = 65535
+	publicMethods   = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+)
+
+var ErrServerClosed = errors.New("rtsp: server closed")
+
+type ServerConfig struct {
+	// Publishers is where the publisher of a path is looked up, for example the Peers
+	// of a WHIPHandler. Required.
+	Publishers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	// PublisherID returns the ID of the publisher a path, such as "cam1" for
+	// rtsp://host/cam1, exposes. Defaults to the path itself.
+	PublisherID func(path string) string
+	// UDPAddress is where the RTP port for clients playing over UDP is bound, with
+	// RTCP on the next port. Defaults to a free pair of ports on every interface.
+	UDPAddress string
+	// SessionTimeout is how long a session over UDP lives without a request or RTCP
+	// from the client. Defaults to one minute.
+	SessionTimeout time.Duration
+	// SenderReportInterval is how often Sender Reports are sent for clients to
+	// synchronize tracks on. Defaults to 1 second; a negative value sends none.
+	SenderReportInterval time.Duration
+	LoggerFactory        logging.LoggerFactory
+}
+
+/*
+Server is an RTSP server exposing the local tracks of the publishers of a
+PeerManager. It answers DESCRIBE for a path with every local track of its publisher
+and sends the tracks set up with SETUP over UDP or interleaved in the connection
+once the session plays, attached to each track like any other subscriber.
+*/
+type Server struct {
+	publishers     *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	publisherID    func(path string) string
+	sessionTimeout time.Duration
+	rtpConn        *net.UDPConn
+	rtcpConn       *net.UDPConn
+	mu             sync.Mutex
+	listeners      map[net.Listener]struct{}
+	conns          map[*conn]struct{}
+	sessions       map[string]*session
+	closed         bool
+	done           chan struct{}
+	wg             sync.WaitGroup
+	loggerFactory  logging.LoggerFactory
+	log            logging.LeveledLogger
+}
+
+/*
+NewServer creates an RTSP server and binds its UDP ports. Serve it on a listener.
+*/
+func NewServer(config ServerConfig) (*Server, error) {
+	if config.Publishers == nil {
+		return nil, errors.New("rtsp: publishers required")
+	}
+	s := &Server{
+		publishers:     config.Publishers,
+		publisherID:    config.PublisherID,
+		sessionTimeout: config.SessionTimeout,
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[*conn]struct{}),
+		sessions:       make(map[string]*session),
+		done:           make(chan struct{}),
+		loggerFactory:  config.LoggerFactory,
+		log:            webrtclog.NewLogger(config.LoggerFactory, "rtsp-server"),
+	}
+	if s.publisherID == nil {
+		s.publisherID = func(path string) string {
+			return path
+		}
+	}
+	if s.sessionTimeout == 0 {
+		s.sessionTimeout = defaultSessionTimeout
+	}
+	address := config.UDPAddress
+	if address == "" {
+		address = ":0"
+	}
+	var err error
+	if s.rtpConn, s.rtcpConn, err = webrtcrtp.ListenPair(address, false); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.readRTCP()
+	interval := config.SenderReportInterval
+	if interval == 0 {
+		interval = defaultSenderReportInterval
+	}
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.sendSenderReports(interval)
+	}
+	return s, nil
+}
+
+/*
+ListenAndServe listens on the TCP address, such as ":8554", and serves it.
+*/
+func (s *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+/*
+Serve accepts RTSP connections on listener until the server is closed, and then
+returns ErrServerClosed.
+*/
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+	}()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		c := newConn(s, netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+		}()
+	}
+}
+
+/*
+UDPAddr returns the address RTP is sent from to clients playing over UDP.
+*/
+func (s *Server) UDPAddr() *net.UDPAddr {
+	return s.rtpConn.LocalAddr().(*net.UDPAddr)
+}
+
+/*
+Close stops the listeners, ends every session and closes every connection.
+*/
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	listeners := maps.Clone(s.listeners)
+	conns := maps.Clone(s.conns)
+	sessions := maps.Clone(s.sessions)
+	s.mu.Unlock()
+	for listener := range listeners {
+		listener.Close()
+	}
+	for _, session := range sessions {
+		session.close()
+	}
+	for c := range conns {
+		c.close()
+	}
+	s.rtpConn.Close()
+	s.rtcpConn.Close()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *Server) removeSession(session *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.id)
+}
+
+func (s *Server) getSession(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+/*
+readRTCP reads the RTCP clients send over UDP, which keeps their sessions alive.
+*/
+func (s *Server) readRTCP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_, address, err := s.rtcpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		sessions := slices.Collect(maps.Values(s.sessions))
+		s.mu.Unlock()
+		for _, session := range sessions {
+			session.mu.Lock()
+			fromClient := slices.ContainsFunc(session.streams, func(stream *stream) bool {
+				return stream.rtcpAddr != nil && stream.rtcpAddr.IP.Equal(address.IP) && stream.rtcpAddr.Port == address.Port
+			})
+			session.mu.Unlock()
+			if fromClient {
+				session.touch()
+			}
+		}
+	}
+}
+
+func (s *Server) sendSenderReports(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			sessions := slices.Collect(maps.Values(s.sessions))
+			s.mu.Unlock()
+			for _, session := range sessions {
+				session.sendSenderReports()
+			}
+		}
+	}
+}
+
+/*
+handle answers a request received on c.
+*/
+func (s *Server) handle(c *conn, req *request) *response {
+	var res *response
+	switch req.method {
+	case "OPTIONS":
+		res = newResponse(200).set("Public", publicMethods)
+	case "DESCRIBE":
+		res = s.describe(req)
+	case "SETUP":
+		res = s.setup(c, req)
+	case "PLAY":
+		res = s.play(req)
+	case "TEARDOWN":
+		res = s.teardown(req)
+	case "GET_PARAMETER":
+		res = s.keepAlive(req)
+	default:
+		res = newResponse(501).set("Public", publicMethods)
+	}
+	return res
+}
+
+/*
+streamPath returns the path of the publisher a request URL is for, and the control
+of the track when it is for a track.
+*/
+func streamPath(u *url.URL) (string, string) {
+	p := strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func (s *Server) publisher(path string) (*webrtcpeer.SfuPeer, error) {
+	publisher, err := s.publishers.GetPeer(s.publisherID(path))
+	if err != nil {
+		return nil, err
+	}
+	return *publisher, nil
+}
+
+/*
+localTracks returns the local tracks of a publisher, ordered by ID so every
+DESCRIBE lists them alike.
+*/
+func localTracks(peer *webrtcpeer.SfuPeer) []*webrtc.TrackLocalStaticRTP {
+	peer.LocalTracksMu.Lock()
+	defer peer.LocalTracksMu.Unlock()
+	tracks := make([]*webrtc.TrackLocalStaticRTP, 0, len(peer.LocalTracks))
+	for _, track := range peer.LocalTracks {
+		tracks = append(tracks, track)
+	}
+	slices.SortFunc(tracks, func(a, b *webrtc.TrackLocalStaticRTP) int {
+		return strings.Compare(a.ID(), b.ID())
+	})
+	return tracks
+}
+
+func (s *Server) describe(req *request) *response {
+	// The whole path names the publisher; a trailing slash is allowed.
+	p := strings.Trim(req.url.Path, "/")
+	publisher, err := s.publisher(p)
+	if err != nil {
+		return newResponse(404)
+	}
+	tracks := localTracks(publisher)
+	if len(tracks) == 0 {
+		return newResponse(404)
+	}
+	base := *req.url
+	base.Path = "/" + p + "/"
+	base.RawPath = ""
+	res := newResponse(200).set("Content-Base", base.String()).set("Content-Type", "application/sdp")
+	res.body = []byte(sessionDescription(p, tracks))
+	return res
+}
+
+func (s *Server) setup(c *conn, req *request) *response {
+	p, control := streamPath(req.url)
+	if control == "" {
+		// Tracks are set up one by one, on the URLs DESCRIBE gives them.
+		return newResponse(459)
+	}
+	trackID, err := url.PathUnescape(control)
+	if err != nil {
+		return newResponse(400)
+	}
+	publisher, err := s.publisher(p)
+	if err != nil {
+		return newResponse(404)
+	}
+	publisher.LocalTracksMu.Lock()
+	track := publisher.LocalTracks[trackID]
+	publisher.LocalTracksMu.Unlock()
+	if track == nil {
+		return newResponse(404)
+	}
+	transports := parseTransports(req.header.Get("Transport"))
+	if len(transports) == 0 {
+		return newResponse(461)
+	}
+	t := transports[0]
+
+	sess, res := s.setupSession(c, req, p, publisher)
+	if res != nil {
+		return res
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.playing || sess.stream(trackID) != nil {
+		return newResponse(455)
+	}
+	st := newStream(sess, trackID, track.Codec(), t)
+	st.control = control
+	var transportHeader string
+	if t.interleaved {
+		if sess.conn != nil && sess.conn != c {
+			// Interleaved tracks of a session share one connection.
+			return newResponse(455)
+		}
+		if !t.hasChannels {
+			t.channels = [2]int{2 * len(sess.streams), 2*len(sess.streams) + 1}
+			st.transport = t
+		}
+		sess.conn = c
+		transportHeader = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", t.channels[0], t.channels[1], st.ssrc)
+	} else {
+		ip := c.remoteIP()
+		st.rtpAddr = &net.UDPAddr{IP: ip, Port: t.clientPorts[0]}
+		st.rtcpAddr = &net.UDPAddr{IP: ip, Port: t.clientPorts[1]}
+		serverPort := s.UDPAddr().Port
+		transportHeader = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+			t.clientPorts[0], t.clientPorts[1], serverPort, serverPort+1, st.ssrc)
+	}
+	sess.streams = append(sess.streams, st)
+	sess.log.Debugf("Set up track %s over %s", trackID, transportHeader)
+	return newResponse(200).set("Transport", transportHeader).set("Session", s.sessionHeader(sess))
+}
+
+/*
+setupSession returns the session a SETUP adds a track to: the one of its Session
+header, or a new one.
+*/
+func (s *Server) setupSession(c *conn, req *request, p string, publisher *webrtcpeer.SfuPeer) (*session, *response) {
+	if id := sessionID(req); id != "" {
+		sess := s.getSession(id)
+		if sess == nil {
+			return nil, newResponse(454)
+		}
+		if sess.path != p {
+			// A session plays the tracks of one publisher.
+			return nil, newResponse(459)
+		}
+		sess.touch()
+		return sess, nil
+	}
+	sess := &session{
+		id:        newSessionID(),
+		server:    s,
+		path:      p,
+		publisher: publisher,
+		log:       webrtclog.NewLogger(s.loggerFactory, "rtsp-session", "path", p, "remote", c.netConn.RemoteAddr().String()),
+	}
+	sess.timer = time.AfterFunc(s.sessionTimeout, func() {
+		sess.mu.Lock()
+		interleaved := sess.conn != nil
+		sess.mu.Unlock()
+		if interleaved {
+			// The session lives as long as the connection it plays over.
+			sess.touch()
+			return
+		}
+		sess.log.Infof("Session %s timed out", sess.id)
+		sess.close()
+	})
+	s.mu.Lock()
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+	c.addSession(sess)
+	return sess, nil
+}
+
+func sessionID(req *request) string {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	return strings.TrimSpace(id)
+}
+
+func (s *Server) sessionHeader(sess *session) string {
+	// The timeout is announced in whole seconds, rounded up so it is never 0.
+	return fmt.Sprintf("%s;timeout=%d", sess.id, int((s.sessionTimeout+time.Second-1)/time.Second))
+}
+
+/*
+requestSession returns the session of a request for its path.
+*/
+func (s *Server) requestSession(req *request) (*session, *response) {
+	sess := s.getSession(sessionID(req))
+	if sess == nil {
+		return nil, newResponse(454)
+	}
+	p := strings.Trim(req.url.Path, "/")
+	if trackPath, _ := streamPath(req.url); p != sess.path && trackPath != sess.path {
+		return nil, newResponse(459)
+	}
+	sess.touch()
+	return sess, nil
+}
+
+func (s *Server) play(req *request) *response {
+	sess, res := s.requestSession(req)
+	if res != nil {
+		return res
+	}
+	sess.mu.Lock()
+	empty := len(sess.streams) == 0
+	sess.mu.Unlock()
+	if empty {
+		return newResponse(455)
+	}
+	if err := sess.play(); err != nil {
+		sess.log.Warnf("Error playing session %s: %v", sess.id, err)
+		return newResponse(404)
+	}
+	base := *req.url
+	base.Path = "/" + sess.path + "/"
+	base.RawPath = ""
+	sess.mu.Lock()
+	rtpInfo := make([]string, 0, len(sess.streams))
+	for _, st := range sess.streams {
+		rtpInfo = append(rtpInfo, fmt.Sprintf("url=%s%s;seq=%d", base.String(), st.control, st.initialSeq))
+	}
+	sess.mu.Unlock()
+	sess.log.Infof("Playing session %s", sess.id)
+	return newResponse(200).set("Range", "npt=0.000-").set("RTP-Info", strings.Join(rtpInfo, ",")).set("Session", s.sessionHeader(sess))
+}
+
+func (s *Server) teardown(req *request) *response {
+	sess, res := s.requestSession(req)
+	if res != nil {
+		return res
+	}
+	sess.close()
+	return newResponse(200)
+}
+
+/*
+keepAlive answers GET_PARAMETER, which clients send to keep a session alive.
+*/
+func (s *Server) keepAlive(req *request) *response {
+	if sessionID(req) == "" {
+		return newResponse(200)
+	}
+	sess, res := s.requestSession(req)
+	if res != nil {
+		return res
+	}
+	return newResponse(200).set("Session", s.sessionHeader(sess))
+}
+
+/*
+sessionDescription describes the tracks of the publisher at path, each with the
+control URL to set it up with relative to the Content-Base.
+*/
+func sessionDescription(p string, tracks []*webrtc.TrackLocalStaticRTP) string {
+	var sdp strings.Builder
+	sdp.WriteString("v=0\r\n")
+	sdp.WriteString("o=- 0 0 IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&sdp, "s=%s\r\n", path.Base("/"+p))
+	sdp.WriteString("c=IN IP4 0.0.0.0\r\n")
+	sdp.WriteString("t=0 0\r\n")
+	sdp.WriteString("a=control:*\r\n")
+	sdp.WriteString("a=range:npt=0-\r\n")
+	for _, track := range tracks {
+		codec := track.Codec()
+		kind := "video"
+		if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+			kind = "audio"
+		}
+		// Every track is its own RTP session, so dynamic payload types do not collide.
+		pt := webrtcrtp.StaticPayloadType(codec)
+		_, encoding, _ := strings.Cut(codec.MimeType, "/")
+		rtpmap := encoding + "/" + strconv.Itoa(int(codec.ClockRate))
+		if codec.Channels > 1 {
+			rtpmap += "/" + strconv.Itoa(int(codec.Channels))
+		}
+		fmt.Fprintf(&sdp, "m=%s 0 RTP/AVP %d\r\n", kind, pt)
+		fmt.Fprintf(&sdp, "a=rtpmap:%d %s\r\n", pt, rtpmap)
+		if codec.SDPFmtpLine != "" {
+			fmt.Fprintf(&sdp, "a=fmtp:%d %s\r\n", pt, codec.SDPFmtpLine)
+		}
+		fmt.Fprintf(&sdp, "a=control:%s\r\n", url.PathEscape(track.ID()))
+	}
+	return sdp.String()
+}
+
+/*
+conn is an RTSP connection. Responses and interleaved packets are written by one
+goroutine in the order they are queued.
+*/
+type conn struct {
+	server    *Server
+	netConn   net.Conn
+	reader    *bufio.Reader
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	sessions  []*session
+	log       logging.LeveledLogger
+}
+
+func newConn(s *Server, netConn net.Conn) *conn {
+	return &conn{
+		server:  s,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		out:     make(chan []byte, connQueueSize),
+		done:    make(chan struct{}),
+		log:     webrtclog.NewLogger(s.loggerFactory, "rtsp-conn", "remote", netConn.RemoteAddr().String()),
+	}
+}
+
+func (c *conn) remoteIP() net.IP {
+	if address, ok := c.netConn.RemoteAddr().(*net.TCPAddr); ok {
+		return address.IP
+	}
+	return nil
+}
+
+func (c *conn) addSession(sess *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = append(c.sessions, sess)
+}
+
+/*
+serve reads requests and interleaved packets until the connection closes, then
+ends the sessions playing over it.
+*/
+func (c *conn) serve() {
+	defer c.close()
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.write()
+	}()
+	defer func() { <-writerDone }()
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == interleavedMagic {
+			channel, data, err := c.readInterleavedRTCP()
+			if err != nil {
+				return
+			}
+			c.log.Tracef("Received %d bytes on channel %d", len(data), channel)
+			continue
+		}
+		req, err := readRequest(c.reader)
+		if err != nil && !errors.Is(err, errUnsupportedVersion) {
+			c.log.Debugf("Error reading request: %v", err)
+			return
+		}
+		var res *response
+		if err != nil {
+			res = newResponse(505)
+		} else {
+			res = c.server.handle(c, req)
+		}
+		c.queue(res.withCSeq(req.header.Get("CSeq")).marshal(), true)
+	}
+}
+
+/*
+readInterleavedRTCP reads an interleaved packet from the client, which are RTCP
+Receiver Reports; they keep the client's sessions alive.
+*/
+func (c *conn) readInterleavedRTCP() (uint8, []byte, error) {
+	channel, data, err := readInterleaved(c.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := rtcp.Unmarshal(data); err == nil {
+		c.mu.Lock()
+		sessions := slices.Clone(c.sessions)
+		c.mu.Unlock()
+		for _, sess := range sessions {
+			sess.touch()
+		}
+	}
+	return channel, data, nil
+}
+
+func (r *response) withCSeq(cseq string) *response {
+	if cseq != "" {
+		r.header = slices.Insert(r.header, 0, headerField{"CSeq", cseq})
+	}
+	return r
+}
+
+/*
+sendFrame queues an interleaved packet, dropping it when the client is too slow to
+take it.
+*/
+func (c *conn) sendFrame(frame []byte) {
+	c.queue(frame, false)
+}
+
+func (c *conn) queue(data []byte, wait bool) {
+	if wait {
+		select {
+		case c.out <- data:
+		case <-c.done:
+		}
+		return
+	}
+	select {
+	case c.out <- data:
+	case <-c.done:
+	default:
+		c.log.Debugf("Dropped interleaved packet for a slow client")
+	}
+}
+
+func (c *conn) write() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.out:
+			if _, err := c.netConn.Write(data); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+/*
+close closes the connection and ends the sessions with interleaved tracks on it.
+*/
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.netConn.Close()
+		c.server.removeConn(c)
+		c.mu.Lock()
+		sessions := c.sessions
+		c.mu.Unlock()
+		for _, sess := range sessions {
+			sess.mu.Lock()
+			interleaved := sess.conn == c
+			sess.mu.Unlock()
+			if interleaved {
+				sess.close()
+			}
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package webrtcrtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	vp8Codec  = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	opusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+)
+
+type testResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   string
+}
+
+/*
+testClient is a minimal RTSP client keeping the interleaved packets it reads while
+waiting for responses.
+*/
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+	frames []testFrame
+}
+
+type testFrame struct {
+	channel uint8
+	packet  *rtp.Packet
+}
+
+func dialServer(t *testing.T, address string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) do(method string, url string, header ...string) testResponse {
+	c.t.Helper()
+	c.cseq++
+	request := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, field := range header {
+		request += field + "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(request + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if b[0] == '$' {
+			c.frames = append(c.frames, c.readFrame())
+			continue
+		}
+		break
+	}
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fields := strings.SplitN(line, " ", 3)
+	status, _ := strconv.Atoi(fields[1])
+	responseHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	assert.Equal(c.t, strconv.Itoa(c.cseq), responseHeader.Get("CSeq"))
+	body := make([]byte, 0)
+	if length := responseHeader.Get("Content-Length"); length != "" {
+		n, _ := strconv.Atoi(length)
+		body = make([]byte, n)
+		io.ReadFull(c.reader, body)
+	}
+	return testResponse{status: status, header: responseHeader, body: string(body)}
+}
+
+func (c *testClient) readFrame() testFrame {
+	c.t.Helper()
+	channel, data, err := readInterleaved(c.reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	packet := &rtp.Packet{}
+	packet.Unmarshal(data)
+	return testFrame{channel: channel, packet: packet}
+}
+
+/*
+nextFrame returns the next interleaved RTP packet, skipping RTCP channels.
+*/
+func (c *testClient) nextFrame() testFrame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var frame testFrame
+		if len(c.frames) > 0 {
+			frame, c.frames = c.frames[0], c.frames[1:]
+		} else {
+			frame = c.readFrame()
+		}
+		if frame.channel%2 == 0 {
+			return frame
+		}
+	}
+}
+
+func newTestServer(t *testing.T, config ServerConfig) (*Server, string, *webrtcpeer.SfuPeer, map[string]*webrtc.TrackLocalStaticRTP) {
+	t.Helper()
+	publisher, err := webrtcpeer.NewSfuPeer("cam1", &webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(publisher.Shutdown)
+	tracks := make(map[string]*webrtc.TrackLocalStaticRTP)
+	for id, codec := range map[string]webrtc.RTPCodecCapability{"video": vp8Codec, "audio": opusCodec} {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, id, "cam1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		publisher.LocalTracks[id] = track
+		tracks[id] = track
+	}
+	config.Publishers = webrtcpeer.NewSfuPeerManager()
+	config.Publishers.AddPeer(publisher)
+	config.UDPAddress = "127.0.0.1:0"
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return server, "rtsp://" + listener.Addr().String() + "/cam1", publisher, tracks
+}
+
+func writePacket(t *testing.T, track *webrtc.TrackLocalStaticRTP, seq uint16) {
+	t.Helper()
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 100, SSRC: 1, SequenceNumber: seq, Timestamp: uint32(seq) * 3000},
+		Payload: []byte{byte(seq)},
+	}
+	assert.Nil(t, track.WriteRTP(packet))
+}
+
+/*
+transportParam returns a parameter of a Transport header.
+*/
+func transportParam(header string, key string) string {
+	for _, param := range strings.Split(header, ";") {
+		if k, v, _ := strings.Cut(param, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestServer(t *testing.T) {
+	t.Run("Describes the tracks of a publisher", func(t *testing.T) {
+		t.Parallel()
+		_, url, _, _ := newTestServer(t, ServerConfig{})
+		client := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		res := client.do("OPTIONS", "*")
+		assert.Equal(t, 200, res.status)
+		assert.Contains(t, res.header.Get("Public"), "DESCRIBE")
+
+		res = client.do("DESCRIBE", url, "Accept: application/sdp")
+		assert.Equal(t, 200, res.status)
+		assert.Equal(t, url+"/", res.header.Get("Content-Base"))
+		assert.Equal(t, "application/sdp", res.header.Get("Content-Type"))
+		assert.Contains(t, res.body, "m=audio 0 RTP/AVP 96\r\na=rtpmap:96 opus/48000/2\r\na=fmtp:96 minptime=10;useinbandfec=1\r\na=control:audio\r\n")
+		assert.Contains(t, res.body, "m=video 0 RTP/AVP 96\r\na=rtpmap:96 VP8/90000\r\na=control:video\r\n")
+		assert.Less(t, strings.Index(res.body, "m=audio"), strings.Index(res.body, "m=video"))
+
+		assert.Equal(t, 404, client.do("DESCRIBE", url+"x").status)
+		assert.Equal(t, 404, client.do("SETUP", url+"/screen", "Transport: RTP/AVP/TCP;unicast").status)
+		assert.Equal(t, 461, client.do("SETUP", url+"/video", "Transport: RTP/AVP;multicast").status)
+		assert.Equal(t, 454, client.do("PLAY", url, "Session: nope").status)
+		assert.Equal(t, 501, client.do("RECORD", url).status)
+	})
+	t.Run("Plays tracks interleaved in the connection", func(t *testing.T) {
+		t.Parallel()
+		_, url, _, tracks := newTestServer(t, ServerConfig{})
+		client := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		res := client.do("SETUP", url+"/video", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+		assert.Equal(t, 200, res.status)
+		session, _, _ := strings.Cut(res.header.Get("Session"), ";")
+		videoSSRC, _ := strconv.ParseUint(transportParam(res.header.Get("Transport"), "ssrc"), 16, 32)
+		assert.Equal(t, "0-1", transportParam(res.header.Get("Transport"), "interleaved"))
+		res = client.do("SETUP", url+"/audio", "Transport: RTP/AVP/TCP;unicast", "Session: "+session)
+		assert.Equal(t, 200, res.status)
+		assert.Equal(t, "2-3", transportParam(res.header.Get("Transport"), "interleaved"))
+		assert.Equal(t, 455, client.do("SETUP", url+"/audio", "Transport: RTP/AVP/TCP;unicast", "Session: "+session).status)
+
+		res = client.do("PLAY", url+"/", "Session: "+session)
+		assert.Equal(t, 200, res.status)
+		rtpInfo := res.header.Get("RTP-Info")
+		assert.Contains(t, rtpInfo, "url="+url+"/video;seq=")
+		videoSeq, _ := strconv.Atoi(strings.Split(strings.SplitAfter(rtpInfo, "video;seq=")[1], ",")[0])
+
+		writePacket(t, tracks["video"], 1000)
+		writePacket(t, tracks["audio"], 7)
+		writePacket(t, tracks["video"], 1002)
+		// Each track is fed on its own, so only the order within a channel is kept.
+		channels := make(map[uint8][]*rtp.Packet)
+		for i := 0; i < 3; i++ {
+			frame := client.nextFrame()
+			channels[frame.channel] = append(channels[frame.channel], frame.packet)
+		}
+		assert.Len(t, channels[0], 2)
+		assert.Len(t, channels[2], 1)
+		video := channels[0][0]
+		assert.Equal(t, uint32(videoSSRC), video.SSRC)
+		assert.Equal(t, uint8(96), video.PayloadType)
+		assert.Equal(t, uint16(videoSeq), video.SequenceNumber)
+		assert.Equal(t, uint32(3000000), video.Timestamp)
+		// Gaps in the publisher's sequence numbers are kept for the client to see the loss.
+		assert.Equal(t, uint16(videoSeq+2), channels[0][1].SequenceNumber)
+		assert.Equal(t, []byte{7}, channels[2][0].Payload)
+
+		assert.Equal(t, 200, client.do("GET_PARAMETER", url, "Session: "+session).status)
+		assert.Equal(t, 200, client.do("TEARDOWN", url, "Session: "+session).status)
+		assert.Equal(t, 454, client.do("GET_PARAMETER", url, "Session: "+session).status)
+	})
+	t.Run("Plays tracks over UDP", func(t *testing.T) {
+		t.Parallel()
+		server, url, _, tracks := newTestServer(t, ServerConfig{})
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rtpConn.Close()
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		client := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		res := client.do("SETUP", url+"/video", fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+		assert.Equal(t, 200, res.status)
+		serverPort := server.UDPAddr().Port
+		assert.Equal(t, fmt.Sprintf("%d-%d", serverPort, serverPort+1), transportParam(res.header.Get("Transport"), "server_port"))
+		session, _, _ := strings.Cut(res.header.Get("Session"), ";")
+		assert.Equal(t, 200, client.do("PLAY", url, "Session: "+session).status)
+
+		writePacket(t, tracks["video"], 5)
+		buf := make([]byte, 1500)
+		rtpConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, from, err := rtpConn.ReadFromUDP(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, serverPort, from.Port)
+		packet := &rtp.Packet{}
+		assert.Nil(t, packet.Unmarshal(buf[:n]))
+		assert.Equal(t, []byte{5}, packet.Payload)
+
+		// The session outlives the connection.
+		client.conn.Close()
+		other := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		assert.Equal(t, 200, other.do("TEARDOWN", url, "Session: "+session).status)
+	})
+	t.Run("Ends sessions over UDP when the client is silent", func(t *testing.T) {
+		t.Parallel()
+		_, url, _, _ := newTestServer(t, ServerConfig{SessionTimeout: 100 * time.Millisecond})
+		client := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		res := client.do("SETUP", url+"/video", "Transport: RTP/AVP;unicast;client_port=40000-40001")
+		session, _, _ := strings.Cut(res.header.Get("Session"), ";")
+		assert.Equal(t, session+";timeout=1", res.header.Get("Session"))
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, 454, client.do("PLAY", url, "Session: "+session).status)
+	})
+	t.Run("Disconnects interleaved clients when the publisher leaves", func(t *testing.T) {
+		t.Parallel()
+		_, url, publisher, _ := newTestServer(t, ServerConfig{})
+		client := dialServer(t, strings.TrimPrefix(strings.TrimSuffix(url, "/cam1"), "rtsp://"))
+		res := client.do("SETUP", url+"/video", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+		session, _, _ := strings.Cut(res.header.Get("Session"), ";")
+		assert.Equal(t, 200, client.do("PLAY", url, "Session: "+session).status)
+		publisher.Shutdown()
+		client.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := client.reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestParseTransports(t *testing.T) {
+	transports := parseTransports("RTP/AVP;multicast, RTP/AVP/TCP;unicast;interleaved=4-5, RTP/AVP;unicast;client_port=5000")
+	assert.Equal(t, []transport{
+		{interleaved: true, channels: [2]int{4, 5}, hasChannels: true},
+		{clientPorts: [2]int{5000, 5001}},
+	}, transports)
+	assert.Empty(t, parseTransports("RTP/AVP;unicast"))
+	assert.Empty(t, parseTransports("RTP/SAVP;unicast;client_port=5000-5001"))
+}
@@ -0,0 +1,258 @@
+package webrtcrtsp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/aggregator-cloud/webrtcutil/webrtcrtp"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+session is an RTSP session: the tracks of one publisher path a client has set up and
+plays. Sessions with an interleaved track end with their connection; the others when
+the client has been silent for the session timeout.
+*/
+type session struct {
+	id        string
+	server    *Server
+	path      string
+	publisher *webrtcpeer.SfuPeer
+	// conn is the connection interleaved tracks are sent on.
+	conn    *conn
+	mu      sync.Mutex
+	streams []*stream
+	playing bool
+	closing atomic.Bool
+	timer   *time.Timer
+	log     logging.LeveledLogger
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+touch keeps the session alive for another session timeout.
+*/
+func (s *session) touch() {
+	s.timer.Reset(s.server.sessionTimeout)
+}
+
+/*
+stream returns the stream of the local track trackID, if it is set up.
+*/
+func (s *session) stream(trackID string) *stream {
+	for _, stream := range s.streams {
+		if stream.trackID == trackID {
+			return stream
+		}
+	}
+	return nil
+}
+
+/*
+play attaches the streams to their tracks, so packets flow from the next one the
+publisher sends, and asks the publisher for keyframes for the client to start
+decoding at once.
+*/
+func (s *session) play() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.playing {
+		return nil
+	}
+	for i, stream := range s.streams {
+		if err := s.publisher.AttachTrackSink(stream.trackID, stream); err != nil {
+			for _, attached := range s.streams[:i] {
+				s.publisher.DetachTrackSink(attached.trackID, attached)
+			}
+			return err
+		}
+	}
+	s.playing = true
+	for _, stream := range s.streams {
+		if strings.HasPrefix(strings.ToLower(stream.codec.MimeType), "video/") {
+			s.publisher.KeyframeRequester(stream.trackID)()
+		}
+	}
+	return nil
+}
+
+/*
+close detaches the streams and forgets the session. It may be called again, from
+the streams being closed, which does nothing.
+*/
+func (s *session) close() {
+	if s.closing.Swap(true) {
+		return
+	}
+	s.timer.Stop()
+	s.server.removeSession(s)
+	s.mu.Lock()
+	streams, playing := s.streams, s.playing
+	s.playing = false
+	s.mu.Unlock()
+	if playing {
+		for _, stream := range streams {
+			s.publisher.DetachTrackSink(stream.trackID, stream)
+		}
+	}
+	s.log.Debugf("Closed session %s", s.id)
+}
+
+/*
+sendSenderReports sends a Sender Report for every stream that has sent packets,
+with the timing of the publisher's last Sender Report for the track: timestamps
+are forwarded unchanged, so the client can synchronize the tracks with them.
+*/
+func (s *session) sendSenderReports() {
+	s.mu.Lock()
+	streams := s.streams
+	playing := s.playing
+	s.mu.Unlock()
+	if !playing {
+		return
+	}
+	for _, stream := range streams {
+		report, err := s.publisher.LastSenderReport(stream.trackID)
+		if err != nil {
+			continue
+		}
+		stream.mu.Lock()
+		packetCount, octetCount, started := stream.packetCount, stream.octetCount, stream.started
+		stream.mu.Unlock()
+		if !started {
+			continue
+		}
+		data, err := rtcp.Marshal([]rtcp.Packet{&rtcp.SenderReport{
+			SSRC:        stream.ssrc,
+			NTPTime:     report.NTPTime,
+			RTPTime:     report.RTPTime,
+			PacketCount: packetCount,
+			OctetCount:  octetCount,
+		}})
+		if err != nil {
+			continue
+		}
+		stream.send(data, true)
+	}
+}
+
+/*
+stream is a track set up in a session. It is the TrackSink attached to the
+publisher's local track when the session plays.
+*/
+type stream struct {
+	session     *session
+	trackID     string
+	control     string
+	codec       webrtc.RTPCodecCapability
+	payloadType uint8
+	ssrc        uint32
+	transport   transport
+	// rtpAddr and rtcpAddr are where a stream over UDP is sent.
+	rtpAddr  *net.UDPAddr
+	rtcpAddr *net.UDPAddr
+	mu       sync.Mutex
+	started  bool
+	// initialSeq is the sequence number of the first packet sent, as announced in
+	// RTP-Info. The sequence numbers of the publisher are shifted to start there.
+	initialSeq  uint16
+	seqOffset   uint16
+	packetCount uint32
+	octetCount  uint32
+}
+
+func newStream(session *session, trackID string, codec webrtc.RTPCodecCapability, t transport) *stream {
+	return &stream{
+		session:     session,
+		trackID:     trackID,
+		codec:       codec,
+		payloadType: webrtcrtp.StaticPayloadType(codec),
+		ssrc:        mathrand.Uint32(),
+		transport:   t,
+		initialSeq:  uint16(mathrand.Uint32()),
+	}
+}
+
+/*
+WriteRTP sends a packet of the track to the client with the stream's SSRC and
+payload type.
+*/
+func (s *stream) WriteRTP(packet *rtp.Packet) error {
+	s.mu.Lock()
+	if !s.started {
+		s.started = true
+		s.seqOffset = s.initialSeq - packet.SequenceNumber
+	}
+	packet.SequenceNumber += s.seqOffset
+	s.packetCount++
+	s.octetCount += uint32(len(packet.Payload))
+	s.mu.Unlock()
+	packet.PayloadType = s.payloadType
+	packet.SSRC = s.ssrc
+	// Header extensions were negotiated with the publisher, not the client.
+	packet.Extension = false
+	packet.Extensions = nil
+	packet.Padding = false
+	data, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.send(data, false)
+}
+
+func (s *stream) send(data []byte, isRTCP bool) error {
+	if s.transport.interleaved {
+		channel := s.transport.channels[0]
+		if isRTCP {
+			channel = s.transport.channels[1]
+		}
+		s.session.conn.sendFrame(interleavedFrame(uint8(channel), data))
+		return nil
+	}
+	if isRTCP {
+		_, err := s.session.server.rtcpConn.WriteToUDP(data, s.rtcpAddr)
+		return err
+	}
+	_, err := s.session.server.rtpConn.WriteToUDP(data, s.rtpAddr)
+	return err
+}
+
+/*
+Close is called when the stream is detached. When the track ended rather than the
+session, the session ends with it.
+*/
+func (s *stream) Close() error {
+	if !s.session.closing.Load() {
+		go s.session.closeWithConn()
+	}
+	return nil
+}
+
+/*
+closeWithConn ends a session whose track is gone. A client playing over TCP is
+disconnected, since it has no other way to learn the stream ended.
+*/
+func (s *session) closeWithConn() {
+	s.close()
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.close()
+	}
+}
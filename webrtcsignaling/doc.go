@@ -0,0 +1,46 @@
+/*
+Package webrtcsignaling provides a signaling server for SfuPeers.
+
+The Server speaks the protocol over WebSocket. For clients behind proxies that
+block WebSockets, LongPollHandler and EventSourceHandler serve it over HTTP
+long-polling and over Server-Sent Events with POSTs. The HTTP transports address
+a session by the ID returned when it is opened, number the server's messages
+with "seq" and hold them until the client has received them, so a dropped poll
+or event stream resumes where it stopped. Every transport implements Conn and
+feeds the same negotiators.
+
+Every connection is authenticated when it is opened and gets its own SfuPeer
+and SfuPeerNegotiator once it joins. Tracks published by one connection are
+forwarded to every other joined connection. All messages are JSON objects with a
+"type" field:
+
+	client -> server
+	{"type": "join"}
+	{"type": "resume", "resumeToken": "..."}
+	{"type": "offer", "description": {"type": "offer", "sdp": "..."}}
+	{"type": "answer", "description": {"type": "answer", "sdp": "..."}}
+	{"type": "candidate", "candidate": {"candidate": "...", "sdpMid": "0", "sdpMLineIndex": 0}}
+	{"type": "leave"}
+
+	server -> client
+	{"type": "session", "sessionId": "..."}  (HTTP transports only)
+	{"type": "joined", "peerId": "...", "negotiatorId": "...", "resumeToken": "..."}
+	{"type": "resumed", "peerId": "...", "negotiatorId": "..."}
+	{"type": "offer", "negotiatorId": "...", "description": {...}}
+	{"type": "answer", "negotiatorId": "...", "description": {...}}
+	{"type": "candidate", "negotiatorId": "...", "candidate": {...}}
+	{"type": "track_added", "peerId": "...", "trackId": "...", "streamId": "...", "kind": "video"}
+	{"type": "track_removed", "peerId": "...", "trackId": "..."}
+	{"type": "error", "error": "..."}
+
+The server is the impolite side of perfect negotiation, so clients must be polite:
+on an offer collision they roll back their own offer and answer the server's.
+Leaving tears down the peer and removes its tracks from every other peer. A
+connection that drops without leaving keeps its peer for the resume grace period:
+media keeps flowing and the server holds the messages it writes in the meantime.
+Sending resume with the token from joined as the first message of a new
+connection, over any transport, reattaches it; the server answers resumed and
+then sends the held messages, so negotiation continues where it stopped. A peer
+that is not resumed in time is torn down.
+*/
+package webrtcsignaling
@@ -0,0 +1,146 @@
+package webrtcsignaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const eventReplayWindow = 64
+
+/*
+EventSourceHandler returns an http.Handler serving the signaling protocol over
+Server-Sent Events for server messages and POSTs for client messages:
+
+	GET                         opens a session and streams its messages
+	GET    ?session=ID          resumes the session's stream
+	POST   ?session=ID          sends the message in the body
+	DELETE ?session=ID          leaves
+
+The first event of a new stream is {"type": "session", "sessionId": "..."}. Every
+event id has the form "<session id>:<seq>", so an EventSource reconnecting with
+Last-Event-ID resumes its session after the last message it received without
+knowing the session ID. The last messages flushed to a stream are kept for
+replay, since a broken stream only fails the writes after it. Every request is
+authenticated and, unless the server's peer IDs are random, must resolve to the
+peer that opened the session.
+*/
+func (s *Server) EventSourceHandler() http.Handler {
+	return http.HandlerFunc(s.serveEventSource)
+}
+
+func (s *Server) serveEventSource(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session")
+	switch {
+	case r.Method == http.MethodGet:
+		s.stream(w, r, sessionID)
+	case r.Method == http.MethodPost && sessionID != "":
+		s.handleSessionPost(w, r, sessionID)
+	case r.Method == http.MethodDelete && sessionID != "":
+		s.handleSessionDelete(w, r, sessionID)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, sessionID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var after uint64
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, seq, ok := parseEventID(lastEventID)
+		if !ok || (sessionID != "" && sessionID != id) {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		sessionID, after = id, seq
+	}
+
+	var conn *httpConn
+	if sessionID == "" {
+		peerID, err := s.authenticate(r)
+		if err != nil {
+			s.log.Warnf("Rejecting signaling session: %v", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		conn = s.openHTTPConn(peerID)
+	} else if conn = s.lookupHTTPConn(w, r, sessionID); conn == nil {
+		return
+	}
+	conn.attach()
+	defer conn.detach()
+	conn.ack(after)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if sessionID == "" {
+		if err := writeEvent(w, conn.id, Message{Type: MessageTypeSession, SessionID: conn.id}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		messages, notify := conn.next(after)
+		for _, message := range messages {
+			if err := writeEvent(w, conn.id, message); err != nil {
+				return
+			}
+			after = message.Seq
+		}
+		if len(messages) > 0 {
+			flusher.Flush()
+			if after > eventReplayWindow {
+				conn.ack(after - eventReplayWindow)
+			}
+		}
+		select {
+		case <-notify:
+		case <-conn.closed:
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, sessionID string, message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s:%d\ndata: %s\n\n", sessionID, message.Seq, data)
+	return err
+}
+
+/*
+parseEventID splits an event id of the form "<session id>:<seq>".
+*/
+func parseEventID(id string) (string, uint64, bool) {
+	sessionID, value, ok := strings.Cut(id, ":")
+	if !ok || sessionID == "" {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return sessionID, seq, true
+}
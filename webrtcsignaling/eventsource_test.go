@@ -0,0 +1,156 @@
+package webrtcsignaling
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+eventSourceTestConn is the client side of a Server-Sent Events session.
+*/
+type eventSourceTestConn struct {
+	*longPollTestConn
+	resp        *http.Response
+	reader      *bufio.Reader
+	lastEventID string
+}
+
+func dialEventSource(t *testing.T, server *httptest.Server, id string) *eventSourceTestConn {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &eventSourceTestConn{
+		longPollTestConn: &longPollTestConn{url: server.URL + "/events", id: id, ctx: ctx, cancel: cancel},
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MessageTypeSession, message.Type)
+	c.session = message.SessionID
+	return c
+}
+
+/*
+connect opens the event stream, resuming after the last event received like an EventSource.
+*/
+func (c *eventSourceTestConn) connect() error {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, c.url+"?id="+c.id, nil)
+	if err != nil {
+		return err
+	}
+	if c.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", c.lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("stream: %s", resp.Status)
+	}
+	c.resp = resp
+	c.reader = bufio.NewReader(resp.Body)
+	return nil
+}
+
+func (c *eventSourceTestConn) ReadMessage() (Message, error) {
+	var data string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return Message{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			c.lastEventID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var message Message
+			err := json.Unmarshal([]byte(data), &message)
+			return message, err
+		}
+	}
+}
+
+func (c *eventSourceTestConn) Close() error {
+	c.resp.Body.Close()
+	return c.longPollTestConn.Close()
+}
+
+func TestEventSource(t *testing.T) {
+	t.Run("Rejects unauthenticated sessions", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		resp, err := http.Get(httpServer.URL + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("Rejects malformed Last-Event-ID", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		req, _ := http.NewRequest(http.MethodGet, httpServer.URL+"/events?id=alice", nil)
+		req.Header.Set("Last-Event-ID", "42")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("Resumes the session with Last-Event-ID", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		conn := dialEventSource(t, httpServer, "subscriber")
+		t.Cleanup(func() { conn.Close() })
+		assert.NoError(t, conn.WriteMessage(Message{Type: MessageTypeJoin}))
+		joined, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, MessageTypeJoined, joined.Type)
+		assert.Equal(t, fmt.Sprintf("%s:%d", conn.session, joined.Seq), conn.lastEventID)
+
+		conn.resp.Body.Close()
+		assert.NoError(t, conn.WriteMessage(Message{Type: MessageTypeJoin}))
+		assert.NoError(t, conn.connect())
+		message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, MessageTypeError, message.Type)
+		assert.Equal(t, joined.Seq+1, message.Seq)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+	})
+	t.Run("Forwards tracks from long-poll publishers", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		publisher := newTestClient(t, "publisher", dialLongPoll(t, httpServer, "publisher"))
+		publisher.expect(t, MessageTypeJoined)
+		subscriber := newTestClient(t, "subscriber", dialEventSource(t, httpServer, "subscriber"))
+		subscriber.expect(t, MessageTypeJoined)
+		publisher.publish(t)
+
+		added := subscriber.expect(t, MessageTypeTrackAdded)
+		assert.Equal(t, "publisher", added.PeerID)
+		select {
+		case track := <-subscriber.tracks:
+			assert.Equal(t, added.TrackID, track.ID())
+		case <-time.After(10 * time.Second):
+			t.Fatal("subscriber did not receive the track")
+		}
+	})
+}
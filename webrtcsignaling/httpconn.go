@@ -0,0 +1,250 @@
+package webrtcsignaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxMessageSize     = 1 << 16
+	maxPendingMessages = 1024
+)
+
+var (
+	errConnClosed     = errors.New("signaling session closed")
+	errSessionExpired = errors.New("signaling session expired")
+	errOutboxFull     = errors.New("too many undelivered signaling messages")
+)
+
+/*
+httpConn is a Conn for the HTTP transports. It outlives the requests that carry
+it: client messages arrive through POSTs, and server messages are numbered and
+held until the client acknowledges them, so a poll or event stream can pick up
+where the previous one stopped. The session expires after the server's session
+timeout without an attached poll or stream.
+*/
+type httpConn struct {
+	id       string
+	peerID   string
+	incoming chan Message
+	mu       sync.Mutex
+	pending  []Message
+	seq      uint64
+	notify   chan struct{}
+	attached int
+	timeout  time.Duration
+	idle     *time.Timer
+	closed   chan struct{}
+	err      error
+	onClose  func()
+}
+
+func newHTTPConn(peerID string, timeout time.Duration, onClose func()) *httpConn {
+	c := &httpConn{
+		id:       uuid.New().String(),
+		peerID:   peerID,
+		incoming: make(chan Message),
+		notify:   make(chan struct{}),
+		timeout:  timeout,
+		closed:   make(chan struct{}),
+		onClose:  onClose,
+	}
+	c.idle = time.AfterFunc(timeout, func() {
+		c.closeWithError(errSessionExpired)
+	})
+	return c
+}
+
+func (c *httpConn) ReadMessage() (Message, error) {
+	select {
+	case message := <-c.incoming:
+		return message, nil
+	case <-c.closed:
+		return Message{}, c.err
+	}
+}
+
+func (c *httpConn) WriteMessage(message Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return errConnClosed
+	default:
+	}
+	if len(c.pending) >= maxPendingMessages {
+		return errOutboxFull
+	}
+	c.seq++
+	message.Seq = c.seq
+	c.pending = append(c.pending, message)
+	close(c.notify)
+	c.notify = make(chan struct{})
+	return nil
+}
+
+func (c *httpConn) Close() error {
+	c.closeWithError(io.EOF)
+	return nil
+}
+
+func (c *httpConn) closeWithError(err error) {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return
+	default:
+	}
+	c.err = err
+	close(c.closed)
+	c.idle.Stop()
+	c.mu.Unlock()
+	c.onClose()
+}
+
+/*
+deliver hands a client message to the session, waiting until the session has read it.
+*/
+func (c *httpConn) deliver(ctx context.Context, message Message) error {
+	select {
+	case c.incoming <- message:
+		return nil
+	case <-c.closed:
+		return errConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+ack drops the messages the client has received up to and including seq.
+*/
+func (c *httpConn) ack(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := 0
+	for i < len(c.pending) && c.pending[i].Seq <= seq {
+		i++
+	}
+	c.pending = append([]Message(nil), c.pending[i:]...)
+}
+
+/*
+next returns the held messages numbered after seq and a channel closed on the next write.
+*/
+func (c *httpConn) next(seq uint64) ([]Message, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var messages []Message
+	for _, message := range c.pending {
+		if message.Seq > seq {
+			messages = append(messages, message)
+		}
+	}
+	return messages, c.notify
+}
+
+/*
+attach marks a poll or event stream as waiting on the session, which keeps it alive
+until the matching detach.
+*/
+func (c *httpConn) attach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attached++
+	c.idle.Stop()
+}
+
+func (c *httpConn) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attached--
+	if c.attached == 0 {
+		c.idle.Reset(c.timeout)
+	}
+}
+
+/*
+openHTTPConn creates an HTTP session for peerID and starts serving it.
+*/
+func (s *Server) openHTTPConn(peerID string) *httpConn {
+	var conn *httpConn
+	conn = newHTTPConn(peerID, s.sessionTimeout, func() {
+		s.httpConnsMu.Lock()
+		delete(s.httpConns, conn.id)
+		s.httpConnsMu.Unlock()
+	})
+	s.httpConnsMu.Lock()
+	s.httpConns[conn.id] = conn
+	s.httpConnsMu.Unlock()
+	go s.serve(peerID, conn)
+	return conn
+}
+
+/*
+lookupHTTPConn authenticates the request and returns the session it names, checking
+that it is of the same peer when the authenticator gives stable peer IDs. It writes
+the error response itself and returns nil when the request must not proceed.
+*/
+func (s *Server) lookupHTTPConn(w http.ResponseWriter, r *http.Request, sessionID string) *httpConn {
+	peerID, err := s.authenticate(r)
+	if err != nil {
+		s.log.Warnf("Rejecting signaling request: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil
+	}
+	s.httpConnsMu.Lock()
+	conn, ok := s.httpConns[sessionID]
+	s.httpConnsMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil
+	}
+	// Without stable peer IDs, the unguessable session ID alone names the session.
+	if s.stableIDs && conn.peerID != peerID {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil
+	}
+	return conn
+}
+
+/*
+handleSessionPost delivers the message in the request body to the named session.
+*/
+func (s *Server) handleSessionPost(w http.ResponseWriter, r *http.Request, sessionID string) {
+	conn := s.lookupHTTPConn(w, r, sessionID)
+	if conn == nil {
+		return
+	}
+	var message Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := conn.deliver(r.Context(), message); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/*
+handleSessionDelete leaves and closes the named session.
+*/
+func (s *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request, sessionID string) {
+	conn := s.lookupHTTPConn(w, r, sessionID)
+	if conn == nil {
+		return
+	}
+	conn.deliver(r.Context(), Message{Type: MessageTypeLeave})
+	conn.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package webrtcsignaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+/*
+LongPollHandler returns an http.Handler serving the signaling protocol over HTTP
+long-polling, for clients whose proxies do not pass WebSockets:
+
+	POST                        opens a session and returns {"type": "session", "sessionId": "..."}
+	POST   ?session=ID          sends the message in the body
+	GET    ?session=ID&after=N  waits for messages numbered after N
+	DELETE ?session=ID          leaves
+
+Every request is authenticated and, unless the server's peer IDs are random, must
+resolve to the peer that opened the session. A poll acknowledges every message up to its after parameter and returns
+a JSON array of the messages that follow, each carrying its "seq", or 204 when
+none arrive within the poll timeout.
+*/
+func (s *Server) LongPollHandler() http.Handler {
+	return http.HandlerFunc(s.serveLongPoll)
+}
+
+func (s *Server) serveLongPoll(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session")
+	switch {
+	case r.Method == http.MethodPost && sessionID == "":
+		s.openLongPoll(w, r)
+	case r.Method == http.MethodPost:
+		s.handleSessionPost(w, r, sessionID)
+	case r.Method == http.MethodGet && sessionID != "":
+		s.poll(w, r, sessionID)
+	case r.Method == http.MethodDelete && sessionID != "":
+		s.handleSessionDelete(w, r, sessionID)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) openLongPoll(w http.ResponseWriter, r *http.Request) {
+	peerID, err := s.authenticate(r)
+	if err != nil {
+		s.log.Warnf("Rejecting signaling session: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	conn := s.openHTTPConn(peerID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Message{Type: MessageTypeSession, SessionID: conn.id})
+}
+
+func (s *Server) poll(w http.ResponseWriter, r *http.Request, sessionID string) {
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	conn := s.lookupHTTPConn(w, r, sessionID)
+	if conn == nil {
+		return
+	}
+	conn.attach()
+	defer conn.detach()
+	conn.ack(after)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.pollTimeout)
+	defer cancel()
+	for {
+		messages, notify := conn.next(after)
+		if len(messages) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(messages)
+			return
+		}
+		select {
+		case <-notify:
+		case <-conn.closed:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-ctx.Done():
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package webrtcsignaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+longPollTestConn is the client side of a long-poll session.
+*/
+type longPollTestConn struct {
+	url     string
+	id      string
+	session string
+	after   uint64
+	queue   []Message
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func dialLongPoll(t *testing.T, server *httptest.Server, id string) *longPollTestConn {
+	t.Helper()
+	url := server.URL + "/poll"
+	resp, err := http.Post(url+"?id="+id, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("opening session: %s", resp.Status)
+	}
+	var message Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &longPollTestConn{url: url, id: id, session: message.SessionID, ctx: ctx, cancel: cancel}
+}
+
+func (c *longPollTestConn) ReadMessage() (Message, error) {
+	for len(c.queue) == 0 {
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, fmt.Sprintf("%s?id=%s&session=%s&after=%d", c.url, c.id, c.session, c.after), nil)
+		if err != nil {
+			return Message{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return Message{}, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&c.queue)
+		case http.StatusNoContent:
+		default:
+			err = fmt.Errorf("poll: %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return Message{}, err
+		}
+	}
+	message := c.queue[0]
+	c.queue = c.queue[1:]
+	c.after = message.Seq
+	return message, nil
+}
+
+func (c *longPollTestConn) WriteMessage(message Message) error {
+	return c.do(http.MethodPost, message, http.StatusAccepted)
+}
+
+func (c *longPollTestConn) Close() error {
+	c.cancel()
+	return c.do(http.MethodDelete, nil, http.StatusNoContent)
+}
+
+func (c *longPollTestConn) do(method string, body any, status int) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.url+"?id="+c.id+"&session="+c.session, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return nil
+}
+
+func TestLongPoll(t *testing.T) {
+	t.Run("Rejects unauthenticated sessions", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		resp, err := http.Post(httpServer.URL+"/poll", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("Rejects other peers and unknown sessions", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		conn := dialLongPoll(t, httpServer, "alice")
+		t.Cleanup(func() { conn.Close() })
+
+		conn.id = "mallory"
+		assert.ErrorContains(t, conn.WriteMessage(Message{Type: MessageTypeJoin}), "403")
+		conn.id = "alice"
+		conn.session = "unknown"
+		assert.ErrorContains(t, conn.WriteMessage(Message{Type: MessageTypeJoin}), "404")
+	})
+	t.Run("Serves sessions with the default authenticator", func(t *testing.T) {
+		t.Parallel()
+		server := NewServer(ServerConfig{PollTimeout: time.Second})
+		httpServer := httptest.NewServer(http.StripPrefix("/poll", server.LongPollHandler()))
+		t.Cleanup(httpServer.Close)
+		conn := dialLongPoll(t, httpServer, "")
+		t.Cleanup(func() { conn.Close() })
+		assert.NoError(t, conn.WriteMessage(Message{Type: MessageTypeJoin}))
+		message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, MessageTypeJoined, message.Type)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+	})
+	t.Run("Join creates peer and delete leaves", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		conn := dialLongPoll(t, httpServer, "alice")
+		client := newTestClient(t, "alice", conn)
+		joined := client.expect(t, MessageTypeJoined)
+		assert.Equal(t, "alice", joined.PeerID)
+		assert.NotZero(t, joined.Seq)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+
+		assert.NoError(t, conn.Close())
+		assert.Eventually(t, func() bool {
+			return server.Peers().CountPeers() == 0
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+	t.Run("Expires sessions without polls", func(t *testing.T) {
+		t.Parallel()
+		server := NewServer(ServerConfig{
+			Authenticate: func(r *http.Request) (string, error) {
+				return "alice", nil
+			},
+			SessionTimeout:    100 * time.Millisecond,
+			ResumeGracePeriod: -1,
+		})
+		httpServer := httptest.NewServer(http.StripPrefix("/poll", server.LongPollHandler()))
+		t.Cleanup(httpServer.Close)
+		conn := dialLongPoll(t, httpServer, "alice")
+		assert.NoError(t, conn.WriteMessage(Message{Type: MessageTypeJoin}))
+		assert.Eventually(t, func() bool {
+			err := conn.WriteMessage(Message{Type: MessageTypeJoin})
+			return err != nil && strings.Contains(err.Error(), "404")
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, 0, server.Peers().CountPeers())
+	})
+	t.Run("Forwards tracks to WebSocket subscribers", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		publisher := newTestClient(t, "publisher", dialLongPoll(t, httpServer, "publisher"))
+		publisher.expect(t, MessageTypeJoined)
+		subscriber := dialTestClient(t, httpServer, "subscriber")
+		subscriber.expect(t, MessageTypeJoined)
+		publisher.publish(t)
+
+		added := subscriber.expect(t, MessageTypeTrackAdded)
+		assert.Equal(t, "publisher", added.PeerID)
+		select {
+		case track := <-subscriber.tracks:
+			assert.Equal(t, added.TrackID, track.ID())
+		case <-time.After(10 * time.Second):
+			t.Fatal("subscriber did not receive the track")
+		}
+		assert.Equal(t, 2, server.Negotiators().Negotiators.Count())
+	})
+}
@@ -0,0 +1,72 @@
+package webrtcsignaling
+
+import (
+	"github.com/aggregator-cloud/webrtcutil/webrtcnegotiation"
+	"github.com/pion/webrtc/v3"
+)
+
+type MessageType string
+
+const (
+	MessageTypeSession      MessageType = "session"
+	MessageTypeJoin         MessageType = "join"
+	MessageTypeJoined       MessageType = "joined"
+	MessageTypeOffer        MessageType = "offer"
+	MessageTypeAnswer       MessageType = "answer"
+	MessageTypeCandidate    MessageType = "candidate"
+	MessageTypeTrackAdded   MessageType = "track_added"
+	MessageTypeTrackRemoved MessageType = "track_removed"
+	MessageTypeLeave        MessageType = "leave"
+	MessageTypeResume       MessageType = "resume"
+	MessageTypeResumed      MessageType = "resumed"
+	MessageTypeError        MessageType = "error"
+)
+
+/*
+Message is a single message of the signaling protocol described in the package documentation.
+*/
+type Message struct {
+	Type         MessageType                `json:"type"`
+	Seq          uint64                     `json:"seq,omitempty"`
+	SessionID    string                     `json:"sessionId,omitempty"`
+	PeerID       string                     `json:"peerId,omitempty"`
+	NegotiatorID string                     `json:"negotiatorId,omitempty"`
+	ResumeToken  string                     `json:"resumeToken,omitempty"`
+	Description  *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate    *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	TrackID      string                     `json:"trackId,omitempty"`
+	StreamID     string                     `json:"streamId,omitempty"`
+	Kind         string                     `json:"kind,omitempty"`
+	Error        string                     `json:"error,omitempty"`
+}
+
+/*
+isSignal reports whether the message carries negotiation data for a negotiator.
+*/
+func (m Message) isSignal() bool {
+	return m.Type == MessageTypeOffer || m.Type == MessageTypeAnswer || m.Type == MessageTypeCandidate
+}
+
+/*
+SignalMessage converts the message to the negotiation envelope addressed to negotiatorID.
+*/
+func (m Message) SignalMessage(negotiatorID string) webrtcnegotiation.SignalMessage {
+	return webrtcnegotiation.SignalMessage{
+		Type:         webrtcnegotiation.SignalType(m.Type),
+		NegotiatorID: negotiatorID,
+		Description:  m.Description,
+		Candidate:    m.Candidate,
+	}
+}
+
+/*
+MessageFromSignal converts a negotiation envelope to a protocol message.
+*/
+func MessageFromSignal(signal webrtcnegotiation.SignalMessage) Message {
+	return Message{
+		Type:         MessageType(signal.Type),
+		NegotiatorID: signal.NegotiatorID,
+		Description:  signal.Description,
+		Candidate:    signal.Candidate,
+	}
+}
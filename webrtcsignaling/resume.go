@@ -0,0 +1,101 @@
+package webrtcsignaling
+
+import (
+	"errors"
+	"time"
+)
+
+const maxBufferedMessages = 256
+
+var errUnknownResumeToken = errors.New("unknown or expired resume token")
+
+/*
+resume moves conn from the unjoined session current to the joined session that
+resumeToken names, and returns that session. When the authenticator gives stable
+peer IDs, the session must also be of the same peer.
+*/
+func (s *Server) resume(current *session, conn Conn, resumeToken string) (*session, error) {
+	if current.peer != nil {
+		return nil, errors.New("already joined")
+	}
+	s.sessionsMu.Lock()
+	sess, ok := s.resumeTokens[resumeToken]
+	s.sessionsMu.Unlock()
+	if !ok || s.stableIDs && sess.id != current.id {
+		return nil, errUnknownResumeToken
+	}
+	if err := sess.attach(conn); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+/*
+attach makes conn the session's connection, closing the one it replaces, and
+sends the messages held since the session was detached after a resumed message.
+*/
+func (sess *session) attach(conn Conn) error {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return errUnknownResumeToken
+	}
+	if sess.grace != nil {
+		sess.grace.Stop()
+		sess.grace = nil
+	}
+	previous := sess.conn
+	sess.conn = conn
+	buffer := append([]Message{{
+		Type:         MessageTypeResumed,
+		PeerID:       sess.id,
+		NegotiatorID: sess.negotiator.ID(),
+	}}, sess.buffer...)
+	sess.buffer = nil
+	for i, message := range buffer {
+		if err := conn.WriteMessage(message); err != nil {
+			sess.buffer = buffer[max(i, 1):]
+			break
+		}
+	}
+	sess.mu.Unlock()
+	if previous != nil && previous != conn {
+		previous.Close()
+	}
+	sess.log.Infof("Signaling session resumed with %d held messages", len(buffer)-1)
+	return nil
+}
+
+/*
+disconnect detaches a failed connection. A joined session then waits for the
+resume grace period before it is torn down; any other session is torn down now.
+*/
+func (sess *session) disconnect(conn Conn) {
+	sess.mu.Lock()
+	if sess.conn != conn {
+		// The connection was replaced by a resume.
+		sess.mu.Unlock()
+		conn.Close()
+		return
+	}
+	grace := sess.server.resumeGrace
+	if sess.peer == nil || sess.closed || grace < 0 {
+		sess.mu.Unlock()
+		sess.close()
+		return
+	}
+	sess.conn = nil
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		sess.mu.Lock()
+		expired := sess.grace == timer
+		sess.mu.Unlock()
+		if expired {
+			sess.log.Infof("Signaling session not resumed within %s", grace)
+			sess.close()
+		}
+	})
+	sess.grace = timer
+	sess.mu.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,136 @@
+package webrtcsignaling
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+dialRaw opens a websocket without a client peer, for tests driving the protocol by hand.
+*/
+func dialRaw(t *testing.T, server *httptest.Server, id string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?id=" + id
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func exchange(t *testing.T, conn *websocket.Conn, message Message, expected MessageType) Message {
+	t.Helper()
+	if err := conn.WriteJSON(message); err != nil {
+		t.Fatal(err)
+	}
+	return readUntil(t, conn, expected)
+}
+
+func readUntil(t *testing.T, conn *websocket.Conn, expected MessageType) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var reply Message
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("waiting for %s: %v", expected, err)
+		}
+		if reply.Type == expected {
+			return reply
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	t.Run("Resumes with held messages", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		first := dialRaw(t, httpServer, "subscriber")
+		joined := exchange(t, first, Message{Type: MessageTypeJoin}, MessageTypeJoined)
+		assert.NotEmpty(t, joined.ResumeToken)
+		first.Close()
+
+		publisher := dialTestClient(t, httpServer, "publisher")
+		publisher.expect(t, MessageTypeJoined)
+		publisher.publish(t)
+		assert.Eventually(t, func() bool {
+			peer, err := server.Peers().GetPeer("subscriber")
+			return err == nil && len((*peer).GetOthersTrackIDs()) > 0
+		}, 10*time.Second, 20*time.Millisecond)
+		assert.Equal(t, 2, server.Peers().CountPeers())
+
+		second := dialRaw(t, httpServer, "subscriber")
+		resumed := exchange(t, second, Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeResumed)
+		assert.Equal(t, joined.NegotiatorID, resumed.NegotiatorID)
+		added := readUntil(t, second, MessageTypeTrackAdded)
+		assert.Equal(t, "publisher", added.PeerID)
+		offer := readUntil(t, second, MessageTypeOffer)
+		assert.Equal(t, joined.NegotiatorID, offer.NegotiatorID)
+	})
+	t.Run("Rejects unknown tokens and other peers", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		alice := dialRaw(t, httpServer, "alice")
+		joined := exchange(t, alice, Message{Type: MessageTypeJoin}, MessageTypeJoined)
+
+		reply := exchange(t, dialRaw(t, httpServer, "alice"), Message{Type: MessageTypeResume, ResumeToken: "forged"}, MessageTypeError)
+		assert.Equal(t, errUnknownResumeToken.Error(), reply.Error)
+		reply = exchange(t, dialRaw(t, httpServer, "mallory"), Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeError)
+		assert.Equal(t, errUnknownResumeToken.Error(), reply.Error)
+		reply = exchange(t, alice, Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeError)
+		assert.Equal(t, "already joined", reply.Error)
+	})
+	t.Run("Resumes with the default authenticator", func(t *testing.T) {
+		t.Parallel()
+		server := NewServer(ServerConfig{})
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+		first := dialRaw(t, httpServer, "")
+		joined := exchange(t, first, Message{Type: MessageTypeJoin}, MessageTypeJoined)
+		first.Close()
+
+		// Every connection gets a new random peer ID, so the token alone names the session.
+		second := dialRaw(t, httpServer, "")
+		resumed := exchange(t, second, Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeResumed)
+		assert.Equal(t, joined.PeerID, resumed.PeerID)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+		reply := exchange(t, dialRaw(t, httpServer, ""), Message{Type: MessageTypeResume, ResumeToken: "forged"}, MessageTypeError)
+		assert.Equal(t, errUnknownResumeToken.Error(), reply.Error)
+	})
+	t.Run("Takes over a live connection", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		first := dialRaw(t, httpServer, "alice")
+		joined := exchange(t, first, Message{Type: MessageTypeJoin}, MessageTypeJoined)
+
+		second := dialRaw(t, httpServer, "alice")
+		exchange(t, second, Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeResumed)
+		var message Message
+		first.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.Error(t, first.ReadJSON(&message))
+		assert.Equal(t, 1, server.Peers().CountPeers())
+
+		second.WriteJSON(Message{Type: MessageTypeLeave})
+		assert.Eventually(t, func() bool {
+			return server.Peers().CountPeers() == 0
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+	t.Run("Tears down after the grace period", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServerWithConfig(t, ServerConfig{ResumeGracePeriod: 100 * time.Millisecond})
+		conn := dialRaw(t, httpServer, "alice")
+		joined := exchange(t, conn, Message{Type: MessageTypeJoin}, MessageTypeJoined)
+		conn.Close()
+		assert.Eventually(t, func() bool {
+			return server.Peers().CountPeers() == 0
+		}, 5*time.Second, 20*time.Millisecond)
+
+		reply := exchange(t, dialRaw(t, httpServer, "alice"), Message{Type: MessageTypeResume, ResumeToken: joined.ResumeToken}, MessageTypeError)
+		assert.Equal(t, errUnknownResumeToken.Error(), reply.Error)
+	})
+}
@@ -0,0 +1,454 @@
+package webrtcsignaling
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/aggregator-cloud/webrtcutil/webrtcnegotiation"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultPingInterval   = 30 * time.Second
+	defaultPollTimeout    = 25 * time.Second
+	defaultSessionTimeout = time.Minute
+	defaultResumeGrace    = 30 * time.Second
+)
+
+type ServerConfig struct {
+	// PeerConfig is used for every SfuPeer the server creates.
+	PeerConfig *webrtc.Configuration
+	// Peers holds the server's SfuPeers. Defaults to a new PeerManager.
+	Peers *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	// Negotiators holds the negotiators of the server's SfuPeers. Defaults to a new manager.
+	Negotiators *webrtcnegotiation.WebRTCNegotiationManager
+	// Authenticate is called before the upgrade and returns the peer ID for the
+	// connection. A returned error rejects the connection with 401. Defaults to a
+	// random ID, in which case a resumed session is found by its token alone.
+	Authenticate func(r *http.Request) (string, error)
+	// CheckOrigin is passed to the websocket upgrader. Defaults to a same-origin check.
+	CheckOrigin func(r *http.Request) bool
+	// PingInterval is the interval between websocket pings and Server-Sent Events
+	// keepalive comments. Defaults to 30 seconds.
+	PingInterval time.Duration
+	// PollTimeout is how long a long-poll request waits for messages before it
+	// returns empty. Defaults to 25 seconds.
+	PollTimeout time.Duration
+	// SessionTimeout is how long an HTTP session lives without a pending poll or
+	// event stream before it is torn down. Defaults to one minute.
+	SessionTimeout time.Duration
+	// ResumeGracePeriod is how long a joined session outlives its connection,
+	// waiting for the client to resume it with the token it got at join.
+	// Defaults to 30 seconds; a negative value disables resumption.
+	ResumeGracePeriod time.Duration
+	LoggerFactory     logging.LoggerFactory
+}
+
+/*
+Server is an http.Handler speaking the signaling protocol over WebSocket.
+LongPollHandler and EventSourceHandler serve the same protocol over plain HTTP.
+*/
+type Server struct {
+	peerConfig   *webrtc.Configuration
+	peers        *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer]
+	negotiators  *webrtcnegotiation.WebRTCNegotiationManager
+	authenticate func(r *http.Request) (string, error)
+	// stableIDs is true when the authenticator gives a peer the same ID on every
+	// connection, so resuming checks the peer too.
+	stableIDs      bool
+	upgrader       websocket.Upgrader
+	pingInterval   time.Duration
+	pollTimeout    time.Duration
+	sessionTimeout time.Duration
+	resumeGrace    time.Duration
+	sessions       map[string]*session
+	resumeTokens   map[string]*session
+	sessionsMu     sync.Mutex
+	httpConns      map[string]*httpConn
+	httpConnsMu    sync.Mutex
+	loggerFactory  logging.LoggerFactory
+	log            logging.LeveledLogger
+}
+
+/*
+NewServer creates a new signaling server.
+*/
+func NewServer(config ServerConfig) *Server {
+	s := &Server{
+		peerConfig:     config.PeerConfig,
+		peers:          config.Peers,
+		negotiators:    config.Negotiators,
+		authenticate:   config.Authenticate,
+		stableIDs:      config.Authenticate != nil,
+		upgrader:       websocket.Upgrader{CheckOrigin: config.CheckOrigin},
+		pingInterval:   config.PingInterval,
+		pollTimeout:    config.PollTimeout,
+		sessionTimeout: config.SessionTimeout,
+		resumeGrace:    config.ResumeGracePeriod,
+		sessions:       make(map[string]*session),
+		resumeTokens:   make(map[string]*session),
+		httpConns:      make(map[string]*httpConn),
+		loggerFactory:  config.LoggerFactory,
+		log:            webrtclog.NewLogger(config.LoggerFactory, "signaling-server"),
+	}
+	if s.peerConfig == nil {
+		s.peerConfig = &webrtc.Configuration{}
+	}
+	if s.peers == nil {
+		s.peers = webrtcpeer.NewSfuPeerManager()
+	}
+	if s.negotiators == nil {
+		s.negotiators = webrtcnegotiation.NewWebRTCNegotiationManager()
+	}
+	if s.authenticate == nil {
+		s.authenticate = func(r *http.Request) (string, error) {
+			return uuid.New().String(), nil
+		}
+	}
+	if s.pingInterval == 0 {
+		s.pingInterval = defaultPingInterval
+	}
+	if s.pollTimeout == 0 {
+		s.pollTimeout = defaultPollTimeout
+	}
+	if s.sessionTimeout == 0 {
+		s.sessionTimeout = defaultSessionTimeout
+	}
+	if s.resumeGrace == 0 {
+		s.resumeGrace = defaultResumeGrace
+	}
+	return s
+}
+
+func (s *Server) Peers() *webrtcpeer.PeerManager[*webrtcpeer.SfuPeer] {
+	return s.peers
+}
+
+func (s *Server) Negotiators() *webrtcnegotiation.WebRTCNegotiationManager {
+	return s.negotiators
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peerID, err := s.authenticate(r)
+	if err != nil {
+		s.log.Warnf("Rejecting signaling connection: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Warnf("Error upgrading signaling connection: %v", err)
+		return
+	}
+	s.serve(peerID, newWSConn(conn, s.pingInterval))
+}
+
+/*
+join creates the SfuPeer and negotiator of a session and subscribes it to every
+track already published by other sessions, negotiating them in a single offer.
+*/
+func (s *Server) join(sess *session) error {
+	peer, err := webrtcpeer.NewSfuPeerWithConfig(webrtcpeer.SfuPeerConfig{
+		ID:            sess.id,
+		PeerConfig:    s.peerConfig,
+		LoggerFactory: s.loggerFactory,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.peers.AddPeer(peer); err != nil {
+		peer.Close()
+		return err
+	}
+	negotiator := webrtcnegotiation.NewSfuPeerNegotiator(peer, webrtcnegotiation.WebRTCNegotiatorConfig{
+		ID:            sess.id,
+		LoggerFactory: s.loggerFactory,
+	}, func(message webrtcnegotiation.SignalMessage) error {
+		return sess.write(MessageFromSignal(message))
+	})
+	s.negotiators.Negotiators.Add(negotiator.WebRtcNegotiator)
+
+	// Once the session has its peer, closing it tears the peer down in leave. A
+	// session closed before then leaves nothing behind, so the peer is undone here.
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		negotiator.Unbind()
+		s.negotiators.Negotiators.Remove(negotiator.WebRtcNegotiator)
+		if err := s.peers.RemovePeer(peer); err != nil {
+			sess.log.Warnf("Error removing peer: %v", err)
+		}
+		peer.Shutdown()
+		return errConnClosed
+	}
+	sess.peer = peer
+	sess.negotiator = negotiator
+	sess.resumeToken = uuid.New().String()
+	sess.mu.Unlock()
+	peer.AddOnTrackHandler(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		s.publish(sess, remoteTrack)
+	})
+
+	if err := sess.write(Message{
+		Type:         MessageTypeJoined,
+		PeerID:       sess.id,
+		NegotiatorID: negotiator.ID(),
+		ResumeToken:  sess.resumeToken,
+	}); err != nil {
+		return err
+	}
+	s.sessionsMu.Lock()
+	s.sessions[sess.id] = sess
+	s.resumeTokens[sess.resumeToken] = sess
+	s.sessionsMu.Unlock()
+	sess.mu.Lock()
+	closed := sess.closed
+	sess.mu.Unlock()
+	if closed {
+		// leave may have run before the session was listed.
+		s.unlist(sess)
+		return errConnClosed
+	}
+	changes := peer.BeginTrackChanges()
+	defer changes.Commit()
+	for _, other := range s.otherSessions(sess.id) {
+		other.peer.LocalTracksMu.Lock()
+		tracks := make([]*webrtc.TrackLocalStaticRTP, 0, len(other.peer.LocalTracks))
+		for _, track := range other.peer.LocalTracks {
+			tracks = append(tracks, track)
+		}
+		other.peer.LocalTracksMu.Unlock()
+		for _, track := range tracks {
+			s.forward(other, track, sess)
+		}
+	}
+	return nil
+}
+
+/*
+unlist removes the session from those other sessions and resumes can find.
+*/
+func (s *Server) unlist(sess *session) {
+	s.sessionsMu.Lock()
+	if s.sessions[sess.id] == sess {
+		delete(s.sessions, sess.id)
+	}
+	if s.resumeTokens[sess.resumeToken] == sess {
+		delete(s.resumeTokens, sess.resumeToken)
+	}
+	s.sessionsMu.Unlock()
+}
+
+/*
+leave removes the session's tracks from every other session and tears down its peer.
+*/
+func (s *Server) leave(sess *session) {
+	sess.mu.Lock()
+	joined := sess.peer != nil
+	sess.mu.Unlock()
+	if !joined {
+		return
+	}
+	s.unlist(sess)
+
+	sess.peer.LocalTracksMu.Lock()
+	trackIDs := make([]string, 0, len(sess.peer.LocalTracks))
+	for trackID := range sess.peer.LocalTracks {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sess.peer.LocalTracksMu.Unlock()
+	for _, other := range s.otherSessions(sess.id) {
+		changes := other.peer.BeginTrackChanges()
+		for _, trackID := range trackIDs {
+			if !other.peer.IsAlreadySendingTrack(trackID) {
+				continue
+			}
+			if err := changes.RemoveTrack(trackID); err != nil {
+				other.log.Errorf("Error removing track %s: %v", trackID, err)
+				continue
+			}
+			if err := other.write(Message{Type: MessageTypeTrackRemoved, PeerID: sess.id, TrackID: trackID}); err != nil {
+				other.log.Warnf("Error sending track_removed: %v", err)
+			}
+		}
+		changes.Commit()
+	}
+
+	sess.negotiator.Unbind()
+	s.negotiators.Negotiators.Remove(sess.negotiator.WebRtcNegotiator)
+	if err := s.peers.RemovePeer(sess.peer); err != nil {
+		sess.log.Warnf("Error removing peer: %v", err)
+	}
+	sess.peer.Shutdown()
+}
+
+/*
+publish converts a track received from a session and forwards it to every other session.
+*/
+func (s *Server) publish(sess *session, remoteTrack *webrtc.TrackRemote) {
+	localTrack, err := sess.peer.ConvertRemoteTrackToLocalTrack(remoteTrack)
+	if err != nil {
+		sess.log.Errorf("Error converting remote track %s: %v", remoteTrack.ID(), err)
+		return
+	}
+	for _, other := range s.otherSessions(sess.id) {
+		s.forward(sess, localTrack, other)
+	}
+}
+
+func (s *Server) forward(publisher *session, track *webrtc.TrackLocalStaticRTP, subscriber *session) {
+	if _, err := subscriber.peer.AddPublisherTrack(publisher.peer, track.ID()); err != nil {
+		subscriber.log.Errorf("Error adding track %s: %v", track.ID(), err)
+		return
+	}
+	if err := subscriber.write(Message{
+		Type:     MessageTypeTrackAdded,
+		PeerID:   publisher.id,
+		TrackID:  track.ID(),
+		StreamID: track.StreamID(),
+		Kind:     track.Kind().String(),
+	}); err != nil {
+		subscriber.log.Warnf("Error sending track_added: %v", err)
+	}
+}
+
+func (s *Server) otherSessions(id string) []*session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	others := make([]*session, 0, len(s.sessions))
+	for otherID, other := range s.sessions {
+		if otherID != id {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+/*
+session is a joined peer, or a connection that has not joined yet, and its
+SfuPeer and negotiator. A joined session outlives its connection for the resume
+grace period, holding the messages written in the meantime.
+*/
+type session struct {
+	server      *Server
+	id          string
+	peer        *webrtcpeer.SfuPeer
+	negotiator  *webrtcnegotiation.SfuPeerNegotiator
+	resumeToken string
+	mu          sync.Mutex
+	conn        Conn
+	buffer      []Message
+	grace       *time.Timer
+	closed      bool
+	closeOnce   sync.Once
+	log         logging.LeveledLogger
+}
+
+/*
+serve reads conn until it fails or the client leaves. A resume message moves the
+connection over to the session it names.
+*/
+func (sess *session) serve(conn Conn) {
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				sess.log.Infof("Signaling connection closed: %v", err)
+			}
+			sess.disconnect(conn)
+			return
+		}
+		switch message.Type {
+		case MessageTypeLeave:
+			sess.close()
+			return
+		case MessageTypeResume:
+			if resumed, err := sess.server.resume(sess, conn, message.ResumeToken); err == nil {
+				sess = resumed
+				continue
+			} else if err := conn.WriteMessage(Message{Type: MessageTypeError, Error: err.Error()}); err != nil {
+				sess.disconnect(conn)
+				return
+			}
+			continue
+		}
+		if err := sess.handle(message); err != nil {
+			sess.log.Warnf("Error handling %s: %v", message.Type, err)
+			sess.write(Message{Type: MessageTypeError, Error: err.Error()})
+		}
+	}
+}
+
+func (sess *session) handle(message Message) error {
+	switch {
+	case message.Type == MessageTypeJoin:
+		if sess.peer != nil {
+			return errors.New("already joined")
+		}
+		return sess.server.join(sess)
+	case message.isSignal():
+		if sess.negotiator == nil {
+			return errors.New("not joined")
+		}
+		err := sess.server.negotiators.Dispatch(message.SignalMessage(sess.negotiator.ID()))
+		if errors.Is(err, webrtcnegotiation.ErrOfferIgnored) {
+			// The polite client rolls back its offer and answers ours.
+			return nil
+		}
+		return err
+	default:
+		return fmt.Errorf("unexpected message type %q", message.Type)
+	}
+}
+
+/*
+write sends a message on the session's connection, or holds it for the next one
+while the session is detached or the write fails.
+*/
+func (sess *session) write(message Message) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return errConnClosed
+	}
+	if sess.conn != nil && len(sess.buffer) == 0 {
+		if err := sess.conn.WriteMessage(message); err == nil {
+			return nil
+		}
+	}
+	if len(sess.buffer) >= maxBufferedMessages {
+		sess.log.Warnf("Dropping session with %d undelivered messages", len(sess.buffer))
+		go sess.close()
+		return errOutboxFull
+	}
+	sess.buffer = append(sess.buffer, message)
+	return nil
+}
+
+func (sess *session) close() {
+	sess.closeOnce.Do(func() {
+		sess.mu.Lock()
+		sess.closed = true
+		if sess.grace != nil {
+			sess.grace.Stop()
+			sess.grace = nil
+		}
+		conn := sess.conn
+		sess.conn = nil
+		sess.buffer = nil
+		sess.mu.Unlock()
+		sess.server.leave(sess)
+		if conn != nil {
+			conn.Close()
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package webrtcsignaling
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtcnegotiation"
+	"github.com/aggregator-cloud/webrtcutil/webrtcpeer"
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+testClient is a polite client peer speaking the signaling protocol over any transport.
+*/
+type testClient struct {
+	peer       *webrtcpeer.SfuPeer
+	negotiator *webrtcnegotiation.SfuPeerNegotiator
+	writes     chan Message
+	messages   chan Message
+	tracks     chan *webrtc.TrackRemote
+}
+
+func dialTestClient(t *testing.T, server *httptest.Server, id string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?id=" + id
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestClient(t, id, newWSConn(conn, time.Minute))
+}
+
+/*
+newTestClient joins over conn and dispatches the signals it receives to the client's negotiator.
+*/
+func newTestClient(t *testing.T, id string, conn Conn) *testClient {
+	t.Helper()
+	peer, err := webrtcpeer.NewSfuPeer(id, &webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := make(chan Message, 64)
+	done := make(chan struct{})
+	c := &testClient{
+		peer:     peer,
+		writes:   writes,
+		messages: make(chan Message, 64),
+		tracks:   make(chan *webrtc.TrackRemote, 8),
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case message := <-writes:
+				if err := conn.WriteMessage(message); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	manager := webrtcnegotiation.NewWebRTCNegotiationManager()
+	c.negotiator = webrtcnegotiation.NewSfuPeerNegotiator(peer, webrtcnegotiation.WebRTCNegotiatorConfig{
+		ID:       id,
+		IsPolite: true,
+	}, func(message webrtcnegotiation.SignalMessage) error {
+		select {
+		case writes <- MessageFromSignal(message):
+		case <-done:
+		}
+		return nil
+	})
+	manager.Negotiators.Add(c.negotiator.WebRtcNegotiator)
+	peer.AddOnTrackHandler(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		c.tracks <- remoteTrack
+	})
+	go func() {
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			if message.isSignal() {
+				if err := manager.Dispatch(message.SignalMessage(id)); err != nil && !errors.Is(err, webrtcnegotiation.ErrOfferIgnored) {
+					t.Error(err)
+				}
+				continue
+			}
+			c.messages <- message
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		conn.Close()
+		peer.Close()
+	})
+	writes <- Message{Type: MessageTypeJoin}
+	return c
+}
+
+func (c *testClient) expect(t *testing.T, messageType MessageType) Message {
+	t.Helper()
+	for {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %s", messageType)
+			}
+			if message.Type == messageType {
+				return message
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s", messageType)
+		}
+	}
+}
+
+/*
+publish adds a VP8 track to the client and keeps writing packets to it until the test ends.
+*/
+func (c *testClient) publish(t *testing.T) {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", c.peer.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.peer.AddPeerTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}, Payload: []byte{0x10, 0x00, 0x00, 0x00}}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				packet.SequenceNumber++
+				packet.Timestamp += 1800
+				track.WriteRTP(packet)
+			}
+		}
+	}()
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	return newTestServerWithConfig(t, ServerConfig{PollTimeout: time.Second})
+}
+
+/*
+newTestServerWithConfig serves the WebSocket, long-poll and Server-Sent Events
+transports, authenticating peers by their id query parameter.
+*/
+func newTestServerWithConfig(t *testing.T, config ServerConfig) (*Server, *httptest.Server) {
+	t.Helper()
+	config.Authenticate = func(r *http.Request) (string, error) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			return "", errors.New("missing id")
+		}
+		return id, nil
+	}
+	server := NewServer(config)
+	mux := http.NewServeMux()
+	mux.Handle("/", server)
+	mux.Handle("/poll", server.LongPollHandler())
+	mux.Handle("/events", server.EventSourceHandler())
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func TestServer(t *testing.T) {
+	t.Run("Rejects unauthenticated connections", func(t *testing.T) {
+		t.Parallel()
+		_, httpServer := newTestServer(t)
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("Join creates peer", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		client := dialTestClient(t, httpServer, "alice")
+		joined := client.expect(t, MessageTypeJoined)
+		assert.Equal(t, "alice", joined.PeerID)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+		assert.Equal(t, 1, server.Negotiators().Negotiators.Count())
+	})
+	t.Run("Leaves nothing behind when closed before joining", func(t *testing.T) {
+		t.Parallel()
+		server := NewServer(ServerConfig{})
+		sess := &session{server: server, id: "alice", log: server.log}
+		sess.close()
+		assert.ErrorIs(t, server.join(sess), errConnClosed)
+		assert.Nil(t, sess.peer)
+		assert.Equal(t, 0, server.Peers().CountPeers())
+		assert.Equal(t, 0, server.Negotiators().Negotiators.Count())
+	})
+	t.Run("Rejects duplicate peer", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		first := dialTestClient(t, httpServer, "alice")
+		first.expect(t, MessageTypeJoined)
+		second := dialTestClient(t, httpServer, "alice")
+		second.expect(t, MessageTypeError)
+		assert.Equal(t, 1, server.Peers().CountPeers())
+	})
+	t.Run("Forwards tracks and tears down on leave", func(t *testing.T) {
+		t.Parallel()
+		server, httpServer := newTestServer(t)
+		publisher := dialTestClient(t, httpServer, "publisher")
+		publisher.expect(t, MessageTypeJoined)
+		subscriber := dialTestClient(t, httpServer, "subscriber")
+		subscriber.expect(t, MessageTypeJoined)
+		publisher.publish(t)
+
+		added := subscriber.expect(t, MessageTypeTrackAdded)
+		assert.Equal(t, "publisher", added.PeerID)
+		assert.Equal(t, "video", added.Kind)
+		select {
+		case track := <-subscriber.tracks:
+			assert.Equal(t, added.TrackID, track.ID())
+		case <-time.After(10 * time.Second):
+			t.Fatal("subscriber did not receive the track")
+		}
+
+		publisher.writes <- Message{Type: MessageTypeLeave}
+		removed := subscriber.expect(t, MessageTypeTrackRemoved)
+		assert.Equal(t, added.TrackID, removed.TrackID)
+		assert.Eventually(t, func() bool {
+			return server.Peers().CountPeers() == 1
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+}
@@ -0,0 +1,100 @@
+package webrtcsignaling
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aggregator-cloud/webrtcutil/webrtclog"
+	"github.com/gorilla/websocket"
+)
+
+/*
+Conn is the transport of a single signaling session. The server reads client
+messages with ReadMessage until it returns an error; io.EOF marks a normal close.
+*/
+type Conn interface {
+	ReadMessage() (Message, error)
+	WriteMessage(message Message) error
+	Close() error
+}
+
+/*
+serve runs the signaling protocol for peerID over conn until the client leaves or
+the connection fails, then tears down the session.
+*/
+func (s *Server) serve(peerID string, conn Conn) {
+	sess := &session{
+		server: s,
+		id:     peerID,
+		conn:   conn,
+		log:    webrtclog.With(s.log, "peer_id", peerID),
+	}
+	sess.serve(conn)
+}
+
+/*
+wsConn is a Conn over a websocket connection. It pings the client every
+pingInterval and fails reads when no pong arrives within two intervals.
+*/
+type wsConn struct {
+	conn         *websocket.Conn
+	pingInterval time.Duration
+	writeMu      sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newWSConn(conn *websocket.Conn, pingInterval time.Duration) *wsConn {
+	c := &wsConn{
+		conn:         conn,
+		pingInterval: pingInterval,
+		done:         make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+	go c.ping()
+	return c
+}
+
+func (c *wsConn) ReadMessage() (Message, error) {
+	var message Message
+	err := c.conn.ReadJSON(&message)
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return message, io.EOF
+	}
+	return message, err
+}
+
+func (c *wsConn) WriteMessage(message Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(message)
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.conn.Close()
+}
+
+func (c *wsConn) ping() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.pingInterval))
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}